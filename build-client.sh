@@ -5,7 +5,9 @@ set -e
 echo "Building VPN client..."
 
 cd client
-go build -o vpn-client .
+# Advertised to peers as the client version
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+go build -ldflags "-X main.clientVersion=$VERSION" -o vpn-client .
 
 echo "Build complete! Binary: client/vpn-client"
 echo ""
@@ -16,6 +18,9 @@ echo ""
 echo "  # With encryption"
 echo "  sudo ./client/vpn-client -server 95.217.238.72:8888 -encrypt"
 echo ""
+echo "  # Without root: userspace network stack, SOCKS5 on 127.0.0.1:1080, HTTP proxy on 127.0.0.1:3128"
+echo "  ./client/vpn-client -server 95.217.238.72:8888 -encrypt -netstack"
+echo ""
 echo "The client will automatically:"
 echo "  - Connect to the VPN server"
 echo "  - Route all traffic through the VPN"
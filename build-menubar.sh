@@ -15,37 +15,41 @@ SCRIPT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )"
 # Build VPN client
 echo "Building VPN client..."
 cd "$SCRIPT_DIR/client"
-go build -o vpn-client .
+# Advertised to peers as the client version
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+go build -ldflags "-X main.clientVersion=$VERSION" -o vpn-client .
 echo "✅ VPN client built successfully"
 echo ""
 
 # Build menu bar application
 echo "Building menu bar application..."
 cd "$SCRIPT_DIR/menu-bar"
-go build -o family-vpn-menubar .
+# Bake in the key extension releases are verified with (.env can also set it at runtime)
+LDFLAGS=""
+if [ -n "${FAMILY_VPN_ARTIFACT_KEY:-}" ]; then
+    LDFLAGS="-X main.artifactPublicKey=$FAMILY_VPN_ARTIFACT_KEY"
+fi
+go build -ldflags "$LDFLAGS" -o family-vpn-menubar .
 echo "✅ Menu bar application built successfully"
 echo ""
 
 # Build extensions
 echo "Building extensions..."
 
-# Video extension
-cd "$SCRIPT_DIR/extensions/video"
-if [ -f "main.go" ]; then
-    go build -o video-extension .
-    echo "✅ Video extension built successfully"
-else
-    echo "⚠️  Video extension source not found (skipping)"
-fi
-
-# SSH extension
-cd "$SCRIPT_DIR/extensions/ssh"
-if [ -f "main.go" ]; then
-    go build -o ssh-extension .
-    echo "✅ SSH extension built successfully"
-else
-    echo "⚠️  SSH extension source not found (skipping)"
-fi
+# Every extension directory with a manifest is built to the binary it names
+for manifest in "$SCRIPT_DIR"/extensions/*/extension.json; do
+    [ -f "$manifest" ] || continue
+    EXT_DIR=$(dirname "$manifest")
+    EXT_NAME=$(basename "$EXT_DIR")
+    EXT_BINARY=$(sed -n 's/.*"binary": *"\([^"]*\)".*/\1/p' "$manifest")
+    if [ -z "$EXT_BINARY" ]; then
+        echo "⚠️  $EXT_NAME: no binary in extension.json (skipping)"
+        continue
+    fi
+    cd "$EXT_DIR"
+    go build -o "$EXT_BINARY" .
+    echo "✅ $EXT_NAME extension built successfully"
+done
 
 echo ""
 
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// clientVersion is set at build time (-ldflags "-X main.clientVersion=<version>")
+var clientVersion = "dev"
+
+// clientFeatures are the protocol features this client supports
+var clientFeatures = []string{
+	protocol.FeatureSignals,
+	protocol.FeatureSignalReceipts,
+	protocol.FeatureWebSocket,
+	protocol.FeatureCapabilities,
+	protocol.FeatureServices,
+	protocol.FeatureLargeFrames,
+	protocol.FeaturePeerDetails,
+}
+
+// capabilities describes this client and the extensions registered with it
+func (c *VPNClient) capabilities() *protocol.PeerCapabilities {
+	capabilities := &protocol.PeerCapabilities{
+		ClientVersion: clientVersion,
+		Schema:        protocol.SchemaVersion,
+		Features:      clientFeatures,
+	}
+	if c.ipcServer != nil {
+		for _, ext := range c.ipcServer.extensionList() {
+			capabilities.Extensions = append(capabilities.Extensions, ext.ExtensionInfo)
+		}
+	}
+	return capabilities
+}
+
+// advertiseMutex keeps advertisements in the order their state was read
+var advertiseMutex sync.Mutex
+
+// advertiseCapabilities tells the server (and through it every peer) what
+// this client currently runs
+func (c *VPNClient) advertiseCapabilities() {
+	advertiseMutex.Lock()
+	defer advertiseMutex.Unlock()
+
+	data, err := json.Marshal(c.capabilities())
+	if err != nil {
+		log.Printf("[PEERS] Failed to encode capabilities: %v", err)
+		return
+	}
+
+	message := []byte("CTRL:CAPABILITIES:" + string(data))
+	if err := c.queueControlMessage(message); err != nil {
+		log.Printf("[PEERS] Failed to advertise capabilities: %v", err)
+	}
+}
@@ -3,7 +3,16 @@ module vpn-client
 go 1.24.0
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
+	github.com/gorilla/websocket v1.5.3
+	github.com/miguelemosreverte/family-vpn/protocol v0.0.0
+	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	gvisor.dev/gvisor v0.0.0-20250709194456-2a7b29d5230c
+)
+
+require (
+	github.com/google/btree v1.1.2 // indirect
 	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/time v0.7.0 // indirect
 )
+
+replace github.com/miguelemosreverte/family-vpn/protocol => ../protocol
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// ipcCredential is what a token grants. The manager (menu bar) may do
+// anything, including issuing extension tokens; an extension token only
+// covers that extension's signals.
+type ipcCredential struct {
+	extension string
+	manager   bool
+}
+
+// allows reports whether the credential may act for an extension ("" = no extension)
+func (c *ipcCredential) allows(extension string) bool {
+	return c.manager || extension == "" || extension == c.extension
+}
+
+// ipcAuth holds the tokens accepted by the IPC server
+type ipcAuth struct {
+	tokens          map[string]*ipcCredential
+	extensionTokens map[string]string // extension -> its current token
+	mutex           sync.RWMutex
+}
+
+// newIPCAuth creates an empty token store
+func newIPCAuth() *ipcAuth {
+	return &ipcAuth{
+		tokens:          make(map[string]*ipcCredential),
+		extensionTokens: make(map[string]string),
+	}
+}
+
+// newIPCToken generates a random IPC token
+func newIPCToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate IPC token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// issueExtensionToken creates a token for an extension, revoking its previous one
+func (a *ipcAuth) issueExtensionToken(extension string) (string, error) {
+	token, err := newIPCToken()
+	if err != nil {
+		return "", err
+	}
+
+	a.mutex.Lock()
+	if old, exists := a.extensionTokens[extension]; exists {
+		delete(a.tokens, old)
+	}
+	a.tokens[token] = &ipcCredential{extension: extension}
+	a.extensionTokens[extension] = token
+	a.mutex.Unlock()
+
+	return token, nil
+}
+
+// credential returns what a token grants
+func (a *ipcAuth) credential(token string) (*ipcCredential, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	cred, exists := a.tokens[token]
+	return cred, exists
+}
+
+// realUserIDs returns the uid/gid of the user who started us, even under sudo
+func realUserIDs() (int, int) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		uid = sudoUID
+	}
+	if sudoGID, err := strconv.Atoi(os.Getenv("SUDO_GID")); err == nil {
+		gid = sudoGID
+	}
+	return uid, gid
+}
+
+// ipcRuntimeDir returns the private per-user directory shared by the client,
+// the menu bar and extensions (/tmp/family-vpn-<uid>), creating it if needed
+func ipcRuntimeDir() (string, error) {
+	uid, gid := realUserIDs()
+	dir := protocol.RuntimeDir(uid)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create runtime dir: %v", err)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRuntimeDir(dir, info, uid); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to secure runtime dir: %v", err)
+	}
+
+	// We usually run as root via sudo; the menu bar runs as the real user
+	if os.Getuid() == 0 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return "", fmt.Errorf("failed to chown runtime dir: %v", err)
+		}
+	}
+
+	return dir, nil
+}
+
+// checkRuntimeDir refuses a runtime dir someone else planted or left open,
+// whatever user we run as: its owner could swap the socket or token in it.
+// Only the desktop user, or root (who created it for them under sudo), may
+// own it.
+func checkRuntimeDir(dir string, info os.FileInfo, uid int) error {
+	if !info.IsDir() {
+		return fmt.Errorf("runtime dir %s is not a directory", dir)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot check the owner of runtime dir %s", dir)
+	}
+	if owner := int(stat.Uid); owner != uid && owner != 0 {
+		return fmt.Errorf("runtime dir %s is owned by another user (uid %d); remove it", dir, owner)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("runtime dir %s is writable by other users (mode %v); remove it", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// writeManagerToken creates the manager token and stores it in the runtime dir (mode 0600)
+func (a *ipcAuth) writeManagerToken() error {
+	dir, err := ipcRuntimeDir()
+	if err != nil {
+		return err
+	}
+
+	token, err := newIPCToken()
+	if err != nil {
+		return err
+	}
+
+	tokenFile := filepath.Join(dir, protocol.TokenFileName)
+	tmpFile := tokenFile + ".tmp"
+	os.Remove(tmpFile)
+	// O_EXCL so a planted symlink is never followed
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write IPC token: %v", err)
+	}
+	_, err = f.WriteString(token)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write IPC token: %v", err)
+	}
+	if os.Getuid() == 0 {
+		uid, gid := realUserIDs()
+		if err := os.Chown(tmpFile, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown IPC token: %v", err)
+		}
+	}
+	if err := os.Rename(tmpFile, tokenFile); err != nil {
+		return fmt.Errorf("failed to write IPC token: %v", err)
+	}
+
+	a.mutex.Lock()
+	a.tokens[token] = &ipcCredential{manager: true}
+	a.mutex.Unlock()
+
+	log.Printf("[IPC] Manager token written to %s", tokenFile)
+	return nil
+}
+
+// validLocalRequest blocks browser-based access: DNS rebinding shows up as a
+// foreign Host header, and pages always send an Origin on cross-site requests
+func (s *IPCServer) validLocalRequest(r *http.Request) bool {
+	if r.Header.Get("Origin") != "" {
+		return false
+	}
+
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	return host == "127.0.0.1" || host == "localhost"
+}
+
+// ipcHandler is an IPC endpoint that knows the caller's credential
+type ipcHandler func(w http.ResponseWriter, r *http.Request, cred *ipcCredential)
+
+// authorize wraps an IPC endpoint with Host/Origin validation and token authentication
+func (s *IPCServer) authorize(handler ipcHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(protocol.SchemaHeader, strconv.Itoa(protocol.SchemaVersion))
+
+		if !s.validLocalRequest(r) {
+			log.Printf("[IPC] Rejected browser-originated request %s %s (Host %q, Origin %q)", r.Method, r.URL.Path, r.Host, r.Header.Get("Origin"))
+			protocol.WriteError(w, protocol.ErrForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		cred, ok := s.auth.credential(token)
+		if token == "" || !ok {
+			log.Printf("[IPC] Rejected unauthenticated request %s %s", r.Method, r.URL.Path)
+			protocol.WriteError(w, protocol.ErrUnauthorized)
+			return
+		}
+
+		handler(w, r, cred)
+	}
+}
+
+// handleIssueToken issues a token for an extension (manager only)
+func (s *IPCServer) handleIssueToken(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if r.Method != "POST" {
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+		return
+	}
+	if !cred.manager {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeForbidden, http.StatusForbidden, "only the extension manager can issue tokens"))
+		return
+	}
+
+	var payload struct {
+		Extension string `json:"extension"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Extension == "" {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "extension required"))
+		return
+	}
+
+	token, err := s.auth.issueExtensionToken(payload.Extension)
+	if err != nil {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeInternal, http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	log.Printf("[IPC] Issued token for extension '%s'", payload.Extension)
+	writeJSON(w, map[string]string{"extension": payload.Extension, "token": token})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// newAuthServer returns an IPC server with a manager token and a video
+// extension token, and the video extension's revoked first token
+func newAuthServer(t *testing.T) (s *IPCServer, video, revoked string) {
+	t.Helper()
+	s = NewIPCServer(0, NewVPNClient("server:443", false, nil, false, false))
+	s.client.ipcServer = s
+	s.auth.tokens["manager"] = &ipcCredential{manager: true}
+
+	revoked, err := s.auth.issueExtensionToken("video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err = s.auth.issueExtensionToken("video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, video, revoked
+}
+
+// ipcRequest calls an IPC endpoint as a local tool would, with changes
+func ipcRequest(s *IPCServer, handler ipcHandler, method, target, token, body string, change func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Host = "localhost"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if change != nil {
+		change(r)
+	}
+	w := httptest.NewRecorder()
+	s.authorize(handler)(w, r)
+	return w
+}
+
+func TestAuthorize(t *testing.T) {
+	s, video, revoked := newAuthServer(t)
+
+	tests := []struct {
+		name   string
+		token  string
+		change func(r *http.Request)
+		want   int
+	}{
+		{"manager", "manager", nil, http.StatusOK},
+		{"extension", video, nil, http.StatusOK},
+		{"TCP host", video, func(r *http.Request) { r.Host = "127.0.0.1:8889" }, http.StatusOK},
+		{"no token", "", nil, http.StatusUnauthorized},
+		{"unknown token", "0123456789abcdef", nil, http.StatusUnauthorized},
+		{"revoked token", revoked, nil, http.StatusUnauthorized},
+		{"DNS rebinding", video, func(r *http.Request) { r.Host = "attacker.example:8889" }, http.StatusForbidden},
+		{"browser page", video, func(r *http.Request) { r.Header.Set("Origin", "https://attacker.example") }, http.StatusForbidden},
+		{"local page", video, func(r *http.Request) { r.Header.Set("Origin", "http://localhost:8895") }, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ipcRequest(s, s.handleHealth, "GET", "/health", tt.token, "", tt.change)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if w.Header().Get(protocol.SchemaHeader) == "" {
+				t.Error("response has no schema header")
+			}
+		})
+	}
+}
+
+func TestExtensionTokenScope(t *testing.T) {
+	s, video, _ := newAuthServer(t)
+
+	tests := []struct {
+		name    string
+		handler ipcHandler
+		method  string
+		target  string
+		token   string
+		body    string
+		want    int
+	}{
+		{"issue token as manager", s.handleIssueToken, "POST", "/auth/token", "manager", `{"extension":"chat"}`, http.StatusOK},
+		{"issue token as extension", s.handleIssueToken, "POST", "/auth/token", video, `{"extension":"chat"}`, http.StatusForbidden},
+		{"send as another extension", s.handleSendSignal, "POST", "/signal/send", video, `{"extension":"chat","peer":"10.8.0.3","data":"x"}`, http.StatusForbidden},
+		{"poll another extension", s.handlePollSignals, "GET", "/signal/poll?extension=chat", video, "", http.StatusForbidden},
+		{"poll own extension", s.handlePollSignals, "GET", "/signal/poll?extension=video", video, "", http.StatusOK},
+		{"register another extension", s.handleRegisterExtension, "POST", "/extensions/register", video, `{"name":"chat","version":"1.0.0","schema":1}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ipcRequest(s, tt.handler, tt.method, tt.target, tt.token, tt.body, nil)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestCheckRuntimeDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(dir string) (path string, uid int)
+		wantErr bool
+	}{
+		{"private", func(dir string) (string, int) {
+			return dir, os.Getuid()
+		}, false},
+		{"writable by others", func(dir string) (string, int) {
+			os.Chmod(dir, 0777)
+			return dir, os.Getuid()
+		}, true},
+		{"not a directory", func(dir string) (string, int) {
+			path := filepath.Join(dir, "file")
+			os.WriteFile(path, nil, 0600)
+			return path, os.Getuid()
+		}, true},
+		{"owned by another user", func(dir string) (string, int) {
+			if os.Getuid() == 0 {
+				os.Chown(dir, 54321, 54321) // Root may own it, so hand it to someone else
+			}
+			return dir, 12345
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "family-vpn")
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			path, uid := tt.setup(dir)
+
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkRuntimeDir(path, info, uid); (err != nil) != tt.wantErr {
+				t.Errorf("checkRuntimeDir = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// ipcEvent is a broadcast event waiting to be written to a stream
+type ipcEvent struct {
+	eventType string
+	data      interface{}
+}
+
+// ipcSubscriber is one open /events stream
+type ipcSubscriber struct {
+	extension string        // Extension whose signals this stream carries ("" = broadcast events only)
+	wake      chan struct{} // Signals were queued for the extension
+	events    chan ipcEvent // Broadcast events (peers, state, update)
+}
+
+// subscribe registers a new event stream
+func (s *IPCServer) subscribe(extension string) *ipcSubscriber {
+	sub := &ipcSubscriber{
+		extension: extension,
+		wake:      make(chan struct{}, 1),
+		events:    make(chan ipcEvent, 32),
+	}
+
+	s.subscribersMutex.Lock()
+	s.subscribers[sub] = true
+	s.subscribersMutex.Unlock()
+
+	return sub
+}
+
+// unsubscribe removes an event stream
+func (s *IPCServer) unsubscribe(sub *ipcSubscriber) {
+	s.subscribersMutex.Lock()
+	delete(s.subscribers, sub)
+	s.subscribersMutex.Unlock()
+}
+
+// wakeSubscribers tells the streams of an extension that signals are waiting
+func (s *IPCServer) wakeSubscribers(extension string) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	for sub := range s.subscribers {
+		if sub.extension != extension {
+			continue
+		}
+		select {
+		case sub.wake <- struct{}{}:
+		default: // Already pending
+		}
+	}
+}
+
+// PublishEvent pushes a broadcast event to every open stream
+func (s *IPCServer) PublishEvent(eventType string, data interface{}) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	for sub := range s.subscribers {
+		select {
+		case sub.events <- ipcEvent{eventType: eventType, data: data}:
+		default:
+			log.Printf("[IPC] Stream for '%s' is not keeping up, dropping %s event", sub.extension, eventType)
+		}
+	}
+}
+
+// writeEvent writes one Server-Sent Event and flushes it to the subscriber
+func writeEvent(w http.ResponseWriter, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, payload); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// handleEvents streams signals for ?extension= plus peer-list and connection-state
+// changes as Server-Sent Events. Signals written to the stream are acknowledged.
+func (s *IPCServer) handleEvents(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if _, ok := w.(http.Flusher); !ok {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeInternal, http.StatusInternalServerError, "streaming not supported"))
+		return
+	}
+
+	extension := r.URL.Query().Get("extension")
+	if !cred.allows(extension) {
+		protocol.WriteError(w, protocol.ErrForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	sub := s.subscribe(extension)
+	defer s.unsubscribe(sub)
+
+	log.Printf("[IPC] Event stream opened for '%s'", extension)
+	defer log.Printf("[IPC] Event stream closed for '%s'", extension)
+
+	// Start every stream with the current state so subscribers never need to poll
+	if err := writeEvent(w, protocol.EventState, s.client.connectionState()); err != nil {
+		return
+	}
+	s.client.peersMutex.RLock()
+	peers := s.client.peers
+	s.client.peersMutex.RUnlock()
+	if err := writeEvent(w, protocol.EventPeers, peers); err != nil {
+		return
+	}
+
+	// Deliver anything queued before the extension subscribed
+	if extension != "" {
+		select {
+		case sub.wake <- struct{}{}:
+		default: // Already woken by a new signal
+		}
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-sub.wake:
+			if err := s.streamSignals(w, extension); err != nil {
+				return
+			}
+
+		case event := <-sub.events:
+			if err := writeEvent(w, event.eventType, event.data); err != nil {
+				return
+			}
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// streamSignals writes the queued signals of an extension to a stream.
+// Signals that could not be written are put back for the next subscriber.
+func (s *IPCServer) streamSignals(w http.ResponseWriter, extension string) error {
+	queued := s.takeSignals(extension)
+
+	for i, q := range queued {
+		if err := writeEvent(w, protocol.EventSignal, protocol.SignalFromMessage(q.msg)); err != nil {
+			s.requeueSignals(extension, queued[i:])
+			return err
+		}
+		s.client.sendSignalReceipt(q.msg, protocol.SignalTypeAck, "")
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// readReceipt reads the next signal the client sends the server, skipping
+// the capabilities and services it advertises when extensions change
+func readReceipt(t *testing.T, c *VPNClient, tunnel net.Conn) *protocol.SignalMessage {
+	t.Helper()
+	var data string
+	for {
+		tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+		frame, err := c.decrypt(readFrame(t, tunnel))
+		if err != nil {
+			t.Fatalf("decrypt: %v", err)
+		}
+		if strings.HasPrefix(string(frame), "CTRL:CAPABILITIES:") || strings.HasPrefix(string(frame), "CTRL:SERVICES:") {
+			continue
+		}
+		var found bool
+		if data, found = strings.CutPrefix(string(frame), "CTRL:SIGNAL:"); !found {
+			t.Fatalf("frame is not a signal: %.40q", frame)
+		}
+		break
+	}
+	var msg protocol.SignalMessage
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+// readEvent reads the next Server-Sent Event of a stream
+func readEvent(t *testing.T, stream *bufio.Reader) (eventType, data string) {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			return eventType, data
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// newEventsServer serves /events of a client with a registered video extension
+// and returns the video extension's token
+func newEventsServer(t *testing.T, c *VPNClient) (*httptest.Server, string) {
+	t.Helper()
+	c.ipcServer = NewIPCServer(0, c)
+	c.ipcServer.extensions["video"] = &protocol.RegisteredExtension{}
+	token, err := c.ipcServer.auth.issueExtensionToken("video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(c.ipcServer.authorize(c.ipcServer.handleEvents))
+	t.Cleanup(server.Close)
+	return server, token
+}
+
+// openEvents opens an event stream for an extension
+func openEvents(t *testing.T, server *httptest.Server, token, extension string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", server.URL+"/events?extension="+extension, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestEventsStreamSignals(t *testing.T) {
+	c, tunnel := newTestClient(t)
+	server, token := newEventsServer(t, c)
+
+	// Queued before anyone subscribed
+	c.ipcServer.QueueSignal(&protocol.SignalMessage{ID: "early", Type: protocol.SignalTypeData, Extension: "video", From: "10.8.0.3", Payload: "offer"})
+
+	resp := openEvents(t, server, token, "video")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	// Every stream starts with the current state and peers
+	for _, want := range []string{protocol.EventState, protocol.EventPeers} {
+		if eventType, _ := readEvent(t, stream); eventType != want {
+			t.Fatalf("event %s, want %s", eventType, want)
+		}
+	}
+
+	eventType, data := readEvent(t, stream)
+	var signal protocol.Signal
+	json.Unmarshal([]byte(data), &signal)
+	if eventType != protocol.EventSignal || signal.ID != "early" || signal.Peer != "10.8.0.3" || signal.Data != "offer" {
+		t.Fatalf("event %s %s, want the queued signal", eventType, data)
+	}
+	if receipt := readReceipt(t, c, tunnel); receipt.Type != protocol.SignalTypeAck || receipt.ID != "early" || receipt.To != "10.8.0.3" {
+		t.Errorf("receipt = %+v, want an ack to 10.8.0.3", receipt)
+	}
+
+	// Broadcast events reach open streams
+	c.ipcServer.PublishEvent(protocol.EventMessage, protocol.OperatorMessage{Message: "hello"})
+	if eventType, data := readEvent(t, stream); eventType != protocol.EventMessage || !strings.Contains(data, "hello") {
+		t.Errorf("event %s %s, want the operator's message", eventType, data)
+	}
+}
+
+func TestEventsForOtherExtension(t *testing.T) {
+	c, _ := newTestClient(t)
+	server, token := newEventsServer(t, c)
+
+	if resp := openEvents(t, server, token, "chat"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d for another extension's signals, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestSignalFailureReceipts(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        *protocol.SignalMessage
+		wantReason string
+	}{
+		{"extension not running", &protocol.SignalMessage{ID: "a", Extension: "chat", From: "10.8.0.3"}, "extension not running"},
+		{"expired", &protocol.SignalMessage{ID: "b", Extension: "video", From: "10.8.0.3", ExpiresAt: time.Now().Add(-time.Second).Unix()}, "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, tunnel := newTestClient(t)
+			newEventsServer(t, c)
+
+			c.ipcServer.QueueSignal(tt.msg)
+			if queued := c.ipcServer.takeSignals(tt.msg.Extension); len(queued) != 0 {
+				t.Errorf("%d signals delivered, want none", len(queued))
+			}
+			receipt := readReceipt(t, c, tunnel)
+			if receipt.Type != protocol.SignalTypeFailed || receipt.ID != tt.msg.ID || receipt.To != "10.8.0.3" || receipt.Reason != tt.wantReason {
+				t.Errorf("receipt = %+v, want failed (%s) to 10.8.0.3", receipt, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestReceiptsGetNoReceipts(t *testing.T) {
+	c, tunnel := newTestClient(t)
+	newEventsServer(t, c)
+
+	// An ack for a signal we sent, for an extension that has since stopped
+	c.ipcServer.QueueSignal(&protocol.SignalMessage{ID: "a", Type: protocol.SignalTypeAck, Extension: "chat", From: "10.8.0.3"})
+
+	tunnel.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := tunnel.Read(make([]byte, 1)); err == nil {
+		t.Error("a receipt was answered with a receipt")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// isRegistered reports whether an extension is registered with the core
+func (s *IPCServer) isRegistered(extension string) bool {
+	s.extensionsMutex.RLock()
+	defer s.extensionsMutex.RUnlock()
+	_, exists := s.extensions[extension]
+	return exists
+}
+
+// extensionList returns the registered extensions, sorted by name
+func (s *IPCServer) extensionList() []*protocol.RegisteredExtension {
+	s.extensionsMutex.RLock()
+	defer s.extensionsMutex.RUnlock()
+
+	list := make([]*protocol.RegisteredExtension, 0, len(s.extensions))
+	for _, ext := range s.extensions {
+		copied := *ext
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// handleRegisterExtension registers a running extension (POST /extensions/register)
+func (s *IPCServer) handleRegisterExtension(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if r.Method != "POST" {
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+		return
+	}
+
+	var registration protocol.ExtensionRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil || registration.Name == "" {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "name required"))
+		return
+	}
+
+	if !cred.allows(registration.Name) {
+		protocol.WriteError(w, protocol.ErrForbidden)
+		return
+	}
+
+	// Peers' connections to the extension arrive from the host's own
+	// network and its dials to 10.8.0.x bypass the proxies, so it can't work
+	if s.client.netstack {
+		message := "extensions are not supported with the userspace network stack (-netstack)"
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, message))
+		return
+	}
+
+	if registration.Schema != protocol.SchemaVersion {
+		message := fmt.Sprintf("extension speaks IPC schema %d, core speaks %d", registration.Schema, protocol.SchemaVersion)
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, message))
+		return
+	}
+
+	if len(registration.Services) > protocol.MaxServices {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, fmt.Sprintf("at most %d services allowed", protocol.MaxServices)))
+		return
+	}
+	for i := range registration.Services {
+		if err := registration.Services[i].Validate(); err != nil {
+			protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
+
+	now := time.Now()
+	registered := protocol.RegisteredExtension{
+		ExtensionRegistration: registration,
+		RegisteredAt:          now,
+		LastHeartbeat:         now,
+	}
+
+	s.extensionsMutex.Lock()
+	stored := registered // Heartbeats update the stored copy
+	s.extensions[registration.Name] = &stored
+	s.extensionsMutex.Unlock()
+
+	log.Printf("[IPC] Extension '%s' v%s registered", registration.Name, registration.Version)
+	s.extensionsChanged()
+	writeJSON(w, registered)
+}
+
+// handleExtensionHeartbeat keeps a registration alive (POST /extensions/heartbeat?extension=)
+func (s *IPCServer) handleExtensionHeartbeat(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if r.Method != "POST" {
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+		return
+	}
+
+	extension := r.URL.Query().Get("extension")
+	if !cred.allows(extension) {
+		protocol.WriteError(w, protocol.ErrForbidden)
+		return
+	}
+
+	s.extensionsMutex.Lock()
+	registered, exists := s.extensions[extension]
+	if exists {
+		registered.LastHeartbeat = time.Now()
+	}
+	s.extensionsMutex.Unlock()
+
+	if !exists {
+		protocol.WriteError(w, protocol.ErrNotRegistered)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUnregisterExtension removes a registration (POST /extensions/unregister?extension=)
+func (s *IPCServer) handleUnregisterExtension(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if r.Method != "POST" {
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+		return
+	}
+
+	extension := r.URL.Query().Get("extension")
+	if !cred.allows(extension) {
+		protocol.WriteError(w, protocol.ErrForbidden)
+		return
+	}
+
+	if !s.unregisterExtension(extension, "extension stopped") {
+		protocol.WriteError(w, protocol.ErrNotRegistered)
+		return
+	}
+	log.Printf("[IPC] Extension '%s' unregistered", extension)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListExtensions lists the registered extensions (GET /extensions)
+func (s *IPCServer) handleListExtensions(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	writeJSON(w, s.extensionList())
+}
+
+// unregisterExtension forgets an extension and fails the signals still queued
+// for it, so their senders learn right away. Returns false if it wasn't registered.
+func (s *IPCServer) unregisterExtension(extension, reason string) bool {
+	s.extensionsMutex.Lock()
+	_, exists := s.extensions[extension]
+	delete(s.extensions, extension)
+	s.extensionsMutex.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	s.queueMutex.Lock()
+	queued := s.signalQueue[extension]
+	delete(s.signalQueue, extension)
+	s.queueMutex.Unlock()
+
+	for _, q := range queued {
+		s.client.sendSignalReceipt(q.msg, protocol.SignalTypeFailed, reason)
+	}
+	if len(queued) > 0 {
+		log.Printf("[IPC] Dead-lettered %d signal(s) queued for '%s' (%s)", len(queued), extension, reason)
+	}
+
+	s.extensionsChanged()
+	return true
+}
+
+// extensionsChanged tells subscribers, and peers through the server, that the
+// registered extensions (and the services they offer) changed
+func (s *IPCServer) extensionsChanged() {
+	s.PublishEvent(protocol.EventExtensions, s.extensionList())
+	s.client.advertiseCapabilities()
+	s.client.advertiseServices()
+}
+
+// expireExtensions drops registrations whose heartbeats stopped (crashed extensions)
+func (s *IPCServer) expireExtensions() {
+	ticker := time.NewTicker(protocol.ExtensionHeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expireSilentExtensions()
+	}
+}
+
+// expireSilentExtensions unregisters the extensions that sent no heartbeat
+// within protocol.ExtensionRegistrationTTL
+func (s *IPCServer) expireSilentExtensions() {
+	var expired []string
+
+	s.extensionsMutex.RLock()
+	for name, ext := range s.extensions {
+		if time.Since(ext.LastHeartbeat) > protocol.ExtensionRegistrationTTL {
+			expired = append(expired, name)
+		}
+	}
+	s.extensionsMutex.RUnlock()
+
+	for _, name := range expired {
+		log.Printf("[IPC] Extension '%s' stopped sending heartbeats, unregistering", name)
+		s.unregisterExtension(name, "extension not responding")
+	}
+}
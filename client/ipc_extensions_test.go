@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+func TestExtensionLifecycle(t *testing.T) {
+	c, tunnel := newTestClient(t)
+	s := NewIPCServer(0, c)
+	c.ipcServer = s
+	token, err := s.auth.issueExtensionToken("chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(handler ipcHandler, target, body string) int {
+		return ipcRequest(s, handler, "POST", target, token, body, nil).Code
+	}
+	signal := func(id string) *protocol.SignalMessage {
+		return &protocol.SignalMessage{ID: id, Type: protocol.SignalTypeData, Extension: "chat", From: "10.8.0.3", Payload: "hi"}
+	}
+	wantFailed := func(id, reason string) {
+		t.Helper()
+		receipt := readReceipt(t, c, tunnel)
+		if receipt.Type != protocol.SignalTypeFailed || receipt.ID != id || receipt.Reason != reason {
+			t.Errorf("receipt = %+v, want %s failed (%s)", receipt, id, reason)
+		}
+	}
+
+	// Signals for an extension that never registered fail right away
+	s.QueueSignal(signal("early"))
+	wantFailed("early", "extension not running")
+	if code := call(s.handleExtensionHeartbeat, "/extensions/heartbeat?extension=chat", ""); code != http.StatusNotFound {
+		t.Errorf("heartbeat before registering = %d, want %d", code, http.StatusNotFound)
+	}
+
+	registration := fmt.Sprintf(`{"name":"chat","version":"1.0.0","schema":%d}`, protocol.SchemaVersion)
+	if code := call(s.handleRegisterExtension, "/extensions/register", registration); code != http.StatusOK {
+		t.Fatalf("register = %d, want %d", code, http.StatusOK)
+	}
+	if code := call(s.handleExtensionHeartbeat, "/extensions/heartbeat?extension=chat", ""); code != http.StatusNoContent {
+		t.Errorf("heartbeat = %d, want %d", code, http.StatusNoContent)
+	}
+
+	// Signals queued when the extension stops are failed back to the sender
+	s.QueueSignal(signal("queued"))
+	if code := call(s.handleUnregisterExtension, "/extensions/unregister?extension=chat", ""); code != http.StatusNoContent {
+		t.Fatalf("unregister = %d, want %d", code, http.StatusNoContent)
+	}
+	wantFailed("queued", "extension stopped")
+	if s.isRegistered("chat") {
+		t.Error("chat still registered after unregistering")
+	}
+	if code := call(s.handleUnregisterExtension, "/extensions/unregister?extension=chat", ""); code != http.StatusNotFound {
+		t.Errorf("second unregister = %d, want %d", code, http.StatusNotFound)
+	}
+	s.QueueSignal(signal("late"))
+	wantFailed("late", "extension not running")
+}
+
+func TestRegisterValidation(t *testing.T) {
+	s, _, _ := newAuthServer(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"valid", fmt.Sprintf(`{"name":"chat","version":"1.0.0","schema":%d}`, protocol.SchemaVersion), http.StatusOK},
+		{"no name", fmt.Sprintf(`{"version":"1.0.0","schema":%d}`, protocol.SchemaVersion), http.StatusBadRequest},
+		{"other schema", fmt.Sprintf(`{"name":"chat","version":"1.0.0","schema":%d}`, protocol.SchemaVersion+1), http.StatusBadRequest},
+		{"not JSON", `chat`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ipcRequest(s, s.handleRegisterExtension, "POST", "/extensions/register", "manager", tt.body, nil)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestExpireSilentExtensions(t *testing.T) {
+	c, tunnel := newTestClient(t)
+	s := NewIPCServer(0, c)
+	c.ipcServer = s
+	now := time.Now()
+	s.extensions["chat"] = &protocol.RegisteredExtension{LastHeartbeat: now.Add(-protocol.ExtensionRegistrationTTL - time.Second)}
+	s.extensions["video"] = &protocol.RegisteredExtension{LastHeartbeat: now}
+	s.QueueSignal(&protocol.SignalMessage{ID: "queued", Type: protocol.SignalTypeData, Extension: "chat", From: "10.8.0.3"})
+
+	s.expireSilentExtensions()
+	if s.isRegistered("chat") {
+		t.Error("chat still registered after missing its heartbeats")
+	}
+	if !s.isRegistered("video") {
+		t.Error("video unregistered despite a recent heartbeat")
+	}
+	if receipt := readReceipt(t, c, tunnel); receipt.ID != "queued" || receipt.Reason != "extension not responding" {
+		t.Errorf("receipt = %+v, want queued failed (extension not responding)", receipt)
+	}
+}
@@ -1,21 +1,57 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	defaultSignalTTL      = 60  // Seconds a signal may wait for delivery when the sender doesn't say
+	maxQueuedPerExtension = 256 // Undelivered signals kept per extension before the oldest is dropped
 )
 
+// queuedSignal is a signal or delivery receipt waiting for an extension to collect it
+type queuedSignal struct {
+	msg      *protocol.SignalMessage
+	queuedAt time.Time
+}
+
+// expired reports whether the signal's TTL has run out
+func (q *queuedSignal) expired() bool {
+	if q.msg.ExpiresAt != 0 {
+		return time.Now().Unix() > q.msg.ExpiresAt
+	}
+	return time.Since(q.queuedAt) > defaultSignalTTL*time.Second
+}
+
 // IPCServer provides HTTP API for extensions
 type IPCServer struct {
-	port          int
-	client        *VPNClient
-	signalQueue   map[string][]map[string]interface{} // extension -> signals
-	queueMutex    sync.RWMutex
+	port        int // Optional TCP port (0 = Unix socket only)
+	client      *VPNClient
+	signalQueue map[string][]*queuedSignal // extension -> signals and receipts
+	queueMutex  sync.RWMutex
+
+	// Tokens for the manager and extensions
+	auth *ipcAuth
+
+	// Open /events streams
+	subscribers      map[*ipcSubscriber]bool
+	subscribersMutex sync.Mutex
+
+	// Running extensions; signals for anything else are rejected
+	extensions      map[string]*protocol.RegisteredExtension
+	extensionsMutex sync.RWMutex
 }
 
 // NewIPCServer creates a new IPC server
@@ -23,7 +59,10 @@ func NewIPCServer(port int, client *VPNClient) *IPCServer {
 	return &IPCServer{
 		port:        port,
 		client:      client,
-		signalQueue: make(map[string][]map[string]interface{}),
+		signalQueue: make(map[string][]*queuedSignal),
+		subscribers: make(map[*ipcSubscriber]bool),
+		extensions:  make(map[string]*protocol.RegisteredExtension),
+		auth:        newIPCAuth(),
 	}
 }
 
@@ -31,111 +70,289 @@ func NewIPCServer(port int, client *VPNClient) *IPCServer {
 func (s *IPCServer) Start() error {
 	mux := http.NewServeMux()
 
-	// Extension API endpoints
-	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/peers", s.handleGetPeers)
-	mux.HandleFunc("/signal/send", s.handleSendSignal)
-	mux.HandleFunc("/signal/poll", s.handlePollSignals)
+	// Every request needs a token: the manager's comes from the runtime dir,
+	// extensions get theirs from the manager (POST /auth/token)
+	if err := s.auth.writeManagerToken(); err != nil {
+		return err
+	}
 
-	addr := fmt.Sprintf("127.0.0.1:%d", s.port)
-	log.Printf("[IPC] Starting server on http://%s", addr)
+	// Extension API endpoints
+	mux.HandleFunc("/health", s.authorize(s.handleHealth))
+	mux.HandleFunc("/peers", s.authorize(s.handleGetPeers))
+	mux.HandleFunc("/services", s.authorize(s.handleGetServices))
+	mux.HandleFunc("/signal/send", s.authorize(s.handleSendSignal))
+	mux.HandleFunc("/signal/poll", s.authorize(s.handlePollSignals))
+	mux.HandleFunc("/events", s.authorize(s.handleEvents))
+	mux.HandleFunc("/auth/token", s.authorize(s.handleIssueToken))
+	mux.HandleFunc("/extensions", s.authorize(s.handleListExtensions))
+	mux.HandleFunc("/extensions/register", s.authorize(s.handleRegisterExtension))
+	mux.HandleFunc("/extensions/heartbeat", s.authorize(s.handleExtensionHeartbeat))
+	mux.HandleFunc("/extensions/unregister", s.authorize(s.handleUnregisterExtension))
 
+	// Primary transport: Unix socket in the private runtime dir
+	socketListener, err := s.listenSocket()
+	if err != nil {
+		return err
+	}
 	go func() {
-		if err := http.ListenAndServe(addr, mux); err != nil {
-			log.Printf("[IPC] Server error: %v", err)
+		if err := http.Serve(socketListener, mux); err != nil {
+			log.Printf("[IPC] Socket server error: %v", err)
 		}
 	}()
 
+	// Opt-in TCP transport for tools that can't use the socket
+	if s.port > 0 {
+		addr := fmt.Sprintf("127.0.0.1:%d", s.port)
+		log.Printf("[IPC] Starting TCP fallback on http://%s", addr)
+
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Printf("[IPC] Server error: %v", err)
+			}
+		}()
+	}
+
+	go s.expireSignals()
+	go s.expireExtensions()
+
 	return nil
 }
 
+// listenSocket listens on <runtime dir>/ipc.sock, readable only by the real user
+func (s *IPCServer) listenSocket() (net.Listener, error) {
+	dir, err := ipcRuntimeDir()
+	if err != nil {
+		return nil, err
+	}
+	socketPath := filepath.Join(dir, protocol.SocketFileName)
+
+	// Remove a stale socket left by a previous run
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to secure IPC socket: %v", err)
+	}
+	if os.Getuid() == 0 {
+		uid, gid := realUserIDs()
+		if err := os.Chown(socketPath, uid, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to chown IPC socket: %v", err)
+		}
+	}
+
+	log.Printf("[IPC] Starting server on unix://%s", socketPath)
+	return listener, nil
+}
+
 // handleHealth returns health status
-func (s *IPCServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "healthy",
-		"enabled": s.client.enabled,
+func (s *IPCServer) handleHealth(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	writeJSON(w, protocol.HealthStatus{
+		Status:  "healthy",
+		Enabled: s.client.enabled,
+		Schema:  protocol.SchemaVersion,
 	})
 }
 
 // handleGetPeers returns list of connected peers
-func (s *IPCServer) handleGetPeers(w http.ResponseWriter, r *http.Request) {
+func (s *IPCServer) handleGetPeers(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
 	s.client.peersMutex.RLock()
 	peers := s.client.peers
 	s.client.peersMutex.RUnlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(peers)
+	if peers == nil {
+		peers = []*protocol.PeerInfo{}
+	}
+	writeJSON(w, peers)
+}
+
+// handleGetServices returns what each connected device offers
+func (s *IPCServer) handleGetServices(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
+	if r.Method != "GET" {
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.client.peerServices())
 }
 
 // handleSendSignal sends a signal to a peer via VPN
-func (s *IPCServer) handleSendSignal(w http.ResponseWriter, r *http.Request) {
+func (s *IPCServer) handleSendSignal(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		protocol.WriteError(w, protocol.ErrMethodNotAllowed)
 		return
 	}
 
-	var payload struct {
-		Peer string `json:"peer"`
-		Data string `json:"data"`
+	var payload protocol.SendSignalRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "invalid payload"))
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid payload", http.StatusBadRequest)
+	if payload.Extension == "" || payload.Peer == "" {
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "extension and peer are required"))
 		return
 	}
 
-	// Write to outgoing signal file (same mechanism as before)
-	homeDir, err := getRealUserHomeDir()
-	if err != nil {
-		http.Error(w, "Failed to get home dir", http.StatusInternalServerError)
+	if !cred.allows(payload.Extension) {
+		protocol.WriteError(w, protocol.ErrForbidden)
 		return
 	}
 
-	signalFile := filepath.Join(homeDir, fmt.Sprintf(".family-vpn-video-out-%s", payload.Peer))
-	message := fmt.Sprintf("%s:%s", payload.Peer, payload.Data)
+	ttl := payload.TTL
+	if ttl <= 0 {
+		ttl = defaultSignalTTL
+	}
+
+	// The server stamps From with our tunnel address, so it is left empty here
+	msg := &protocol.SignalMessage{
+		ID:        newSignalID(),
+		Type:      protocol.SignalTypeData,
+		Extension: payload.Extension,
+		To:        payload.Peer,
+		Payload:   payload.Data,
+		TTL:       ttl,
+	}
 
-	if err := os.WriteFile(signalFile, []byte(message), 0644); err != nil {
-		http.Error(w, "Failed to write signal", http.StatusInternalServerError)
+	if err := s.client.queueOutgoingSignal(msg); err != nil {
+		log.Printf("[IPC] Rejected '%s' signal to peer %s: %v", payload.Extension, payload.Peer, err)
+		protocolErr, ok := err.(*protocol.Error)
+		if !ok {
+			protocolErr = protocol.NewError(protocol.CodeInternal, http.StatusInternalServerError, err.Error())
+		}
+		protocol.WriteError(w, protocolErr)
 		return
 	}
 
-	log.Printf("[IPC] Signal sent to peer %s", payload.Peer)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+	log.Printf("[IPC] '%s' signal %s sent to peer %s", payload.Extension, msg.ID, payload.Peer)
+	writeJSON(w, protocol.SendSignalResponse{Status: "sent", ID: msg.ID})
 }
 
-// handlePollSignals polls for incoming signals for an extension
-func (s *IPCServer) handlePollSignals(w http.ResponseWriter, r *http.Request) {
+// handlePollSignals returns incoming signals and receipts for an extension.
+// Data signals returned here are acknowledged to their sender.
+// Extensions should prefer the /events stream; polling is kept for older clients.
+func (s *IPCServer) handlePollSignals(w http.ResponseWriter, r *http.Request, cred *ipcCredential) {
 	extension := r.URL.Query().Get("extension")
 	if extension == "" {
-		http.Error(w, "Extension name required", http.StatusBadRequest)
+		protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "extension name required"))
+		return
+	}
+
+	if !cred.allows(extension) {
+		protocol.WriteError(w, protocol.ErrForbidden)
 		return
 	}
 
+	signals := []protocol.Signal{}
+	for _, q := range s.takeSignals(extension) {
+		signals = append(signals, protocol.SignalFromMessage(q.msg))
+		s.client.sendSignalReceipt(q.msg, protocol.SignalTypeAck, "")
+	}
+
+	writeJSON(w, signals)
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// takeSignals removes and returns the live queued signals of an extension,
+// failing the ones that expired while waiting
+func (s *IPCServer) takeSignals(extension string) []*queuedSignal {
 	s.queueMutex.Lock()
-	signals := s.signalQueue[extension]
+	queued := s.signalQueue[extension]
 	s.signalQueue[extension] = nil // Clear queue
 	s.queueMutex.Unlock()
 
-	if signals == nil {
-		signals = []map[string]interface{}{}
+	live := make([]*queuedSignal, 0, len(queued))
+	for _, q := range queued {
+		if q.expired() {
+			s.client.sendSignalReceipt(q.msg, protocol.SignalTypeFailed, "expired")
+			continue
+		}
+		live = append(live, q)
 	}
+	return live
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(signals)
+// requeueSignals puts undelivered signals back at the front of an extension's queue
+func (s *IPCServer) requeueSignals(extension string, signals []*queuedSignal) {
+	s.queueMutex.Lock()
+	s.signalQueue[extension] = append(signals, s.signalQueue[extension]...)
+	s.queueMutex.Unlock()
 }
 
-// QueueSignal queues an incoming signal for an extension
-func (s *IPCServer) QueueSignal(extension, peerIP string, data []byte) {
-	signal := map[string]interface{}{
-		"peer": peerIP,
-		"data": string(data),
+// QueueSignal queues an incoming signal or receipt for the extension it is
+// addressed to. Signals for extensions that aren't registered are failed back
+// to the sender instead of waiting for a collector that will never come.
+func (s *IPCServer) QueueSignal(msg *protocol.SignalMessage) {
+	if msg.Type == "" {
+		msg.Type = protocol.SignalTypeData
+	}
+
+	if !s.isRegistered(msg.Extension) {
+		log.Printf("[IPC] No extension '%s' is running, rejecting %s %s from peer %s", msg.Extension, msg.Type, msg.ID, msg.From)
+		s.client.sendSignalReceipt(msg, protocol.SignalTypeFailed, "extension not running")
+		return
 	}
 
+	var dropped *queuedSignal
+
 	s.queueMutex.Lock()
-	s.signalQueue[extension] = append(s.signalQueue[extension], signal)
+	queue := append(s.signalQueue[msg.Extension], &queuedSignal{msg: msg, queuedAt: time.Now()})
+	if len(queue) > maxQueuedPerExtension {
+		dropped = queue[0]
+		queue = queue[1:]
+	}
+	s.signalQueue[msg.Extension] = queue
 	s.queueMutex.Unlock()
 
-	log.Printf("[IPC] Queued signal for extension '%s' from peer %s", extension, peerIP)
+	log.Printf("[IPC] Queued %s %s for extension '%s' from peer %s", msg.Type, msg.ID, msg.Extension, msg.From)
+	s.wakeSubscribers(msg.Extension)
+
+	if dropped != nil {
+		log.Printf("[IPC] Queue for '%s' is full, dropping %s %s", msg.Extension, dropped.msg.Type, dropped.msg.ID)
+		s.client.sendSignalReceipt(dropped.msg, protocol.SignalTypeFailed, "queue full")
+	}
+}
+
+// expireSignals periodically drops queued signals nobody collected in time
+func (s *IPCServer) expireSignals() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*queuedSignal
+
+		s.queueMutex.Lock()
+		for extension, queue := range s.signalQueue {
+			kept := queue[:0]
+			for _, q := range queue {
+				if q.expired() {
+					expired = append(expired, q)
+				} else {
+					kept = append(kept, q)
+				}
+			}
+			s.signalQueue[extension] = kept
+		}
+		s.queueMutex.Unlock()
+
+		for _, q := range expired {
+			log.Printf("[IPC] '%s' %s %s expired before it was collected", q.msg.Extension, q.msg.Type, q.msg.ID)
+			s.client.sendSignalReceipt(q.msg, protocol.SignalTypeFailed, "expired")
+		}
+	}
+}
+
+// newSignalID generates a random signal ID
+func newSignalID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
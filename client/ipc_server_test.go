@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+func TestListenSocket(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root, as under sudo, to hand the socket to the desktop user")
+	}
+	const uid = 54321 // A desktop user that doesn't exist, so we don't touch a real client's socket
+	t.Setenv("SUDO_UID", "54321")
+	t.Setenv("SUDO_GID", "54321")
+	dir := protocol.RuntimeDir(uid)
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// A stale socket from a previous run
+	os.Mkdir(dir, 0700)
+	os.Chown(dir, uid, uid)
+	socketPath := filepath.Join(dir, protocol.SocketFileName)
+	os.WriteFile(socketPath, nil, 0666)
+
+	s := NewIPCServer(0, NewVPNClient("server:443", false, nil, false, false))
+	listener, err := s.listenSocket()
+	if err != nil {
+		t.Fatalf("listenSocket: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is %v, want a socket", socketPath, info.Mode())
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode %o, want 600", perm)
+	}
+	if owner := info.Sys().(*syscall.Stat_t).Uid; owner != uid {
+		t.Errorf("socket owned by %d, want the desktop user %d", owner, uid)
+	}
+}
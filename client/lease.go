@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultLeaseFile is where the client keeps the server's lease token
+func defaultLeaseFile() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "family-vpn", "lease-token")
+}
+
+// loadLeaseToken returns the lease token of this device's previous address,
+// or "" if there is none
+func (c *VPNClient) loadLeaseToken() string {
+	if c.leaseFile == "" {
+		return ""
+	}
+	data, err := os.ReadFile(c.leaseFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveLeaseToken keeps the lease token the server sent (LEASE), so the next
+// connection gets the same address back
+func (c *VPNClient) saveLeaseToken(token string) {
+	if c.leaseFile == "" || token == c.loadLeaseToken() {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.leaseFile), 0700); err != nil {
+		log.Printf("[PEERS] Failed to save lease token: %v", err)
+		return
+	}
+	if err := os.WriteFile(c.leaseFile, []byte(token+"\n"), 0600); err != nil {
+		log.Printf("[PEERS] Failed to save lease token: %v", err)
+	}
+}
@@ -13,10 +13,10 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 	"github.com/songgao/water"
 )
 
@@ -34,34 +35,17 @@ const (
 	SERVER_IP  = "10.8.0.1"
 )
 
-// getRealUserHomeDir returns the real user's home directory, even when running as root via sudo
-func getRealUserHomeDir() (string, error) {
-	// Check if running as root via sudo
-	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
-		// Running via sudo - get the original user's home directory
-		if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
-			return filepath.Join("/Users", sudoUser), nil // macOS
-		}
-	}
-
-	// Fallback to standard home directory
-	return os.UserHomeDir()
-}
+const (
+	maxQueuedControlMessages = 256                    // Outgoing control messages buffered for the tunnel writer
+	controlQueueTimeout      = 500 * time.Millisecond // How long a sender waits for room in a full queue
+)
 
-// PeerInfo represents a connected VPN peer
-type PeerInfo struct {
-	Hostname    string `json:"hostname"`
-	VPNAddress  string `json:"vpn_address"`
-	PublicIP    string `json:"public_ip"`
-	ConnectedAt string `json:"connected_at"`
-	OS          string `json:"os"`
-}
 
 type VPNClient struct {
 	serverAddr   string
 	encryption   bool
 	key          []byte
-	tunIface     *water.Interface
+	tunIface     io.ReadWriteCloser // TUN device, or the userspace stack with -netstack
 	conn         net.Conn
 	enabled      bool
 	originalGW   string
@@ -69,11 +53,28 @@ type VPNClient struct {
 	noTimeout    bool // If true, run indefinitely (for production use)
 	useTLS       bool // If true, use TLS to look like HTTPS
 	assignedIP   string // VPN IP assigned by server
-	peers        []*PeerInfo // List of connected peers
+	peers        []*protocol.PeerInfo // List of connected peers, with their details
+	listedPeers  []*protocol.PeerInfo // Latest PEER_LIST, as sent
+	peerDetails  map[string]*protocol.PeerDetails // Latest PEER_DETAILS per address
 	peersMutex   sync.RWMutex
 	// WebSocket for real-time signaling
-	wsConn     *websocket.Conn
+	wsConn       *websocket.Conn
+	sessionToken string // Signaling credential issued by the server over the tunnel
 	ipcServer  *IPCServer // Reference to IPC server for signal delivery
+	// Tunnel writer shared by the TUN egress loop and control messages
+	writer       *bufio.Writer
+	writerMutex  sync.Mutex
+	controlQueue chan []byte // Outgoing control messages (signals, receipts)
+	done         chan struct{} // Closed by Disconnect; ends sendControlMessages
+	doneOnce     sync.Once
+	ipcPort      int         // Local IPC TCP port, off by default (0 = Unix socket only)
+	services     []protocol.Service // Read from the -services file; extensions add their own
+	leaseFile    string             // Keeps the server's lease token ("" = get a new address every time)
+	// Userspace mode (-netstack): no TUN device or route changes, so no root;
+	// apps use the local proxies instead
+	netstack      bool
+	socksPort     int // Local SOCKS5 proxy port in userspace mode (0 = off)
+	httpProxyPort int // Local HTTP proxy port in userspace mode (0 = off)
 }
 
 func NewVPNClient(serverAddr string, encryption bool, key []byte, noTimeout bool, useTLS bool) *VPNClient {
@@ -84,6 +85,10 @@ func NewVPNClient(serverAddr string, encryption bool, key []byte, noTimeout bool
 		enabled:    false,
 		noTimeout:  noTimeout,
 		useTLS:     useTLS,
+		controlQueue: make(chan []byte, maxQueuedControlMessages),
+		peerDetails:  make(map[string]*protocol.PeerDetails),
+		done:         make(chan struct{}),
+		ipcPort:      0,
 	}
 }
 
@@ -276,6 +281,11 @@ func (c *VPNClient) cleanupTUN() error {
 		c.tunIface.Close()
 	}
 
+	if c.netstack {
+		log.Printf("Userspace network stack stopped")
+		return nil
+	}
+
 	if runtime.GOOS == "darwin" {
 		// macOS cleanup - utun devices are automatically removed when closed
 		log.Printf("TUN device %s closed", c.tunName)
@@ -404,9 +414,12 @@ func (c *VPNClient) Connect() error {
 	if hostname == "" {
 		hostname = "Unknown"
 	}
-	peerInfo := &PeerInfo{
-		Hostname: hostname,
-		OS:       runtime.GOOS,
+	peerInfo := &protocol.PeerInfo{
+		Hostname:     hostname,
+		OS:           runtime.GOOS,
+		Capabilities: c.capabilities(),
+		Services:     c.localServices(),
+		LeaseToken:   c.loadLeaseToken(),
 	}
 	peerInfoJSON, err := json.Marshal(peerInfo)
 	if err != nil {
@@ -437,36 +450,44 @@ func (c *VPNClient) Connect() error {
 	c.assignedIP = string(vpnIPBuf)
 	log.Printf("[PEERS] Assigned VPN IP: %s", c.assignedIP)
 
-	// Setup TUN with assigned IP
-	if err := c.setupTUN(); err != nil {
-		return err
-	}
+	if c.netstack {
+		// Userspace stack with local proxies: the host's network is left alone
+		if err := c.setupNetstack(); err != nil {
+			return err
+		}
+	} else {
+		// Setup TUN with assigned IP
+		if err := c.setupTUN(); err != nil {
+			return err
+		}
 
-	// Route traffic
-	if err := c.routeAllTraffic(); err != nil {
-		c.cleanupTUN()
-		return err
+		// Route traffic
+		if err := c.routeAllTraffic(); err != nil {
+			c.cleanupTUN()
+			return err
+		}
 	}
 
+	c.writer = bufio.NewWriter(conn)
 	c.enabled = true
 	done := make(chan bool)
 
 	// Start IPC server for extensions
-	ipcServer := NewIPCServer(8889, c)
+	ipcServer := NewIPCServer(c.ipcPort, c)
 	c.ipcServer = ipcServer // Store reference for WebSocket signal delivery
 	if err := ipcServer.Start(); err != nil {
 		log.Printf("[IPC] Failed to start IPC server: %v", err)
 	}
+	c.publishState()
 
-	// Connect to WebSocket for real-time signaling
-	go c.connectWebSocket()
+	// WebSocket signaling starts once the server sends our session token (SESSION control message)
 
 	// TUN -> Server (egress)
 	go func() {
 		buffer := make([]byte, MTU)
 		lengthBuf := make([]byte, 4) // Reuse length buffer
-		writer := bufio.NewWriter(conn) // Buffered writer
-		var writerMutex sync.Mutex // Protect writer from concurrent access
+		writer := c.writer // Buffered writer
+		writerMutex := &c.writerMutex // Protect writer from concurrent access (shared with control messages)
 
 		// Diagnostics
 		var packetsSent, flushCount, totalBytesSent int64
@@ -588,8 +609,8 @@ func (c *VPNClient) Connect() error {
 	// Server -> TUN (ingress)
 	go func() {
 		lengthBuf := make([]byte, 4)
-		packetBuf := make([]byte, MTU*2) // Reuse packet buffer (sized for encrypted packets)
-		reader := bufio.NewReader(conn)  // Buffered reader
+		packetBuf := make([]byte, protocol.MaxFrameSize) // Reuse packet buffer (sized for control messages)
+		reader := bufio.NewReader(conn)                   // Buffered reader
 
 		// Diagnostics
 		var packetsRecv, totalBytesRecv int64
@@ -633,7 +654,7 @@ func (c *VPNClient) Connect() error {
 			}
 
 			length := binary.BigEndian.Uint32(lengthBuf)
-			if length > MTU*2 { // Sanity check
+			if length > protocol.MaxFrameSize { // Sanity check
 				log.Printf("Invalid packet length: %d", length)
 				done <- true
 				return
@@ -677,8 +698,8 @@ func (c *VPNClient) Connect() error {
 		}
 	}()
 
-	// Monitor outgoing video signals and send to peers via VPN
-	go c.monitorOutgoingVideoSignals(conn)
+	// Send control messages queued by IPC (extension signals) through the tunnel
+	go c.sendControlMessages()
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -712,30 +733,77 @@ func (c *VPNClient) handleControlMessage(message []byte) {
 	// Check if this is a PEER_LIST message
 	if strings.HasPrefix(command, "PEER_LIST:") {
 		peerListJSON := command[10:] // Skip "PEER_LIST:" prefix
-		var peerList []*PeerInfo
+		var peerList []*protocol.PeerInfo
 		if err := json.Unmarshal([]byte(peerListJSON), &peerList); err != nil {
 			log.Printf("[PEERS] Failed to parse peer list: %v", err)
 			return
 		}
 
 		c.peersMutex.Lock()
-		c.peers = peerList
+		c.listedPeers = peerList
+		peers := c.mergePeerDetails()
 		c.peersMutex.Unlock()
 
-		log.Printf("[PEERS] Updated peer list: %d peers connected", len(peerList))
-		for _, peer := range peerList {
+		log.Printf("[PEERS] Updated peer list: %d peers connected", len(peers))
+		for _, peer := range peers {
 			log.Printf("[PEERS]   - %s (%s) at %s", peer.Hostname, peer.OS, peer.VPNAddress)
 		}
 
-		// Write peer list to file for menu bar app
-		c.writePeerListToFile()
+		// Notify the menu bar and extensions
+		if c.ipcServer != nil {
+			c.ipcServer.PublishEvent(protocol.EventPeers, peers)
+		}
+		return
+	}
+
+	// Check if this is a peer's capabilities and services
+	if strings.HasPrefix(command, "PEER_DETAILS:") {
+		var details protocol.PeerDetails
+		if err := json.Unmarshal([]byte(command[13:]), &details); err != nil {
+			log.Printf("[PEERS] Failed to parse peer details: %v", err)
+			return
+		}
+
+		c.peersMutex.Lock()
+		c.peerDetails[details.VPNAddress] = &details
+		peers := c.mergePeerDetails()
+		c.peersMutex.Unlock()
+
+		if c.ipcServer != nil {
+			c.ipcServer.PublishEvent(protocol.EventPeers, peers)
+		}
+		return
+	}
+
+	// Check if this is an extension signal from another peer
+	if strings.HasPrefix(command, "SIGNAL:") {
+		c.handleSignalMessage(command[7:]) // Skip "SIGNAL:" prefix
+		return
+	}
+
+	// Check if this is our signaling session token
+	if strings.HasPrefix(command, "SESSION:") {
+		c.sessionToken = command[8:]
+		log.Printf("[WS] Received signaling session token")
+		go c.connectWebSocket()
+		return
+	}
+
+	// Check if this is the token that gets us this address again next time
+	if strings.HasPrefix(command, "LEASE:") {
+		c.saveLeaseToken(command[6:])
 		return
 	}
 
-	// Check if this is a VIDEO_CALL message
-	if strings.HasPrefix(command, "VIDEO_CALL:") {
-		log.Printf("[VIDEO] Received video call message")
-		c.handleVideoCallMessage(command[11:]) // Skip "VIDEO_CALL:" prefix
+	// Check if this is an operator broadcast from the admin API
+	if strings.HasPrefix(command, "MESSAGE:") {
+		log.Printf("[CONTROL] Message from server operator: %s", command[8:])
+		if c.ipcServer != nil {
+			c.ipcServer.PublishEvent(protocol.EventMessage, protocol.OperatorMessage{
+				Message:    command[8:],
+				ReceivedAt: time.Now().Format(time.RFC3339),
+			})
+		}
 		return
 	}
 
@@ -744,18 +812,9 @@ func (c *VPNClient) handleControlMessage(message []byte) {
 	// Handle component-specific update messages
 	if strings.HasPrefix(command, "UPDATE_") {
 		log.Printf("[CONTROL] Update signal received: %s", command)
-		// Write component-specific update signal that menu bar app will detect
-		homeDir, err := getRealUserHomeDir()
-		if err != nil {
-			log.Printf("[CONTROL] Failed to get home dir: %v", err)
-			return
-		}
-		signalFile := filepath.Join(homeDir, ".family-vpn-update-signal")
-		// Write the full update message (e.g., "UPDATE_VIDEO", "UPDATE_VPN", etc.)
-		if err := os.WriteFile(signalFile, []byte(command), 0644); err != nil {
-			log.Printf("[CONTROL] Failed to write update signal: %v", err)
-		} else {
-			log.Printf("[CONTROL] Update signal written: %s", command)
+		// Forward the full update message (e.g., "UPDATE_VIDEO", "UPDATE_VPN", etc.) to the menu bar
+		if c.ipcServer != nil {
+			c.ipcServer.PublishEvent(protocol.EventUpdate, protocol.UpdateNotice{Message: command})
 		}
 		return
 	}
@@ -766,57 +825,152 @@ func (c *VPNClient) handleControlMessage(message []byte) {
 	}
 }
 
-// writePeerListToFile writes the peer list to a file for the menu bar app
-func (c *VPNClient) writePeerListToFile() {
-	homeDir, err := getRealUserHomeDir()
-	if err != nil {
-		log.Printf("[PEERS] Failed to get home dir: %v", err)
+// mergePeerDetails rebuilds the peer list from the latest PEER_LIST and the
+// PEER_DETAILS received for each peer, and returns it. Servers that don't
+// send PEER_DETAILS put the details in PEER_LIST itself. Callers hold peersMutex.
+func (c *VPNClient) mergePeerDetails() []*protocol.PeerInfo {
+	peers := make([]*protocol.PeerInfo, len(c.listedPeers))
+	for i, peer := range c.listedPeers {
+		details, exists := c.peerDetails[peer.VPNAddress]
+		if !exists {
+			peers[i] = peer
+			continue
+		}
+		merged := *peer
+		merged.Capabilities = details.Capabilities
+		merged.Services = details.Services
+		peers[i] = &merged
+	}
+	c.peers = peers
+	return peers
+}
+
+// handleSignalMessage routes an incoming peer signal to the extension it is addressed to
+func (c *VPNClient) handleSignalMessage(data string) {
+	var msg protocol.SignalMessage
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		log.Printf("[SIGNAL] Failed to parse signal: %v", err)
+		return
+	}
+
+	if c.ipcServer == nil {
+		log.Printf("[SIGNAL] Warning: IPC server not available, cannot deliver '%s' signal", msg.Extension)
 		return
 	}
 
-	peerFile := filepath.Join(homeDir, ".family-vpn-peers.json")
+	log.Printf("[SIGNAL] Routing '%s' %s %s from %s via IPC", msg.Extension, msg.Type, msg.ID, msg.From)
+	c.ipcServer.QueueSignal(&msg)
+}
+
+// sendSignalReceipt tells the sender of a data signal whether its extension received it
+func (c *VPNClient) sendSignalReceipt(msg *protocol.SignalMessage, receiptType, reason string) {
+	if msg.Type != protocol.SignalTypeData || msg.From == "" {
+		return // Receipts are never answered with receipts
+	}
 
-	c.peersMutex.RLock()
-	peerJSON, err := json.MarshalIndent(c.peers, "", "  ")
-	c.peersMutex.RUnlock()
+	receipt := &protocol.SignalMessage{
+		ID:        msg.ID,
+		Type:      receiptType,
+		Extension: msg.Extension,
+		To:        msg.From,
+		Reason:    reason,
+	}
+	if err := c.queueOutgoingSignal(receipt); err != nil {
+		log.Printf("[SIGNAL] Failed to send %s receipt for %s: %v", receiptType, msg.ID, err)
+	}
+}
 
+// queueOutgoingSignal hands a signal to the tunnel writer for delivery to the server
+func (c *VPNClient) queueOutgoingSignal(msg *protocol.SignalMessage) error {
+	if protocol.SignalPayloadSize([]byte(msg.Payload)) > protocol.MaxSignalPayload {
+		return protocol.ErrSignalTooLarge
+	}
+	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("[PEERS] Failed to marshal peer list: %v", err)
-		return
+		return fmt.Errorf("failed to encode signal: %v", err)
 	}
+	if len(data) > protocol.MaxSignalSize {
+		return protocol.ErrSignalTooLarge
+	}
+	return c.queueControlMessage([]byte("CTRL:SIGNAL:" + string(data)))
+}
 
-	if err := os.WriteFile(peerFile, peerJSON, 0644); err != nil {
-		log.Printf("[PEERS] Failed to write peer file: %v", err)
-	} else {
-		log.Printf("[PEERS] Wrote peer list to %s", peerFile)
+// queueControlMessage queues a control message for the tunnel. It waits briefly
+// when the queue is full and fails immediately when the tunnel is down.
+// Control messages travel as single tunnel frames; the server drops the
+// connection on oversized frames, so larger messages are refused here.
+func (c *VPNClient) queueControlMessage(message []byte) error {
+	if !c.enabled {
+		return protocol.ErrTunnelDown
+	}
+	if len(message) > protocol.MaxControlMessage {
+		return fmt.Errorf("control message too large (%d bytes)", len(message))
+	}
+
+	select {
+	case c.controlQueue <- message:
+		return nil
+	case <-time.After(controlQueueTimeout):
+		return protocol.ErrQueueFull
 	}
 }
 
-// handleVideoCallMessage handles incoming video call signaling from peers
-func (c *VPNClient) handleVideoCallMessage(data string) {
-	// Use IPC queue for real-time signal delivery to extensions
-	if c.ipcServer != nil {
-		log.Printf("[VIDEO] Queueing video signal via IPC")
-		c.ipcServer.QueueSignal("video", "", []byte(data))
-	} else {
-		log.Printf("[VIDEO] Warning: IPC server not available, cannot deliver signal")
+// sendControlMessages writes queued control messages into the tunnel
+func (c *VPNClient) sendControlMessages() {
+	lengthBuf := make([]byte, 4)
+
+	for {
+		var message []byte
+		select {
+		case message = <-c.controlQueue:
+		case <-c.done:
+			return
+		}
+
+		encrypted, err := c.encrypt(message)
+		if err != nil {
+			log.Printf("[SIGNAL] Failed to encrypt control message: %v", err)
+			continue
+		}
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(encrypted)))
+
+		c.writerMutex.Lock()
+		_, err = c.writer.Write(lengthBuf)
+		if err == nil {
+			_, err = c.writer.Write(encrypted)
+		}
+		if err == nil {
+			err = c.writer.Flush() // Signals are latency-sensitive, don't wait for the flusher
+		}
+		c.writerMutex.Unlock()
+
+		if err != nil {
+			log.Printf("[SIGNAL] Failed to send control message: %v", err)
+		}
 	}
 }
 
-// connectWebSocket connects to the server's WebSocket endpoint for real-time signaling
+// connectWebSocket connects to the server's WebSocket endpoint for real-time signaling.
+// It dials the server's tunnel address, so the connection travels inside the VPN tunnel,
+// and authenticates with the session token the server issued for this tunnel.
 func (c *VPNClient) connectWebSocket() {
-	// Extract server host from serverAddr
-	serverHost, _, err := net.SplitHostPort(c.serverAddr)
-	if err != nil {
-		log.Printf("[WS] Failed to parse server address: %v", err)
+	if c.sessionToken == "" {
+		log.Printf("[WS] No session token yet, not connecting")
 		return
 	}
 
 	// Connect to WebSocket endpoint (port 9000 for HTTP/WebSocket server)
-	wsURL := fmt.Sprintf("ws://%s:9000/ws?vpn_ip=%s", serverHost, c.assignedIP)
+	wsURL := fmt.Sprintf("ws://%s:9000/ws", SERVER_IP)
 	log.Printf("[WS] Connecting to %s", wsURL)
 
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.sessionToken)
+	dialer := *websocket.DefaultDialer
+	if device, ok := c.tunIface.(*netstackDevice); ok {
+		// No TUN device routes the server's tunnel address: dial through the stack
+		dialer.NetDialContext = device.DialContext
+	}
+	conn, _, err := dialer.Dial(wsURL, header)
 	if err != nil {
 		log.Printf("[WS] Failed to connect: %v", err)
 		log.Printf("[WS] Will fall back to legacy control messages")
@@ -825,6 +979,7 @@ func (c *VPNClient) connectWebSocket() {
 
 	c.wsConn = conn
 	log.Printf("[WS] Connected successfully for real-time signaling")
+	c.publishState()
 
 	// Handle incoming WebSocket messages
 	go c.handleWebSocketMessages()
@@ -838,6 +993,7 @@ func (c *VPNClient) handleWebSocketMessages() {
 			c.wsConn = nil
 		}
 		log.Printf("[WS] WebSocket connection closed")
+		c.publishState()
 	}()
 
 	for c.enabled {
@@ -855,98 +1011,21 @@ func (c *VPNClient) handleWebSocketMessages() {
 
 		log.Printf("[WS] Received message type: %s", msgType)
 
-		// Route signal based on type
-		if msgType == "signal" {
-			// Parse signal data to determine extension
-			if strings.HasPrefix(data, "VIDEO_CALL:") {
-				videoData := data[11:] // Skip "VIDEO_CALL:" prefix
-				log.Printf("[WS] Routing video signal to video extension via IPC")
-				if c.ipcServer != nil {
-					c.ipcServer.QueueSignal("video", "", []byte(videoData))
-				}
-			}
-		}
-	}
-}
-
-// monitorOutgoingVideoSignals monitors for outgoing video signals and sends them via VPN
-func (c *VPNClient) monitorOutgoingVideoSignals(conn net.Conn) {
-	homeDir, err := getRealUserHomeDir()
-	if err != nil {
-		log.Printf("[VIDEO] Failed to get home dir: %v", err)
-		return
-	}
-
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-
-	processedFiles := make(map[string]bool)
-
-	for c.enabled {
-		<-ticker.C
-
-		// Scan for video signal files
-		files, err := filepath.Glob(filepath.Join(homeDir, ".family-vpn-video-out-*"))
-		if err != nil {
-			continue
-		}
-
-		for _, file := range files {
-			if processedFiles[file] {
-				continue // Already processed
-			}
-
-			// Read signal data
-			data, err := os.ReadFile(file)
-			if err != nil {
-				continue
-			}
-
-			content := string(data)
-			if content == "" {
-				continue
-			}
-
-			log.Printf("[VIDEO] Found outgoing video signal in %s", file)
-
-			// Send via VPN as control message
-			message := []byte("CTRL:VIDEO_CALL:" + content)
-
-			// Encrypt the control message
-			encrypted, err := c.encrypt(message)
-			if err != nil {
-				log.Printf("[VIDEO] Failed to encrypt video signal: %v", err)
-				continue
-			}
-
-			// Send length + encrypted packet
-			lengthBuf := make([]byte, 4)
-			binary.BigEndian.PutUint32(lengthBuf, uint32(len(encrypted)))
-
-			if _, err := conn.Write(lengthBuf); err != nil {
-				log.Printf("[VIDEO] Failed to send video signal length: %v", err)
-				continue
-			}
-
-			if _, err := conn.Write(encrypted); err != nil {
-				log.Printf("[VIDEO] Failed to send video signal: %v", err)
-				continue
-			}
-
-			log.Printf("[VIDEO] Sent video signal to server")
-
-			// Mark as processed and delete file
-			processedFiles[file] = true
-			os.Remove(file)
+		// Route signal to the extension named in its envelope
+		if msgType == "signal" && strings.HasPrefix(data, "SIGNAL:") {
+			c.handleSignalMessage(data[7:]) // Skip "SIGNAL:" prefix
 		}
 	}
 }
 
 func (c *VPNClient) Disconnect() error {
 	c.enabled = false
+	c.doneOnce.Do(func() { close(c.done) })
 
-	if err := c.restoreRouting(); err != nil {
-		log.Printf("Failed to restore routing: %v", err)
+	if !c.netstack {
+		if err := c.restoreRouting(); err != nil {
+			log.Printf("Failed to restore routing: %v", err)
+		}
 	}
 
 	if c.conn != nil {
@@ -958,15 +1037,48 @@ func (c *VPNClient) Disconnect() error {
 	}
 
 	log.Println("VPN disconnected")
+	c.publishState()
 	return nil
 }
 
+// connectionState describes the tunnel and signaling connection for IPC subscribers
+func (c *VPNClient) connectionState() protocol.ConnectionState {
+	state := protocol.ConnectionState{
+		Connected: c.enabled,
+		VPNIP:     c.assignedIP,
+		Server:    c.serverAddr,
+		Signaling: c.wsConn != nil,
+	}
+	if c.netstack {
+		if c.socksPort > 0 {
+			state.SOCKSProxy = fmt.Sprintf("127.0.0.1:%d", c.socksPort)
+		}
+		if c.httpProxyPort > 0 {
+			state.HTTPProxy = fmt.Sprintf("127.0.0.1:%d", c.httpProxyPort)
+		}
+	}
+	return state
+}
+
+// publishState pushes the current connection state to IPC subscribers
+func (c *VPNClient) publishState() {
+	if c.ipcServer != nil {
+		c.ipcServer.PublishEvent(protocol.EventState, c.connectionState())
+	}
+}
+
 func main() {
 	server := flag.String("server", "", "VPN server address (e.g., 95.217.238.72:443)")
 	encrypt := flag.Bool("encrypt", false, "Enable encryption")
 	useTLS := flag.Bool("tls", true, "Use TLS to look like HTTPS (default true)")
 	cpuprofile := flag.String("cpuprofile", "", "Write CPU profile to file")
 	noTimeout := flag.Bool("no-timeout", false, "Run indefinitely (default: 60s timeout for safety)")
+	ipcPort := flag.Int("ipc-port", 0, "Local IPC TCP port for tools that can't use the Unix socket (0 = off). Any local process could take the port first, so only enable it if needed")
+	netstack := flag.Bool("netstack", false, "Run a userspace network stack with local SOCKS5/HTTP proxies instead of a TUN device (no root needed)")
+	socksPort := flag.Int("socks-port", 1080, "Local SOCKS5 proxy port with -netstack (0 = off)")
+	httpProxyPort := flag.Int("http-proxy-port", 3128, "Local HTTP proxy port with -netstack (0 = off)")
+	servicesFile := flag.String("services", "", "JSON file listing the services this device offers the family")
+	leaseFile := flag.String("lease-file", defaultLeaseFile(), "File keeping the server's lease token, so this device keeps its VPN address (empty = don't keep)")
 	flag.Parse()
 
 	if *server == "" {
@@ -991,6 +1103,19 @@ func main() {
 	key := []byte("0123456789abcdef0123456789abcdef") // 32 bytes for AES-256
 
 	client := NewVPNClient(*server, *encrypt, key, *noTimeout, *useTLS)
+	client.ipcPort = *ipcPort
+	client.netstack = *netstack
+	client.socksPort = *socksPort
+	client.httpProxyPort = *httpProxyPort
+	client.leaseFile = *leaseFile
+	if *servicesFile != "" {
+		services, err := loadServices(*servicesFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[SERVICES] Not advertising services: %v", err)
+		}
+		client.services = services
+		log.Printf("[SERVICES] Offering %d service(s) from %s", len(services), *servicesFile)
+	}
 	if err := client.Connect(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// newTestClient returns a connected client whose tunnel writes to the
+// returned connection
+func newTestClient(t *testing.T) (*VPNClient, net.Conn) {
+	t.Helper()
+	c := NewVPNClient("server:443", true, []byte("0123456789abcdef0123456789abcdef"), false, false)
+	tunnel, server := net.Pipe()
+	t.Cleanup(func() { tunnel.Close(); server.Close() })
+
+	c.enabled = true
+	c.writer = bufio.NewWriter(tunnel)
+	go c.sendControlMessages()
+	t.Cleanup(func() { c.doneOnce.Do(func() { close(c.done) }) })
+	return c, server
+}
+
+// readFrame reads one length-prefixed frame the way the server does
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	var length [4]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatalf("reading frame length: %v", err)
+	}
+	if n := binary.BigEndian.Uint32(length[:]); n > protocol.MaxFrameSize {
+		t.Fatalf("frame of %d bytes, the server accepts at most %d", n, protocol.MaxFrameSize)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return frame
+}
+
+func TestLargeSignalEndToEnd(t *testing.T) {
+	sender, tunnel := newTestClient(t)
+
+	// An SDP offer is several KB, with newlines and quotes to escape
+	payload := strings.Repeat("a=candidate:1 1 udp 2130706431 \"10.8.0.2\" 50000 typ host\r\n", 110)
+	if len(payload) < 6<<10 {
+		t.Fatalf("payload is only %d bytes", len(payload))
+	}
+
+	msg := &protocol.SignalMessage{ID: "offer", Extension: "video", To: "10.8.0.3", Payload: payload}
+	if err := sender.queueOutgoingSignal(msg); err != nil {
+		t.Fatalf("queueOutgoingSignal: %v", err)
+	}
+
+	frame, err := sender.decrypt(readFrame(t, tunnel))
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	data, found := strings.CutPrefix(string(frame), "CTRL:SIGNAL:")
+	if !found {
+		t.Fatalf("frame is not a signal: %.40q", frame)
+	}
+
+	// The server relays the signal as it came, addressed to the receiver
+	receiver := NewVPNClient("server:443", false, nil, false, false)
+	receiver.ipcServer = NewIPCServer(0, receiver)
+	receiver.ipcServer.extensions["video"] = &protocol.RegisteredExtension{}
+	receiver.handleControlMessage([]byte("SIGNAL:" + data))
+
+	queue := receiver.ipcServer.signalQueue["video"]
+	if len(queue) != 1 {
+		t.Fatalf("%d signals queued for the extension, want 1", len(queue))
+	}
+	if queue[0].msg.Payload != payload {
+		t.Errorf("payload arrived as %d bytes, want the %d sent", len(queue[0].msg.Payload), len(payload))
+	}
+}
+
+func TestQueueOutgoingSignalTooLarge(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	msg := &protocol.SignalMessage{ID: "big", Extension: "video", To: "10.8.0.3", Payload: strings.Repeat("x", protocol.MaxSignalPayload)}
+	if err := c.queueOutgoingSignal(msg); !errors.Is(err, protocol.ErrSignalTooLarge) {
+		t.Errorf("queueOutgoingSignal = %v, want ErrSignalTooLarge", err)
+	}
+}
+
+func TestPeerDetailsMerge(t *testing.T) {
+	c := NewVPNClient("server:443", false, nil, false, false)
+
+	// Details may come before the list that has the peer
+	c.handleControlMessage([]byte(`PEER_DETAILS:{"vpn_address":"10.8.0.3","capabilities":{"client_version":"1.2.0"},"services":[{"name":"ssh","port":22,"protocol":"tcp"}]}`))
+	c.handleControlMessage([]byte(`PEER_LIST:[{"hostname":"laptop","vpn_address":"10.8.0.2"},{"hostname":"desktop","vpn_address":"10.8.0.3"}]`))
+
+	if len(c.peers) != 2 {
+		t.Fatalf("%d peers, want 2", len(c.peers))
+	}
+	if c.peers[0].Capabilities != nil || c.peers[0].Services != nil {
+		t.Errorf("peer without details got some: %+v", c.peers[0])
+	}
+	desktop := c.peers[1]
+	if desktop.Capabilities == nil || desktop.Capabilities.ClientVersion != "1.2.0" {
+		t.Errorf("desktop capabilities = %+v, want client 1.2.0", desktop.Capabilities)
+	}
+	if len(desktop.Services) != 1 || desktop.Services[0].Name != "ssh" {
+		t.Errorf("desktop services = %+v, want ssh", desktop.Services)
+	}
+
+	// A later list keeps the details; new details replace them
+	c.handleControlMessage([]byte(`PEER_LIST:[{"hostname":"desktop","vpn_address":"10.8.0.3"}]`))
+	c.handleControlMessage([]byte(`PEER_DETAILS:{"vpn_address":"10.8.0.3"}`))
+	if len(c.peers) != 1 || c.peers[0].Capabilities != nil || c.peers[0].Services != nil {
+		t.Errorf("peers = %+v, want desktop without details", c.peers)
+	}
+	if c.listedPeers[0].Hostname != "desktop" {
+		t.Errorf("listed peers changed: %+v", c.listedPeers)
+	}
+}
+
+func TestPeerListFromOlderServer(t *testing.T) {
+	c := NewVPNClient("server:443", false, nil, false, false)
+
+	// Servers without PEER_DETAILS put the details in the list
+	c.handleControlMessage([]byte(`PEER_LIST:[{"hostname":"desktop","vpn_address":"10.8.0.3","services":[{"name":"ssh","port":22,"protocol":"tcp"}]}]`))
+	if len(c.peers) != 1 || len(c.peers[0].Services) != 1 {
+		t.Errorf("peers = %+v, want desktop offering ssh", c.peers)
+	}
+}
+
+func TestOperatorMessageEvent(t *testing.T) {
+	c := NewVPNClient("server:443", false, nil, false, false)
+	c.ipcServer = NewIPCServer(0, c)
+	sub := c.ipcServer.subscribe("")
+
+	c.handleControlMessage([]byte("MESSAGE:Server maintenance at 22:00"))
+
+	select {
+	case event := <-sub.events:
+		message, ok := event.data.(protocol.OperatorMessage)
+		if event.eventType != protocol.EventMessage || !ok || message.Message != "Server maintenance at 22:00" {
+			t.Errorf("event = %+v, want the operator's message", event)
+		}
+	default:
+		t.Fatal("no event published for the operator's message")
+	}
+}
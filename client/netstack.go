@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNIC   = 1         // The stack's only interface
+	netstackQueue = 1024      // Outgoing packets buffered for the tunnel
+	netstackDNS   = "1.1.1.1" // Resolver used through the tunnel, as in routeAllTraffic
+)
+
+// netstackDevice is a userspace TCP/IP stack used instead of the TUN device
+// (-netstack). It needs no root: the host's interfaces, routes and DNS are
+// left alone, and apps reach the VPN through the local SOCKS5 and HTTP proxies.
+// Like the TUN device, it reads the packets the stack sends and writes the
+// packets that arrive from the tunnel.
+type netstackDevice struct {
+	stack    *stack.Stack
+	link     *channel.Endpoint
+	resolver *net.Resolver
+	ctx      context.Context // Cancelled on Close, ending Read
+	cancel   context.CancelFunc
+}
+
+// newNetstackDevice creates a stack that owns localIP and sends everything
+// else into the tunnel. Connections peers open to localIP are forwarded to
+// forwardIP, the host's own address: services peers reach over the TUN
+// device are reachable the same way, while loopback-only ones stay private.
+func newNetstackDevice(localIP string, forwardIP net.IP) (*netstackDevice, error) {
+	ip := net.ParseIP(localIP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid VPN IP %q", localIP)
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	link := channel.New(netstackQueue, MTU, "")
+	if err := s.CreateNIC(netstackNIC, link); err != nil {
+		return nil, fmt.Errorf("failed to create netstack interface: %v", err)
+	}
+
+	address := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4Slice(ip).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(netstackNIC, address, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("failed to assign %s: %v", localIP, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: netstackNIC}})
+
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+
+	d := &netstackDevice{stack: s, link: link}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dialIP(ctx, network, net.JoinHostPort(netstackDNS, "53"))
+		},
+	}
+
+	if forwardIP != nil {
+		forwarder := tcp.NewForwarder(s, 0, 256, func(r *tcp.ForwarderRequest) {
+			d.forwardInbound(r, forwardIP)
+		})
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+	}
+	return d, nil
+}
+
+// setupNetstack replaces the TUN device with a userspace stack and starts the
+// local proxies into it
+func (c *VPNClient) setupNetstack() error {
+	// Peers' connections go to the address we reach the server from
+	var forwardIP net.IP
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		forwardIP = addr.IP
+	}
+
+	device, err := newNetstackDevice(c.assignedIP, forwardIP)
+	if err != nil {
+		return err
+	}
+	c.tunIface = device
+	c.tunName = "netstack"
+
+	if c.socksPort > 0 {
+		if err := serveSOCKS5(fmt.Sprintf("127.0.0.1:%d", c.socksPort), device.DialContext); err != nil {
+			device.Close()
+			return err
+		}
+	}
+	if c.httpProxyPort > 0 {
+		if err := serveHTTPProxy(fmt.Sprintf("127.0.0.1:%d", c.httpProxyPort), device.DialContext); err != nil {
+			device.Close()
+			return err
+		}
+	}
+
+	log.Printf("Userspace network stack running with IP %s (no TUN device, routes unchanged)", c.assignedIP)
+	return nil
+}
+
+// Read returns the next packet the stack sends into the tunnel
+func (d *netstackDevice) Read(p []byte) (int, error) {
+	pkt := d.link.ReadContext(d.ctx)
+	if pkt == nil {
+		return 0, io.EOF // Closed
+	}
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(p, view.AsSlice()), nil
+}
+
+// Write hands a packet from the tunnel to the stack. Only IPv4 is tunneled.
+func (d *netstackDevice) Write(p []byte) (int, error) {
+	if len(p) == 0 || header.IPVersion(p) != header.IPv4Version {
+		return len(p), nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), p...)), // The caller reuses p
+	})
+	d.link.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+	return len(p), nil
+}
+
+// Close stops the stack and ends Read
+func (d *netstackDevice) Close() error {
+	d.cancel()
+	d.link.Close()
+	d.stack.Close()
+	return nil
+}
+
+// DialContext opens a TCP or UDP connection through the tunnel. Host names
+// are resolved through the tunnel as well, so DNS doesn't leak.
+func (d *netstackDevice) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		addrs, err := d.resolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		host = addrs[0].String()
+	}
+	return d.dialIP(ctx, network, net.JoinHostPort(host, port))
+}
+
+// dialIP opens a connection to an IPv4 address and port through the tunnel
+func (d *netstackDevice) dialIP(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	port, err := strconv.Atoi(portString)
+	if ip == nil || err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid IPv4 address %q", address)
+	}
+	remote := tcpip.FullAddress{NIC: netstackNIC, Addr: tcpip.AddrFrom4Slice(ip), Port: uint16(port)}
+
+	switch network {
+	case "tcp", "tcp4":
+		return gonet.DialContextTCP(ctx, d.stack, remote, ipv4.ProtocolNumber)
+	case "udp", "udp4":
+		return gonet.DialUDP(d.stack, nil, &remote, ipv4.ProtocolNumber)
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+}
+
+// forwardInbound connects a peer's TCP connection to the same port on the host
+func (d *netstackDevice) forwardInbound(r *tcp.ForwarderRequest, forwardIP net.IP) {
+	id := r.ID()
+	target := net.JoinHostPort(forwardIP.String(), strconv.Itoa(int(id.LocalPort)))
+
+	local, err := net.Dial("tcp", target)
+	if err != nil {
+		r.Complete(true) // Nothing listening: refuse, as the TUN device would
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Printf("[NETSTACK] Failed to accept connection from %s: %v", id.RemoteAddress, tcpErr)
+		r.Complete(true)
+		local.Close()
+		return
+	}
+	r.Complete(false)
+
+	go relay(gonet.NewTCPConn(&wq, ep), local)
+}
+
+// relay copies between two connections until both directions are done
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Pass the end of one direction on, keeping the other open
+		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
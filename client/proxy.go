@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+const proxyDialTimeout = 30 * time.Second // How long a proxy waits for a connection through the tunnel
+
+// dialFunc opens a connection through the tunnel
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// SOCKS5 constants (RFC 1928)
+const (
+	socksVersion            = 5
+	socksNoAuth             = 0x00
+	socksNoAcceptable       = 0xff
+	socksConnect            = 0x01
+	socksAddrIPv4           = 0x01
+	socksAddrDomain         = 0x03
+	socksSucceeded          = 0x00
+	socksHostUnreachable    = 0x04
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+// serveSOCKS5 runs a SOCKS5 proxy (CONNECT, no authentication) on a local
+// address, sending every connection through the tunnel
+func serveSOCKS5(addr string, dial dialFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("[PROXY] SOCKS5 proxy on socks5://%s", addr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("[PROXY] SOCKS5 proxy stopped: %v", err)
+				return
+			}
+			go handleSOCKS5(conn, dial)
+		}
+	}()
+	return nil
+}
+
+// handleSOCKS5 serves one SOCKS5 client
+func handleSOCKS5(conn net.Conn, dial dialFunc) {
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	reader := bufio.NewReader(conn)
+
+	// Greeting: version, then the authentication methods the client supports
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		conn.Close()
+		return
+	}
+	if !containsByte(methods, socksNoAuth) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{socksVersion, socksNoAuth})
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCommandUnsupported)
+		conn.Close()
+		return
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			conn.Close()
+			return
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			conn.Close()
+			return
+		}
+		host = string(name)
+	default: // The tunnel only carries IPv4
+		socksReply(conn, socksAddressUnsupported)
+		conn.Close()
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	remote, err := dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		log.Printf("[PROXY] SOCKS5 connection to %s failed: %v", target, err)
+		socksReply(conn, socksHostUnreachable)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Whatever the client sent after its request is already buffered
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		remote.Write(data)
+	}
+	relay(conn, remote)
+}
+
+// socksReply answers a SOCKS5 request. The bound address is not meaningful
+// through the tunnel, so it is always 0.0.0.0:0.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// containsByte reports whether b contains c
+func containsByte(b []byte, c byte) bool {
+	for _, x := range b {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// serveHTTPProxy runs an HTTP proxy on a local address: CONNECT for HTTPS and
+// other TCP, plain forwarding for http:// URLs, all through the tunnel
+func serveHTTPProxy(addr string, dial dialFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("[PROXY] HTTP proxy on http://%s", addr)
+
+	forward := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.Header["X-Forwarded-For"] = nil // Don't add one
+		},
+		Transport: &http.Transport{
+			DialContext:         dial,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[PROXY] HTTP request to %s failed: %v", r.URL.Host, err)
+			http.Error(w, "Family VPN proxy: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				handleHTTPConnect(w, r, dial)
+				return
+			}
+			if r.URL.Scheme != "http" || r.URL.Host == "" {
+				http.Error(w, "Family VPN proxy: only http:// URLs and CONNECT are supported", http.StatusBadRequest)
+				return
+			}
+			forward.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: proxyDialTimeout,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("[PROXY] HTTP proxy stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handleHTTPConnect opens a tunnel for a CONNECT request
+func handleHTTPConnect(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), proxyDialTimeout)
+	remote, err := dial(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		log.Printf("[PROXY] CONNECT to %s failed: %v", r.Host, err)
+		http.Error(w, "Family VPN proxy: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		remote.Close()
+		http.Error(w, "Family VPN proxy: CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		remote.Write(data)
+	}
+	relay(conn, remote)
+}
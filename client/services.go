@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// loadServices reads the services this device offers from a JSON file (a list
+// of protocol.Service). Entries without a protocol are tcp.
+func loadServices(path string) ([]protocol.Service, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []protocol.Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	valid := make([]protocol.Service, 0, len(services))
+	for _, service := range services {
+		if service.Protocol == "" {
+			service.Protocol = "tcp"
+		}
+		service.Extension = "" // Only extensions advertise extension services
+		if err := service.Validate(); err != nil {
+			log.Printf("[SERVICES] Ignoring service in %s: %v", path, err)
+			continue
+		}
+		valid = append(valid, service)
+	}
+	return valid, nil
+}
+
+// localServices returns what this device offers: the services file, then the
+// services of each registered extension
+func (c *VPNClient) localServices() []protocol.Service {
+	services := append([]protocol.Service{}, c.services...)
+	if c.ipcServer != nil {
+		for _, ext := range c.ipcServer.extensionList() {
+			for _, service := range ext.Services {
+				service.Extension = ext.Name
+				services = append(services, service)
+			}
+		}
+	}
+	return services
+}
+
+// servicesMutex keeps advertisements in the order their state was read
+var servicesMutex sync.Mutex
+
+// advertiseServices tells the server (and through it every peer) what this
+// device currently offers
+func (c *VPNClient) advertiseServices() {
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+
+	data, err := json.Marshal(c.localServices())
+	if err != nil {
+		log.Printf("[SERVICES] Failed to encode services: %v", err)
+		return
+	}
+
+	message := []byte("CTRL:SERVICES:" + string(data))
+	if err := c.queueControlMessage(message); err != nil {
+		log.Printf("[SERVICES] Failed to advertise services: %v", err)
+	}
+}
+
+// peerServices lists what each connected device offers, skipping devices
+// that offer nothing
+func (c *VPNClient) peerServices() []protocol.PeerServices {
+	c.peersMutex.RLock()
+	defer c.peersMutex.RUnlock()
+
+	list := []protocol.PeerServices{}
+	for _, peer := range c.peers {
+		if len(peer.Services) == 0 {
+			continue
+		}
+		list = append(list, protocol.PeerServices{
+			Peer:     peer.VPNAddress,
+			Hostname: peer.Hostname,
+			Services: peer.Services,
+		})
+	}
+	return list
+}
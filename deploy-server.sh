@@ -63,7 +63,7 @@ git reset --hard origin/main
 
 echo '→ Building server...'
 cd server
-/usr/local/go/bin/go build -o ../vpn-server main.go
+/usr/local/go/bin/go build -o ../vpn-server .
 cd ..
 
 echo '→ Stopping old server...'
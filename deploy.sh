@@ -7,13 +7,26 @@
 #   ./deploy.sh vpn       - Deploy only VPN core
 #   ./deploy.sh menu      - Deploy only menu-bar
 #
+# The admin API only answers inside the VPN, so connect to it first.
+#
 
 set -e
 
 VPN_SERVER="95.217.238.72"
+ADMIN_SERVER="10.8.0.1" # Server's tunnel address (admin API and /update/init)
 UPDATE_PORT="9000"
 COMPONENT="${1:-all}"
 
+# Load operator credentials (VPN_ADMIN_TOKEN) from .env
+if [ -f .env ]; then
+    export $(cat .env | grep -v '^#' | xargs)
+fi
+
+if [ -z "${VPN_ADMIN_TOKEN:-}" ]; then
+    echo "❌ VPN_ADMIN_TOKEN is not set (add it to .env) - /update/init requires it"
+    exit 1
+fi
+
 echo "========================================"
 echo "Family VPN - Component Deployment"
 echo "========================================"
@@ -74,8 +87,16 @@ echo ""
 for COMP in "${COMPONENTS[@]}"; do
     echo "🚀 Deploying component: $COMP"
 
-    UPDATE_ENDPOINT="http://$VPN_SERVER:$UPDATE_PORT/update/init?component=$COMP"
-    RESPONSE=$(curl -s -w "\n%{http_code}" -X POST "$UPDATE_ENDPOINT" 2>&1)
+    # Extensions are installed from signed releases, so publish one first
+    if [ -f "extensions/$COMP/extension.json" ]; then
+        if ! ./publish-extension.sh "$COMP"; then
+            echo "  ❌ $COMP could not be published"
+            continue
+        fi
+    fi
+
+    UPDATE_ENDPOINT="http://$ADMIN_SERVER:$UPDATE_PORT/update/init?component=$COMP"
+    RESPONSE=$(curl -s -w "\n%{http_code}" -X POST -H "Authorization: Bearer $VPN_ADMIN_TOKEN" "$UPDATE_ENDPOINT" 2>&1)
     HTTP_CODE=$(echo "$RESPONSE" | tail -1)
     BODY=$(echo "$RESPONSE" | sed '$d')
 
@@ -0,0 +1,18 @@
+module github.com/miguelemosreverte/family-vpn/extensions/chat
+
+go 1.25.4
+
+require (
+	github.com/miguelemosreverte/family-vpn/extensions/framework v0.0.0
+	github.com/miguelemosreverte/family-vpn/ipc v0.0.0
+	github.com/miguelemosreverte/family-vpn/protocol v0.0.0
+	go.etcd.io/bbolt v1.4.3
+)
+
+require golang.org/x/sys v0.29.0 // indirect
+
+replace (
+	github.com/miguelemosreverte/family-vpn/extensions/framework => ../framework
+	github.com/miguelemosreverte/family-vpn/ipc => ../../ipc
+	github.com/miguelemosreverte/family-vpn/protocol => ../../protocol
+)
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	familyConversation = "family"         // Messages to every member
+	deliveryInterval   = 15 * time.Second // How often queued messages are retried
+	signalTTL          = 10 * time.Minute // How long the server may hold a message for a reconnecting peer
+	deliveryTimeout    = 2 * signalTTL    // A message without a receipt is sent again after this
+)
+
+// errTooLong is returned for messages that don't fit in a signal
+var errTooLong = errors.New("message is too long")
+
+// message is a chat message, sent or received. Peers are named by VPN
+// address: the server assigns addresses (and gives a device its own back),
+// while hostnames are whatever a peer claims, so two devices may report the
+// same one.
+type message struct {
+	ID           string    `json:"id"`
+	Conversation string    `json:"conversation"`        // familyConversation, or the other peer's VPN address
+	From         string    `json:"from,omitempty"`      // Author's VPN address, on received messages
+	FromName     string    `json:"from_name,omitempty"` // Hostname the author reported, for display only
+	Text         string    `json:"text"`
+	SentAt       time.Time `json:"sent_at"`
+	Outgoing     bool      `json:"outgoing"`
+	Pending      []string  `json:"pending,omitempty"`   // VPN addresses it still has to reach
+	Delivered    []string  `json:"delivered,omitempty"` // VPN addresses that received it
+}
+
+// chatSignal carries a message to a peer
+type chatSignal struct {
+	ID     string    `json:"id"`
+	Family bool      `json:"family,omitempty"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// ChatExtension sends messages between family members. Messages are kept in
+// a local store and queued until their recipients are online.
+type ChatExtension struct {
+	*framework.ExtensionBase
+	vpnClient *ipc.VPNClient
+	port      int
+	stateDir  string
+	hostname  string
+	store     *messageStore
+	server    *http.Server
+	cancel    context.CancelFunc // Ends the signal subscription and delivery loop
+	wake      chan struct{}      // Runs the delivery loop right away
+
+	updateLock sync.Mutex // Serializes read-modify-write of stored messages
+
+	inFlight     map[string]time.Time // "<message>/<recipient>" -> when it was sent
+	inFlightLock sync.Mutex
+
+	members     map[string]string // VPN address -> hostname of peers that ran chat: the recipients of family messages
+	membersLock sync.Mutex
+
+	listeners     map[chan message]bool // Open UI event streams
+	listenersLock sync.Mutex
+}
+
+// NewChatExtension creates a new chat extension
+func NewChatExtension(vpnPort int, stateDir string) *ChatExtension {
+	hostname, _ := os.Hostname()
+	e := &ChatExtension{
+		ExtensionBase: framework.NewExtensionBase("chat", "1.0.0"),
+		vpnClient:     ipc.NewVPNClient(vpnPort),
+		port:          8895,
+		stateDir:      stateDir,
+		hostname:      hostname,
+		wake:          make(chan struct{}, 1),
+		inFlight:      make(map[string]time.Time),
+		members:       make(map[string]string),
+		listeners:     make(map[chan message]bool),
+	}
+	e.SetVPNClient(e.vpnClient)
+	return e
+}
+
+// Start starts the chat extension
+func (e *ChatExtension) Start() error {
+	// Check VPN core is running
+	if err := e.vpnClient.Health(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", e.stateDir, err)
+	}
+	store, err := openStore(filepath.Join(e.stateDir, "messages.db"))
+	if err != nil {
+		return fmt.Errorf("failed to open message store: %v", err)
+	}
+	e.store = store
+
+	framework.ReadJSONFile(e.membersPath(), &e.members)
+
+	e.server = &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", e.port), Handler: e.uiHandler()}
+	log.Printf("[CHAT] Serving chat UI on http://%s", e.server.Addr)
+	e.SetEndpoint("ui", fmt.Sprintf("http://127.0.0.1:%d", e.port))
+
+	go func() {
+		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[CHAT] Server error: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.monitorSignals(ctx)
+	go e.deliverLoop(ctx)
+
+	return nil
+}
+
+// Stop stops the extension. Undelivered messages are sent after the next start.
+func (e *ChatExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		e.server.Shutdown(ctx)
+	}
+	if e.store != nil {
+		return e.store.close()
+	}
+	return nil
+}
+
+// Health returns true if extension is healthy
+func (e *ChatExtension) Health() bool {
+	if e.vpnClient == nil {
+		return false
+	}
+	return e.vpnClient.Health() == nil
+}
+
+// Status reports how many messages are waiting for delivery
+func (e *ChatExtension) Status() interface{} {
+	queued := 0
+	if e.store != nil {
+		queued = len(e.store.pending())
+	}
+	return struct {
+		Queued  int      `json:"queued"`
+		Members []string `json:"members"`
+	}{queued, e.memberList()}
+}
+
+// send stores a new message and queues it for its recipients
+func (e *ChatExtension) send(conversation, text string) (message, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || conversation == "" {
+		return message{}, errors.New("conversation and text are required")
+	}
+	if conversation != familyConversation && net.ParseIP(conversation) == nil {
+		return message{}, errors.New("conversation must be family or a VPN address")
+	}
+
+	id, err := newMessageID()
+	if err != nil {
+		return message{}, err
+	}
+	m := message{
+		ID:           id,
+		Conversation: conversation,
+		Text:         text,
+		SentAt:       time.Now().UTC(),
+		Outgoing:     true,
+	}
+	if conversation == familyConversation {
+		m.Pending = e.memberList()
+	} else {
+		m.Pending = []string{conversation}
+	}
+
+	if data, _ := json.Marshal(e.signalFor(m)); protocol.SignalPayloadSize(data) > protocol.MaxSignalPayload {
+		return message{}, errTooLong
+	}
+	if err := e.store.put(m); err != nil {
+		return message{}, err
+	}
+
+	e.publish(m)
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+	return m, nil
+}
+
+// signalFor returns the signal that carries a message
+func (e *ChatExtension) signalFor(m message) chatSignal {
+	return chatSignal{ID: m.ID, Family: m.Conversation == familyConversation, Text: m.Text, SentAt: m.SentAt}
+}
+
+// deliverLoop sends queued messages to recipients that are online, until ctx is cancelled
+func (e *ChatExtension) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		e.deliverPending()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+	}
+}
+
+// deliverPending sends every queued message to those of its recipients that
+// are online and not already waiting for it
+func (e *ChatExtension) deliverPending() {
+	peers, err := e.vpnClient.GetPeers()
+	if err != nil {
+		return // Tunnel down: everything stays queued
+	}
+
+	online := make(map[string]bool) // VPN addresses running chat
+	for _, peer := range peers {
+		if peer.Hostname != e.hostname && peer.RunsExtension(e.Name()) {
+			online[peer.VPNAddress] = true
+			e.addMember(peer.VPNAddress, peer.Hostname)
+		}
+	}
+
+	for _, m := range e.store.pending() {
+		data, err := json.Marshal(e.signalFor(m))
+		if err != nil {
+			continue
+		}
+		for _, recipient := range m.Pending {
+			if !online[recipient] || !e.startDelivery(m.ID, recipient) {
+				continue
+			}
+
+			id, recipient := m.ID, recipient
+			_, err := e.vpnClient.SendSignalWithOptions(e.Name(), recipient, data, ipc.SignalOptions{
+				TTL: signalTTL,
+				OnDelivered: func(string, string) {
+					e.delivered(id, recipient)
+				},
+				OnFailed: func(_, _, reason string) {
+					log.Printf("[CHAT] Message %s to %s not delivered (%s); will retry", id, recipient, reason)
+					e.endDelivery(id, recipient)
+				},
+			})
+			if err != nil {
+				log.Printf("[CHAT] Failed to send message %s to %s: %v", id, recipient, err)
+				e.endDelivery(id, recipient)
+			}
+		}
+	}
+}
+
+// startDelivery marks a message as on its way to a recipient. Returns false
+// if it already is; deliveries without a receipt are retried after deliveryTimeout.
+func (e *ChatExtension) startDelivery(id, recipient string) bool {
+	e.inFlightLock.Lock()
+	defer e.inFlightLock.Unlock()
+
+	key := id + "/" + recipient
+	if sent, exists := e.inFlight[key]; exists && time.Since(sent) < deliveryTimeout {
+		return false
+	}
+	e.inFlight[key] = time.Now()
+	return true
+}
+
+// endDelivery forgets a delivery attempt
+func (e *ChatExtension) endDelivery(id, recipient string) {
+	e.inFlightLock.Lock()
+	delete(e.inFlight, id+"/"+recipient)
+	e.inFlightLock.Unlock()
+}
+
+// delivered records that a recipient received a message
+func (e *ChatExtension) delivered(id, recipient string) {
+	e.endDelivery(id, recipient)
+
+	e.updateLock.Lock()
+	defer e.updateLock.Unlock()
+
+	m, exists := e.store.get(id)
+	if !exists {
+		return
+	}
+	pending := []string{}
+	for _, address := range m.Pending {
+		if address != recipient {
+			pending = append(pending, address)
+		}
+	}
+	if len(pending) == len(m.Pending) {
+		return // Receipt for a delivery already recorded
+	}
+	m.Pending = pending
+	m.Delivered = append(m.Delivered, recipient)
+
+	if err := e.store.put(m); err != nil {
+		log.Printf("[CHAT] Failed to record delivery of %s: %v", id, err)
+		return
+	}
+	e.publish(m)
+}
+
+// monitorSignals stores messages from peers until ctx is cancelled
+func (e *ChatExtension) monitorSignals(ctx context.Context) {
+	log.Printf("[CHAT] Subscribing to chat signals via IPC")
+
+	err := e.vpnClient.SubscribeToSignals(ctx, e.Name(), func(peerIP string, data []byte) {
+		var signal chatSignal
+		if err := json.Unmarshal(data, &signal); err != nil || signal.ID == "" || strings.TrimSpace(signal.Text) == "" {
+			log.Printf("[CHAT] Ignoring invalid signal from %s", peerIP)
+			return
+		}
+		// peerIP is the server-stamped sender
+		e.receive(peerIP, signal)
+	})
+
+	if err != nil {
+		log.Printf("[CHAT] Error subscribing to signals: %v", err)
+	}
+}
+
+// receive stores a message from a peer, once: retried deliveries are ignored
+func (e *ChatExtension) receive(peerIP string, signal chatSignal) {
+	from := e.peerName(peerIP)
+	e.addMember(peerIP, from)
+
+	e.updateLock.Lock()
+	if _, exists := e.store.get(signal.ID); exists {
+		e.updateLock.Unlock()
+		return
+	}
+	m := message{
+		ID:           signal.ID,
+		Conversation: peerIP,
+		From:         peerIP,
+		FromName:     from,
+		Text:         signal.Text,
+		SentAt:       signal.SentAt,
+	}
+	if signal.Family {
+		m.Conversation = familyConversation
+	}
+	err := e.store.put(m)
+	e.updateLock.Unlock()
+	if err != nil {
+		log.Printf("[CHAT] Failed to store message from %s (%s): %v", from, peerIP, err)
+		return
+	}
+
+	log.Printf("[CHAT] Message from %s (%s)", from, peerIP)
+	if !e.publish(m) {
+		e.Notify("Message from "+e.label(peerIP), m.Text)
+	}
+}
+
+// peerName returns the hostname the peer with a VPN address reports, for
+// display only
+func (e *ChatExtension) peerName(peerIP string) string {
+	peers, err := e.vpnClient.GetPeers()
+	if err == nil {
+		for _, peer := range peers {
+			if peer.VPNAddress == peerIP {
+				return peer.Hostname
+			}
+		}
+	}
+	return peerIP
+}
+
+// addMember remembers a peer that runs chat, so family messages reach it
+// even when it is offline at the time they are written
+func (e *ChatExtension) addMember(address, hostname string) {
+	e.membersLock.Lock()
+	defer e.membersLock.Unlock()
+
+	if name, exists := e.members[address]; exists && name == hostname {
+		return
+	}
+	e.members[address] = hostname
+
+	if err := framework.WriteJSONFile(e.membersPath(), e.members); err != nil {
+		log.Printf("[CHAT] Failed to save members: %v", err)
+	}
+}
+
+// memberList returns the VPN addresses of the known members, sorted
+func (e *ChatExtension) memberList() []string {
+	e.membersLock.Lock()
+	defer e.membersLock.Unlock()
+
+	members := []string{}
+	for address := range e.members {
+		members = append(members, address)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// label names a member for display: the hostname it reported, with its VPN
+// address when another member reports the same hostname, since the name
+// alone would not tell them apart
+func (e *ChatExtension) label(address string) string {
+	e.membersLock.Lock()
+	defer e.membersLock.Unlock()
+
+	hostname, exists := e.members[address]
+	if !exists || hostname == "" {
+		return address
+	}
+	for other, name := range e.members {
+		if other != address && name == hostname {
+			return fmt.Sprintf("%s (%s)", hostname, address)
+		}
+	}
+	return hostname
+}
+
+// membersPath is where the known members are kept
+func (e *ChatExtension) membersPath() string {
+	return filepath.Join(e.stateDir, "members.json")
+}
+
+// newMessageID returns a random message ID
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func main() {
+	configDir, _ := os.UserConfigDir()
+
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
+	stateDir := flag.String("state-dir", filepath.Join(configDir, "family-vpn", "chat"), "Where messages are stored")
+	flag.Parse()
+
+	ext := NewChatExtension(*vpnPort, *stateDir)
+	if err := ext.Run(ext); err != nil {
+		log.Fatalf("Extension failed: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// fakeCore stands in for the VPN client: it reports peers and records the
+// signals extensions send
+type fakeCore struct {
+	mu    sync.Mutex
+	peers []protocol.PeerInfo
+	sent  []protocol.SendSignalRequest
+}
+
+func (f *fakeCore) setPeers(peers ...protocol.PeerInfo) {
+	f.mu.Lock()
+	f.peers = peers
+	f.mu.Unlock()
+}
+
+func (f *fakeCore) signals() []protocol.SendSignalRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]protocol.SendSignalRequest(nil), f.sent...)
+}
+
+func (f *fakeCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/peers":
+		json.NewEncoder(w).Encode(f.peers)
+	case "/signal/send":
+		var request protocol.SendSignalRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		f.sent = append(f.sent, request)
+		json.NewEncoder(w).Encode(protocol.SendSignalResponse{Status: "sent", ID: "signal"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestExtension returns the extension with an open store and a fake VPN client
+func newTestExtension(t *testing.T) (*ChatExtension, *fakeCore) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "chat") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	core := &fakeCore{}
+	listener, err := net.Listen("unix", filepath.Join(dir, "ipc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(core)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	e := NewChatExtension(0, dir)
+	e.hostname = "me"
+	e.vpnClient = ipc.NewVPNClientSocket(filepath.Join(dir, "ipc.sock"), 0)
+	e.store, err = openStore(filepath.Join(dir, "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.store.close() })
+	return e, core
+}
+
+// chatPeer is a peer running chat
+func chatPeer(hostname, address string) protocol.PeerInfo {
+	return protocol.PeerInfo{
+		Hostname:     hostname,
+		VPNAddress:   address,
+		Capabilities: &protocol.PeerCapabilities{Extensions: []protocol.ExtensionInfo{{Name: "chat"}}},
+	}
+}
+
+func TestMessageQueuedUntilOnline(t *testing.T) {
+	e, core := newTestExtension(t)
+
+	m, err := e.send("10.8.0.3", "dinner at 8")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	e.deliverPending()
+	if signals := core.signals(); len(signals) != 0 {
+		t.Fatalf("sent %+v to an offline peer", signals)
+	}
+
+	core.setPeers(chatPeer("me", "10.8.0.2"), chatPeer("laptop", "10.8.0.3"))
+	e.deliverPending()
+	e.deliverPending() // Still waiting for the receipt: not sent again
+	signals := core.signals()
+	if len(signals) != 1 || signals[0].Peer != "10.8.0.3" {
+		t.Fatalf("signals sent = %+v, want one to 10.8.0.3", signals)
+	}
+
+	e.delivered(m.ID, "10.8.0.3")
+	stored, _ := e.store.get(m.ID)
+	if len(stored.Pending) != 0 || len(stored.Delivered) != 1 || stored.Delivered[0] != "10.8.0.3" {
+		t.Errorf("after the receipt, message = %+v, want delivered to 10.8.0.3", stored)
+	}
+	if pending := e.store.pending(); len(pending) != 0 {
+		t.Errorf("%d messages still queued", len(pending))
+	}
+}
+
+func TestDuplicateHostnames(t *testing.T) {
+	e, core := newTestExtension(t)
+	core.setPeers(chatPeer("laptop", "10.8.0.3"), chatPeer("laptop", "10.8.0.4")) // One claims the other's name
+
+	if _, err := e.send("10.8.0.4", "hello"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	e.deliverPending()
+	signals := core.signals()
+	if len(signals) != 1 || signals[0].Peer != "10.8.0.4" {
+		t.Fatalf("signals sent = %+v, want one to 10.8.0.4 only", signals)
+	}
+
+	if label := e.label("10.8.0.3"); label != "laptop (10.8.0.3)" {
+		t.Errorf("label = %q, want the address to tell the laptops apart", label)
+	}
+
+	// Replies land in the conversation of the address they came from
+	e.receive("10.8.0.3", chatSignal{ID: "reply", Text: "hi"})
+	if messages := e.store.conversation("10.8.0.3"); len(messages) != 1 || messages[0].From != "10.8.0.3" {
+		t.Errorf("conversation with 10.8.0.3 = %+v, want the reply", messages)
+	}
+	if messages := e.store.conversation("10.8.0.4"); len(messages) != 1 {
+		t.Errorf("conversation with 10.8.0.4 has %d messages, want only ours", len(messages))
+	}
+}
+
+func TestFamilyMessageReachesMembers(t *testing.T) {
+	e, core := newTestExtension(t)
+	core.setPeers(chatPeer("me", "10.8.0.2"), chatPeer("laptop", "10.8.0.3"), chatPeer("desktop", "10.8.0.4"))
+	e.deliverPending() // Learns who runs chat
+
+	m, err := e.send(familyConversation, "hello everyone")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(m.Pending) != 2 || m.Pending[0] != "10.8.0.3" || m.Pending[1] != "10.8.0.4" {
+		t.Errorf("pending = %v, want both members by address", m.Pending)
+	}
+
+	// Members offline now still get it once they are back
+	core.setPeers()
+	e.deliverPending()
+	core.setPeers(chatPeer("desktop", "10.8.0.4"))
+	e.deliverPending()
+	if signals := core.signals(); len(signals) != 1 || signals[0].Peer != "10.8.0.4" {
+		t.Errorf("signals sent = %+v, want one to 10.8.0.4", signals)
+	}
+}
+
+func TestSendValidatesConversation(t *testing.T) {
+	e, _ := newTestExtension(t)
+
+	tests := []struct {
+		name         string
+		conversation string
+		text         string
+		valid        bool
+	}{
+		{"family", familyConversation, "hi", true},
+		{"address", "10.8.0.3", "hi", true},
+		{"hostname", "laptop", "hi", false},
+		{"empty text", "10.8.0.3", "  ", false},
+		{"too long", "10.8.0.3", string(make([]byte, protocol.MaxSignalPayload)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := e.send(tt.conversation, tt.text); (err == nil) != tt.valid {
+				t.Errorf("send(%q) = %v, want valid %v", tt.conversation, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.put(message{ID: "a", Conversation: "10.8.0.3", Text: "queued", Outgoing: true, Pending: []string{"10.8.0.3"}})
+	store.put(message{ID: "b", Conversation: "10.8.0.3", Text: "received"})
+	store.close()
+
+	store, err = openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if pending := store.pending(); len(pending) != 1 || pending[0].ID != "a" {
+		t.Errorf("pending after restart = %+v, want message a", pending)
+	}
+	if messages := store.conversation("10.8.0.3"); len(messages) != 2 {
+		t.Errorf("%d messages after restart, want 2", len(messages))
+	}
+}
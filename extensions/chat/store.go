@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// messagesBucket holds every message as JSON, keyed by message ID
+var messagesBucket = []byte("messages")
+
+// messageStore keeps messages in a bbolt database: a single-file embedded
+// key/value store whose writes are transactions, so a crash never leaves a
+// message half written.
+type messageStore struct {
+	db *bolt.DB
+}
+
+// openStore opens the message database, creating it if needed
+func openStore(path string) (*messageStore, error) {
+	// The timeout turns a second running instance into an error instead of a hang
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &messageStore{db: db}, nil
+}
+
+// put stores a new message or the new state of one
+func (s *messageStore) put(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).Put([]byte(m.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save message: %v", err)
+	}
+	return nil
+}
+
+// get returns a message by ID
+func (s *messageStore) get(id string) (message, bool) {
+	var m message
+	found := false
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(messagesBucket).Get([]byte(id))
+		found = data != nil && json.Unmarshal(data, &m) == nil
+		return nil
+	})
+	return m, found
+}
+
+// conversation returns the messages of a conversation, oldest first
+func (s *messageStore) conversation(id string) []message {
+	return s.sorted(func(m message) bool { return m.Conversation == id })
+}
+
+// pending returns our messages that some recipient hasn't received yet
+func (s *messageStore) pending() []message {
+	return s.sorted(func(m message) bool { return len(m.Pending) > 0 })
+}
+
+// latest returns the last message of each conversation
+func (s *messageStore) latest() map[string]message {
+	latest := make(map[string]message)
+	for _, m := range s.sorted(func(message) bool { return true }) {
+		latest[m.Conversation] = m
+	}
+	return latest
+}
+
+// sorted returns the matching messages, oldest first. A family's history is
+// small enough to scan.
+func (s *messageStore) sorted(match func(message) bool) []message {
+	messages := []message{}
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).ForEach(func(key, data []byte) error {
+			var m message
+			if err := json.Unmarshal(data, &m); err != nil {
+				log.Printf("[CHAT] Skipping damaged message %s", key)
+				return nil
+			}
+			if match(m) {
+				messages = append(messages, m)
+			}
+			return nil
+		})
+	})
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].SentAt.Equal(messages[j].SentAt) {
+			return messages[i].ID < messages[j].ID
+		}
+		return messages[i].SentAt.Before(messages[j].SentAt)
+	})
+	return messages
+}
+
+// close closes the database
+func (s *messageStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed ui.html
+var uiHTML string
+
+// conversationInfo is an entry of GET /api/conversations
+type conversationInfo struct {
+	ID     string   `json:"id"`   // familyConversation or a VPN address
+	Name   string   `json:"name"` // What to call it, see ChatExtension.label
+	Online bool     `json:"online"`
+	Last   *message `json:"last,omitempty"`
+}
+
+// uiHandler serves the chat page and the API it uses:
+// GET /api/conversations, GET /api/messages?conversation=<id>,
+// POST /api/messages ({"conversation", "text"}) and GET /api/events (new and
+// updated messages as Server-Sent Events)
+func (e *ChatExtension) uiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(uiHTML))
+	})
+	mux.HandleFunc("/api/conversations", e.handleConversations)
+	mux.HandleFunc("/api/messages", e.handleMessages)
+	mux.HandleFunc("/api/events", e.handleEvents)
+
+	// DNS rebinding shows up as a foreign Host header, and other pages
+	// always send their own Origin on cross-site requests
+	hosts := map[string]bool{
+		fmt.Sprintf("127.0.0.1:%d", e.port): true,
+		fmt.Sprintf("localhost:%d", e.port): true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !hosts[r.Host] || (origin != "" && origin != "http://"+r.Host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleConversations lists the family conversation, every member and
+// anyone else we have messages with
+func (e *ChatExtension) handleConversations(w http.ResponseWriter, r *http.Request) {
+	online := make(map[string]bool)
+	if peers, err := e.vpnClient.GetPeers(); err == nil {
+		for _, peer := range peers {
+			online[peer.VPNAddress] = peer.RunsExtension(e.Name())
+		}
+	}
+
+	latest := e.store.latest()
+	ids := map[string]bool{familyConversation: true}
+	for _, member := range e.memberList() {
+		ids[member] = true
+	}
+	for id := range latest {
+		ids[id] = true
+	}
+
+	conversations := []conversationInfo{}
+	for id := range ids {
+		info := conversationInfo{ID: id, Name: e.label(id), Online: id == familyConversation || online[id]}
+		if last, exists := latest[id]; exists {
+			info.Last = &last
+		}
+		conversations = append(conversations, info)
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		// Family first, then the most recent conversations
+		a, b := conversations[i], conversations[j]
+		if (a.ID == familyConversation) != (b.ID == familyConversation) {
+			return a.ID == familyConversation
+		}
+		if (a.Last == nil) != (b.Last == nil) {
+			return a.Last != nil
+		}
+		if a.Last != nil && !a.Last.SentAt.Equal(b.Last.SentAt) {
+			return a.Last.SentAt.After(b.Last.SentAt)
+		}
+		return a.ID < b.ID
+	})
+
+	writeJSON(w, http.StatusOK, conversations)
+}
+
+// handleMessages lists a conversation or sends a message
+func (e *ChatExtension) handleMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, e.store.conversation(r.URL.Query().Get("conversation")))
+
+	case "POST":
+		// Browsers can't send JSON cross-origin without a preflight we don't
+		// answer, so other pages can't post as the user
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var request struct {
+			Conversation string `json:"conversation"`
+			Text         string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		m, err := e.send(request.Conversation, request.Text)
+		switch {
+		case err == errTooLong:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusCreated, m)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEvents streams new and updated messages to the page
+func (e *ChatExtension) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	updates := make(chan message, 32)
+	e.listenersLock.Lock()
+	e.listeners[updates] = true
+	e.listenersLock.Unlock()
+	defer func() {
+		e.listenersLock.Lock()
+		delete(e.listeners, updates)
+		e.listenersLock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m := <-updates:
+			data, _ := json.Marshal(m)
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// publish sends a new or updated message to the open pages. Returns false if
+// no page is open.
+func (e *ChatExtension) publish(m message) bool {
+	e.listenersLock.Lock()
+	defer e.listenersLock.Unlock()
+
+	for updates := range e.listeners {
+		select {
+		case updates <- m:
+		default: // A stalled page reloads the conversation when it reconnects
+		}
+	}
+	return len(e.listeners) > 0
+}
+
+// writeJSON writes a JSON reply
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+)
+
+// Clip kinds
+const (
+	kindText  = "text"
+	kindImage = "image" // PNG
+)
+
+// clip is the content of the clipboard
+type clip struct {
+	Kind string
+	Data []byte
+}
+
+// readClipboard returns the clipboard text, or its image when there is no
+// text and images are enabled. Returns nil for an empty clipboard.
+func readClipboard(images bool) (*clip, error) {
+	text, err := exec.Command("pbpaste").Output()
+	if err != nil {
+		return nil, fmt.Errorf("pbpaste: %v", err)
+	}
+	if len(text) > 0 {
+		return &clip{Kind: kindText, Data: text}, nil
+	}
+	if !images {
+		return nil, nil
+	}
+
+	// AppleScript prints the image as «data PNGf89504E47...»
+	output, err := exec.Command("osascript", "-e", "the clipboard as «class PNGf»").Output()
+	if err != nil {
+		return nil, nil // No image either
+	}
+	encoded := strings.TrimSpace(string(output))
+	encoded = strings.TrimSuffix(strings.TrimPrefix(encoded, "«data PNGf"), "»")
+	data, err := hex.DecodeString(encoded)
+	if err != nil || len(data) == 0 {
+		return nil, nil
+	}
+	return &clip{Kind: kindImage, Data: data}, nil
+}
+
+// writeClipboard replaces the clipboard content
+func writeClipboard(c *clip) error {
+	if c.Kind == kindText {
+		cmd := exec.Command("pbcopy")
+		cmd.Stdin = bytes.NewReader(c.Data)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("pbcopy: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	tmpFile, err := os.CreateTemp("", "family-vpn-clipboard-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(c.Data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	script := fmt.Sprintf("set the clipboard to (read (POSIX file %s) as «class PNGf»)", framework.AppleScriptString(tmpFile.Name()))
+	if output, err := exec.Command("osascript", "-e", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("osascript: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	pollInterval    = time.Second      // How often the clipboard is checked for changes
+	clipLifetime    = 2 * time.Minute  // How long a larger clip can be fetched by its peers
+	signalTTL       = 30 * time.Second // Stale clipboards aren't worth delivering
+	defaultMaxBytes = 1 << 20
+	historyLimit    = 100 // Activity entries kept
+	httpTimeout     = 30 * time.Second
+)
+
+// clipSignal announces a new clipboard to a peer. Small text is included;
+// anything else is fetched from the sender (GET /clips/<id>).
+type clipSignal struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Text   string `json:"text,omitempty"`
+	Port   int    `json:"port,omitempty"` // Sender's data port, for clips that aren't inline
+}
+
+// clipboardConfig is the extension's config file. Nothing is shared until
+// peers are added to the allow-lists. The lists name peers by VPN address:
+// the server assigns addresses (and gives a device its own back), while
+// hostnames are whatever a peer claims.
+type clipboardConfig struct {
+	SendTo      []string `json:"send_to"`      // VPN addresses our clipboard is copied to; "*" is everyone
+	ReceiveFrom []string `json:"receive_from"` // VPN addresses allowed to replace our clipboard
+	Images      bool     `json:"images"`       // Sync images as well as text
+	MaxBytes    int64    `json:"max_bytes"`    // Larger clips are neither sent nor accepted
+}
+
+// pendingClip is a clip waiting to be fetched by the peers it was announced to
+type pendingClip struct {
+	clip
+	peers   map[string]bool // VPN addresses allowed to fetch it
+	expires time.Time
+}
+
+// activity is an entry of the history shown in the extension status. Clip
+// contents are never recorded.
+type activity struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // "sent", "received" or "rejected"
+	Peer      string    `json:"peer"`      // VPN address
+	Label     string    `json:"label"`     // Hostname the peer reported, for display only
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// ClipboardExtension shares the clipboard with allow-listed peers
+type ClipboardExtension struct {
+	*framework.ExtensionBase
+	vpnClient  *ipc.VPNClient
+	port       int
+	stateDir   string
+	config     clipboardConfig
+	server     *http.Server
+	httpClient *http.Client
+	cancel     context.CancelFunc // Ends the signal subscription and clipboard watcher
+
+	lastHash string // Clipboard content we last saw or wrote, so it isn't echoed back
+	hashLock sync.Mutex
+
+	pending     map[string]*pendingClip
+	pendingLock sync.Mutex
+
+	history     []activity
+	historyLock sync.Mutex
+}
+
+// NewClipboardExtension creates a new shared clipboard extension
+func NewClipboardExtension(vpnPort int, stateDir string) *ClipboardExtension {
+	e := &ClipboardExtension{
+		ExtensionBase: framework.NewExtensionBase("clipboard", "1.0.0"),
+		vpnClient:     ipc.NewVPNClient(vpnPort),
+		port:          8894,
+		stateDir:      stateDir,
+		httpClient:    &http.Client{Timeout: httpTimeout},
+		pending:       make(map[string]*pendingClip),
+	}
+	e.SetVPNClient(e.vpnClient)
+	e.HandleAction("send-clipboard", e.sendClipboard)
+	return e
+}
+
+// Start starts the shared clipboard extension
+func (e *ClipboardExtension) Start() error {
+	// Check VPN core is running
+	if err := e.vpnClient.Health(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", e.stateDir, err)
+	}
+	if err := e.loadConfig(); err != nil {
+		return err
+	}
+	framework.ReadJSONFile(e.historyPath(), &e.history)
+
+	// Peers fetch larger clips from us over the VPN
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clips/", e.handleClipRequest)
+	e.server = &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", e.port), Handler: mux}
+
+	log.Printf("[CLIPBOARD] Sending to %v, receiving from %v (images: %v, limit %d bytes)", e.config.SendTo, e.config.ReceiveFrom, e.config.Images, e.config.MaxBytes)
+	e.SetEndpoint("data", fmt.Sprintf("http://127.0.0.1:%d", e.port))
+
+	go func() {
+		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[CLIPBOARD] Server error: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.monitorSignals(ctx)
+	go e.watchClipboard(ctx)
+
+	return nil
+}
+
+// Stop stops the extension
+func (e *ClipboardExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return e.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// Health returns true if extension is healthy
+func (e *ClipboardExtension) Health() bool {
+	if e.vpnClient == nil {
+		return false
+	}
+	return e.vpnClient.Health() == nil
+}
+
+// Status reports the allow-lists and recent activity on the health endpoint
+func (e *ClipboardExtension) Status() interface{} {
+	e.historyLock.Lock()
+	defer e.historyLock.Unlock()
+
+	return struct {
+		clipboardConfig
+		History []activity `json:"history"`
+	}{e.config, append([]activity{}, e.history...)}
+}
+
+// loadConfig reads the allow-lists, writing an empty config on first start
+func (e *ClipboardExtension) loadConfig() error {
+	path := filepath.Join(e.stateDir, "config.json")
+	err := framework.ReadJSONFile(path, &e.config)
+	if os.IsNotExist(err) {
+		e.config = clipboardConfig{SendTo: []string{}, ReceiveFrom: []string{}, MaxBytes: defaultMaxBytes}
+		if err := framework.WriteJSONFile(path, &e.config); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		log.Printf("[CLIPBOARD] Add peers' VPN addresses to %s to share the clipboard", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if e.config.MaxBytes <= 0 {
+		e.config.MaxBytes = defaultMaxBytes
+	}
+	for _, entry := range append(append([]string{}, e.config.SendTo...), e.config.ReceiveFrom...) {
+		if entry != "*" && net.ParseIP(entry) == nil {
+			log.Printf("[CLIPBOARD] Ignoring %q in %s: allow-lists name peers by VPN address", entry, path)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether an allow-list contains the peer at a VPN address
+func allowed(list []string, address string) bool {
+	for _, entry := range list {
+		if entry == "*" || entry == address {
+			return true
+		}
+	}
+	return false
+}
+
+// watchClipboard sends every new clipboard to the peers in send_to, until ctx is cancelled
+func (e *ClipboardExtension) watchClipboard(ctx context.Context) {
+	// Whatever was copied before we started stays here
+	if c, err := readClipboard(e.config.Images); err == nil && c != nil {
+		e.seen(c)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if len(e.config.SendTo) == 0 {
+			continue
+		}
+		c, err := readClipboard(e.config.Images)
+		if err != nil {
+			log.Printf("[CLIPBOARD] Failed to read clipboard: %v", err)
+			continue
+		}
+		if c == nil || !e.seen(c) {
+			continue
+		}
+		if int64(len(c.Data)) > e.config.MaxBytes {
+			log.Printf("[CLIPBOARD] Not sharing %s of %d bytes (limit %d)", c.Kind, len(c.Data), e.config.MaxBytes)
+			continue
+		}
+
+		peers, err := e.vpnClient.GetPeers()
+		if err != nil {
+			log.Printf("[CLIPBOARD] Failed to get peers: %v", err)
+			continue
+		}
+		hostname, _ := os.Hostname()
+		for _, peer := range peers {
+			if peer.Hostname == hostname || !peer.RunsExtension(e.Name()) || !allowed(e.config.SendTo, peer.VPNAddress) {
+				continue
+			}
+			if err := e.sendClip(peer.VPNAddress, peer.Hostname, c); err != nil {
+				log.Printf("[CLIPBOARD] Failed to send clipboard to %s: %v", peer.Hostname, err)
+			}
+		}
+	}
+}
+
+// seen records the clipboard content. Returns false if it is what we last saw.
+func (e *ClipboardExtension) seen(c *clip) bool {
+	hash := clipHash(c)
+	e.hashLock.Lock()
+	defer e.hashLock.Unlock()
+
+	if hash == e.lastHash {
+		return false
+	}
+	e.lastHash = hash
+	return true
+}
+
+// sendClipboard runs the "send-clipboard" peer action: the current clipboard
+// goes to that peer once, whether or not it is in send_to
+func (e *ClipboardExtension) sendClipboard(target protocol.PeerTarget) error {
+	c, err := readClipboard(e.config.Images)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errors.New("the clipboard is empty")
+	}
+	if int64(len(c.Data)) > e.config.MaxBytes {
+		return fmt.Errorf("the clipboard is larger than %d bytes", e.config.MaxBytes)
+	}
+	return e.sendClip(target.Peer, target.Name, c)
+}
+
+// sendClip announces a clip to a peer, keeping it for the peer to fetch if
+// it is too large to travel in the signal
+func (e *ClipboardExtension) sendClip(peerIP, peerName string, c *clip) error {
+	id, err := newClipID()
+	if err != nil {
+		return err
+	}
+
+	signal := clipSignal{ID: id, Kind: c.Kind, Size: int64(len(c.Data)), SHA256: sha256Hex(c.Data)}
+	if c.Kind == kindText {
+		signal.Text = string(c.Data)
+	}
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	if protocol.SignalPayloadSize(data) > protocol.MaxSignalPayload || c.Kind != kindText {
+		signal.Text = ""
+		signal.Port = e.port
+		e.keepPending(id, peerIP, c)
+		if data, err = json.Marshal(signal); err != nil {
+			return err
+		}
+	}
+	_, err = e.vpnClient.SendSignalWithOptions(e.Name(), peerIP, data, ipc.SignalOptions{
+		TTL: signalTTL,
+		OnFailed: func(id, peerIP, reason string) {
+			log.Printf("[CLIPBOARD] Clipboard for %s was not delivered: %s", peerName, reason)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[CLIPBOARD] Sent %s (%d bytes) to %s (%s)", c.Kind, len(c.Data), peerName, peerIP)
+	e.record(activity{Direction: "sent", Peer: peerIP, Label: peerName, Kind: c.Kind, Size: int64(len(c.Data))})
+	return nil
+}
+
+// keepPending stores a clip for GET /clips/<id>, dropping expired ones
+func (e *ClipboardExtension) keepPending(id, peerIP string, c *clip) {
+	e.pendingLock.Lock()
+	defer e.pendingLock.Unlock()
+
+	for pendingID, pending := range e.pending {
+		if time.Now().After(pending.expires) {
+			delete(e.pending, pendingID)
+		}
+	}
+	e.pending[id] = &pendingClip{clip: *c, peers: map[string]bool{peerIP: true}, expires: time.Now().Add(clipLifetime)}
+}
+
+// handleClipRequest serves a pending clip to the peer it was announced to
+func (e *ClipboardExtension) handleClipRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/clips/")
+	remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	e.pendingLock.Lock()
+	pending, exists := e.pending[id]
+	e.pendingLock.Unlock()
+
+	// Unknown, expired, and announced to someone else look the same
+	if !exists || !pending.peers[remoteIP] || time.Now().After(pending.expires) {
+		http.Error(w, "Clip not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(pending.Data)))
+	w.Write(pending.Data)
+}
+
+// monitorSignals handles clips from peers until ctx is cancelled
+func (e *ClipboardExtension) monitorSignals(ctx context.Context) {
+	log.Printf("[CLIPBOARD] Subscribing to clipboard signals via IPC")
+
+	err := e.vpnClient.SubscribeToSignals(ctx, e.Name(), func(peerIP string, data []byte) {
+		var signal clipSignal
+		if err := json.Unmarshal(data, &signal); err != nil || signal.ID == "" {
+			log.Printf("[CLIPBOARD] Ignoring invalid signal from %s", peerIP)
+			return
+		}
+		// peerIP is the server-stamped sender
+		go e.handleClip(peerIP, signal)
+	})
+
+	if err != nil {
+		log.Printf("[CLIPBOARD] Error subscribing to signals: %v", err)
+	}
+}
+
+// handleClip puts a peer's clip on our clipboard if the allow-list and limits
+// permit it. peerIP is the server-stamped sender, which is what the allow-list
+// names; the hostname it reports is only shown.
+func (e *ClipboardExtension) handleClip(peerIP string, signal clipSignal) {
+	peerName := peerIP
+	if peers, err := e.vpnClient.GetPeers(); err == nil {
+		for _, peer := range peers {
+			if peer.VPNAddress == peerIP {
+				peerName = peer.Hostname
+			}
+		}
+	}
+
+	reject := func(reason string) {
+		log.Printf("[CLIPBOARD] Rejected %s from %s (%s): %s", signal.Kind, peerName, peerIP, reason)
+		e.record(activity{Direction: "rejected", Peer: peerIP, Label: peerName, Kind: signal.Kind, Size: signal.Size, Reason: reason})
+	}
+
+	switch {
+	case !allowed(e.config.ReceiveFrom, peerIP):
+		reject("not in receive_from")
+		return
+	case signal.Kind != kindText && signal.Kind != kindImage, !protocol.ValidSHA256(signal.SHA256):
+		reject("invalid clip")
+		return
+	case signal.Kind == kindImage && !e.config.Images:
+		reject("images are disabled")
+		return
+	case signal.Size < 0 || signal.Size > e.config.MaxBytes:
+		reject(fmt.Sprintf("larger than %d bytes", e.config.MaxBytes))
+		return
+	}
+
+	c := &clip{Kind: signal.Kind, Data: []byte(signal.Text)}
+	if signal.Port > 0 {
+		data, err := e.fetchClip(peerIP, signal)
+		if err != nil {
+			reject(err.Error())
+			return
+		}
+		c.Data = data
+	}
+	if int64(len(c.Data)) != signal.Size || sha256Hex(c.Data) != signal.SHA256 {
+		reject("checksum mismatch")
+		return
+	}
+
+	e.seen(c) // Not to be sent back
+	if err := writeClipboard(c); err != nil {
+		log.Printf("[CLIPBOARD] Failed to set clipboard: %v", err)
+		return
+	}
+
+	log.Printf("[CLIPBOARD] Received %s (%d bytes) from %s (%s)", c.Kind, len(c.Data), peerName, peerIP)
+	e.record(activity{Direction: "received", Peer: peerIP, Label: peerName, Kind: c.Kind, Size: int64(len(c.Data))})
+	title := fmt.Sprintf("Clipboard from %s (%s)", peerName, peerIP)
+	if c.Kind == kindText {
+		e.Notify(title, fmt.Sprintf("Text (%d characters) is ready to paste", len([]rune(string(c.Data)))))
+	} else {
+		e.Notify(title, "An image is ready to paste")
+	}
+}
+
+// fetchClip downloads a clip that didn't fit in its signal
+func (e *ClipboardExtension) fetchClip(peerIP string, signal clipSignal) ([]byte, error) {
+	if signal.Port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	resp, err := e.httpClient.Get(fmt.Sprintf("http://%s/clips/%s", net.JoinHostPort(peerIP, strconv.Itoa(signal.Port)), signal.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch clip: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch clip: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, e.config.MaxBytes+1))
+}
+
+// record adds an entry to the activity history and saves it
+func (e *ClipboardExtension) record(entry activity) {
+	entry.Time = time.Now()
+
+	e.historyLock.Lock()
+	e.history = append(e.history, entry)
+	if len(e.history) > historyLimit {
+		e.history = e.history[len(e.history)-historyLimit:]
+	}
+	err := framework.WriteJSONFile(e.historyPath(), e.history)
+	e.historyLock.Unlock()
+
+	if err != nil {
+		log.Printf("[CLIPBOARD] Failed to save history: %v", err)
+	}
+}
+
+// historyPath is where the activity history is kept
+func (e *ClipboardExtension) historyPath() string {
+	return filepath.Join(e.stateDir, "history.json")
+}
+
+// newClipID returns a random, unguessable clip ID
+func newClipID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// clipHash identifies clipboard content
+func clipHash(c *clip) string {
+	return c.Kind + ":" + sha256Hex(c.Data)
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func main() {
+	configDir, _ := os.UserConfigDir()
+
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
+	stateDir := flag.String("state-dir", filepath.Join(configDir, "family-vpn", "clipboard"), "Where the allow-lists and history are kept")
+	flag.Parse()
+
+	ext := NewClipboardExtension(*vpnPort, *stateDir)
+	if err := ext.Run(ext); err != nil {
+		log.Fatalf("Extension failed: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// newTestExtension returns the extension with a VPN client that reports peers
+func newTestExtension(t *testing.T, config clipboardConfig, peers []protocol.PeerInfo) *ClipboardExtension {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "clip") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "ipc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(peers)
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	e := NewClipboardExtension(0, dir)
+	e.vpnClient = ipc.NewVPNClientSocket(filepath.Join(dir, "ipc.sock"), 0)
+	e.config = config
+	return e
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		address string
+		want    bool
+	}{
+		{"empty", nil, "10.8.0.2", false},
+		{"listed", []string{"10.8.0.3", "10.8.0.2"}, "10.8.0.2", true},
+		{"not listed", []string{"10.8.0.3"}, "10.8.0.2", false},
+		{"everyone", []string{"*"}, "10.8.0.2", true},
+		{"hostname", []string{"laptop"}, "10.8.0.2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowed(tt.list, tt.address); got != tt.want {
+				t.Errorf("allowed(%v, %s) = %v, want %v", tt.list, tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleClipAllowList(t *testing.T) {
+	peers := []protocol.PeerInfo{
+		{Hostname: "moms-laptop", VPNAddress: "10.8.0.2"},
+		{Hostname: "moms-laptop", VPNAddress: "10.8.0.3"}, // Claims someone else's name
+	}
+	config := clipboardConfig{ReceiveFrom: []string{"10.8.0.2"}, MaxBytes: defaultMaxBytes}
+
+	tests := []struct {
+		name   string
+		peerIP string
+		reason string
+	}{
+		// An allowed sender gets past the allow-list, so a bad clip is caught next
+		{"allowed", "10.8.0.2", "invalid clip"},
+		{"same hostname, other address", "10.8.0.3", "not in receive_from"},
+		{"unknown peer", "10.8.0.9", "not in receive_from"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExtension(t, config, peers)
+			e.handleClip(tt.peerIP, clipSignal{ID: "a", Kind: "video", Size: 1})
+
+			if len(e.history) != 1 {
+				t.Fatalf("%d history entries, want 1", len(e.history))
+			}
+			entry := e.history[0]
+			if entry.Direction != "rejected" || entry.Reason != tt.reason {
+				t.Errorf("entry = %+v, want rejected: %s", entry, tt.reason)
+			}
+			if entry.Peer != tt.peerIP {
+				t.Errorf("entry names peer %q, want its address %s", entry.Peer, tt.peerIP)
+			}
+		})
+	}
+}
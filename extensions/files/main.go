@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+)
+
+const (
+	chunkSize        = 1 << 20            // Bytes per checksummed chunk
+	transferLifetime = 7 * 24 * time.Hour // Unfinished transfers are dropped after this
+	offerTimeout     = 2 * time.Minute    // How long the receiver's accept dialog waits
+	signalTTL        = 10 * time.Minute   // Offers may wait this long for an offline peer
+	resumeInterval   = time.Minute        // How often interrupted downloads are retried
+	chunkAttempts    = 5                  // Tries per chunk before a download is paused
+	httpTimeout      = 60 * time.Second
+)
+
+// Transfer signal types
+const (
+	signalOffer    = "offer"    // Sender -> receiver: a file is waiting
+	signalAccept   = "accept"   // Receiver -> sender: downloading
+	signalDecline  = "decline"  // Receiver -> sender: not wanted
+	signalComplete = "complete" // Receiver -> sender: received and verified
+	signalFailed   = "failed"   // Either way: the transfer was abandoned
+)
+
+// transferSignal negotiates a transfer. It travels as a VPN signal, so it only
+// describes the file; the data itself is pulled over HTTP from the sender.
+type transferSignal struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Port     int    `json:"port,omitempty"` // Sender's data port
+	FromName string `json:"from_name,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// transferManifest is served by the sender (GET /transfers/<id>) and lists
+// the checksum of every chunk
+type transferManifest struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Size      int64    `json:"size"`
+	SHA256    string   `json:"sha256"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"` // Hex SHA-256 per chunk
+}
+
+// FilesExtension sends files to peers and receives files from them
+type FilesExtension struct {
+	*framework.ExtensionBase
+	vpnClient    *ipc.VPNClient
+	port         int
+	downloadsDir string
+	stateDir     string
+	server       *http.Server
+	cancel       context.CancelFunc // Ends the signal subscription and resume loop
+
+	outgoing      map[string]*outgoingTransfer
+	incoming      map[string]*incomingTransfer
+	transfersLock sync.Mutex
+}
+
+// NewFilesExtension creates a new file transfer extension
+func NewFilesExtension(vpnPort int, downloadsDir, stateDir string) *FilesExtension {
+	e := &FilesExtension{
+		ExtensionBase: framework.NewExtensionBase("files", "1.0.0"),
+		vpnClient:     ipc.NewVPNClient(vpnPort),
+		port:          8892,
+		downloadsDir:  downloadsDir,
+		stateDir:      stateDir,
+		outgoing:      make(map[string]*outgoingTransfer),
+		incoming:      make(map[string]*incomingTransfer),
+	}
+	e.SetVPNClient(e.vpnClient)
+	e.HandleAction("send-file", e.sendFile)
+	return e
+}
+
+// Start starts the file transfer extension
+func (e *FilesExtension) Start() error {
+	// Check VPN core is running
+	if err := e.vpnClient.Health(); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{e.outgoingDir(), e.incomingDir(), e.downloadsDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+	e.loadOutgoing()
+	e.loadIncoming()
+
+	// Peers pull file data from us over the VPN
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transfers/", e.handleTransfer)
+	e.server = &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", e.port), Handler: mux}
+
+	log.Printf("[FILES] Serving transfers on http://%s (accessible via VPN)", e.server.Addr)
+	e.SetEndpoint("data", fmt.Sprintf("http://127.0.0.1:%d", e.port))
+
+	go func() {
+		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[FILES] Server error: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.monitorSignals(ctx)
+	go e.resumeDownloads(ctx)
+
+	return nil
+}
+
+// Stop stops the extension. Unfinished downloads resume on the next start.
+func (e *FilesExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return e.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// Health returns true if extension is healthy
+func (e *FilesExtension) Health() bool {
+	if e.vpnClient == nil {
+		return false
+	}
+	return e.vpnClient.Health() == nil
+}
+
+// outgoingDir holds the offers we made (see send.go)
+func (e *FilesExtension) outgoingDir() string {
+	return filepath.Join(e.stateDir, "outgoing")
+}
+
+// incomingDir holds the offers we accepted (see receive.go)
+func (e *FilesExtension) incomingDir() string {
+	return filepath.Join(e.stateDir, "incoming")
+}
+
+// sendSignal sends a transfer signal to the files extension of a peer
+func (e *FilesExtension) sendSignal(peerIP string, signal transferSignal) error {
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	_, err = e.vpnClient.SendSignalWithOptions(e.Name(), peerIP, data, ipc.SignalOptions{
+		TTL: signalTTL,
+		OnFailed: func(id, peerIP, reason string) {
+			log.Printf("[FILES] %s signal for transfer %s to %s was not delivered: %s", signal.Type, signal.ID, peerIP, reason)
+			if signal.Type == signalOffer {
+				e.dropOutgoing(signal.ID)
+				e.Notify("File not sent", fmt.Sprintf("%s could not be offered: %s", signal.Name, reason))
+			}
+		},
+	})
+	return err
+}
+
+// monitorSignals handles transfer signals from peers until ctx is cancelled
+func (e *FilesExtension) monitorSignals(ctx context.Context) {
+	log.Printf("[FILES] Subscribing to transfer signals via IPC")
+
+	err := e.vpnClient.SubscribeToSignals(ctx, e.Name(), func(peerIP string, data []byte) {
+		var signal transferSignal
+		if err := json.Unmarshal(data, &signal); err != nil || !validTransferID(signal.ID) {
+			log.Printf("[FILES] Ignoring invalid signal from %s", peerIP)
+			return
+		}
+
+		// peerIP is the server-stamped sender
+		switch signal.Type {
+		case signalOffer:
+			go e.handleOffer(peerIP, signal)
+		case signalAccept, signalDecline, signalComplete:
+			e.handleReply(peerIP, signal)
+		case signalFailed:
+			e.handleFailed(peerIP, signal)
+		}
+	})
+
+	if err != nil {
+		log.Printf("[FILES] Error subscribing to signals: %v", err)
+	}
+}
+
+// handleFailed abandons a transfer the peer gave up on, in either direction
+func (e *FilesExtension) handleFailed(peerIP string, signal transferSignal) {
+	if transfer := e.outgoingTransfer(signal.ID, peerIP); transfer != nil {
+		e.handleReply(peerIP, signal)
+		return
+	}
+	if transfer := e.incomingTransfer(signal.ID, peerIP); transfer != nil {
+		log.Printf("[FILES] Sender cancelled transfer %s: %s", signal.ID, signal.Reason)
+		e.dropIncoming(transfer, true)
+		e.Notify("File not received", fmt.Sprintf("%s: %s", transfer.Name, signal.Reason))
+	}
+}
+
+// formatSize formats a byte count for dialogs
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+func main() {
+	home, _ := os.UserHomeDir()
+	configDir, _ := os.UserConfigDir()
+
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
+	downloadsDir := flag.String("downloads", filepath.Join(home, "Downloads"), "Where received files are saved")
+	stateDir := flag.String("state-dir", filepath.Join(configDir, "family-vpn", "files"), "Where unfinished transfers are tracked")
+	flag.Parse()
+
+	ext := NewFilesExtension(*vpnPort, *downloadsDir, *stateDir)
+	if err := ext.Run(ext); err != nil {
+		log.Fatalf("Extension failed: %v", err)
+	}
+}
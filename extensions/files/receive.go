@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// incomingTransfer is an offer we accepted. It is kept on disk next to the
+// partial download until the file is complete, so downloads resume after an
+// interruption or restart.
+type incomingTransfer struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Peer     string    `json:"peer"`
+	Port     int       `json:"port"`
+	FromName string    `json:"from_name"`
+	Accepted time.Time `json:"accepted"`
+
+	active bool // A download is running
+}
+
+// abortError ends a download for good: the sender can no longer serve the
+// file, or what arrived doesn't match what was offered
+type abortError struct {
+	reason string
+}
+
+func (e *abortError) Error() string {
+	return e.reason
+}
+
+// handleOffer asks the user whether to accept a file and starts downloading it
+func (e *FilesExtension) handleOffer(peerIP string, offer transferSignal) {
+	if !validTransferID(offer.ID) {
+		log.Printf("[FILES] Ignoring offer with invalid ID from %s", peerIP)
+		return
+	}
+	name := filepath.Base(offer.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || offer.Size < 0 ||
+		!protocol.ValidSHA256(offer.SHA256) || offer.Port <= 0 || offer.Port > 65535 {
+		log.Printf("[FILES] Ignoring invalid offer %s from %s", offer.ID, peerIP)
+		return
+	}
+
+	e.transfersLock.Lock()
+	_, known := e.incoming[offer.ID]
+	e.transfersLock.Unlock()
+	if known {
+		return // Offer delivered twice
+	}
+
+	fromName := offer.FromName
+	if fromName == "" {
+		fromName = peerIP
+	}
+
+	log.Printf("[FILES] %s (%s) offers %s (%s)", fromName, peerIP, name, formatSize(offer.Size))
+	if !confirmOffer(fromName, name, offer.Size) {
+		log.Printf("[FILES] Declined %s from %s", name, fromName)
+		if err := e.sendSignal(peerIP, transferSignal{Type: signalDecline, ID: offer.ID}); err != nil {
+			log.Printf("[FILES] Failed to decline %s: %v", offer.ID, err)
+		}
+		return
+	}
+
+	transfer := &incomingTransfer{
+		ID:       offer.ID,
+		Name:     name,
+		Size:     offer.Size,
+		SHA256:   offer.SHA256,
+		Peer:     peerIP,
+		Port:     offer.Port,
+		FromName: fromName,
+		Accepted: time.Now(),
+	}
+	if err := framework.WriteJSONFile(e.incomingStatePath(offer.ID), transfer); err != nil {
+		log.Printf("[FILES] Failed to save transfer %s: %v", offer.ID, err)
+		return
+	}
+
+	e.transfersLock.Lock()
+	e.incoming[offer.ID] = transfer
+	e.transfersLock.Unlock()
+
+	if err := e.sendSignal(peerIP, transferSignal{Type: signalAccept, ID: offer.ID}); err != nil {
+		log.Printf("[FILES] Failed to accept %s: %v", offer.ID, err)
+	}
+	e.download(transfer)
+}
+
+// confirmOffer asks the user to accept a file. No answer means no.
+func confirmOffer(fromName, name string, size int64) bool {
+	message := fmt.Sprintf("%s wants to send you “%s” (%s).", fromName, name, formatSize(size))
+	script := fmt.Sprintf(`display dialog %s buttons {"Decline", "Accept"} default button "Accept" with title "Family VPN" giving up after %d`,
+		framework.AppleScriptString(message), int(offerTimeout/time.Second))
+
+	output, err := exec.Command("osascript", "-e", script).Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(output), "button returned:Accept") && !strings.Contains(string(output), "gave up:true")
+}
+
+// incomingStatePath is where an accepted offer is recorded
+func (e *FilesExtension) incomingStatePath(id string) string {
+	return filepath.Join(e.incomingDir(), id+".json")
+}
+
+// partPath is the partial download, kept in the downloads folder so the
+// finished file is moved into place with a rename
+func (e *FilesExtension) partPath(id string) string {
+	return filepath.Join(e.downloadsDir, ".family-vpn-"+id+".part")
+}
+
+// incomingTransfer returns a transfer we accepted from peerIP, or nil
+func (e *FilesExtension) incomingTransfer(id, peerIP string) *incomingTransfer {
+	e.transfersLock.Lock()
+	defer e.transfersLock.Unlock()
+
+	transfer, exists := e.incoming[id]
+	if !exists || transfer.Peer != peerIP {
+		return nil
+	}
+	return transfer
+}
+
+// dropIncoming forgets an accepted offer, and its partial download if asked
+func (e *FilesExtension) dropIncoming(transfer *incomingTransfer, removePart bool) {
+	e.transfersLock.Lock()
+	delete(e.incoming, transfer.ID)
+	e.transfersLock.Unlock()
+
+	os.Remove(e.incomingStatePath(transfer.ID))
+	if removePart {
+		os.Remove(e.partPath(transfer.ID))
+	}
+}
+
+// loadIncoming restores the downloads that were unfinished when we last stopped
+func (e *FilesExtension) loadIncoming() {
+	paths, _ := filepath.Glob(filepath.Join(e.incomingDir(), "*.json"))
+	for _, path := range paths {
+		var transfer incomingTransfer
+		if err := framework.ReadJSONFile(path, &transfer); err != nil {
+			log.Printf("[FILES] Dropping unreadable transfer %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		e.incoming[transfer.ID] = &transfer
+	}
+}
+
+// resumeDownloads retries interrupted downloads until ctx is cancelled
+func (e *FilesExtension) resumeDownloads(ctx context.Context) {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		e.transfersLock.Lock()
+		var pending []*incomingTransfer
+		for _, transfer := range e.incoming {
+			if !transfer.active {
+				pending = append(pending, transfer)
+			}
+		}
+		e.transfersLock.Unlock()
+
+		for _, transfer := range pending {
+			if time.Since(transfer.Accepted) > transferLifetime {
+				e.abandon(transfer, "transfer expired")
+				continue
+			}
+			go e.download(transfer)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// download fetches a transfer, keeping whatever already arrived. Network
+// problems pause it until resumeDownloads tries again.
+func (e *FilesExtension) download(transfer *incomingTransfer) {
+	e.transfersLock.Lock()
+	if transfer.active {
+		e.transfersLock.Unlock()
+		return
+	}
+	transfer.active = true
+	e.transfersLock.Unlock()
+
+	defer func() {
+		e.transfersLock.Lock()
+		transfer.active = false
+		e.transfersLock.Unlock()
+	}()
+
+	path, err := e.fetch(transfer)
+	var abort *abortError
+	switch {
+	case errors.As(err, &abort):
+		e.abandon(transfer, abort.reason)
+	case err != nil:
+		log.Printf("[FILES] Download of %s paused, will resume: %v", transfer.Name, err)
+	default:
+		log.Printf("[FILES] Received %s from %s: %s", transfer.Name, transfer.FromName, path)
+		e.dropIncoming(transfer, false)
+		if err := e.sendSignal(transfer.Peer, transferSignal{Type: signalComplete, ID: transfer.ID}); err != nil {
+			log.Printf("[FILES] Failed to confirm %s: %v", transfer.ID, err)
+		}
+		e.Notify("File received", fmt.Sprintf("%s from %s is in %s", filepath.Base(path), transfer.FromName, filepath.Base(e.downloadsDir)))
+	}
+}
+
+// abandon gives up on a download and tells the sender
+func (e *FilesExtension) abandon(transfer *incomingTransfer, reason string) {
+	log.Printf("[FILES] Giving up on %s from %s: %s", transfer.Name, transfer.FromName, reason)
+	e.dropIncoming(transfer, true)
+	if err := e.sendSignal(transfer.Peer, transferSignal{Type: signalFailed, ID: transfer.ID, Reason: reason}); err != nil {
+		log.Printf("[FILES] Failed to report %s: %v", transfer.ID, err)
+	}
+	e.Notify("File not received", fmt.Sprintf("%s from %s: %s", transfer.Name, transfer.FromName, reason))
+}
+
+// fetch downloads the chunks still missing from the partial file, verifies
+// the whole file and moves it into the downloads folder. Returns its path.
+func (e *FilesExtension) fetch(transfer *incomingTransfer) (string, error) {
+	client := &http.Client{Timeout: httpTimeout}
+	baseURL := fmt.Sprintf("http://%s/transfers/%s", net.JoinHostPort(transfer.Peer, strconv.Itoa(transfer.Port)), transfer.ID)
+
+	manifest, err := fetchManifest(client, baseURL)
+	if err != nil {
+		return "", err
+	}
+	expectedChunks := (transfer.Size + manifest.ChunkSize - 1) / manifest.ChunkSize
+	if manifest.Size != transfer.Size || manifest.SHA256 != transfer.SHA256 || int64(len(manifest.Chunks)) != expectedChunks {
+		return "", &abortError{"the sender's file doesn't match the offer"}
+	}
+
+	part, err := os.OpenFile(e.partPath(transfer.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer part.Close()
+	if err := part.Truncate(transfer.Size); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, manifest.ChunkSize)
+	fetched := 0
+	for index, checksum := range manifest.Chunks {
+		offset := int64(index) * manifest.ChunkSize
+		chunk := buf[:min(manifest.ChunkSize, transfer.Size-offset)]
+
+		// Chunks that already arrived intact are kept (resume)
+		if _, err := part.ReadAt(chunk, offset); err == nil && sha256Hex(chunk) == checksum {
+			continue
+		}
+
+		data, err := fetchChunk(client, baseURL, index, checksum)
+		if err != nil {
+			return "", err
+		}
+		if _, err := part.WriteAt(data, offset); err != nil {
+			return "", err
+		}
+		fetched++
+	}
+	if err := part.Sync(); err != nil {
+		return "", err
+	}
+	log.Printf("[FILES] Fetched %d of %d chunks of %s", fetched, len(manifest.Chunks), transfer.Name)
+
+	// Chunk checksums come from the sender's manifest; the whole-file
+	// checksum from the offer is the final word
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	whole := sha256.New()
+	if _, err := io.Copy(whole, part); err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(whole.Sum(nil)) != transfer.SHA256 {
+		return "", &abortError{"checksum mismatch"}
+	}
+
+	path := uniquePath(e.downloadsDir, transfer.Name)
+	if err := os.Rename(e.partPath(transfer.ID), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// fetchManifest gets the chunk list of a transfer from the sender
+func fetchManifest(client *http.Client, baseURL string) (*transferManifest, error) {
+	resp, err := client.Get(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := transferStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var manifest transferManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.ChunkSize <= 0 || manifest.ChunkSize > 64<<20 {
+		return nil, &abortError{"invalid chunk size"}
+	}
+	return &manifest, nil
+}
+
+// fetchChunk downloads one chunk, retrying until it arrives intact
+func fetchChunk(client *http.Client, baseURL string, index int, checksum string) ([]byte, error) {
+	var lastErr error
+	for attempt := 1; attempt <= chunkAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		resp, err := client.Get(fmt.Sprintf("%s/chunks/%d", baseURL, index))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := transferStatus(resp); err != nil {
+			resp.Body.Close()
+			var abort *abortError
+			if errors.As(err, &abort) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if sha256Hex(data) != checksum {
+			lastErr = fmt.Errorf("chunk %d failed its checksum", index)
+			continue
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// transferStatus turns the sender's error replies into errors. 404 and 410
+// mean the offer is gone, so they abort the download.
+func transferStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return &abortError{"the sender no longer offers the file"}
+	case http.StatusGone:
+		return &abortError{"the file changed on the sender"}
+	}
+	return fmt.Errorf("sender replied %s", resp.Status)
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uniquePath returns dir/name, or "name (n).ext" if that is taken
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+}
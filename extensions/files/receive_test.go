@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveTransfers serves a sender's transfers over HTTP, like Start, and
+// counts the chunks it hands out
+func serveTransfers(t *testing.T, sender *FilesExtension) (port int, chunksServed func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	served := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/chunks/") {
+			mu.Lock()
+			served++
+			mu.Unlock()
+		}
+		sender.handleTransfer(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().(*net.TCPAddr).Port, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return served
+	}
+}
+
+// newReceiver returns a files extension that accepted the sender's offer
+func newReceiver(t *testing.T, offered *outgoingTransfer, port int) (*FilesExtension, *incomingTransfer) {
+	t.Helper()
+	dir := t.TempDir()
+	e := NewFilesExtension(0, filepath.Join(dir, "Downloads"), filepath.Join(dir, "state"))
+	os.MkdirAll(e.downloadsDir, 0700)
+
+	return e, &incomingTransfer{
+		ID:       offered.ID,
+		Name:     offered.Name,
+		Size:     offered.Size,
+		SHA256:   offered.SHA256,
+		Peer:     "127.0.0.1",
+		Port:     port,
+		FromName: "dad",
+		Accepted: time.Now(),
+	}
+}
+
+func TestFetch(t *testing.T) {
+	sender, offered := newSender(t, 2*chunkSize+100, "127.0.0.1")
+	port, chunksServed := serveTransfers(t, sender)
+	receiver, transfer := newReceiver(t, offered, port)
+
+	path, err := receiver.fetch(transfer)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if path != filepath.Join(receiver.downloadsDir, "holiday.mov") {
+		t.Errorf("saved as %s", path)
+	}
+	want, _ := os.ReadFile(offered.Path)
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, want) {
+		t.Error("received file differs from the sent one")
+	}
+	if n := chunksServed(); n != 3 {
+		t.Errorf("%d chunks fetched, want 3", n)
+	}
+	if _, err := os.Stat(receiver.partPath(transfer.ID)); !os.IsNotExist(err) {
+		t.Error("partial download left behind")
+	}
+}
+
+func TestFetchResumes(t *testing.T) {
+	sender, offered := newSender(t, 2*chunkSize+100, "127.0.0.1")
+	port, chunksServed := serveTransfers(t, sender)
+	receiver, transfer := newReceiver(t, offered, port)
+
+	// The first two chunks arrived before the connection dropped, but the
+	// second was only half written
+	data, _ := os.ReadFile(offered.Path)
+	part := make([]byte, len(data))
+	copy(part, data[:chunkSize+chunkSize/2])
+	if err := os.WriteFile(receiver.partPath(transfer.ID), part, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := receiver.fetch(transfer)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Error("resumed file differs from the sent one")
+	}
+	if n := chunksServed(); n != 2 {
+		t.Errorf("%d chunks fetched, want the 2 missing ones", n)
+	}
+}
+
+func TestFetchAborts(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(sender *FilesExtension, offered *outgoingTransfer, transfer *incomingTransfer)
+	}{
+		{"offer withdrawn", func(sender *FilesExtension, offered *outgoingTransfer, transfer *incomingTransfer) {
+			delete(sender.outgoing, offered.ID)
+		}},
+		{"file changed", func(sender *FilesExtension, offered *outgoingTransfer, transfer *incomingTransfer) {
+			os.WriteFile(offered.Path, make([]byte, offered.Size), 0644)
+			os.Chtimes(offered.Path, time.Now(), time.Now().Add(time.Hour))
+		}},
+		{"manifest differs from offer", func(sender *FilesExtension, offered *outgoingTransfer, transfer *incomingTransfer) {
+			transfer.Size++
+		}},
+		{"checksum mismatch", func(sender *FilesExtension, offered *outgoingTransfer, transfer *incomingTransfer) {
+			// The sender lies in its manifest about the whole file
+			transfer.SHA256 = strings.Repeat("0", 64)
+			offered.SHA256 = transfer.SHA256
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, offered := newSender(t, chunkSize+100, "127.0.0.1")
+			port, _ := serveTransfers(t, sender)
+			receiver, transfer := newReceiver(t, offered, port)
+			tt.change(sender, offered, transfer)
+
+			_, err := receiver.fetch(transfer)
+			var abort *abortError
+			if !errors.As(err, &abort) {
+				t.Errorf("fetch = %v, want the download abandoned", err)
+			}
+			if entries, _ := os.ReadDir(receiver.downloadsDir); hasVisible(entries) {
+				t.Error("a file was saved to the downloads folder")
+			}
+		})
+	}
+}
+
+// hasVisible reports whether entries include anything but partial downloads
+func hasVisible(entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	for n, want := range []string{"holiday.mov", "holiday (1).mov", "holiday (2).mov"} {
+		path := uniquePath(dir, "holiday.mov")
+		if filepath.Base(path) != want {
+			t.Fatalf("file %d saved as %s, want %s", n, filepath.Base(path), want)
+		}
+		os.WriteFile(path, []byte(strconv.Itoa(n)), 0600)
+	}
+}
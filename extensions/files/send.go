@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// outgoingTransfer is a file we offered to a peer. It is kept on disk until
+// the peer declines, completes or gives up, so downloads can resume after a
+// restart on either side.
+type outgoingTransfer struct {
+	transferManifest
+	Path     string    `json:"path"`
+	Peer     string    `json:"peer"` // Only this VPN address may download it
+	PeerName string    `json:"peer_name"`
+	ModTime  time.Time `json:"mod_time"` // The file must not change while it is offered
+	Created  time.Time `json:"created"`
+}
+
+// sendFile runs the "send-file" peer action. The file dialog can stay open
+// for a long time, so the menu bar gets its answer right away.
+func (e *FilesExtension) sendFile(target protocol.PeerTarget) error {
+	go func() {
+		path, err := chooseFile(target.Name)
+		if err != nil {
+			log.Printf("[FILES] File dialog failed: %v", err)
+			return
+		}
+		if path == "" {
+			return // Cancelled
+		}
+
+		if err := e.offerFile(target, path); err != nil {
+			log.Printf("[FILES] Failed to send %s to %s: %v", path, target.Name, err)
+			e.Notify("File not sent", err.Error())
+		}
+	}()
+	return nil
+}
+
+// chooseFile asks the user for a file to send. Returns "" if they cancelled.
+func chooseFile(peerName string) (string, error) {
+	script := fmt.Sprintf("POSIX path of (choose file with prompt %s)", framework.AppleScriptString("Send a file to "+peerName))
+	output, err := exec.Command("osascript", "-e", script).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "-128") {
+			return "", nil // User canceled
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// offerFile checksums a file and offers it to a peer
+func (e *FilesExtension) offerFile(target protocol.PeerTarget, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", filepath.Base(path))
+	}
+
+	id, err := newTransferID()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[FILES] Checksumming %s (%s)", path, formatSize(info.Size()))
+	sum, chunks, err := checksumFile(path)
+	if err != nil {
+		return err
+	}
+
+	transfer := &outgoingTransfer{
+		transferManifest: transferManifest{
+			ID:        id,
+			Name:      filepath.Base(path),
+			Size:      info.Size(),
+			SHA256:    sum,
+			ChunkSize: chunkSize,
+			Chunks:    chunks,
+		},
+		Path:     path,
+		Peer:     target.Peer,
+		PeerName: target.Name,
+		ModTime:  info.ModTime(),
+		Created:  time.Now(),
+	}
+	if err := framework.WriteJSONFile(filepath.Join(e.outgoingDir(), id+".json"), transfer); err != nil {
+		return fmt.Errorf("failed to save transfer: %v", err)
+	}
+
+	e.transfersLock.Lock()
+	e.outgoing[id] = transfer
+	e.transfersLock.Unlock()
+
+	hostname, _ := os.Hostname()
+	err = e.sendSignal(target.Peer, transferSignal{
+		Type:     signalOffer,
+		ID:       id,
+		Name:     transfer.Name,
+		Size:     transfer.Size,
+		SHA256:   sum,
+		Port:     e.port,
+		FromName: hostname,
+	})
+	if err != nil {
+		e.dropOutgoing(id)
+		return fmt.Errorf("failed to offer the file: %v", err)
+	}
+
+	log.Printf("[FILES] Offered %s (%s) to %s as transfer %s", transfer.Name, formatSize(transfer.Size), target.Peer, id)
+	return nil
+}
+
+// newTransferID returns a random, unguessable transfer ID
+func newTransferID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validTransferID reports whether an ID from a peer has the format
+// newTransferID creates (32 lowercase hex digits). IDs end up in file names
+// (state and partial downloads), so nothing else may pass.
+func validTransferID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// checksumFile returns the SHA-256 of a file and of each of its chunks
+func checksumFile(path string) (string, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	chunks := []string{}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			chunks = append(chunks, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(whole.Sum(nil)), chunks, nil
+}
+
+// outgoingTransfer returns a transfer we offered to peerIP, or nil
+func (e *FilesExtension) outgoingTransfer(id, peerIP string) *outgoingTransfer {
+	e.transfersLock.Lock()
+	defer e.transfersLock.Unlock()
+
+	transfer, exists := e.outgoing[id]
+	if !exists || transfer.Peer != peerIP {
+		return nil
+	}
+	return transfer
+}
+
+// dropOutgoing forgets an offer
+func (e *FilesExtension) dropOutgoing(id string) {
+	e.transfersLock.Lock()
+	delete(e.outgoing, id)
+	e.transfersLock.Unlock()
+	os.Remove(filepath.Join(e.outgoingDir(), id+".json"))
+}
+
+// loadOutgoing restores the offers that were still open when we last stopped
+func (e *FilesExtension) loadOutgoing() {
+	paths, _ := filepath.Glob(filepath.Join(e.outgoingDir(), "*.json"))
+	for _, path := range paths {
+		var transfer outgoingTransfer
+		if err := framework.ReadJSONFile(path, &transfer); err != nil {
+			log.Printf("[FILES] Dropping unreadable transfer %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		if time.Since(transfer.Created) > transferLifetime {
+			log.Printf("[FILES] Offer of %s to %s expired", transfer.Name, transfer.PeerName)
+			os.Remove(path)
+			continue
+		}
+		e.outgoing[transfer.ID] = &transfer
+	}
+}
+
+// handleReply acts on the receiver's answer to one of our offers
+func (e *FilesExtension) handleReply(peerIP string, signal transferSignal) {
+	transfer := e.outgoingTransfer(signal.ID, peerIP)
+	if transfer == nil {
+		return
+	}
+
+	switch signal.Type {
+	case signalAccept:
+		log.Printf("[FILES] %s accepted %s", transfer.PeerName, transfer.Name)
+		e.Notify("Sending file", fmt.Sprintf("%s is receiving %s", transfer.PeerName, transfer.Name))
+	case signalDecline:
+		log.Printf("[FILES] %s declined %s", transfer.PeerName, transfer.Name)
+		e.dropOutgoing(transfer.ID)
+		e.Notify("File declined", fmt.Sprintf("%s declined %s", transfer.PeerName, transfer.Name))
+	case signalComplete:
+		log.Printf("[FILES] %s received %s", transfer.PeerName, transfer.Name)
+		e.dropOutgoing(transfer.ID)
+		e.Notify("File sent", fmt.Sprintf("%s was delivered to %s", transfer.Name, transfer.PeerName))
+	case signalFailed:
+		log.Printf("[FILES] %s could not receive %s: %s", transfer.PeerName, transfer.Name, signal.Reason)
+		e.dropOutgoing(transfer.ID)
+		e.Notify("File not sent", fmt.Sprintf("%s could not receive %s: %s", transfer.PeerName, transfer.Name, signal.Reason))
+	}
+}
+
+// handleTransfer serves an offered file to the peer it was offered to:
+// GET /transfers/<id> returns the transferManifest and
+// GET /transfers/<id>/chunks/<n> returns chunk n
+func (e *FilesExtension) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/transfers/"), "/")
+	remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// Unknown, and offered to someone else, look the same
+	transfer := e.outgoingTransfer(parts[0], remoteIP)
+	if transfer == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := os.Stat(transfer.Path)
+	if err != nil || info.Size() != transfer.Size || !info.ModTime().Equal(transfer.ModTime) {
+		http.Error(w, "File changed since it was offered", http.StatusGone)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(transfer.transferManifest)
+
+	case len(parts) == 3 && parts[1] == "chunks":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 || index >= len(transfer.Chunks) {
+			http.Error(w, "Invalid chunk", http.StatusBadRequest)
+			return
+		}
+		e.serveChunk(w, transfer, index)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// serveChunk writes one chunk of an offered file
+func (e *FilesExtension) serveChunk(w http.ResponseWriter, transfer *outgoingTransfer, index int) {
+	file, err := os.Open(transfer.Path)
+	if err != nil {
+		http.Error(w, "File unavailable", http.StatusGone)
+		return
+	}
+	defer file.Close()
+
+	offset := int64(index) * transfer.ChunkSize
+	length := transfer.ChunkSize
+	if remaining := transfer.Size - offset; remaining < length {
+		length = remaining
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if _, err := io.Copy(w, io.NewSectionReader(file, offset, length)); err != nil {
+		log.Printf("[FILES] Failed to send chunk %d of %s: %v", index, transfer.ID, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSender returns a files extension offering a file of size bytes to peer
+func newSender(t *testing.T, size int, peer string) (*FilesExtension, *outgoingTransfer) {
+	t.Helper()
+	dir := t.TempDir()
+	e := NewFilesExtension(0, filepath.Join(dir, "Downloads"), filepath.Join(dir, "state"))
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(dir, "holiday.mov")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	sum, chunks, err := checksumFile(path)
+	if err != nil {
+		t.Fatalf("checksumFile: %v", err)
+	}
+	id, _ := newTransferID()
+
+	transfer := &outgoingTransfer{
+		transferManifest: transferManifest{ID: id, Name: "holiday.mov", Size: int64(size), SHA256: sum, ChunkSize: chunkSize, Chunks: chunks},
+		Path:             path,
+		Peer:             peer,
+		PeerName:         "mom",
+		ModTime:          info.ModTime(),
+		Created:          time.Now(),
+	}
+	e.outgoing[id] = transfer
+	return e, transfer
+}
+
+func TestChecksumFile(t *testing.T) {
+	tests := []struct {
+		size       int
+		wantChunks int
+	}{
+		{0, 0},
+		{1, 1},
+		{chunkSize, 1},
+		{chunkSize + 1, 2},
+	}
+
+	for _, tt := range tests {
+		_, transfer := newSender(t, tt.size, "10.8.0.3")
+		if len(transfer.Chunks) != tt.wantChunks {
+			t.Errorf("%d bytes: %d chunks, want %d", tt.size, len(transfer.Chunks), tt.wantChunks)
+		}
+		data, _ := os.ReadFile(transfer.Path)
+		if transfer.SHA256 != sha256Hex(data) {
+			t.Errorf("%d bytes: checksum %s, want %s", tt.size, transfer.SHA256, sha256Hex(data))
+		}
+	}
+}
+
+func TestValidTransferID(t *testing.T) {
+	id, err := newTransferID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id, true},
+		{"0123456789abcdef0123456789abcdef", true},
+		{"0123456789ABCDEF0123456789ABCDEF", false},
+		{"0123456789abcdef", false},
+		{"../../../../Library/LaunchAgents/x", false},
+		{"0123456789abcdef0123456789abcde/", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := validTransferID(tt.id); got != tt.want {
+			t.Errorf("validTransferID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestHandleTransfer(t *testing.T) {
+	e, transfer := newSender(t, chunkSize+10, "10.8.0.3")
+
+	tests := []struct {
+		name   string
+		remote string
+		path   string
+		want   int
+	}{
+		{"manifest", "10.8.0.3", "/transfers/" + transfer.ID, http.StatusOK},
+		{"chunk", "10.8.0.3", "/transfers/" + transfer.ID + "/chunks/1", http.StatusOK},
+		{"chunk out of range", "10.8.0.3", "/transfers/" + transfer.ID + "/chunks/2", http.StatusBadRequest},
+		{"another peer", "10.8.0.4", "/transfers/" + transfer.ID, http.StatusNotFound},
+		{"unknown transfer", "10.8.0.3", "/transfers/0123456789abcdef0123456789abcdef", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.RemoteAddr = tt.remote + ":50000"
+			w := httptest.NewRecorder()
+			e.handleTransfer(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if tt.name == "chunk" && w.Body.Len() != 10 {
+				t.Errorf("last chunk is %d bytes, want 10", w.Body.Len())
+			}
+			if tt.name == "manifest" {
+				var manifest transferManifest
+				json.Unmarshal(w.Body.Bytes(), &manifest)
+				if manifest.SHA256 != transfer.SHA256 || len(manifest.Chunks) != 2 {
+					t.Errorf("manifest = %+v, want the offered file", manifest)
+				}
+			}
+		})
+	}
+
+	// The file changed after it was offered
+	os.Chtimes(transfer.Path, time.Now(), time.Now().Add(time.Hour))
+	r := httptest.NewRequest("GET", "/transfers/"+transfer.ID, nil)
+	r.RemoteAddr = "10.8.0.3:50000"
+	w := httptest.NewRecorder()
+	e.handleTransfer(w, r)
+	if w.Code != http.StatusGone {
+		t.Errorf("status %d for a changed file, want %d", w.Code, http.StatusGone)
+	}
+}
@@ -0,0 +1,91 @@
+package framework
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// ActionHandler runs a peer action (declared with "invoke": true in the manifest)
+type ActionHandler func(target protocol.PeerTarget) error
+
+// StatusReporter is implemented by extensions that report details (progress,
+// errors) along with their health. Status must be JSON-encodable.
+type StatusReporter interface {
+	Status() interface{}
+}
+
+// HandleAction registers the handler for a peer action. The menu bar calls it
+// over the control socket when the user picks the action under a peer.
+func (e *ExtensionBase) HandleAction(id string, handler ActionHandler) {
+	if e.actions == nil {
+		e.actions = make(map[string]ActionHandler)
+	}
+	e.actions[id] = handler
+}
+
+// serveControl answers the extension manager on the Unix socket it assigned us
+func (e *ExtensionBase) serveControl(ext Extension, socketPath string) error {
+	os.Remove(socketPath) // Left over from a previous run
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to secure %s: %v", socketPath, err)
+	}
+	e.control = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		health := protocol.ExtensionHealth{
+			ExtensionInfo: e.Info(),
+			Healthy:       ext.Health(),
+		}
+		if reporter, ok := ext.(StatusReporter); ok {
+			if status, err := json.Marshal(reporter.Status()); err == nil {
+				health.Status = status
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+
+	mux.HandleFunc("/actions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			protocol.WriteError(w, protocol.ErrMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/actions/")
+		handler, exists := e.actions[id]
+		if !exists {
+			protocol.WriteError(w, protocol.NewError(protocol.CodeNotFound, http.StatusNotFound, "unknown action "+id))
+			return
+		}
+
+		var target protocol.PeerTarget
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil || target.Peer == "" {
+			protocol.WriteError(w, protocol.NewError(protocol.CodeBadRequest, http.StatusBadRequest, "peer required"))
+			return
+		}
+
+		if err := handler(target); err != nil {
+			protocol.WriteError(w, protocol.NewError(protocol.CodeInternal, http.StatusInternalServerError, err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,129 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// testExtension is an extension that reports a status
+type testExtension struct {
+	*ExtensionBase
+	healthy bool
+}
+
+func (e *testExtension) Start() error        { return nil }
+func (e *testExtension) Stop() error         { return nil }
+func (e *testExtension) Health() bool        { return e.healthy }
+func (e *testExtension) Status() interface{} { return map[string]int{"transfers": 2} }
+
+// controlClient serves ext's control socket and returns a client for it
+func controlClient(t *testing.T, ext *testExtension) *http.Client {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ctl") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "ext.sock")
+	if err := ext.serveControl(ext, socketPath); err != nil {
+		t.Fatalf("serveControl: %v", err)
+	}
+	t.Cleanup(func() { ext.control.Close() })
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("control socket mode %o, want 600", perm)
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+}
+
+func TestControlHealth(t *testing.T) {
+	for _, healthy := range []bool{true, false} {
+		ext := &testExtension{ExtensionBase: NewExtensionBase("files", "1.2.0"), healthy: healthy}
+		client := controlClient(t, ext)
+
+		resp, err := client.Get("http://extension/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var health protocol.ExtensionHealth
+		json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+
+		wantStatus := http.StatusOK
+		if !healthy {
+			wantStatus = http.StatusServiceUnavailable
+		}
+		if resp.StatusCode != wantStatus || health.Healthy != healthy {
+			t.Errorf("healthy %v: status %d, healthy %v", healthy, resp.StatusCode, health.Healthy)
+		}
+		if health.Name != "files" || health.Version != "1.2.0" || health.Schema != protocol.SchemaVersion {
+			t.Errorf("health reports %+v, want files v1.2.0", health.ExtensionInfo)
+		}
+		if string(health.Status) != `{"transfers":2}` {
+			t.Errorf("status = %s, want the extension's status", health.Status)
+		}
+	}
+}
+
+func TestControlActions(t *testing.T) {
+	ext := &testExtension{ExtensionBase: NewExtensionBase("files", "1.2.0"), healthy: true}
+	var invoked protocol.PeerTarget
+	ext.HandleAction("send-file", func(target protocol.PeerTarget) error {
+		invoked = target
+		return nil
+	})
+	ext.HandleAction("broken", func(target protocol.PeerTarget) error {
+		return errors.New("no file dialog")
+	})
+	client := controlClient(t, ext)
+
+	tests := []struct {
+		name   string
+		method string
+		action string
+		body   string
+		want   int
+	}{
+		{"invoke", "POST", "send-file", `{"peer":"10.8.0.3","name":"mom"}`, http.StatusNoContent},
+		{"unknown action", "POST", "delete-everything", `{"peer":"10.8.0.3"}`, http.StatusNotFound},
+		{"no peer", "POST", "send-file", `{"name":"mom"}`, http.StatusBadRequest},
+		{"handler fails", "POST", "broken", `{"peer":"10.8.0.3"}`, http.StatusInternalServerError},
+		{"GET", "GET", "send-file", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://extension/actions/"+tt.action, strings.NewReader(tt.body))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	if invoked.Peer != "10.8.0.3" || invoked.Name != "mom" {
+		t.Errorf("send-file got %+v, want 10.8.0.3 (mom)", invoked)
+	}
+}
@@ -1,10 +1,15 @@
 package framework
 
 import (
+	"context"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 )
 
 // Extension is the interface that all extensions must implement
@@ -30,6 +35,13 @@ type ExtensionBase struct {
 	name    string
 	version string
 	stopCh  chan bool
+	control net.Listener             // Control socket for the extension manager, if it gave us one
+	actions map[string]ActionHandler // Peer actions invoked over the control socket
+
+	// Registration with the VPN core (see registration.go)
+	vpnClient *ipc.VPNClient
+	endpoints map[string]string
+	services  []protocol.Service
 }
 
 // NewExtensionBase creates a new extension base
@@ -51,14 +63,43 @@ func (e *ExtensionBase) Version() string {
 	return e.version
 }
 
+// Info describes the extension and the IPC schema it was built against
+func (e *ExtensionBase) Info() protocol.ExtensionInfo {
+	return protocol.ExtensionInfo{
+		Name:    e.name,
+		Version: e.version,
+		Schema:  protocol.SchemaVersion,
+	}
+}
+
 // Run runs the extension with signal handling
 func (e *ExtensionBase) Run(ext Extension) error {
-	log.Printf("[%s] Starting extension v%s", ext.Name(), ext.Version())
+	log.Printf("[%s] Starting extension v%s (IPC schema %d)", ext.Name(), ext.Version(), protocol.SchemaVersion)
 
 	if err := ext.Start(); err != nil {
 		return err
 	}
 
+	// Tell the VPN core we're running so signals for us are accepted
+	stopHeartbeats := func() {}
+	if e.vpnClient != nil {
+		if err := e.register(); err != nil {
+			log.Printf("[%s] Failed to register with VPN core: %v", ext.Name(), err)
+		} else {
+			log.Printf("[%s] Registered with VPN core", ext.Name())
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopHeartbeats = cancel
+		go e.keepRegistered(ctx)
+	}
+
+	// Answer the extension manager's health probes
+	if socketPath := os.Getenv(protocol.ExtensionSocketEnv); socketPath != "" {
+		if err := e.serveControl(ext, socketPath); err != nil {
+			log.Printf("[%s] Control socket unavailable: %v", ext.Name(), err)
+		}
+	}
+
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -71,6 +112,15 @@ func (e *ExtensionBase) Run(ext Extension) error {
 	}
 
 	log.Printf("[%s] Stopping extension...", ext.Name())
+	if e.control != nil {
+		e.control.Close()
+	}
+	stopHeartbeats()
+	if e.vpnClient != nil {
+		if err := e.vpnClient.UnregisterExtension(e.name); err != nil {
+			log.Printf("[%s] Failed to unregister from VPN core: %v", ext.Name(), err)
+		}
+	}
 	if err := ext.Stop(); err != nil {
 		log.Printf("[%s] Error during stop: %v", ext.Name(), err)
 		return err
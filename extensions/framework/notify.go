@@ -0,0 +1,21 @@
+package framework
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// AppleScriptString quotes s for use in an AppleScript
+func AppleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Notify shows a macOS notification
+func (e *ExtensionBase) Notify(title, message string) {
+	script := fmt.Sprintf("display notification %s with title %s", AppleScriptString(message), AppleScriptString(title))
+	if err := exec.Command("osascript", "-e", script).Run(); err != nil {
+		log.Printf("[%s] Failed to show notification: %v", e.name, err)
+	}
+}
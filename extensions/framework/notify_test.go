@@ -0,0 +1,22 @@
+package framework
+
+import "testing"
+
+func TestAppleScriptString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hello", `"hello"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\path`, `"C:\\path"`},
+		{`x" & do shell script "touch /tmp/x`, `"x\" & do shell script \"touch /tmp/x"`},
+		{`\"`, `"\\\""`},
+	}
+
+	for _, tt := range tests {
+		if got := AppleScriptString(tt.in); got != tt.want {
+			t.Errorf("AppleScriptString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
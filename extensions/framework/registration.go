@@ -0,0 +1,66 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// SetVPNClient makes Run register the extension with the VPN core once it
+// has started, keep the registration alive and remove it on exit
+func (e *ExtensionBase) SetVPNClient(client *ipc.VPNClient) {
+	e.vpnClient = client
+}
+
+// SetEndpoint advertises an endpoint (e.g. "ui") in the extension's
+// registration. Call it from Start, before Run registers.
+func (e *ExtensionBase) SetEndpoint(name, url string) {
+	if e.endpoints == nil {
+		e.endpoints = make(map[string]string)
+	}
+	e.endpoints[name] = url
+}
+
+// AddService advertises a service the extension offers (e.g. the port its
+// peers connect to) to every peer while it runs. Call it from Start, before
+// Run registers.
+func (e *ExtensionBase) AddService(service protocol.Service) {
+	e.services = append(e.services, service)
+}
+
+// register announces the extension to the VPN core
+func (e *ExtensionBase) register() error {
+	return e.vpnClient.RegisterExtension(protocol.ExtensionRegistration{
+		ExtensionInfo: e.Info(),
+		Endpoints:     e.endpoints,
+		Services:      e.services,
+	})
+}
+
+// keepRegistered sends heartbeats until ctx is cancelled, registering again
+// whenever the VPN core has forgotten us (e.g. after it restarted)
+func (e *ExtensionBase) keepRegistered(ctx context.Context) {
+	ticker := time.NewTicker(protocol.ExtensionHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := e.vpnClient.Heartbeat(e.name)
+		if errors.Is(err, protocol.ErrNotRegistered) {
+			log.Printf("[%s] VPN core lost our registration, registering again", e.name)
+			err = e.register()
+		}
+		if err != nil {
+			log.Printf("[%s] Heartbeat failed: %v", e.name, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package framework
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+func TestRegister(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reg") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A VPN core that records the registration
+	registrations := make(chan protocol.ExtensionRegistration, 1)
+	listener, err := net.Listen("unix", filepath.Join(dir, "ipc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var registration protocol.ExtensionRegistration
+		if r.URL.Path != "/extensions/register" || json.NewDecoder(r.Body).Decode(&registration) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		registrations <- registration
+		json.NewEncoder(w).Encode(protocol.RegisteredExtension{ExtensionRegistration: registration})
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	e := NewExtensionBase("files", "1.2.0")
+	e.SetVPNClient(ipc.NewVPNClientSocket(filepath.Join(dir, "ipc.sock"), 0))
+	e.SetEndpoint("data", "http://127.0.0.1:8892")
+	e.AddService(protocol.Service{Name: "files", Port: 8892, Protocol: "tcp"})
+
+	if err := e.register(); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	got := <-registrations
+	if got.Name != "files" || got.Version != "1.2.0" || got.Schema != protocol.SchemaVersion {
+		t.Errorf("registered %+v, want files v1.2.0", got.ExtensionInfo)
+	}
+	if got.Endpoints["data"] != "http://127.0.0.1:8892" {
+		t.Errorf("endpoints = %v, want the data endpoint", got.Endpoints)
+	}
+	if len(got.Services) != 1 || got.Services[0].Port != 8892 {
+		t.Errorf("services = %+v, want port 8892", got.Services)
+	}
+}
@@ -0,0 +1,28 @@
+package framework
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// WriteJSONFile saves state atomically (write to a temporary file, then rename)
+func WriteJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// ReadJSONFile loads state saved by WriteJSONFile
+func ReadJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,44 @@
+package framework
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONFileRoundTrip(t *testing.T) {
+	type state struct {
+		Peers map[string]string `json:"peers"`
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	want := state{Peers: map[string]string{"10.8.0.3": "mom"}}
+	if err := WriteJSONFile(path, want); err != nil {
+		t.Fatalf("WriteJSONFile: %v", err)
+	}
+	var got state
+	if err := ReadJSONFile(path, &got); err != nil {
+		t.Fatalf("ReadJSONFile: %v", err)
+	}
+	if got.Peers["10.8.0.3"] != "mom" {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file mode %o, want 600", perm)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestReadJSONFileMissing(t *testing.T) {
+	var v map[string]string
+	if err := ReadJSONFile(filepath.Join(t.TempDir(), "missing.json"), &v); !os.IsNotExist(err) {
+		t.Errorf("ReadJSONFile = %v, want a not-exist error", err)
+	}
+}
@@ -6,16 +6,23 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/miguelemosreverte/family-vpn/extensions/framework"
 	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 )
 
+// validUsername matches the login names openTerminal passes to ssh
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
 // SSHExtension implements SSH terminal access to peers
 type SSHExtension struct {
 	*framework.ExtensionBase
@@ -25,11 +32,14 @@ type SSHExtension struct {
 
 // NewSSHExtension creates a new SSH extension
 func NewSSHExtension(vpnPort int) *SSHExtension {
-	return &SSHExtension{
+	e := &SSHExtension{
 		ExtensionBase: framework.NewExtensionBase("ssh", "1.0.1"), // Test: component-aware deployment
 		vpnClient:     ipc.NewVPNClient(vpnPort),
 		port:          8891, // Different from video (8890)
 	}
+	e.SetVPNClient(e.vpnClient)
+	e.HandleAction("ssh-terminal", e.openTerminal)
+	return e
 }
 
 // Start starts the SSH extension
@@ -47,6 +57,8 @@ func (e *SSHExtension) Start() error {
 
 	addr := fmt.Sprintf("0.0.0.0:%d", e.port)
 	log.Printf("[SSH] Starting server on http://%s (accessible via VPN)", addr)
+	e.SetEndpoint("api", fmt.Sprintf("http://127.0.0.1:%d", e.port))
+	e.AddService(protocol.Service{Name: "ssh-api", Port: e.port, Protocol: "tcp", Description: "SSH key setup for the ssh extension"})
 
 	go func() {
 		if err := http.ListenAndServe(addr, mux); err != nil {
@@ -79,8 +91,14 @@ func (e *SSHExtension) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleSSH opens an SSH terminal to the specified peer
+// handleSSH opens an SSH terminal to the specified peer. The server listens
+// on the VPN for key setup, so only local callers may open terminals.
 func (e *SSHExtension) handleSSH(w http.ResponseWriter, r *http.Request) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	peerIP := r.URL.Query().Get("peer")
 	peerName := r.URL.Query().Get("name")
 	username := r.URL.Query().Get("username")
@@ -90,40 +108,70 @@ func (e *SSHExtension) handleSSH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := e.openTerminal(protocol.PeerTarget{Peer: peerIP, Name: peerName, Username: username}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "opened",
+		"peer":   peerIP,
+		"name":   peerName,
+	})
+}
+
+// openTerminal opens Terminal.app with an SSH session to the peer
+// (the "ssh-terminal" peer action)
+func (e *SSHExtension) openTerminal(peer protocol.PeerTarget) error {
 	// If no username provided, use current user
+	username := peer.Username
 	if username == "" {
 		if u, err := user.Current(); err == nil {
 			username = u.Username
 		}
 	}
 
-	target := peerIP
-	if username != "" {
-		target = fmt.Sprintf("%s@%s", username, peerIP)
+	script, err := terminalScript(peer.Peer, username)
+	if err != nil {
+		return err
 	}
+	log.Printf("[SSH] Opening SSH terminal to %s (%s)", peer.Name, peer.Peer)
 
-	log.Printf("[SSH] Opening SSH terminal to %s (%s)", peerName, target)
-
-	// Open Terminal with SSH command
 	// On macOS, use osascript to open Terminal.app with SSH
-	script := fmt.Sprintf(`tell application "Terminal"
-		activate
-		do script "ssh %s"
-	end tell`, target)
-
 	cmd := exec.Command("osascript", "-e", script)
 	if err := cmd.Start(); err != nil {
 		log.Printf("[SSH] Failed to open terminal: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to open terminal: %v", err), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("failed to open terminal: %v", err)
 	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "opened",
-		"peer":   peerIP,
-		"name":   peerName,
-	})
+// terminalScript returns the AppleScript that runs ssh to a peer in
+// Terminal.app. The target is quoted for the shell Terminal runs it in, and
+// the command for AppleScript.
+func terminalScript(peerIP, username string) (string, error) {
+	if net.ParseIP(peerIP) == nil {
+		return "", fmt.Errorf("invalid peer address %q", peerIP)
+	}
+	target := peerIP
+	if username != "" {
+		if !validUsername.MatchString(username) {
+			return "", fmt.Errorf("invalid username %q", username)
+		}
+		target = username + "@" + peerIP
+	}
+
+	command := "ssh " + shellQuote(target)
+	return fmt.Sprintf(`tell application "Terminal"
+		activate
+		do script %s
+	end tell`, framework.AppleScriptString(command)), nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 // handleSetupSSHKey receives a public key and adds it to authorized_keys
@@ -179,7 +227,7 @@ func (e *SSHExtension) handleSetupSSHKey(w http.ResponseWriter, r *http.Request)
 }
 
 func main() {
-	vpnPort := flag.Int("vpn-port", 8889, "VPN core IPC port")
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
 	flag.Parse()
 
 	ext := NewSSHExtension(*vpnPort)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTerminalScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		peerIP   string
+		username string
+		want     string // The do script line
+		wantErr  bool
+	}{
+		{"address", "10.8.0.3", "", `do script "ssh '10.8.0.3'"`, false},
+		{"user", "10.8.0.3", "mom", `do script "ssh 'mom@10.8.0.3'"`, false},
+		{"address with AppleScript", `10.8.0.3" & do shell script "touch /tmp/x`, "", "", true},
+		{"address with shell", "10.8.0.3; rm -rf ~", "", "", true},
+		{"user with shell", "10.8.0.3", "mom$(touch /tmp/x)", "", true},
+		{"user with quote", "10.8.0.3", `mom'"`, "", true},
+		{"user as option", "10.8.0.3", "-oProxyCommand=x", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := terminalScript(tt.peerIP, tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("terminalScript error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !strings.Contains(script, tt.want) {
+				t.Errorf("script = %s, want it to contain %s", script, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"mom@10.8.0.3", `'mom@10.8.0.3'`},
+		{"it's", `'it'\''s'`},
+		{"$(x)", `'$(x)'`},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandleSSHFromPeer(t *testing.T) {
+	e := NewSSHExtension(0)
+
+	// The API listens on the VPN; peers must not open terminals here
+	r := httptest.NewRequest("GET", "/ssh?peer=10.8.0.3", nil)
+	r.RemoteAddr = "10.8.0.3:50000"
+	w := httptest.NewRecorder()
+	e.handleSSH(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d for a peer, want %d", w.Code, http.StatusForbidden)
+	}
+}
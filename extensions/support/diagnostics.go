@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	stepTimeout = 30 * time.Second // Per command
+	logLines    = 200              // Lines collected from the end of each log
+)
+
+// step is one part of a diagnostic: a fixed command, or a function for what
+// is read in-process
+type step struct {
+	Label   string
+	Command []string
+	Run     func(vpnClient *ipc.VPNClient, w io.Writer) error
+}
+
+// diagnostic is one of the curated checks a helper may request. Helpers only
+// pick a diagnostic by ID; they can never run their own commands.
+type diagnostic struct {
+	ID          string
+	Label       string
+	Description string // Shown in the consent prompt
+	Steps       []step
+}
+
+// diagnostics is the curated set, in menu order
+var diagnostics = []diagnostic{
+	{
+		ID:          "vpn-status",
+		Label:       "VPN status",
+		Description: "the VPN connection, connected devices, running extensions and network routes",
+		Steps: []step{
+			{Label: "VPN client", Run: vpnStatus},
+			{Label: "Routes", Command: []string{"netstat", "-rn", "-f", "inet"}},
+		},
+	},
+	{
+		ID:          "network",
+		Label:       "Network tests",
+		Description: "pings, DNS settings and a test download",
+		Steps: []step{
+			{Label: "Default route", Command: []string{"route", "-n", "get", "default"}},
+			{Label: "VPN gateway", Command: []string{"ping", "-c", "3", "10.8.0.1"}},
+			{Label: "Internet", Command: []string{"ping", "-c", "3", "1.1.1.1"}},
+			{Label: "DNS", Command: []string{"scutil", "--dns"}},
+			{Label: "HTTPS", Command: []string{"curl", "-sS", "-o", "/dev/null", "-w", "status %{http_code} in %{time_total}s\n", "https://www.apple.com"}},
+		},
+	},
+	{
+		ID:          "logs",
+		Label:       "Collect logs",
+		Description: "the last lines of the Family VPN extension logs",
+		Steps: []step{
+			{Label: "Extension logs", Run: collectLogs},
+		},
+	},
+}
+
+// findDiagnostic returns a diagnostic by ID or label, or nil
+func findDiagnostic(key string) *diagnostic {
+	for i := range diagnostics {
+		if diagnostics[i].ID == key || diagnostics[i].Label == key {
+			return &diagnostics[i]
+		}
+	}
+	return nil
+}
+
+// run runs every step, writing their output to w. A failing step doesn't stop the others.
+func (d *diagnostic) run(ctx context.Context, vpnClient *ipc.VPNClient, w io.Writer) {
+	for _, s := range d.Steps {
+		fmt.Fprintf(w, "\n=== %s ===\n", s.Label)
+
+		var err error
+		if s.Run != nil {
+			err = s.Run(vpnClient, w)
+		} else {
+			stepCtx, cancel := context.WithTimeout(ctx, stepTimeout)
+			cmd := exec.CommandContext(stepCtx, s.Command[0], s.Command[1:]...)
+			cmd.Stdout = w
+			cmd.Stderr = w
+			fmt.Fprintf(w, "$ %s\n", strings.Join(s.Command, " "))
+			err = cmd.Run()
+			cancel()
+		}
+		if err != nil {
+			fmt.Fprintf(w, "(failed: %v)\n", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// vpnStatus reports what the local VPN client knows
+func vpnStatus(vpnClient *ipc.VPNClient, w io.Writer) error {
+	if err := vpnClient.Health(); err != nil {
+		return fmt.Errorf("VPN client not reachable: %v", err)
+	}
+	fmt.Fprintln(w, "VPN client is running")
+
+	peers, err := vpnClient.GetPeers()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d connected device(s):\n", len(peers))
+	for _, peer := range peers {
+		version := "unknown version"
+		if peer.Capabilities != nil {
+			version = peer.Capabilities.ClientVersion
+		}
+		fmt.Fprintf(w, "  %s %s (%s, %s, since %s)\n", peer.Hostname, peer.VPNAddress, peer.OS, version, peer.ConnectedAt)
+	}
+
+	extensions, err := vpnClient.ListExtensions()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d running extension(s):\n", len(extensions))
+	for _, ext := range extensions {
+		fmt.Fprintf(w, "  %s %s (last heartbeat %s)\n", ext.Name, ext.Version, ext.LastHeartbeat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// collectLogs writes the end of each extension log kept by the menu bar
+func collectLogs(_ *ipc.VPNClient, w io.Writer) error {
+	paths, err := filepath.Glob(filepath.Join(protocol.RuntimeDir(os.Getuid()), "logs", "*.log"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(w, "No logs found")
+	}
+	for _, path := range paths {
+		lines, err := tail(path, logLines)
+		if err != nil {
+			fmt.Fprintf(w, "--- %s: %v\n", filepath.Base(path), err)
+			continue
+		}
+		fmt.Fprintf(w, "--- %s (last %d lines)\n", filepath.Base(path), len(lines))
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+	return nil
+}
+
+// tail returns the last n lines of a file
+func tail(path string, n int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
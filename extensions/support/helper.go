@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// helperSession is a diagnostic we asked a peer to run. Its output is written
+// to a transcript that opens in Console and fills in as it arrives.
+type helperSession struct {
+	ID         string
+	Peer       string
+	PeerName   string
+	Diagnostic *diagnostic
+	transcript *os.File
+	next       int            // Seq of the next output to write
+	held       map[int]string // Output that arrived ahead of its turn
+	timer      *time.Timer    // Gives up on a silent peer
+}
+
+// requestSupport runs the "remote-support" peer action. The diagnostic picker
+// can stay open for a long time, so the menu bar gets its answer right away.
+func (e *SupportExtension) requestSupport(target protocol.PeerTarget) error {
+	go func() {
+		d, err := chooseDiagnostic(target.Name)
+		if err != nil {
+			log.Printf("[SUPPORT] Diagnostic picker failed: %v", err)
+			return
+		}
+		if d == nil {
+			return // Cancelled
+		}
+
+		if err := e.startSession(target, d); err != nil {
+			log.Printf("[SUPPORT] Failed to request %s from %s: %v", d.ID, target.Name, err)
+			e.Notify("Remote support", err.Error())
+		}
+	}()
+	return nil
+}
+
+// chooseDiagnostic asks which diagnostic to run. Returns nil if the user cancelled.
+func chooseDiagnostic(peerName string) (*diagnostic, error) {
+	labels := []string{}
+	for _, d := range diagnostics {
+		labels = append(labels, framework.AppleScriptString(d.Label))
+	}
+	script := fmt.Sprintf("choose from list {%s} with title %s with prompt %s",
+		strings.Join(labels, ", "), framework.AppleScriptString("Remote Support"), framework.AppleScriptString("Run on "+peerName+":"))
+
+	output, err := exec.Command("osascript", "-e", script).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	choice := strings.TrimSpace(string(output))
+	if choice == "false" {
+		return nil, nil // User canceled
+	}
+	return findDiagnostic(choice), nil
+}
+
+// startSession asks a peer to run a diagnostic and opens its transcript
+func (e *SupportExtension) startSession(target protocol.PeerTarget, d *diagnostic) error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.sessionsDir(), id+".log")
+	transcript, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(transcript, "Remote support session %s\n%s on %s (%s), requested %s\nWaiting for %s to approve...\n",
+		id, d.Label, target.Name, target.Peer, time.Now().Format(time.RFC1123), target.Name)
+
+	session := &helperSession{
+		ID:         id,
+		Peer:       target.Peer,
+		PeerName:   target.Name,
+		Diagnostic: d,
+		transcript: transcript,
+		held:       make(map[int]string),
+	}
+	session.timer = time.AfterFunc(sessionTimeout, func() {
+		e.endHelperSession(id, "failed", "no answer from "+target.Name)
+	})
+
+	e.sessionsLock.Lock()
+	e.helping[id] = session
+	e.sessionsLock.Unlock()
+
+	e.audit(auditEntry{Session: id, Role: "helper", Peer: target.Peer, Label: target.Name, Diagnostic: d.ID, Event: "requested"})
+	if err := e.sendSignal(target.Peer, supportSignal{Type: signalRequest, Session: id, Diagnostic: d.ID}); err != nil {
+		e.endHelperSession(id, "failed", err.Error())
+		return fmt.Errorf("failed to send the request: %v", err)
+	}
+
+	log.Printf("[SUPPORT] Asked %s to run %s (session %s)", target.Name, d.ID, id)
+	if err := exec.Command("open", "-a", "Console", path).Start(); err != nil {
+		log.Printf("[SUPPORT] Failed to open transcript: %v", err)
+	}
+	return nil
+}
+
+// handleReply writes a peer's answer to one of our sessions into its transcript
+func (e *SupportExtension) handleReply(peerIP string, signal supportSignal) {
+	e.sessionsLock.Lock()
+	session, exists := e.helping[signal.Session]
+	if !exists || session.Peer != peerIP {
+		e.sessionsLock.Unlock()
+		return
+	}
+
+	var event, detail string
+	switch signal.Type {
+	case signalApproved:
+		fmt.Fprintf(session.transcript, "%s approved. Running %s...\n", session.PeerName, session.Diagnostic.Label)
+		e.audit(auditEntry{Session: session.ID, Role: "helper", Peer: session.Peer, Label: session.PeerName, Diagnostic: session.Diagnostic.ID, Event: "approved"})
+
+	case signalDenied:
+		event, detail = "denied", signal.Reason
+
+	case signalOutput:
+		if signal.Seq >= session.next {
+			session.held[signal.Seq] = signal.Data
+		}
+		session.writeHeld(false)
+
+	case signalEnd:
+		session.writeHeld(true)
+		event, detail = "finished", ""
+		if signal.Reason != "" {
+			event, detail = "failed", signal.Reason
+		}
+	}
+	e.sessionsLock.Unlock()
+
+	if event != "" {
+		e.endHelperSession(session.ID, event, detail)
+	}
+}
+
+// writeHeld writes the output that is next in line. At the end of the session
+// whatever is left is written too, noting the gaps. Callers hold sessionsLock.
+func (s *helperSession) writeHeld(final bool) {
+	for {
+		data, exists := s.held[s.next]
+		if !exists {
+			break
+		}
+		s.transcript.WriteString(data)
+		delete(s.held, s.next)
+		s.next++
+	}
+	if !final || len(s.held) == 0 {
+		return
+	}
+
+	seqs := []int{}
+	for seq := range s.held {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		s.transcript.WriteString("\n[some output was lost]\n" + s.held[seq])
+	}
+}
+
+// endHelperSession closes one of our sessions and records how it ended
+func (e *SupportExtension) endHelperSession(id, event, detail string) {
+	e.sessionsLock.Lock()
+	session, exists := e.helping[id]
+	delete(e.helping, id)
+	e.sessionsLock.Unlock()
+	if !exists {
+		return
+	}
+
+	session.timer.Stop()
+	switch event {
+	case "finished":
+		fmt.Fprintf(session.transcript, "\n=== Finished %s ===\n", time.Now().Format(time.RFC1123))
+	case "denied":
+		fmt.Fprintf(session.transcript, "\n=== %s did not approve: %s ===\n", session.PeerName, detail)
+		e.Notify("Remote support", fmt.Sprintf("%s did not approve %s", session.PeerName, session.Diagnostic.Label))
+	default:
+		fmt.Fprintf(session.transcript, "\n=== Failed: %s ===\n", detail)
+	}
+	session.transcript.Close()
+
+	log.Printf("[SUPPORT] Session %s with %s %s %s", id, session.PeerName, event, detail)
+	e.audit(auditEntry{Session: id, Role: "helper", Peer: session.Peer, Label: session.PeerName, Diagnostic: session.Diagnostic.ID, Event: event, Detail: detail})
+}
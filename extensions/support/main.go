@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+)
+
+const (
+	signalTTL      = time.Minute      // Support sessions are live; stale signals are useless
+	consentTimeout = 2 * time.Minute  // How long the consent prompt waits for an answer
+	sessionTimeout = 10 * time.Minute // A helper gives up on a session after this
+	maxOutput      = 256 << 10        // Output sent per session; the rest is cut off
+	maxRunning     = 64               // Sessions remembered as asked to run here
+)
+
+// Support signal types
+const (
+	signalRequest  = "request"  // Helper -> target: please run a diagnostic
+	signalApproved = "approved" // Target -> helper: the user agreed, output follows
+	signalDenied   = "denied"   // Target -> helper: the user (or trust list) said no
+	signalOutput   = "output"   // Target -> helper: a piece of output
+	signalEnd      = "end"      // Target -> helper: the diagnostic finished
+)
+
+// supportSignal is one message of a support session
+type supportSignal struct {
+	Type       string `json:"type"`
+	Session    string `json:"session"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+	Seq        int    `json:"seq,omitempty"`  // Output order; on "end", the number of output signals
+	Data       string `json:"data,omitempty"` // Output
+	Reason     string `json:"reason,omitempty"`
+}
+
+// supportConfig is the extension's config file. Peers are named by VPN
+// address: the server assigns addresses (and gives a device its own back),
+// while hostnames are whatever a peer claims.
+type supportConfig struct {
+	Trusted []string `json:"trusted"` // VPN addresses that may ask for diagnostics; "*" is everyone
+}
+
+// auditEntry is a line of the audit log. Both sides of a session record it.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	Role       string    `json:"role"`  // "helper" (we asked) or "target" (we ran it)
+	Peer       string    `json:"peer"`  // VPN address
+	Label      string    `json:"label"` // Hostname the peer reported, for display only
+	Diagnostic string    `json:"diagnostic"`
+	Event      string    `json:"event"` // requested, approved, denied, finished, failed
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// SupportExtension lets trusted peers run curated diagnostics on this
+// machine after the user consents, and run them on peers
+type SupportExtension struct {
+	*framework.ExtensionBase
+	vpnClient *ipc.VPNClient
+	stateDir  string
+	config    supportConfig
+	cancel    context.CancelFunc // Ends the signal subscription
+	ctx       context.Context    // Cancelled on Stop; running diagnostics end with it
+
+	helping      map[string]*helperSession // Sessions we requested, by ID
+	running      map[string]time.Time      // When we were asked to run each session, by ID
+	sessionsLock sync.Mutex
+
+	auditLock sync.Mutex
+}
+
+// NewSupportExtension creates a new remote support extension
+func NewSupportExtension(vpnPort int, stateDir string) *SupportExtension {
+	e := &SupportExtension{
+		ExtensionBase: framework.NewExtensionBase("support", "1.0.0"),
+		vpnClient:     ipc.NewVPNClient(vpnPort),
+		stateDir:      stateDir,
+		helping:       make(map[string]*helperSession),
+		running:       make(map[string]time.Time),
+	}
+	e.SetVPNClient(e.vpnClient)
+	e.HandleAction("remote-support", e.requestSupport)
+	return e
+}
+
+// Start starts the remote support extension
+func (e *SupportExtension) Start() error {
+	// Check VPN core is running
+	if err := e.vpnClient.Health(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.sessionsDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", e.sessionsDir(), err)
+	}
+	if err := e.loadConfig(); err != nil {
+		return err
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.monitorSignals(e.ctx)
+	return nil
+}
+
+// Stop stops the extension, ending any diagnostic that is running
+func (e *SupportExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	return nil
+}
+
+// Health returns true if extension is healthy
+func (e *SupportExtension) Health() bool {
+	if e.vpnClient == nil {
+		return false
+	}
+	return e.vpnClient.Health() == nil
+}
+
+// loadConfig reads the trusted peers. By default anyone may ask: the user
+// still has to approve every session.
+func (e *SupportExtension) loadConfig() error {
+	path := filepath.Join(e.stateDir, "config.json")
+	err := framework.ReadJSONFile(path, &e.config)
+	if os.IsNotExist(err) {
+		e.config = supportConfig{Trusted: []string{"*"}}
+		if err := framework.WriteJSONFile(path, &e.config); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	for _, entry := range e.config.Trusted {
+		if entry != "*" && net.ParseIP(entry) == nil {
+			log.Printf("[SUPPORT] Ignoring %q in %s: trusted peers are named by VPN address", entry, path)
+		}
+	}
+	return nil
+}
+
+// trusted reports whether the peer at a VPN address may request diagnostics
+func (e *SupportExtension) trusted(address string) bool {
+	for _, entry := range e.config.Trusted {
+		if entry == "*" || entry == address {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSignal sends a support signal to a peer
+func (e *SupportExtension) sendSignal(peerIP string, signal supportSignal) error {
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	_, err = e.vpnClient.SendSignalWithOptions(e.Name(), peerIP, data, ipc.SignalOptions{
+		TTL: signalTTL,
+		OnFailed: func(id, peerIP, reason string) {
+			log.Printf("[SUPPORT] %s signal for session %s to %s was not delivered: %s", signal.Type, signal.Session, peerIP, reason)
+		},
+	})
+	return err
+}
+
+// monitorSignals handles support signals from peers until ctx is cancelled
+func (e *SupportExtension) monitorSignals(ctx context.Context) {
+	log.Printf("[SUPPORT] Subscribing to support signals via IPC")
+
+	err := e.vpnClient.SubscribeToSignals(ctx, e.Name(), func(peerIP string, data []byte) {
+		var signal supportSignal
+		if err := json.Unmarshal(data, &signal); err != nil || !validSessionID(signal.Session) {
+			log.Printf("[SUPPORT] Ignoring invalid signal from %s", peerIP)
+			return
+		}
+
+		// peerIP is the server-stamped sender
+		switch signal.Type {
+		case signalRequest:
+			go e.handleRequest(peerIP, signal)
+		case signalApproved, signalDenied, signalOutput, signalEnd:
+			e.handleReply(peerIP, signal)
+		}
+	})
+
+	if err != nil {
+		log.Printf("[SUPPORT] Error subscribing to signals: %v", err)
+	}
+}
+
+// peerName returns the hostname the peer with a VPN address reports, for
+// display only
+func (e *SupportExtension) peerName(peerIP string) string {
+	peers, err := e.vpnClient.GetPeers()
+	if err == nil {
+		for _, peer := range peers {
+			if peer.VPNAddress == peerIP {
+				return peer.Hostname
+			}
+		}
+	}
+	return peerIP
+}
+
+// audit appends an entry to the audit log
+func (e *SupportExtension) audit(entry auditEntry) {
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	e.auditLock.Lock()
+	defer e.auditLock.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(e.stateDir, "audit.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("[SUPPORT] Failed to write audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
+
+// sessionsDir holds the transcript of every session, on both sides
+func (e *SupportExtension) sessionsDir() string {
+	return filepath.Join(e.stateDir, "sessions")
+}
+
+// newSessionID returns a random, unguessable session ID
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validSessionID reports whether a session ID from a peer has the format
+// newSessionID creates (32 lowercase hex digits). Session IDs end up in file
+// names (transcripts), so nothing else may pass.
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func main() {
+	configDir, _ := os.UserConfigDir()
+
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
+	stateDir := flag.String("state-dir", filepath.Join(configDir, "family-vpn", "support"), "Where the trust list, audit log and session transcripts are kept")
+	flag.Parse()
+
+	ext := NewSupportExtension(*vpnPort, *stateDir)
+	if err := ext.Run(ext); err != nil {
+		log.Fatalf("Extension failed: %v", err)
+	}
+}
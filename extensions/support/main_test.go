@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// newTestExtension returns the extension with a VPN client that reports peers
+// and records the signals it sends
+func newTestExtension(t *testing.T, config supportConfig, peers []protocol.PeerInfo) (*SupportExtension, func() []protocol.SendSignalRequest) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "support") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var mu sync.Mutex
+	var sent []protocol.SendSignalRequest
+	listener, err := net.Listen("unix", filepath.Join(dir, "ipc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/peers":
+			json.NewEncoder(w).Encode(peers)
+		case "/signal/send":
+			var request protocol.SendSignalRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			mu.Lock()
+			sent = append(sent, request)
+			mu.Unlock()
+			json.NewEncoder(w).Encode(protocol.SendSignalResponse{Status: "sent", ID: "signal"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	e := NewSupportExtension(0, dir)
+	e.vpnClient = ipc.NewVPNClientSocket(filepath.Join(dir, "ipc.sock"), 0)
+	e.config = config
+	return e, func() []protocol.SendSignalRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]protocol.SendSignalRequest(nil), sent...)
+	}
+}
+
+// readAudit returns the entries of the audit log
+func readAudit(t *testing.T, e *SupportExtension) []auditEntry {
+	t.Helper()
+	file, err := os.Open(filepath.Join(e.stateDir, "audit.log"))
+	if err != nil {
+		t.Fatalf("opening audit log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("parsing audit entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestTrusted(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		address string
+		want    bool
+	}{
+		{"empty", nil, "10.8.0.2", false},
+		{"listed", []string{"10.8.0.3", "10.8.0.2"}, "10.8.0.2", true},
+		{"not listed", []string{"10.8.0.3"}, "10.8.0.2", false},
+		{"everyone", []string{"*"}, "10.8.0.2", true},
+		{"hostname", []string{"moms-laptop"}, "10.8.0.2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewSupportExtension(0, t.TempDir())
+			e.config = supportConfig{Trusted: tt.trusted}
+			if got := e.trusted(tt.address); got != tt.want {
+				t.Errorf("trusted(%s) with %v = %v, want %v", tt.address, tt.trusted, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestSpoofedHostname(t *testing.T) {
+	peers := []protocol.PeerInfo{
+		{Hostname: "moms-laptop", VPNAddress: "10.8.0.2"},
+		{Hostname: "moms-laptop", VPNAddress: "10.8.0.3"}, // Claims someone else's name
+	}
+	e, sent := newTestExtension(t, supportConfig{Trusted: []string{"10.8.0.2"}}, peers)
+
+	e.handleRequest("10.8.0.3", supportSignal{Type: signalRequest, Session: "0123456789abcdef0123456789abcdef", Diagnostic: diagnostics[0].ID})
+
+	signals := sent()
+	if len(signals) != 1 || signals[0].Peer != "10.8.0.3" {
+		t.Fatalf("signals sent = %+v, want one reply to 10.8.0.3", signals)
+	}
+	var reply supportSignal
+	if err := json.Unmarshal([]byte(signals[0].Data), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != signalDenied || reply.Reason != "not a trusted device" {
+		t.Errorf("reply = %+v, want denied as not a trusted device", reply)
+	}
+
+	entries := readAudit(t, e)
+	if len(entries) != 1 {
+		t.Fatalf("%d audit entries, want 1", len(entries))
+	}
+	if entries[0].Peer != "10.8.0.3" || entries[0].Label != "moms-laptop" || entries[0].Event != "denied" {
+		t.Errorf("audit entry = %+v, want the denial recorded by address", entries[0])
+	}
+}
+
+func TestConsentMessage(t *testing.T) {
+	message := consentMessage("moms-laptop", "10.8.0.3", &diagnostics[0])
+	if !strings.HasPrefix(message, "The device at 10.8.0.3,") {
+		t.Errorf("consent message doesn't lead with the VPN address: %q", message)
+	}
+	if !strings.Contains(message, "sent to 10.8.0.3") {
+		t.Errorf("consent message doesn't say results go to the VPN address: %q", message)
+	}
+}
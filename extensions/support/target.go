@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	chunkSize     = 512                    // Output bytes per signal, before JSON escaping
+	flushInterval = 500 * time.Millisecond // How often buffered output is sent
+)
+
+// handleRequest asks the user whether a peer may run a diagnostic here, then
+// runs it and streams the output back
+func (e *SupportExtension) handleRequest(peerIP string, request supportSignal) {
+	if !validSessionID(request.Session) {
+		log.Printf("[SUPPORT] Ignoring request with invalid session ID from %s", peerIP)
+		return
+	}
+
+	e.sessionsLock.Lock()
+	if _, ok := e.running[request.Session]; ok {
+		e.sessionsLock.Unlock()
+		return // Request delivered twice
+	}
+	// A request can only be delivered again within its TTL, and a session
+	// ends within sessionTimeout, so older ones need not be remembered
+	for id, asked := range e.running {
+		if time.Since(asked) > sessionTimeout {
+			delete(e.running, id)
+		}
+	}
+	if len(e.running) >= maxRunning {
+		e.sessionsLock.Unlock()
+		log.Printf("[SUPPORT] Ignoring request from %s: too many sessions", peerIP)
+		return
+	}
+	e.running[request.Session] = time.Now()
+	e.sessionsLock.Unlock()
+
+	peerName := e.peerName(peerIP)
+	entry := auditEntry{Session: request.Session, Role: "target", Peer: peerIP, Label: peerName, Diagnostic: request.Diagnostic}
+	deny := func(reason string) {
+		log.Printf("[SUPPORT] Denied %s from %s (%s): %s", request.Diagnostic, peerName, peerIP, reason)
+		entry.Event, entry.Detail = "denied", reason
+		e.audit(entry)
+		if err := e.sendSignal(peerIP, supportSignal{Type: signalDenied, Session: request.Session, Reason: reason}); err != nil {
+			log.Printf("[SUPPORT] Failed to deny session %s: %v", request.Session, err)
+		}
+	}
+
+	d := findDiagnostic(request.Diagnostic)
+	if d == nil {
+		deny("unknown diagnostic")
+		return
+	}
+	if !e.trusted(peerIP) {
+		deny("not a trusted device")
+		return
+	}
+
+	entry.Event = "requested"
+	e.audit(entry)
+	log.Printf("[SUPPORT] %s (%s) asks to run %s", peerName, peerIP, d.ID)
+	if !askConsent(peerName, peerIP, d) {
+		deny("declined by the user")
+		return
+	}
+
+	entry.Event = "approved"
+	e.audit(entry)
+	if err := e.sendSignal(peerIP, supportSignal{Type: signalApproved, Session: request.Session}); err != nil {
+		log.Printf("[SUPPORT] Failed to approve session %s: %v", request.Session, err)
+		return
+	}
+
+	// The user can read exactly what was sent in the transcript
+	var transcript io.Writer = io.Discard
+	if file, err := os.OpenFile(filepath.Join(e.sessionsDir(), request.Session+".log"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err == nil {
+		defer file.Close()
+		fmt.Fprintf(file, "Remote support session %s\n%s for %s (%s), approved %s\n", request.Session, d.Label, peerName, peerIP, time.Now().Format(time.RFC1123))
+		transcript = file
+	}
+
+	stream := newOutputStream(e, peerIP, request.Session, transcript)
+	d.run(e.ctx, e.vpnClient, stream)
+	reason := ""
+	if e.ctx.Err() != nil {
+		reason = "support extension stopped"
+	}
+	sent := stream.close(reason)
+
+	entry.Event, entry.Detail = "finished", fmt.Sprintf("%d bytes sent", sent)
+	if reason != "" {
+		entry.Event, entry.Detail = "failed", reason
+	}
+	e.audit(entry)
+	log.Printf("[SUPPORT] Session %s for %s (%s) %s", request.Session, peerName, peerIP, entry.Event)
+	e.Notify("Remote support", fmt.Sprintf("%s sent to %s (%s)", d.Label, peerName, peerIP))
+}
+
+// consentMessage is the text of the consent prompt. The VPN address comes
+// first: the server assigned it, while the name is what the device claims.
+func consentMessage(peerName, peerIP string, d *diagnostic) string {
+	return fmt.Sprintf("The device at %s, which calls itself \"%s\", asks to run \"%s\" on this Mac.\n\nThis collects %s. The results are sent to %s and kept in your support history.",
+		peerIP, peerName, d.Label, d.Description, peerIP)
+}
+
+// askConsent shows the consent prompt. No answer counts as no.
+func askConsent(peerName, peerIP string, d *diagnostic) bool {
+	message := consentMessage(peerName, peerIP, d)
+	script := fmt.Sprintf("display dialog %s with title %s buttons {\"Deny\", \"Allow\"} default button \"Deny\" with icon caution giving up after %d",
+		framework.AppleScriptString(message), framework.AppleScriptString("Family VPN Remote Support"), int(consentTimeout.Seconds()))
+
+	output, err := exec.Command("osascript", "-e", script).Output()
+	if err != nil {
+		return false
+	}
+	result := string(output)
+	return strings.Contains(result, "button returned:Allow") && !strings.Contains(result, "gave up:true")
+}
+
+// outputStream sends what a diagnostic writes to the helper in numbered
+// signals and copies it to the local transcript
+type outputStream struct {
+	e          *SupportExtension
+	peerIP     string
+	session    string
+	transcript io.Writer
+	pending    []byte
+	seq        int // Signals sent
+	sent       int // Bytes sent or queued
+	truncated  bool
+	done       chan struct{}
+	lock       sync.Mutex
+}
+
+// newOutputStream starts sending output every flushInterval
+func newOutputStream(e *SupportExtension, peerIP, session string, transcript io.Writer) *outputStream {
+	s := &outputStream{e: e, peerIP: peerIP, session: session, transcript: transcript, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.lock.Lock()
+				s.flush()
+				s.lock.Unlock()
+			}
+		}
+	}()
+	return s
+}
+
+// Write queues output, up to maxOutput per session
+func (s *outputStream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := len(p)
+	s.transcript.Write(p)
+	if s.truncated {
+		return n, nil
+	}
+	if room := maxOutput - s.sent; len(p) > room {
+		p = append(p[:room:room], "\n[output truncated]\n"...)
+		s.truncated = true
+	}
+	s.pending = append(s.pending, p...)
+	s.sent += len(p)
+	if len(s.pending) >= chunkSize {
+		s.flush()
+	}
+	return n, nil
+}
+
+// flush sends the queued output. Callers hold the lock.
+func (s *outputStream) flush() {
+	for len(s.pending) > 0 {
+		n := chunkSize
+		for {
+			if n > len(s.pending) {
+				n = len(s.pending)
+			}
+			// Keep multi-byte characters in one piece
+			for n > 1 && n < len(s.pending) && !utf8.RuneStart(s.pending[n]) {
+				n--
+			}
+			data, _ := json.Marshal(supportSignal{Type: signalOutput, Session: s.session, Seq: s.seq, Data: string(s.pending[:n])})
+			if protocol.SignalPayloadSize(data) <= protocol.MaxSignalPayload || n <= 16 {
+				break
+			}
+			n /= 2 // Output that escapes badly (control characters)
+		}
+
+		err := s.e.sendSignal(s.peerIP, supportSignal{Type: signalOutput, Session: s.session, Seq: s.seq, Data: string(s.pending[:n])})
+		if err != nil {
+			log.Printf("[SUPPORT] Failed to send output of session %s: %v", s.session, err)
+		}
+		s.pending = s.pending[n:]
+		s.seq++
+	}
+}
+
+// close sends the remaining output and the end of the session. Returns the
+// number of bytes sent.
+func (s *outputStream) close(reason string) int {
+	close(s.done)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flush()
+	if err := s.e.sendSignal(s.peerIP, supportSignal{Type: signalEnd, Session: s.session, Seq: s.seq, Reason: reason}); err != nil {
+		log.Printf("[SUPPORT] Failed to end session %s: %v", s.session, err)
+	}
+	return s.sent
+}
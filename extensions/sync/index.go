@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// workDir is our own directory inside each shared folder (downloads in
+// progress, deleted files); it is never synced
+const workDir = ".family-sync"
+
+// Folder states reported in folderStatus
+const (
+	stateIdle     = "idle"
+	stateScanning = "scanning"
+	stateSyncing  = "syncing"
+	stateError    = "error"
+)
+
+// version is a version vector: how many changes each device made to a file.
+// Two versions where neither includes the other are a conflict.
+type version map[string]uint64
+
+// Results of version.compare
+const (
+	versionEqual = iota
+	versionNewer
+	versionOlder
+	versionConcurrent
+)
+
+// compare tells whether v is equal to, newer or older than other, or concurrent with it
+func (v version) compare(other version) int {
+	newer, older := false, false
+	for device, n := range v {
+		if n > other[device] {
+			newer = true
+		}
+	}
+	for device, n := range other {
+		if n > v[device] {
+			older = true
+		}
+	}
+	switch {
+	case newer && older:
+		return versionConcurrent
+	case newer:
+		return versionNewer
+	case older:
+		return versionOlder
+	}
+	return versionEqual
+}
+
+// bump returns a copy of v with one more change by device
+func (v version) bump(device string) version {
+	bumped := v.merge(nil)
+	bumped[device]++
+	return bumped
+}
+
+// merge returns the smallest version that includes both v and other
+func (v version) merge(other version) version {
+	merged := make(version, len(v))
+	for device, n := range v {
+		merged[device] = n
+	}
+	for device, n := range other {
+		if n > merged[device] {
+			merged[device] = n
+		}
+	}
+	return merged
+}
+
+// fileInfo is one file of a folder index. Entries are replaced, never modified,
+// so they can be shared with the HTTP handlers.
+type fileInfo struct {
+	Name       string   `json:"name"` // Slash-separated, relative to the folder
+	Size       int64    `json:"size"`
+	ModTime    int64    `json:"mod_time"` // Unix nanoseconds
+	Deleted    bool     `json:"deleted,omitempty"`
+	Blocks     []string `json:"blocks,omitempty"` // Hex SHA-256 per block
+	Version    version  `json:"version"`
+	ModifiedBy string   `json:"modified_by"` // Device that made this version
+	Sequence   int64    `json:"sequence"`    // When the serving device's index last changed for this file
+}
+
+// sameContent reports whether two entries describe the same data
+func (f *fileInfo) sameContent(other *fileInfo) bool {
+	if f.Deleted || other.Deleted {
+		return f.Deleted == other.Deleted
+	}
+	if f.Size != other.Size || len(f.Blocks) != len(other.Blocks) {
+		return false
+	}
+	for i := range f.Blocks {
+		if f.Blocks[i] != other.Blocks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// folderIndex is what we know about a folder, saved in the state directory
+type folderIndex struct {
+	Sequence int64                `json:"sequence"` // Highest Sequence in Files
+	Files    map[string]*fileInfo `json:"files"`
+	Remote   map[string]int64     `json:"remote"` // Device ID -> its highest Sequence we applied
+}
+
+// folder is a shared folder. Only its runFolder goroutine changes the index,
+// and it holds lock while doing so; HTTP handlers read under the lock.
+type folder struct {
+	folderConfig
+	root         string
+	indexPath    string
+	pullRequests chan protocol.PeerInfo
+
+	lock  sync.RWMutex
+	index *folderIndex
+
+	statusLock sync.Mutex
+	status     folderStatus
+}
+
+// folderStatus is a folder's part of the health endpoint's status
+type folderStatus struct {
+	ID           string       `json:"id"`
+	Label        string       `json:"label"`
+	Path         string       `json:"path"`
+	State        string       `json:"state"`
+	Files        int          `json:"files"`
+	Bytes        int64        `json:"bytes"`
+	LastScan     time.Time    `json:"last_scan"`
+	Conflicts    int          `json:"conflicts"`     // Conflict copies made since start
+	BytesFetched int64        `json:"bytes_fetched"` // Downloaded from peers since start
+	BytesReused  int64        `json:"bytes_reused"`  // Of updated files, already here
+	Peers        []peerStatus `json:"peers"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// peerStatus is how far along we are with one peer's copy of a folder
+type peerStatus struct {
+	Name     string    `json:"name"`
+	Device   string    `json:"device"`
+	InSync   bool      `json:"in_sync"` // We have applied all of its changes
+	LastSync time.Time `json:"last_sync"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// openFolder loads the index of a configured folder
+func (e *SyncExtension) openFolder(fc folderConfig) (*folder, error) {
+	if fc.ID == "" || strings.ContainsAny(fc.ID, `/\`) || fc.Path == "" {
+		return nil, errors.New("id and path are required")
+	}
+	if len(fc.Peers) == 0 {
+		return nil, errors.New("not shared with any peer")
+	}
+	if fc.Label == "" {
+		fc.Label = fc.ID
+	}
+
+	f := &folder{
+		folderConfig: fc,
+		root:         expandHome(fc.Path),
+		indexPath:    filepath.Join(e.stateDir, fc.ID+".json"),
+		pullRequests: make(chan protocol.PeerInfo, 1),
+	}
+	if err := os.MkdirAll(filepath.Join(f.root, workDir, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+
+	var index folderIndex
+	if err := framework.ReadJSONFile(f.indexPath, &index); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*fileInfo)
+	}
+	if index.Remote == nil {
+		index.Remote = make(map[string]int64)
+	}
+	f.index = &index
+
+	f.status = folderStatus{ID: f.ID, Label: f.Label, Path: f.root, State: stateIdle, Peers: []peerStatus{}}
+	return f, nil
+}
+
+// sharedWith reports whether the folder is shared with the peer at a VPN
+// address. Shares name addresses rather than hostnames: the server assigns
+// addresses (and gives a device its own back), while hostnames are whatever
+// a peer claims.
+func (f *folder) sharedWith(address string) bool {
+	for _, peer := range f.Peers {
+		if peer == "*" || peer == address {
+			return true
+		}
+	}
+	return false
+}
+
+// sequence returns the current sequence of the index
+func (f *folder) sequence() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.index.Sequence
+}
+
+// file returns the index entry for a name, or nil
+func (f *folder) file(name string) *fileInfo {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.index.Files[name]
+}
+
+// changesSince returns the entries that changed after a sequence, oldest first
+func (f *folder) changesSince(since int64) []*fileInfo {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	changes := []*fileInfo{}
+	for _, file := range f.index.Files {
+		if file.Sequence > since {
+			changes = append(changes, file)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Sequence < changes[j].Sequence })
+	return changes
+}
+
+// record puts entries in the index under new sequence numbers, so peers pull them from us
+func (f *folder) record(files ...*fileInfo) {
+	f.lock.Lock()
+	for _, file := range files {
+		f.index.Sequence++
+		file.Sequence = f.index.Sequence
+		f.index.Files[file.Name] = file
+	}
+	f.lock.Unlock()
+}
+
+// save writes the index to the state directory
+func (f *folder) save() error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return framework.WriteJSONFile(f.indexPath, f.index)
+}
+
+// localPath returns where a file of the index lives on disk
+func (f *folder) localPath(name string) string {
+	return filepath.Join(f.root, filepath.FromSlash(name))
+}
+
+// validName reports whether a name from a peer stays inside the folder
+func validName(name string) bool {
+	if name == "" || strings.Contains(name, `\`) || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == workDir {
+			return false
+		}
+	}
+	return true
+}
+
+// validDeviceID reports whether a device ID from a peer has the format
+// loadDeviceID creates (16 lowercase hex digits). Device IDs end up in file
+// names (conflict copies), so nothing else may pass.
+func validDeviceID(device string) bool {
+	if len(device) != 16 {
+		return false
+	}
+	for _, c := range device {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validEntry checks an entry of a peer's index, including the name it would
+// get as a conflict copy
+func validEntry(remote *fileInfo) error {
+	if !validName(remote.Name) {
+		return fmt.Errorf("invalid name %q", remote.Name)
+	}
+	if !validDeviceID(remote.ModifiedBy) {
+		return fmt.Errorf("%s: invalid device %q", remote.Name, remote.ModifiedBy)
+	}
+	for device := range remote.Version {
+		if !validDeviceID(device) {
+			return fmt.Errorf("%s: invalid device %q in version", remote.Name, device)
+		}
+	}
+	if !remote.Deleted && int64(len(remote.Blocks)) != (remote.Size+blockSize-1)/blockSize {
+		return fmt.Errorf("%s: %d blocks for %d bytes", remote.Name, len(remote.Blocks), remote.Size)
+	}
+	if !validName(conflictCopyName(remote)) {
+		return fmt.Errorf("%s: invalid conflict name", remote.Name)
+	}
+	return nil
+}
+
+// ignored reports whether a file is left out of syncing
+func ignored(name string) bool {
+	return name == workDir || name == ".DS_Store" || strings.HasPrefix(name, "._")
+}
+
+// scan walks the folder and records files that were added, changed or
+// deleted since the last scan. Returns the number of changes.
+func (f *folder) scan(device string) (int, error) {
+	if _, err := os.Stat(f.root); err != nil {
+		return 0, err // Unmounted volumes must not look like everything was deleted
+	}
+
+	var changes, touched []*fileInfo
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Unreadable entries are retried on the next scan
+		}
+		if p == f.root {
+			return nil
+		}
+		if ignored(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil // Directories are implied by files; links aren't synced
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(f.root, p)
+		name := filepath.ToSlash(rel)
+		seen[name] = true
+
+		existing := f.file(name)
+		if existing != nil && !existing.Deleted && existing.Size == info.Size() && existing.ModTime == info.ModTime().UnixNano() {
+			return nil
+		}
+
+		blocks, err := hashBlocks(p)
+		if err != nil {
+			return nil
+		}
+		file := &fileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Blocks: blocks}
+		if existing != nil && file.sameContent(existing) {
+			// Only touched: keep the version, just remember the new time
+			touchedFile := *existing
+			touchedFile.ModTime = file.ModTime
+			touched = append(touched, &touchedFile)
+			return nil
+		}
+
+		var previous version
+		if existing != nil {
+			previous = existing.Version
+		}
+		file.Version = previous.bump(device)
+		file.ModifiedBy = device
+		changes = append(changes, file)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	f.lock.RLock()
+	for name, existing := range f.index.Files {
+		if !existing.Deleted && !seen[name] {
+			changes = append(changes, &fileInfo{
+				Name:       name,
+				ModTime:    time.Now().UnixNano(),
+				Deleted:    true,
+				Version:    existing.Version.bump(device),
+				ModifiedBy: device,
+			})
+		}
+	}
+	f.lock.RUnlock()
+
+	if len(changes) == 0 && len(touched) == 0 {
+		return 0, nil
+	}
+	f.lock.Lock()
+	for _, file := range touched {
+		f.index.Files[file.Name] = file
+	}
+	f.lock.Unlock()
+	f.record(changes...)
+	return len(changes), f.save()
+}
+
+// unchanged reports whether a file on disk still matches its index entry,
+// so it can be replaced without losing an edit the last scan didn't see
+func (f *folder) unchanged(file *fileInfo) bool {
+	info, err := os.Stat(f.localPath(file.Name))
+	if file.Deleted {
+		return os.IsNotExist(err)
+	}
+	return err == nil && info.Size() == file.Size && info.ModTime().UnixNano() == file.ModTime
+}
+
+// hashBlocks returns the SHA-256 of each block of a file
+func hashBlocks(p string) ([]string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	blocks := []string{}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			blocks = append(blocks, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// snapshot returns the folder's status with its current totals
+func (f *folder) snapshot() folderStatus {
+	f.lock.RLock()
+	files, bytes := 0, int64(0)
+	for _, file := range f.index.Files {
+		if !file.Deleted {
+			files++
+			bytes += file.Size
+		}
+	}
+	f.lock.RUnlock()
+
+	f.statusLock.Lock()
+	defer f.statusLock.Unlock()
+	status := f.status
+	status.Files = files
+	status.Bytes = bytes
+	status.Peers = append([]peerStatus{}, f.status.Peers...)
+	return status
+}
+
+// updateStatus changes the folder's status under its lock
+func (f *folder) updateStatus(update func(status *folderStatus)) {
+	f.statusLock.Lock()
+	update(&f.status)
+	f.statusLock.Unlock()
+}
+
+// setState records what the folder is doing
+func (f *folder) setState(state string) {
+	f.updateStatus(func(status *folderStatus) { status.State = state })
+}
+
+// setError records a failure of the last scan or sync
+func (f *folder) setError(err error) {
+	f.updateStatus(func(status *folderStatus) {
+		status.State = stateError
+		status.Error = err.Error()
+	})
+}
+
+// scanned records a successful scan
+func (f *folder) scanned() {
+	f.updateStatus(func(status *folderStatus) {
+		status.State = stateIdle
+		status.Error = ""
+		status.LastScan = time.Now()
+	})
+}
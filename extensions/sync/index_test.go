@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"notes.txt", true},
+		{"photos/2024/beach.jpg", true},
+		{".hidden", true},
+		{"a..b", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../outside", false},
+		{"photos/../../outside", false},
+		{"photos/..", false},
+		{"..", false},
+		{"./notes.txt", false},
+		{"photos//beach.jpg", false},
+		{"photos/", false},
+		{`photos\beach.jpg`, false},
+		{`..\outside`, false},
+		{workDir, false},
+		{workDir + "/trash/notes.txt", false},
+		{"photos/" + workDir + "/x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validName(tt.name); got != tt.want {
+				t.Errorf("validName(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidEntry(t *testing.T) {
+	const device = "0123456789abcdef"
+	tests := []struct {
+		name    string
+		entry   fileInfo
+		wantErr bool
+	}{
+		{"valid", fileInfo{Name: "notes.txt", Size: 1, Blocks: []string{"x"}, Version: version{device: 1}, ModifiedBy: device}, false},
+		{"deleted", fileInfo{Name: "notes.txt", Deleted: true, Version: version{device: 2}, ModifiedBy: device}, false},
+		{"escaping name", fileInfo{Name: "../notes.txt", Version: version{device: 1}, ModifiedBy: device, Deleted: true}, true},
+		{"device with a path", fileInfo{Name: "notes.txt", Deleted: true, Version: version{device: 1}, ModifiedBy: "../../../../tmp/x"}, true},
+		{"bad device in version", fileInfo{Name: "notes.txt", Deleted: true, Version: version{"/x": 1}, ModifiedBy: device}, true},
+		{"blocks don't match size", fileInfo{Name: "notes.txt", Size: blockSize + 1, Blocks: []string{"x"}, Version: version{device: 1}, ModifiedBy: device}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validEntry(&tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		v, other version
+		want     int
+	}{
+		{"both empty", version{}, version{}, versionEqual},
+		{"equal", version{"a": 1, "b": 2}, version{"a": 1, "b": 2}, versionEqual},
+		{"missing counts as zero", version{"a": 1, "b": 0}, version{"a": 1}, versionEqual},
+		{"newer", version{"a": 2}, version{"a": 1}, versionNewer},
+		{"newer by another device", version{"a": 1, "b": 1}, version{"a": 1}, versionNewer},
+		{"newer than nothing", version{"a": 1}, nil, versionNewer},
+		{"older", version{"a": 1}, version{"a": 1, "b": 1}, versionOlder},
+		{"concurrent", version{"a": 2, "b": 1}, version{"a": 1, "b": 2}, versionConcurrent},
+		{"concurrent devices", version{"a": 1}, version{"b": 1}, versionConcurrent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.v.compare(tt.other); got != tt.want {
+				t.Errorf("compare() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionBumpAndMerge(t *testing.T) {
+	v := version{"a": 1}
+	bumped := v.bump("b")
+	if v["b"] != 0 {
+		t.Error("bump modified the original version")
+	}
+	if bumped.compare(v) != versionNewer {
+		t.Errorf("bumped version %v is not newer than %v", bumped, v)
+	}
+
+	other := version{"a": 3}
+	merged := bumped.merge(other)
+	if merged.compare(bumped) != versionNewer || merged.compare(other) != versionNewer {
+		t.Errorf("merge %v does not include %v and %v", merged, bumped, other)
+	}
+	if want := (version{"a": 3, "b": 1}); merged.compare(want) != versionEqual {
+		t.Errorf("merge = %v, want %v", merged, want)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/extensions/framework"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	blockSize     = 128 << 10        // Bytes per hashed block
+	scanInterval  = 10 * time.Second // How often folders are checked for local changes
+	pullInterval  = time.Minute      // How often peers are polled in case a signal was missed
+	peersCacheTTL = 10 * time.Second // How long GetPeers results are reused
+	httpTimeout   = 60 * time.Second
+)
+
+// syncSignal tells the peers sharing a folder that our copy changed; they
+// pull the changes over HTTP (see pull.go)
+type syncSignal struct {
+	Folder   string `json:"folder"`
+	Sequence int64  `json:"sequence"`
+}
+
+// folderConfig is a shared folder in the config file. Every peer sharing it
+// uses the same ID; paths may differ.
+type folderConfig struct {
+	ID    string   `json:"id"`
+	Label string   `json:"label"`
+	Path  string   `json:"path"`  // "~/" is expanded
+	Peers []string `json:"peers"` // VPN addresses to sync with; "*" is everyone running sync
+}
+
+// syncConfig is the extension's config file
+type syncConfig struct {
+	Folders []folderConfig `json:"folders"`
+}
+
+// SyncExtension keeps shared folders in sync with the same folders on other peers
+type SyncExtension struct {
+	*framework.ExtensionBase
+	vpnClient  *ipc.VPNClient
+	port       int
+	configPath string
+	stateDir   string
+	device     string // Random ID of this device, used in file versions
+	hostname   string
+	server     *http.Server
+	httpClient *http.Client
+	cancel     context.CancelFunc // Ends the signal subscription and folder loops
+
+	folders map[string]*folder
+
+	peersLock    sync.Mutex
+	peersCache   []protocol.PeerInfo
+	peersFetched time.Time
+}
+
+// NewSyncExtension creates a new folder sync extension
+func NewSyncExtension(vpnPort int, configPath, stateDir string) *SyncExtension {
+	hostname, _ := os.Hostname()
+	e := &SyncExtension{
+		ExtensionBase: framework.NewExtensionBase("sync", "1.0.0"),
+		vpnClient:     ipc.NewVPNClient(vpnPort),
+		port:          8893,
+		configPath:    configPath,
+		stateDir:      stateDir,
+		hostname:      hostname,
+		httpClient:    &http.Client{Timeout: httpTimeout},
+		folders:       make(map[string]*folder),
+	}
+	e.SetVPNClient(e.vpnClient)
+	return e
+}
+
+// Start starts the folder sync extension
+func (e *SyncExtension) Start() error {
+	// Check VPN core is running
+	if err := e.vpnClient.Health(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", e.stateDir, err)
+	}
+	device, err := e.loadDeviceID()
+	if err != nil {
+		return fmt.Errorf("failed to load device ID: %v", err)
+	}
+	e.device = device
+
+	config, err := e.loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, fc := range config.Folders {
+		f, err := e.openFolder(fc)
+		if err != nil {
+			log.Printf("[SYNC] Skipping folder %q: %v", fc.ID, err)
+			continue
+		}
+		e.folders[f.ID] = f
+	}
+	if len(e.folders) == 0 {
+		log.Printf("[SYNC] No shared folders; add them to %s", e.configPath)
+	}
+
+	// Peers pull indexes and blocks from us over the VPN
+	mux := http.NewServeMux()
+	mux.HandleFunc("/folders/", e.handleFolder)
+	e.server = &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", e.port), Handler: mux}
+
+	log.Printf("[SYNC] Serving %d folder(s) as device %s on http://%s (accessible via VPN)", len(e.folders), e.device, e.server.Addr)
+	e.SetEndpoint("data", fmt.Sprintf("http://127.0.0.1:%d", e.port))
+
+	go func() {
+		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[SYNC] Server error: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.monitorSignals(ctx)
+	for _, f := range e.folders {
+		go e.runFolder(ctx, f)
+	}
+
+	return nil
+}
+
+// Stop stops the extension. A transfer in progress is retried on the next start.
+func (e *SyncExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return e.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// Health returns true if extension is healthy
+func (e *SyncExtension) Health() bool {
+	if e.vpnClient == nil {
+		return false
+	}
+	return e.vpnClient.Health() == nil
+}
+
+// Status reports the sync state of every folder on the health endpoint
+func (e *SyncExtension) Status() interface{} {
+	status := struct {
+		Device  string         `json:"device"`
+		Folders []folderStatus `json:"folders"`
+	}{Device: e.device, Folders: []folderStatus{}}
+
+	for _, f := range e.folders {
+		status.Folders = append(status.Folders, f.snapshot())
+	}
+	sort.Slice(status.Folders, func(i, j int) bool { return status.Folders[i].ID < status.Folders[j].ID })
+	return status
+}
+
+// loadConfig reads the shared folders, writing an example config on first start
+func (e *SyncExtension) loadConfig() (*syncConfig, error) {
+	var config syncConfig
+	err := framework.ReadJSONFile(e.configPath, &config)
+	if os.IsNotExist(err) {
+		// Not shared with anyone until peers are added
+		config.Folders = []folderConfig{{ID: "family-photos", Label: "Family Photos", Path: "~/Family Photos", Peers: []string{}}}
+		if err := framework.WriteJSONFile(e.configPath, &config); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", e.configPath, err)
+		}
+		return &config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", e.configPath, err)
+	}
+	return &config, nil
+}
+
+// loadDeviceID returns this device's ID, creating it on first start. It is
+// not the hostname so that renaming a machine doesn't fork file versions.
+func (e *SyncExtension) loadDeviceID() (string, error) {
+	path := filepath.Join(e.stateDir, "device-id")
+	if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	device := hex.EncodeToString(id)
+	return device, os.WriteFile(path, []byte(device+"\n"), 0600)
+}
+
+// peers returns the VPN peers, cached briefly since every block request checks them
+func (e *SyncExtension) peers() ([]protocol.PeerInfo, error) {
+	e.peersLock.Lock()
+	defer e.peersLock.Unlock()
+
+	if time.Since(e.peersFetched) < peersCacheTTL {
+		return e.peersCache, nil
+	}
+	peers, err := e.vpnClient.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	e.peersCache = peers
+	e.peersFetched = time.Now()
+	return peers, nil
+}
+
+// folderPeers returns the connected peers running sync that a folder is shared with
+func (e *SyncExtension) folderPeers(f *folder) []protocol.PeerInfo {
+	peers, err := e.peers()
+	if err != nil {
+		log.Printf("[SYNC] Failed to get peers: %v", err)
+		return nil
+	}
+
+	var shared []protocol.PeerInfo
+	for _, peer := range peers {
+		if peer.Hostname == e.hostname || !peer.RunsExtension(e.Name()) || !f.sharedWith(peer.VPNAddress) {
+			continue
+		}
+		shared = append(shared, peer)
+	}
+	return shared
+}
+
+// peerByAddress returns the connected peer with a VPN address, or nil
+func (e *SyncExtension) peerByAddress(address string) *protocol.PeerInfo {
+	peers, err := e.peers()
+	if err != nil {
+		return nil
+	}
+	for i := range peers {
+		if peers[i].VPNAddress == address {
+			return &peers[i]
+		}
+	}
+	return nil
+}
+
+// announce tells the peers sharing a folder that it changed. Peers that miss
+// it catch up on their next poll, so delivery isn't tracked.
+func (e *SyncExtension) announce(f *folder) {
+	data, err := json.Marshal(syncSignal{Folder: f.ID, Sequence: f.sequence()})
+	if err != nil {
+		return
+	}
+	for _, peer := range e.folderPeers(f) {
+		if err := e.vpnClient.SendSignal(e.Name(), peer.VPNAddress, data); err != nil {
+			log.Printf("[SYNC] Failed to notify %s of changes to %s: %v", peer.Hostname, f.Label, err)
+		}
+	}
+}
+
+// monitorSignals queues a pull whenever a peer announces changes, until ctx is cancelled
+func (e *SyncExtension) monitorSignals(ctx context.Context) {
+	log.Printf("[SYNC] Subscribing to sync signals via IPC")
+
+	err := e.vpnClient.SubscribeToSignals(ctx, e.Name(), func(peerIP string, data []byte) {
+		var signal syncSignal
+		if err := json.Unmarshal(data, &signal); err != nil {
+			log.Printf("[SYNC] Ignoring invalid signal from %s", peerIP)
+			return
+		}
+
+		// peerIP is the server-stamped sender
+		f, exists := e.folders[signal.Folder]
+		if !exists {
+			return
+		}
+		peer := e.peerByAddress(peerIP)
+		if peer == nil || !f.sharedWith(peer.VPNAddress) {
+			log.Printf("[SYNC] Ignoring changes to %s from %s: not shared with it", signal.Folder, peerIP)
+			return
+		}
+
+		select {
+		case f.pullRequests <- *peer:
+		default: // A pull is already queued
+		}
+	})
+
+	if err != nil {
+		log.Printf("[SYNC] Error subscribing to signals: %v", err)
+	}
+}
+
+// runFolder scans a folder for local changes and pulls remote ones until ctx
+// is cancelled. Everything that modifies the folder happens here, one step at a time.
+func (e *SyncExtension) runFolder(ctx context.Context, f *folder) {
+	if e.scanFolder(f) {
+		e.announce(f)
+	}
+	e.pullAll(f)
+
+	scanTicker := time.NewTicker(scanInterval)
+	defer scanTicker.Stop()
+	pullTicker := time.NewTicker(pullInterval)
+	defer pullTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scanTicker.C:
+			if e.scanFolder(f) {
+				e.announce(f)
+			}
+		case <-pullTicker.C:
+			e.pullAll(f)
+		case peer := <-f.pullRequests:
+			e.scanFolder(f)
+			e.pull(f, peer)
+		}
+	}
+}
+
+// scanFolder records local changes. Returns true if there were any.
+func (e *SyncExtension) scanFolder(f *folder) bool {
+	f.setState(stateScanning)
+	changed, err := f.scan(e.device)
+	if err != nil {
+		log.Printf("[SYNC] Failed to scan %s: %v", f.Label, err)
+		f.setError(err)
+		return false
+	}
+	f.scanned()
+	if changed > 0 {
+		log.Printf("[SYNC] %d local change(s) in %s", changed, f.Label)
+	}
+	return changed > 0
+}
+
+// expandHome expands a leading "~/" in a configured path
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, strings.TrimPrefix(path, "~"))
+	}
+	return path
+}
+
+func main() {
+	configDir, _ := os.UserConfigDir()
+	stateDir := filepath.Join(configDir, "family-vpn", "sync")
+
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
+	configPath := flag.String("config", filepath.Join(stateDir, "folders.json"), "Shared folders")
+	flag.StringVar(&stateDir, "state-dir", stateDir, "Where folder indexes are kept")
+	flag.Parse()
+
+	ext := NewSyncExtension(*vpnPort, *configPath, stateDir)
+	if err := ext.Run(ext); err != nil {
+		log.Fatalf("Extension failed: %v", err)
+	}
+}
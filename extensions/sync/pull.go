@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// indexPage is served by GET /folders/<id> (without Files) and
+// GET /folders/<id>/index?since=<sequence>
+type indexPage struct {
+	Device   string      `json:"device"`
+	Sequence int64       `json:"sequence"`
+	Files    []*fileInfo `json:"files,omitempty"` // Changed since the requested sequence, oldest first
+}
+
+// errLocalChange skips a remote change to a file that was edited here after the last scan
+var errLocalChange = errors.New("changed locally since the last scan")
+
+// handleFolder serves a folder to the peers it is shared with:
+// GET /folders/<id> returns the device and sequence,
+// GET /folders/<id>/index?since=<n> the entries changed after sequence n and
+// GET /folders/<id>/blocks/<n>?name=<name>&hash=<sha256> block n of a file
+func (e *SyncExtension) handleFolder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/folders/"), "/")
+	remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// Unknown, and not shared with the caller, look the same
+	f, exists := e.folders[parts[0]]
+	peer := e.peerByAddress(remoteIP)
+	if !exists || peer == nil || !f.sharedWith(peer.VPNAddress) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(indexPage{Device: e.device, Sequence: f.sequence()})
+
+	case len(parts) == 2 && parts[1] == "index":
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		page := indexPage{Device: e.device, Sequence: f.sequence()}
+		if since > page.Sequence {
+			since = 0 // Our index was reset; the peer needs all of it
+		}
+		page.Files = f.changesSince(since)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+
+	case len(parts) == 3 && parts[1] == "blocks":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 {
+			http.Error(w, "Invalid block", http.StatusBadRequest)
+			return
+		}
+		e.serveBlock(w, f, r.URL.Query().Get("name"), index, r.URL.Query().Get("hash"))
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// serveBlock writes one block of a file, if it still has the expected hash
+func (e *SyncExtension) serveBlock(w http.ResponseWriter, f *folder, name string, index int, hash string) {
+	file := f.file(name)
+	if file == nil || file.Deleted || index >= len(file.Blocks) || file.Blocks[index] != hash || !f.unchanged(file) {
+		http.Error(w, "Block no longer available", http.StatusGone)
+		return
+	}
+
+	data, err := readBlock(f.localPath(name), file.Size, index)
+	if err != nil {
+		http.Error(w, "Block no longer available", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// readBlock reads block n of a file of the given size
+func readBlock(p string, size int64, index int) ([]byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	offset := int64(index) * blockSize
+	length := int64(blockSize)
+	if remaining := size - offset; remaining < length {
+		length = remaining
+	}
+	if length <= 0 {
+		return nil, io.EOF
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pullAll pulls a folder's changes from every peer it is shared with
+func (e *SyncExtension) pullAll(f *folder) {
+	for _, peer := range e.folderPeers(f) {
+		e.pull(f, peer)
+	}
+}
+
+// pull applies the changes a peer made since we last pulled from it, and
+// records the outcome in the folder status
+func (e *SyncExtension) pull(f *folder, peer protocol.PeerInfo) {
+	f.setState(stateSyncing)
+	device, inSync, err := e.pullChanges(f, peer)
+	if err != nil {
+		log.Printf("[SYNC] Failed to sync %s with %s: %v", f.Label, peer.Hostname, err)
+	}
+
+	f.updateStatus(func(status *folderStatus) {
+		if status.State == stateSyncing {
+			status.State = stateIdle
+		}
+		ps := peerStatus{Name: peer.Hostname, Device: device, InSync: inSync && err == nil}
+		if err != nil {
+			ps.Error = err.Error()
+		}
+		for i := range status.Peers {
+			if status.Peers[i].Name == peer.Hostname {
+				ps.LastSync = status.Peers[i].LastSync
+				status.Peers = append(status.Peers[:i], status.Peers[i+1:]...)
+				break
+			}
+		}
+		if err == nil {
+			ps.LastSync = time.Now()
+		}
+		status.Peers = append(status.Peers, ps)
+	})
+}
+
+// pullChanges fetches a peer's index changes and applies them in order. The
+// peer's sequence we have applied only moves past changes that succeeded, so
+// failed ones are retried on the next pull. Returns the peer's device ID and
+// whether we caught up with it.
+func (e *SyncExtension) pullChanges(f *folder, peer protocol.PeerInfo) (string, bool, error) {
+	base := fmt.Sprintf("http://%s:%d/folders/%s", peer.VPNAddress, e.port, url.PathEscape(f.ID))
+
+	var summary indexPage
+	if err := e.getJSON(base, &summary); err != nil {
+		return "", false, err
+	}
+	if !validDeviceID(summary.Device) || summary.Device == e.device {
+		return summary.Device, false, fmt.Errorf("invalid device %q", summary.Device)
+	}
+
+	f.lock.RLock()
+	since := f.index.Remote[summary.Device]
+	f.lock.RUnlock()
+	if since == summary.Sequence {
+		return summary.Device, true, nil
+	}
+
+	var page indexPage
+	if err := e.getJSON(fmt.Sprintf("%s/index?since=%d", base, since), &page); err != nil {
+		return summary.Device, false, err
+	}
+	if page.Device != summary.Device {
+		return summary.Device, false, errors.New("peer changed device ID")
+	}
+
+	// One bad entry means a broken or hostile peer: apply nothing
+	for _, remote := range page.Files {
+		if err := validEntry(remote); err != nil {
+			return page.Device, false, fmt.Errorf("rejected index: %v", err)
+		}
+	}
+
+	applied := page.Sequence
+	var firstErr error
+	for _, remote := range page.Files {
+		if err := e.apply(f, base, remote); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", remote.Name, err)
+				applied = remote.Sequence - 1
+			}
+		}
+	}
+
+	f.lock.Lock()
+	f.index.Remote[page.Device] = applied
+	f.lock.Unlock()
+	if err := f.save(); err != nil {
+		return page.Device, false, fmt.Errorf("failed to save index: %v", err)
+	}
+	return page.Device, firstErr == nil, firstErr
+}
+
+// apply brings a remote entry into the folder. Changes that include ours
+// replace our copy; concurrent ones are a conflict and keep both versions.
+// The caller saves the index.
+func (e *SyncExtension) apply(f *folder, base string, remote *fileInfo) error {
+	local := f.file(remote.Name)
+	if local == nil {
+		if _, err := os.Lstat(f.localPath(remote.Name)); err == nil {
+			return errLocalChange // Created after the last scan
+		}
+		if !remote.Deleted {
+			if err := e.download(f, base, remote, nil, remote.Name); err != nil {
+				return err
+			}
+		}
+		f.record(adopted(remote, remote.Version))
+		return nil
+	}
+
+	comparison := remote.Version.compare(local.Version)
+	if comparison == versionEqual || comparison == versionOlder {
+		return nil // Nothing we don't have
+	}
+	if !f.unchanged(local) {
+		return errLocalChange
+	}
+
+	merged := remote.Version.merge(local.Version)
+	switch {
+	case remote.sameContent(local):
+		// Same data reached both sides; just settle on one version
+		settled := adopted(remote, merged)
+		settled.ModTime = local.ModTime
+		f.record(settled)
+
+	case comparison == versionNewer:
+		if err := e.replace(f, base, remote, local); err != nil {
+			return err
+		}
+		f.record(adopted(remote, merged))
+
+	case remote.Deleted:
+		// Deleted there, edited here: the edit wins
+		kept := *local
+		kept.Version = merged
+		f.record(&kept)
+
+	case local.Deleted:
+		// Edited there, deleted here: the edit wins
+		if err := e.download(f, base, remote, nil, remote.Name); err != nil {
+			return err
+		}
+		f.record(adopted(remote, merged))
+
+	default:
+		if err := e.resolveConflict(f, base, remote, local, merged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace swaps our copy of a file for a newer remote version
+func (e *SyncExtension) replace(f *folder, base string, remote, local *fileInfo) error {
+	if remote.Deleted {
+		return f.trash(local.Name)
+	}
+	return e.download(f, base, remote, local, remote.Name)
+}
+
+// resolveConflict keeps both of two concurrent edits. Both peers pick the same
+// winner (the most recent edit) and give the other a conflict name, so they
+// end up with the same two files.
+func (e *SyncExtension) resolveConflict(f *folder, base string, remote, local *fileInfo, merged version) error {
+	remoteWins := remote.ModTime > local.ModTime || (remote.ModTime == local.ModTime && remote.ModifiedBy > local.ModifiedBy)
+	if remoteWins {
+		conflictName := conflictCopyName(local)
+		if !validName(conflictName) {
+			return fmt.Errorf("invalid conflict name %q", conflictName)
+		}
+		log.Printf("[SYNC] Conflict on %s in %s: keeping our version as %s", local.Name, f.Label, conflictName)
+		if err := os.Rename(f.localPath(local.Name), f.localPath(conflictName)); err != nil {
+			return err
+		}
+		// The conflict copy is picked up as a new file by the next scan
+		if err := e.download(f, base, remote, nil, remote.Name); err != nil {
+			return err
+		}
+		f.record(adopted(remote, merged))
+	} else {
+		conflictName := conflictCopyName(remote)
+		if !validName(conflictName) {
+			return fmt.Errorf("invalid conflict name %q", conflictName)
+		}
+		log.Printf("[SYNC] Conflict on %s in %s: keeping the peer's version as %s", local.Name, f.Label, conflictName)
+		if err := e.download(f, base, remote, nil, conflictName); err != nil {
+			return err
+		}
+		kept := *local
+		kept.Version = merged
+		f.record(&kept)
+	}
+
+	f.updateStatus(func(status *folderStatus) { status.Conflicts++ })
+	return nil
+}
+
+// conflictCopyName names the losing version of a conflict after its device
+// and time, e.g. "IMG_1.sync-conflict-20240102-150405-ab12cd34.jpg"
+func conflictCopyName(file *fileInfo) string {
+	ext := path.Ext(file.Name)
+	stamp := time.Unix(0, file.ModTime).UTC().Format("20060102-150405")
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", strings.TrimSuffix(file.Name, ext), stamp, file.ModifiedBy, ext)
+}
+
+// adopted returns our index entry for a remote file we now have
+func adopted(remote *fileInfo, v version) *fileInfo {
+	file := *remote
+	file.Version = v
+	return &file
+}
+
+// trash moves a file deleted by a peer into the folder's work directory
+// instead of removing it, so an accidental delete can be undone
+func (f *folder) trash(name string) error {
+	dest := filepath.Join(f.root, workDir, "trash", time.Now().Format("20060102-150405"), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(f.localPath(name), dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// download writes a remote file to dest (a name in the folder). Blocks that
+// our copy (local, may be nil) already has are copied from it; only the
+// others are fetched from the peer.
+func (e *SyncExtension) download(f *folder, base string, remote, local *fileInfo, dest string) error {
+	tmpFile, err := os.CreateTemp(filepath.Join(f.root, workDir, "tmp"), "download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	have := make(map[string]int)
+	if local != nil && !local.Deleted {
+		for i, hash := range local.Blocks {
+			have[hash] = i
+		}
+	}
+
+	var fetched, reused int64
+	for i, hash := range remote.Blocks {
+		var data []byte
+		if n, exists := have[hash]; exists {
+			data, err = readBlock(f.localPath(local.Name), local.Size, n)
+			if err != nil || blockHash(data) != hash {
+				data = nil // Our copy changed; fall back to the peer
+			}
+		}
+		if data != nil {
+			reused += int64(len(data))
+		} else {
+			data, err = e.fetchBlock(base, remote, i)
+			if err != nil {
+				return err
+			}
+			fetched += int64(len(data))
+		}
+		if _, err := tmpFile.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	destPath := f.localPath(dest)
+	modTime := time.Unix(0, remote.ModTime)
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmpFile.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), destPath); err != nil {
+		return err
+	}
+
+	f.updateStatus(func(status *folderStatus) {
+		status.BytesFetched += fetched
+		status.BytesReused += reused
+	})
+	log.Printf("[SYNC] Updated %s in %s (%d bytes fetched, %d reused)", dest, f.Label, fetched, reused)
+	return nil
+}
+
+// fetchBlock downloads and checks block n of a remote file
+func (e *SyncExtension) fetchBlock(base string, remote *fileInfo, index int) ([]byte, error) {
+	query := url.Values{"name": {remote.Name}, "hash": {remote.Blocks[index]}}
+	resp, err := e.httpClient.Get(fmt.Sprintf("%s/blocks/%d?%s", base, index, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("block %d: status %d", index, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, blockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if blockHash(data) != remote.Blocks[index] {
+		return nil, fmt.Errorf("block %d: checksum mismatch", index)
+	}
+	return data, nil
+}
+
+// blockHash returns the hex SHA-256 of a block
+func blockHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// getJSON fetches a JSON document from a peer
+func (e *SyncExtension) getJSON(u string, v interface{}) error {
+	resp, err := e.httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os/exec"
 
@@ -16,14 +18,17 @@ type VideoExtension struct {
 	*framework.ExtensionBase
 	vpnClient   *ipc.VPNClient
 	videoServer *videocall.VideoServer
+	cancel      context.CancelFunc // Ends the signal subscription
 }
 
 // NewVideoExtension creates a new video calling extension
 func NewVideoExtension(vpnPort int) *VideoExtension {
-	return &VideoExtension{
+	e := &VideoExtension{
 		ExtensionBase: framework.NewExtensionBase("video", "1.0.0"),
 		vpnClient:     ipc.NewVPNClient(vpnPort),
 	}
+	e.SetVPNClient(e.vpnClient)
+	return e
 }
 
 // Start starts the video extension
@@ -38,7 +43,12 @@ func (e *VideoExtension) Start() error {
 
 	// Wire up SendToPeer to use VPN IPC
 	e.videoServer.SendToPeer = func(peerIP string, data []byte) error {
-		return e.vpnClient.SendSignal(peerIP, data)
+		_, err := e.vpnClient.SendSignalWithOptions(e.Name(), peerIP, data, ipc.SignalOptions{
+			OnFailed: func(id, peerIP, reason string) {
+				log.Printf("[VIDEO] Signal %s to %s was not delivered: %s", id, peerIP, reason)
+			},
+		})
+		return err
 	}
 
 	port, err := e.videoServer.Start()
@@ -47,15 +57,21 @@ func (e *VideoExtension) Start() error {
 	}
 
 	log.Printf("[VIDEO] Server started on port %d", port)
+	e.SetEndpoint("ui", fmt.Sprintf("http://127.0.0.1:%d", port))
 
 	// Subscribe to incoming video signals from VPN
-	go e.monitorIncomingSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.monitorIncomingSignals(ctx)
 
 	return nil
 }
 
 // Stop stops the video extension
 func (e *VideoExtension) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
 	if e.videoServer != nil {
 		return e.videoServer.Stop()
 	}
@@ -70,12 +86,11 @@ func (e *VideoExtension) Health() bool {
 	return e.vpnClient.Health() == nil
 }
 
-// monitorIncomingSignals monitors for incoming video call signals via IPC polling
-func (e *VideoExtension) monitorIncomingSignals() {
+// monitorIncomingSignals receives incoming video call signals pushed over IPC until ctx is cancelled
+func (e *VideoExtension) monitorIncomingSignals(ctx context.Context) {
 	log.Printf("[VIDEO] Subscribing to video signals via IPC")
 
-	// Use IPC polling instead of file monitoring
-	err := e.vpnClient.SubscribeToSignals("video", func(peerIP string, data []byte) {
+	err := e.vpnClient.SubscribeToSignals(ctx, "video", func(peerIP string, data []byte) {
 		if len(data) == 0 {
 			return
 		}
@@ -89,22 +104,18 @@ func (e *VideoExtension) monitorIncomingSignals() {
 			return
 		}
 
-		// Handle different signal types
+		// Handle different signal types (peerIP is the server-stamped sender)
 		sigType, _ := signal["type"].(string)
 		switch sigType {
 		case "call-start":
 			// Auto-open video window for incoming call
-			fromIP, _ := signal["from"].(string)
 			fromName, _ := signal["fromName"].(string)
-			if fromIP != "" {
-				log.Printf("[VIDEO] Incoming call from %s (%s) - auto-opening", fromName, fromIP)
-				go e.autoOpenVideoCall(fromIP, fromName)
-			}
+			log.Printf("[VIDEO] Incoming call from %s (%s) - auto-opening", fromName, peerIP)
+			go e.autoOpenVideoCall(peerIP, fromName)
 		case "offer", "answer", "ice-candidate":
 			// Forward WebRTC signaling to video server
 			if e.videoServer != nil {
-				fromIP, _ := signal["peer"].(string)
-				e.videoServer.HandlePeerMessage(fromIP, data)
+				e.videoServer.HandlePeerMessage(peerIP, data)
 			}
 		}
 	})
@@ -131,7 +142,7 @@ func (e *VideoExtension) autoOpenVideoCall(peerIP, peerName string) {
 }
 
 func main() {
-	vpnPort := flag.Int("vpn-port", 8889, "VPN core IPC port")
+	vpnPort := flag.Int("vpn-port", 0, "VPN core IPC TCP port, if it serves one (0 = Unix socket only)")
 	flag.Parse()
 
 	ext := NewVideoExtension(*vpnPort)
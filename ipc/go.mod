@@ -1,3 +1,7 @@
 module github.com/miguelemosreverte/family-vpn/ipc
 
 go 1.25.4
+
+require github.com/miguelemosreverte/family-vpn/protocol v0.0.0
+
+replace github.com/miguelemosreverte/family-vpn/protocol => ../protocol
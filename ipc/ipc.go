@@ -1,65 +1,283 @@
 package ipc
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
 )
 
+// defaultSignalTTL mirrors the VPN core's default when SignalOptions.TTL is zero
+const defaultSignalTTL = 60 * time.Second
+
+// SignalOptions controls delivery of a signal sent with SendSignalWithOptions
+type SignalOptions struct {
+	// TTL is how long the signal may wait for an offline peer or extension (0 = core default)
+	TTL time.Duration
+
+	// OnDelivered is called once the target extension has received the signal
+	OnDelivered func(id, peerIP string)
+
+	// OnFailed is called if the signal expired or was dropped before delivery
+	OnFailed func(id, peerIP, reason string)
+}
+
+// pendingSignal is a sent signal still waiting for its delivery receipt
+type pendingSignal struct {
+	peerIP   string
+	options  SignalOptions
+	deadline time.Time
+}
+
 // VPNClient provides IPC interface to VPN core for extensions
 type VPNClient struct {
-	baseURL string
-	client  *http.Client
+	baseURL   string
+	client    *http.Client
+	stream    *http.Client // No timeout: event streams stay open
+	token     string       // IPC token (defaults to $FAMILY_VPN_IPC_TOKEN, see protocol.TokenEnv)
+	tokenFile string       // If set, the token is re-read from this file on every request
+
+	// Sent signals awaiting a receipt (delivered through SubscribeToSignals)
+	pending      map[string]*pendingSignal
+	pendingMutex sync.Mutex
 }
 
-// NewVPNClient creates a new IPC client to communicate with VPN core
+// NewVPNClient creates a new IPC client to communicate with VPN core. It uses
+// the Unix socket ($FAMILY_VPN_IPC_SOCKET or protocol.SocketPath). With a port,
+// it falls back to TCP when the socket is unavailable; only pass one if the
+// core serves it (vpn-client -ipc-port), because the token goes to whatever
+// listens there.
 func NewVPNClient(port int) *VPNClient {
+	socketPath := os.Getenv(protocol.SocketEnv)
+	if socketPath == "" {
+		socketPath = protocol.SocketPath(os.Getuid())
+	}
+	return NewVPNClientSocket(socketPath, port)
+}
+
+// NewVPNClientSocket creates an IPC client for the socket at socketPath, with
+// an opt-in TCP fallback on fallbackPort (0 = socket only)
+func NewVPNClientSocket(socketPath string, fallbackPort int) *VPNClient {
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, "unix", socketPath)
+			if err == nil || fallbackPort <= 0 {
+				return conn, err
+			}
+			return dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", fallbackPort))
+		},
+	}
+
 	return &VPNClient{
-		baseURL: fmt.Sprintf("http://127.0.0.1:%d", port),
+		// The host is only used for the Host header; the transport picks the connection
+		baseURL: "http://localhost",
 		client: &http.Client{
-			Timeout: 5 * time.Second,
+			Transport: transport,
+			Timeout:   5 * time.Second,
 		},
+		stream:  &http.Client{Transport: transport},
+		token:   os.Getenv(protocol.TokenEnv),
+		pending: make(map[string]*pendingSignal),
+	}
+}
+
+// SetToken sets the IPC token sent with every request
+func (c *VPNClient) SetToken(token string) {
+	c.token = token
+}
+
+// UseTokenFile reads the IPC token from a file on every request, so a
+// restarted VPN client's new token is picked up (used by the manager)
+func (c *VPNClient) UseTokenFile(path string) {
+	c.tokenFile = path
+}
+
+// authToken returns the current IPC token
+func (c *VPNClient) authToken() string {
+	if c.tokenFile != "" {
+		if data, err := os.ReadFile(c.tokenFile); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return c.token
+}
+
+// newRequest builds an authenticated request to the VPN core
+func (c *VPNClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if token := c.authToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
+	return req, nil
 }
 
-// SendSignal sends a control signal to a specific peer via VPN
-func (c *VPNClient) SendSignal(peerIP string, data []byte) error {
-	payload := map[string]interface{}{
-		"peer": peerIP,
-		"data": string(data),
+// IssueExtensionToken asks the VPN core for a token scoped to one extension.
+// Only the manager token may do this; issuing again revokes the previous token.
+func (c *VPNClient) IssueExtensionToken(extension string) (string, error) {
+	jsonData, err := json.Marshal(map[string]string{"extension": extension})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal payload: %v", err)
+	}
+
+	req, err := c.newRequest(context.Background(), "POST", "/auth/token", bytes.NewReader(jsonData))
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", protocol.ReadError(resp.StatusCode, body)
+	}
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+	return result.Token, nil
+}
+
+// SendSignal sends a signal to the named extension on a specific peer via VPN.
+// The receiving side sees our VPN address as the sender (stamped by the server).
+func (c *VPNClient) SendSignal(extension, peerIP string, data []byte) error {
+	_, err := c.SendSignalWithOptions(extension, peerIP, data, SignalOptions{})
+	return err
+}
+
+// SendSignalWithOptions sends a signal and returns its ID. Delivery callbacks
+// fire from SubscribeToSignals, so the sending extension must be subscribed.
+func (c *VPNClient) SendSignalWithOptions(extension, peerIP string, data []byte, options SignalOptions) (string, error) {
+	payload := protocol.SendSignalRequest{
+		Extension: extension,
+		Peer:      peerIP,
+		Data:      string(data),
+		TTL:       int(options.TTL / time.Second),
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %v", err)
+		return "", fmt.Errorf("failed to marshal payload: %v", err)
 	}
 
-	resp, err := c.client.Post(c.baseURL+"/signal/send", "application/json", bytes.NewReader(jsonData))
+	req, err := c.newRequest(context.Background(), "POST", "/signal/send", bytes.NewReader(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to send signal: %v", err)
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send signal: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("signal send failed: %s - %s", resp.Status, string(body))
+		return "", protocol.ReadError(resp.StatusCode, body)
 	}
 
-	return nil
+	var result protocol.SendSignalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode send response: %v", err)
+	}
+
+	if options.OnDelivered != nil || options.OnFailed != nil {
+		ttl := options.TTL
+		if ttl <= 0 {
+			ttl = defaultSignalTTL
+		}
+
+		c.pendingMutex.Lock()
+		c.pending[result.ID] = &pendingSignal{
+			peerIP:   peerIP,
+			options:  options,
+			deadline: time.Now().Add(ttl + 30*time.Second), // Grace for the receipt's own trip back
+		}
+		c.pendingMutex.Unlock()
+	}
+
+	return result.ID, nil
+}
+
+// resolveSignal fires the delivery callback for a receipt and forgets the signal
+func (c *VPNClient) resolveSignal(id, receiptType, reason string) {
+	c.pendingMutex.Lock()
+	pending, exists := c.pending[id]
+	delete(c.pending, id)
+	c.pendingMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	if receiptType == protocol.SignalTypeAck {
+		if pending.options.OnDelivered != nil {
+			pending.options.OnDelivered(id, pending.peerIP)
+		}
+	} else if pending.options.OnFailed != nil {
+		pending.options.OnFailed(id, pending.peerIP, reason)
+	}
+}
+
+// expirePendingSignals fails signals whose receipt never arrived
+func (c *VPNClient) expirePendingSignals() {
+	now := time.Now()
+
+	c.pendingMutex.Lock()
+	var expired []string
+	for id, pending := range c.pending {
+		if now.After(pending.deadline) {
+			expired = append(expired, id)
+		}
+	}
+	c.pendingMutex.Unlock()
+
+	for _, id := range expired {
+		c.resolveSignal(id, protocol.SignalTypeFailed, "no receipt")
+	}
 }
 
 // GetPeers retrieves list of connected VPN peers
-func (c *VPNClient) GetPeers() ([]map[string]interface{}, error) {
-	resp, err := c.client.Get(c.baseURL + "/peers")
+func (c *VPNClient) GetPeers() ([]protocol.PeerInfo, error) {
+	req, err := c.newRequest(context.Background(), "GET", "/peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get peers: %v", err)
 	}
 	defer resp.Body.Close()
 
-	var peers []map[string]interface{}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, protocol.ReadError(resp.StatusCode, body)
+	}
+
+	var peers []protocol.PeerInfo
 	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
 		return nil, fmt.Errorf("failed to decode peers: %v", err)
 	}
@@ -67,40 +285,204 @@ func (c *VPNClient) GetPeers() ([]map[string]interface{}, error) {
 	return peers, nil
 }
 
-// SubscribeToSignals subscribes to incoming signals for this extension
-func (c *VPNClient) SubscribeToSignals(extensionName string, handler func(peerIP string, data []byte)) error {
-	// Poll for signals (could be upgraded to websocket later)
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+// Subscribe streams events for an extension until ctx is cancelled. The
+// stream is re-established automatically if the VPN core restarts; handler is
+// called from a single goroutine. Returns nil once ctx is cancelled.
+func (c *VPNClient) Subscribe(ctx context.Context, extensionName string, handler func(protocol.Event)) error {
+	backoff := time.Second
 
-	for range ticker.C {
-		resp, err := c.client.Get(c.baseURL + "/signal/poll?extension=" + extensionName)
-		if err != nil {
-			continue
+	for {
+		connected, err := c.streamEvents(ctx, extensionName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			backoff = time.Second
+		}
+
+		log.Printf("[IPC] Event stream for '%s' ended (%v), resubscribing in %v", extensionName, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
 		}
 
-		var signals []map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&signals); err != nil {
-			resp.Body.Close()
-			continue
+		if backoff < 10*time.Second {
+			backoff *= 2
 		}
-		resp.Body.Close()
+	}
+}
+
+// streamEvents reads one /events stream until it ends. connected reports
+// whether the stream was established at all.
+func (c *VPNClient) streamEvents(ctx context.Context, extensionName string, handler func(protocol.Event)) (connected bool, err error) {
+	req, err := c.newRequest(ctx, "GET", "/events?extension="+url.QueryEscape(extensionName), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
 
-		for _, signal := range signals {
-			peerIP, _ := signal["peer"].(string)
-			data, _ := signal["data"].(string)
-			if peerIP != "" && data != "" {
-				handler(peerIP, []byte(data))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return false, protocol.ReadError(resp.StatusCode, body)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) // Signals may carry large SDP payloads
+
+	var event protocol.Event
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// Blank line ends an event
+			if event.Type != "" {
+				event.Data = json.RawMessage(data.String())
+				handler(event)
 			}
+			event = protocol.Event{}
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Keepalive comment
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data.WriteString(strings.TrimPrefix(line, "data: "))
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, io.EOF
+}
+
+// SubscribeToSignals delivers incoming signals for this extension until ctx is cancelled.
+// Delivery receipts for signals sent with SendSignalWithOptions are handled here too.
+//
+// Before the /events stream it took no context and polled forever; pass
+// context.Background() for that behaviour.
+func (c *VPNClient) SubscribeToSignals(ctx context.Context, extensionName string, handler func(peerIP string, data []byte)) error {
+	// Fail sent signals whose receipt never arrives
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.expirePendingSignals()
+			}
+		}
+	}()
+
+	return c.Subscribe(ctx, extensionName, func(event protocol.Event) {
+		if event.Type != protocol.EventSignal {
+			return
+		}
+
+		var signal protocol.Signal
+		if err := json.Unmarshal(event.Data, &signal); err != nil {
+			log.Printf("[IPC] Failed to decode signal: %v", err)
+			return
+		}
+
+		switch signal.Type {
+		case protocol.SignalTypeAck, protocol.SignalTypeFailed:
+			c.resolveSignal(signal.ID, signal.Type, signal.Reason)
+		default:
+			if signal.Peer != "" && signal.Data != "" {
+				handler(signal.Peer, []byte(signal.Data))
+			}
+		}
+	})
+}
+
+// call sends a JSON request to the VPN core and decodes the JSON reply into
+// result (if not nil). Error replies are returned as *protocol.Error.
+func (c *VPNClient) call(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %v", err)
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+
+	req, err := c.newRequest(context.Background(), method, path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("VPN core not responding: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(resp.Body)
+		return protocol.ReadError(resp.StatusCode, data)
+	}
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return fmt.Errorf("failed to decode %s response: %v", path, err)
+		}
+	}
 	return nil
 }
 
+// RegisterExtension tells the VPN core the extension is running. Until it
+// registers, signals addressed to the extension are failed back to the sender.
+func (c *VPNClient) RegisterExtension(registration protocol.ExtensionRegistration) error {
+	return c.call("POST", "/extensions/register", registration, nil)
+}
+
+// Heartbeat keeps an extension's registration alive. It returns an error
+// matching protocol.ErrNotRegistered if the core no longer knows the
+// extension (e.g. it restarted), in which case the extension registers again.
+func (c *VPNClient) Heartbeat(extension string) error {
+	return c.call("POST", "/extensions/heartbeat?extension="+url.QueryEscape(extension), nil, nil)
+}
+
+// UnregisterExtension removes an extension's registration on shutdown
+func (c *VPNClient) UnregisterExtension(extension string) error {
+	return c.call("POST", "/extensions/unregister?extension="+url.QueryEscape(extension), nil, nil)
+}
+
+// GetServices returns what each connected device offers
+func (c *VPNClient) GetServices() ([]protocol.PeerServices, error) {
+	var services []protocol.PeerServices
+	if err := c.call("GET", "/services", nil, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// ListExtensions returns the extensions registered with the VPN core
+func (c *VPNClient) ListExtensions() ([]protocol.RegisteredExtension, error) {
+	var extensions []protocol.RegisteredExtension
+	if err := c.call("GET", "/extensions", nil, &extensions); err != nil {
+		return nil, err
+	}
+	return extensions, nil
+}
+
 // Health checks if VPN core is running
 func (c *VPNClient) Health() error {
-	resp, err := c.client.Get(c.baseURL + "/health")
+	req, err := c.newRequest(context.Background(), "GET", "/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("VPN core not responding: %v", err)
 	}
@@ -110,5 +492,14 @@ func (c *VPNClient) Health() error {
 		return fmt.Errorf("VPN core unhealthy: %s", resp.Status)
 	}
 
+	var status protocol.HealthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to decode health response: %v", err)
+	}
+	// Older cores don't report a schema; anything else must match ours
+	if status.Schema != 0 && status.Schema != protocol.SchemaVersion {
+		return fmt.Errorf("VPN core speaks IPC schema %d, expected %d", status.Schema, protocol.SchemaVersion)
+	}
+
 	return nil
 }
@@ -0,0 +1,275 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// fakeCore stands in for the VPN client's IPC server. Each /events stream
+// gets the events of one entry of streams, then ends.
+type fakeCore struct {
+	mu         sync.Mutex
+	streams    [][]protocol.Event
+	extensions []string // ?extension= of each stream
+	sent       int
+}
+
+func (f *fakeCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/signal/send":
+		f.mu.Lock()
+		f.sent++
+		id := fmt.Sprintf("s%d", f.sent)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(protocol.SendSignalResponse{Status: "sent", ID: id})
+
+	case "/events":
+		f.mu.Lock()
+		f.extensions = append(f.extensions, r.URL.Query().Get("extension"))
+		var events []protocol.Event
+		if len(f.streams) > 0 {
+			events, f.streams = f.streams[0], f.streams[1:]
+		}
+		last := len(f.streams) == 0
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keepalive\n\n")
+		for _, event := range events {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+		}
+		w.(http.Flusher).Flush()
+		if last {
+			<-r.Context().Done() // The last stream stays open
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestClient returns a client of a fake core that serves streams
+func newTestClient(t *testing.T, streams ...[]protocol.Event) (*VPNClient, *fakeCore) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ipc") // Short enough for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	core := &fakeCore{streams: streams}
+	listener, err := net.Listen("unix", filepath.Join(dir, "ipc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(core)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return NewVPNClientSocket(filepath.Join(dir, "ipc.sock"), 0), core
+}
+
+// signalEvent returns a signal event for a fake stream
+func signalEvent(signal protocol.Signal) protocol.Event {
+	data, _ := json.Marshal(signal)
+	return protocol.Event{Type: protocol.EventSignal, Data: data}
+}
+
+func TestSubscribeToSignals(t *testing.T) {
+	c, core := newTestClient(t, []protocol.Event{
+		{Type: protocol.EventState, Data: json.RawMessage(`{"connected":true}`)},
+		signalEvent(protocol.Signal{ID: "s1", Type: protocol.SignalTypeAck}),
+		signalEvent(protocol.Signal{ID: "s2", Type: protocol.SignalTypeFailed, Reason: "expired"}),
+		signalEvent(protocol.Signal{ID: "in", Type: protocol.SignalTypeData, Peer: "10.8.0.3", Data: "hello"}),
+	})
+
+	delivered := make(chan string, 1)
+	failed := make(chan string, 1)
+	options := SignalOptions{
+		OnDelivered: func(id, peerIP string) { delivered <- id + " " + peerIP },
+		OnFailed:    func(id, peerIP, reason string) { failed <- id + " " + peerIP + " " + reason },
+	}
+	for _, peer := range []string{"10.8.0.3", "10.8.0.4"} {
+		if _, err := c.SendSignalWithOptions("video", peer, []byte("offer"), options); err != nil {
+			t.Fatalf("SendSignalWithOptions: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SubscribeToSignals(ctx, "video", func(peerIP string, data []byte) {
+			received <- peerIP + " " + string(data)
+		})
+	}()
+
+	for _, tt := range []struct {
+		name string
+		ch   chan string
+		want string
+	}{
+		{"delivered", delivered, "s1 10.8.0.3"},
+		{"failed", failed, "s2 10.8.0.4 expired"},
+		{"received", received, "10.8.0.3 hello"},
+	} {
+		select {
+		case got := <-tt.ch:
+			if got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.name, got, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s callback", tt.name)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("SubscribeToSignals after cancel = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SubscribeToSignals kept running after its context was cancelled")
+	}
+	core.mu.Lock()
+	defer core.mu.Unlock()
+	if len(core.extensions) != 1 || core.extensions[0] != "video" {
+		t.Errorf("subscribed for %q, want video", core.extensions)
+	}
+}
+
+func TestSubscribeResubscribes(t *testing.T) {
+	// The first stream ends, as when the VPN core restarts
+	c, core := newTestClient(t,
+		[]protocol.Event{{Type: protocol.EventState, Data: json.RawMessage(`{"connected":false}`)}},
+		[]protocol.Event{{Type: protocol.EventState, Data: json.RawMessage(`{"connected":true}`)}},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan string, 2)
+	go c.Subscribe(ctx, "a&extension=b", func(event protocol.Event) {
+		events <- string(event.Data)
+	})
+
+	for _, want := range []string{`{"connected":false}`, `{"connected":true}`} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("event = %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event %s", want)
+		}
+	}
+
+	core.mu.Lock()
+	defer core.mu.Unlock()
+	for _, extension := range core.extensions {
+		if extension != "a&extension=b" {
+			t.Errorf("core saw extension %q, want the name unchanged", extension)
+		}
+	}
+}
+
+func TestPendingSignalExpires(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	failed := make(chan string, 1)
+	id, err := c.SendSignalWithOptions("video", "10.8.0.3", []byte("offer"), SignalOptions{
+		OnFailed: func(id, peerIP, reason string) { failed <- reason },
+	})
+	if err != nil {
+		t.Fatalf("SendSignalWithOptions: %v", err)
+	}
+
+	c.expirePendingSignals()
+	select {
+	case reason := <-failed:
+		t.Fatalf("signal failed (%s) before its deadline", reason)
+	default:
+	}
+
+	c.pendingMutex.Lock()
+	c.pending[id].deadline = time.Now().Add(-time.Second)
+	c.pendingMutex.Unlock()
+	c.expirePendingSignals()
+	select {
+	case reason := <-failed:
+		if reason != "no receipt" {
+			t.Errorf("reason = %q, want no receipt", reason)
+		}
+	default:
+		t.Fatal("signal without a receipt never failed")
+	}
+
+	// A late receipt is ignored
+	c.resolveSignal(id, protocol.SignalTypeAck, "")
+}
+
+func TestSocketTransport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "ipc.sock")
+
+	// serve answers /health with the name of the transport it listens on
+	serve := func(listener net.Listener, name string) {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Transport", name)
+		}))
+		server.Listener = listener
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := tcpListener.Addr().(*net.TCPAddr).Port
+	serve(tcpListener, "tcp")
+
+	transport := func(c *VPNClient) string {
+		req, _ := c.newRequest(context.Background(), "GET", "/health", nil)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return ""
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Transport")
+	}
+
+	// No socket yet: only a client that opted into TCP reaches the core
+	if got := transport(NewVPNClientSocket(socketPath, 0)); got != "" {
+		t.Errorf("socket-only client reached the core over %s", got)
+	}
+	if got := transport(NewVPNClientSocket(socketPath, tcpPort)); got != "tcp" {
+		t.Errorf("client with a fallback port used %q, want tcp", got)
+	}
+
+	socketListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(socketListener, "unix")
+
+	// The socket wins when both are up
+	if got := transport(NewVPNClientSocket(socketPath, tcpPort)); got != "unix" {
+		t.Errorf("client used %q, want the socket", got)
+	}
+}
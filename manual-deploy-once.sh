@@ -29,7 +29,7 @@ cd /root/family-vpn
 git pull origin main
 chmod +x server-update.sh
 cd server
-go build -o /root/family-vpn/vpn-server main.go
+go build -o /root/family-vpn/vpn-server .
 pkill vpn-server || true
 cd /root/family-vpn
 nohup ./vpn-server -port 8888 -webhook-port 9000 > /var/log/vpn-server.log 2>&1 &
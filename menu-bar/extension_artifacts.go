@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// artifactPublicKey is the release signing key baked in at build time
+// (-ldflags "-X main.artifactPublicKey=<base64>"); FAMILY_VPN_ARTIFACT_KEY overrides it
+var artifactPublicKey string
+
+const (
+	maxArtifactSize     = 200 << 20
+	artifactTimeout     = 5 * time.Minute
+	previousSuffix      = ".previous"                                  // Installed version kept for rollback
+	rejectedSuffix      = ".rejected"                                  // Digest of the release the last rollback removed
+	updateHealthTimeout = 2*healthProbeInterval + 2*healthProbeTimeout // How long a new version has to report healthy
+)
+
+// artifactSource downloads signed extension releases from the VPN server
+type artifactSource struct {
+	baseURL string
+	key     ed25519.PublicKey
+	client  *http.Client
+}
+
+// UseArtifacts makes RestartExtension install releases published on the
+// server (see server/artifacts.go) instead of just restarting
+func (m *ExtensionManager) UseArtifacts(baseURL string, key ed25519.PublicKey) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.artifacts = &artifactSource{
+		baseURL: baseURL,
+		key:     key,
+		client:  &http.Client{Timeout: artifactTimeout},
+	}
+}
+
+// get fetches a URL, failing on anything but 200
+func (a *artifactSource) get(url string, limit int64) ([]byte, error) {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// latest fetches and verifies the latest release of an extension for this platform
+func (a *artifactSource) latest(name string) (*protocol.Release, error) {
+	query := url.Values{"os": {runtime.GOOS}, "arch": {runtime.GOARCH}}
+	data, err := a.get(a.baseURL+"/artifacts/releases/"+url.PathEscape(name)+"?"+query.Encode(), 1<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	var release protocol.Release
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("invalid release: %v", err)
+	}
+	if release.Name != name || release.OS != runtime.GOOS || release.Arch != runtime.GOARCH {
+		return nil, fmt.Errorf("server sent the release of %s for %s/%s", release.Name, release.OS, release.Arch)
+	}
+	if err := release.Verify(a.key); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// download fetches a release's binary and checks it against the signed digest
+func (a *artifactSource) download(release *protocol.Release) ([]byte, error) {
+	if release.Size > maxArtifactSize {
+		return nil, fmt.Errorf("binary too large (%d bytes)", release.Size)
+	}
+	data, err := a.get(a.baseURL+"/artifacts/blobs/"+release.SHA256, release.Size+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := release.VerifyBinary(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomic writes a file via a temporary file and rename
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmpFile := path + ".download"
+	if err := os.WriteFile(tmpFile, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile, mode); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// updateExtension installs the latest release of a stopped extension. The
+// installed binary and manifest are kept as *.previous for rollbackExtension.
+// Returns false if the installed version already is the latest release;
+// releases that aren't newer than it, or that were rolled back, are refused
+// (see RollBackExtension for going back a version).
+func (m *ExtensionManager) updateExtension(name string) (bool, error) {
+	m.mutex.RLock()
+	artifacts := m.artifacts
+	ext, exists := m.extensions[name]
+	var dir, binaryPath string
+	if exists {
+		dir, binaryPath = ext.Dir, ext.BinaryPath
+	}
+	m.mutex.RUnlock()
+
+	if !exists {
+		return false, fmt.Errorf("extension %s not registered", name)
+	}
+	if artifacts == nil {
+		return false, fmt.Errorf("no artifact signing key configured")
+	}
+
+	manifestPath := filepath.Join(dir, protocol.ManifestFileName)
+	installedManifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return false, err
+	}
+	installed, err := protocol.ParseManifest(installedManifest)
+	if err != nil {
+		return false, err
+	}
+
+	release, err := artifacts.latest(name)
+	if err != nil {
+		return false, err
+	}
+	if digest, err := fileSHA256(binaryPath); err == nil && digest == release.SHA256 {
+		log.Printf("[EXT] Extension %s is up to date (v%s)", name, release.Version)
+		return false, nil
+	}
+	if rejected, err := os.ReadFile(manifestPath + rejectedSuffix); err == nil && string(rejected) == release.SHA256 {
+		return false, fmt.Errorf("latest release v%s was rolled back, waiting for a newer one", release.Version)
+	}
+	newer, err := protocol.CompareVersions(release.Version, installed.Version)
+	if err != nil {
+		return false, err
+	}
+	if newer <= 0 {
+		return false, fmt.Errorf("latest release v%s is not newer than the installed v%s", release.Version, installed.Version)
+	}
+
+	log.Printf("[EXT] Downloading %s v%s (%d bytes)", name, release.Version, release.Size)
+	binary, err := artifacts.download(release)
+	if err != nil {
+		return false, err
+	}
+	manifest, err := release.LoadManifest()
+	if err != nil {
+		return false, err
+	}
+
+	// Keep the installed version, then swap each file in with a rename. The
+	// manifest is copied rather than moved so discovery never sees it missing.
+	if err := writeFileAtomic(manifestPath+previousSuffix, installedManifest, 0644); err != nil {
+		return false, fmt.Errorf("failed to keep previous manifest: %v", err)
+	}
+	if err := os.Rename(binaryPath, binaryPath+previousSuffix); err != nil && !os.IsNotExist(err) {
+		os.Remove(manifestPath + previousSuffix)
+		return false, fmt.Errorf("failed to keep previous binary: %v", err)
+	}
+
+	// From here on a failure puts the installed version back, so the
+	// extension can still be restarted as it was
+	newBinaryPath := filepath.Join(dir, manifest.Binary)
+	if err := writeFileAtomic(newBinaryPath, binary, 0755); err != nil {
+		restorePrevious(binaryPath, newBinaryPath, manifestPath)
+		return false, fmt.Errorf("failed to install binary: %v", err)
+	}
+	if err := writeFileAtomic(manifestPath, release.Manifest, 0644); err != nil {
+		restorePrevious(binaryPath, newBinaryPath, manifestPath)
+		return false, fmt.Errorf("failed to install manifest: %v", err)
+	}
+
+	log.Printf("[EXT] Installed %s v%s (%s)", name, release.Version, release.SHA256)
+	return true, nil
+}
+
+// restorePrevious undoes a half-finished updateExtension: the new binary is
+// removed and the kept one moved back. The manifest was not replaced yet.
+func restorePrevious(binaryPath, newBinaryPath, manifestPath string) {
+	os.Remove(newBinaryPath + ".download")
+	os.Remove(newBinaryPath)
+	if err := os.Rename(binaryPath+previousSuffix, binaryPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("[EXT] Failed to restore %s: %v", binaryPath, err)
+		return // Keep the manifest copy so rollbackExtension can still try
+	}
+	os.Remove(manifestPath + previousSuffix)
+}
+
+// rollbackExtension restores the version updateExtension replaced. The
+// version it removes is recorded so updateExtension doesn't install it again.
+func (m *ExtensionManager) rollbackExtension(name string) error {
+	m.mutex.RLock()
+	ext, exists := m.extensions[name]
+	var dir string
+	if exists {
+		dir = ext.Dir
+	}
+	m.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("extension %s not registered", name)
+	}
+
+	manifestPath := filepath.Join(dir, protocol.ManifestFileName)
+	data, err := os.ReadFile(manifestPath + previousSuffix)
+	if err != nil {
+		return fmt.Errorf("no previous version: %v", err)
+	}
+	manifest, err := protocol.ParseManifest(data)
+	if err != nil {
+		return err
+	}
+
+	// The version being removed, whose binary may have another name
+	var removedBinary string
+	if current, err := protocol.LoadManifest(manifestPath); err == nil {
+		removedBinary = filepath.Join(dir, current.Binary)
+		if digest, err := fileSHA256(removedBinary); err == nil {
+			if err := writeFileAtomic(manifestPath+rejectedSuffix, []byte(digest), 0644); err != nil {
+				log.Printf("[EXT] Failed to record the rolled back release of %s: %v", name, err)
+			}
+		}
+	}
+
+	binaryPath := filepath.Join(dir, manifest.Binary)
+	if err := os.Rename(binaryPath+previousSuffix, binaryPath); err != nil {
+		return fmt.Errorf("failed to restore binary: %v", err)
+	}
+	if removedBinary != "" && removedBinary != binaryPath {
+		os.Remove(removedBinary)
+	}
+	if err := writeFileAtomic(manifestPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to restore manifest: %v", err)
+	}
+	os.Remove(manifestPath + previousSuffix)
+
+	log.Printf("[EXT] Rolled back %s to v%s", name, manifest.Version)
+	return nil
+}
+
+// waitHealthy waits for a freshly started extension to pass a health check
+func (m *ExtensionManager) waitHealthy(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		m.mutex.RLock()
+		ext, exists := m.extensions[name]
+		var status, lastError string
+		if exists {
+			status, lastError = ext.Status, ext.LastError
+		}
+		m.mutex.RUnlock()
+
+		switch {
+		case !exists:
+			return fmt.Errorf("extension %s was removed", name)
+		case status == extensionStatusHealthy:
+			return nil
+		case status == extensionStatusRestarting || status == extensionStatusFailed:
+			return fmt.Errorf("crashed: %s", lastError)
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("not healthy after %v", timeout)
+}
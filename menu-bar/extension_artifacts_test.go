@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// releaseServer serves one signed release of the chat extension, like
+// server/artifacts.go
+func releaseServer(t *testing.T, key ed25519.PrivateKey, version, binaryName string, binary []byte) *httptest.Server {
+	t.Helper()
+	sum := sha256.Sum256(binary)
+	release := &protocol.Release{
+		Name:     "chat",
+		Version:  version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		SHA256:   hex.EncodeToString(sum[:]),
+		Size:     int64(len(binary)),
+		Manifest: []byte(`{"name":"chat","version":"` + version + `","binary":"` + binaryName + `"}`),
+	}
+	release.Sign(key)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/artifacts/releases/chat":
+			json.NewEncoder(w).Encode(release)
+		case "/artifacts/blobs/" + release.SHA256:
+			w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// readFile returns a file's contents, or "" if it doesn't exist
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRollbackRejectsRelease(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	dir := filepath.Join(t.TempDir(), "extensions", "chat")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, protocol.ManifestFileName), []byte(`{"name":"chat","version":"1.0.0","binary":"chat"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "chat"), []byte("v1"), 0755)
+
+	// The new release renamed its binary
+	server := releaseServer(t, private, "1.1.0", "chat-extension", []byte("v2"))
+	m := NewExtensionManager(filepath.Dir(filepath.Dir(dir)), nil, 0)
+	m.extensions["chat"] = &ExtensionInfo{Name: "chat", Dir: dir, BinaryPath: filepath.Join(dir, "chat")}
+	m.UseArtifacts(server.URL, public)
+
+	if updated, err := m.updateExtension("chat"); !updated || err != nil {
+		t.Fatalf("updateExtension = %v, %v; want the new release installed", updated, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "chat-extension")); got != "v2" {
+		t.Fatalf("new binary = %q, want v2", got)
+	}
+
+	if err := m.rollbackExtension("chat"); err != nil {
+		t.Fatalf("rollbackExtension: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "chat")); got != "v1" {
+		t.Errorf("binary after rollback = %q, want v1", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "chat-extension")); got != "" {
+		t.Errorf("rolled back binary %q left behind", got)
+	}
+	if got := readFile(t, filepath.Join(dir, protocol.ManifestFileName)); !strings.Contains(got, `"1.0.0"`) {
+		t.Errorf("manifest after rollback = %s, want v1.0.0", got)
+	}
+
+	// Restarting doesn't install the release that was just rolled back
+	updated, err := m.updateExtension("chat")
+	if updated || err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("updateExtension after rollback = %v, %v; want the release refused", updated, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "chat")); got != "v1" {
+		t.Errorf("binary = %q after refusing the release, want v1", got)
+	}
+}
+
+func TestUpdateAfterRejectedRelease(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	dir := filepath.Join(t.TempDir(), "extensions", "chat")
+	os.MkdirAll(dir, 0755)
+	manifestPath := filepath.Join(dir, protocol.ManifestFileName)
+	os.WriteFile(manifestPath, []byte(`{"name":"chat","version":"1.0.0","binary":"chat"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "chat"), []byte("v1"), 0755)
+	os.WriteFile(manifestPath+rejectedSuffix, []byte(hex.EncodeToString(make([]byte, 32))), 0644)
+
+	// A fixed release comes out after the rejected one
+	server := releaseServer(t, private, "1.1.1", "chat", []byte("v3"))
+	m := NewExtensionManager(filepath.Dir(filepath.Dir(dir)), nil, 0)
+	m.extensions["chat"] = &ExtensionInfo{Name: "chat", Dir: dir, BinaryPath: filepath.Join(dir, "chat")}
+	m.UseArtifacts(server.URL, public)
+
+	if updated, err := m.updateExtension("chat"); !updated || err != nil {
+		t.Errorf("updateExtension = %v, %v; want the newer release installed", updated, err)
+	}
+}
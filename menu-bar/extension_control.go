@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// controlClient talks to an extension over the control socket it serves
+// (protocol.ExtensionSocketPath)
+func controlClient(name string, timeout time.Duration) *http.Client {
+	socketPath := protocol.ExtensionSocketPath(os.Getuid(), name)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// InvokeAction runs a peer action ("invoke": true in the manifest) in its extension
+func (m *ExtensionManager) InvokeAction(name, actionID string, target protocol.PeerTarget) error {
+	if !m.IsRunning(name) {
+		return fmt.Errorf("the %s extension is not running", name)
+	}
+
+	body, err := json.Marshal(target)
+	if err != nil {
+		return fmt.Errorf("failed to marshal action: %v", err)
+	}
+
+	client := controlClient(name, 10*time.Second)
+	resp, err := client.Post("http://extension/actions/"+actionID, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s extension not responding: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(resp.Body)
+		return protocol.ReadError(resp.StatusCode, data)
+	}
+	return nil
+}
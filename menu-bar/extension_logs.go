@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	extensionLogMaxSize = 1 << 20 // Bytes per log file before it is rotated
+	extensionLogBackups = 3       // Rotated files kept (<name>.log.1 ... .3)
+	crashLogLines       = 20      // Output lines logged when an extension crashes
+)
+
+// extensionLogPath returns the log file of an extension
+func extensionLogPath(name string) string {
+	return filepath.Join(protocol.RuntimeDir(os.Getuid()), "logs", name+".log")
+}
+
+// rotatingLog is an io.Writer appending to a file that is rotated once it
+// grows past extensionLogMaxSize
+type rotatingLog struct {
+	path  string
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// openRotatingLog opens (or creates) a log file for appending
+func openRotatingLog(path string) (*rotatingLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log dir: %v", err)
+	}
+
+	file, size, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingLog{path: path, file: file, size: size}, nil
+}
+
+// openLogFile opens a log file for appending and returns its size
+func openLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to open log: %v", err)
+	}
+	return file, info.Size(), nil
+}
+
+// Write appends to the log, rotating it first if it would grow too large.
+// If rotating fails the current file keeps growing rather than losing
+// output, and rotation is retried after another extensionLogMaxSize bytes.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(p)) > extensionLogMaxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("[EXT] %v", err)
+			l.size = 0
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts <name>.log to <name>.log.1 (and so on) and starts a new file.
+// The current file is only closed once the new one is open.
+func (l *rotatingLog) rotate() error {
+	for i := extensionLogBackups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i-1), fmt.Sprintf("%s.%d", l.path, i))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log: %v", err)
+	}
+
+	file, size, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file, l.size = file, size
+	return nil
+}
+
+// Close closes the log file
+func (l *rotatingLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// LogPath returns the current log file of an extension
+func (m *ExtensionManager) LogPath(name string) string {
+	return extensionLogPath(name)
+}
+
+// LogTail returns up to the last n lines of an extension's current log
+func (m *ExtensionManager) LogTail(name string, n int) (string, error) {
+	file, err := os.Open(extensionLogPath(name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The tail of a log is in its last few kilobytes
+	const window = 16 * 1024
+	if info, err := file.Stat(); err == nil && info.Size() > window {
+		file.Seek(-window, io.SeekEnd)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLog writes data to a log, failing the test on errors
+func writeLog(t *testing.T, l *rotatingLog, data []byte) {
+	t.Helper()
+	if n, err := l.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v; want %d, nil", n, err, len(data))
+	}
+}
+
+func TestRotatingLog(t *testing.T) {
+	full := bytes.Repeat([]byte("x"), extensionLogMaxSize)
+
+	tests := []struct {
+		name        string
+		writes      [][]byte
+		wantCurrent string
+		wantBackups int
+	}{
+		{"small writes", [][]byte{[]byte("a\n"), []byte("b\n")}, "a\nb\n", 0},
+		{"rotates when full", [][]byte{full, []byte("next\n")}, "next\n", 1},
+		{"oversized first write", [][]byte{append(full, 'y')}, string(full) + "y", 0},
+		{"keeps a limited number of backups", [][]byte{full, full, full, full, full, []byte("last\n")}, "last\n", extensionLogBackups},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs", "chat.log")
+			l, err := openRotatingLog(path)
+			if err != nil {
+				t.Fatalf("openRotatingLog: %v", err)
+			}
+			defer l.Close()
+
+			for _, data := range tt.writes {
+				writeLog(t, l, data)
+			}
+
+			current, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(current) != tt.wantCurrent {
+				t.Errorf("current log has %d bytes, want %d", len(current), len(tt.wantCurrent))
+			}
+			for i := 1; i <= extensionLogBackups+1; i++ {
+				_, err := os.Stat(fmt.Sprintf("%s.%d", path, i))
+				if exists := err == nil; exists != (i <= tt.wantBackups) {
+					t.Errorf("backup %d exists = %v, want %v", i, exists, i <= tt.wantBackups)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingLogReopensExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), extensionLogMaxSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := openRotatingLog(path)
+	if err != nil {
+		t.Fatalf("openRotatingLog: %v", err)
+	}
+	defer l.Close()
+
+	// The size of what was already there counts
+	writeLog(t, l, []byte("after restart\n"))
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("full log was not rotated: %v", err)
+	}
+}
+
+func TestRotatingLogRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	l, err := openRotatingLog(path)
+	if err != nil {
+		t.Fatalf("openRotatingLog: %v", err)
+	}
+	defer l.Close()
+
+	// A non-empty directory where the first backup goes makes rotating fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	writeLog(t, l, bytes.Repeat([]byte("x"), extensionLogMaxSize))
+	writeLog(t, l, []byte("still logged\n"))
+	writeLog(t, l, []byte("and this\n"))
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(current, []byte("still logged\nand this\n")) {
+		t.Errorf("output after a failed rotation was lost: log ends with %q", current[len(current)-20:])
+	}
+}
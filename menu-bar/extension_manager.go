@@ -1,24 +1,52 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 )
 
+// manifestWatchInterval is how often extension manifests are re-scanned
+const manifestWatchInterval = 5 * time.Second
+
+// errNetstackExtensions is why extensions don't run with VPN_NETSTACK=true:
+// the userspace stack gives them no tunnel address to listen or dial on
+var errNetstackExtensions = errors.New("extensions are not supported in userspace (VPN_NETSTACK) mode")
+
 // ExtensionInfo represents a managed extension
 type ExtensionInfo struct {
 	Name       string
+	Dir        string             // Extension directory, holds the manifest
+	Manifest   *protocol.Manifest // As last discovered
 	BinaryPath string
 	Args       []string
 	Process    *exec.Cmd
 	Running    bool
 	LastStart  time.Time
 	RestartCh  chan bool
+
+	// Supervision (see extension_supervisor.go)
+	Status       string        // extensionStatus* constant
+	Failures     int           // Crashes or failed health checks since the last stable run
+	LastError    string        // Why the extension last failed
+	exited       chan struct{} // Closed when the current process exits
+	killReason   string        // Set when the supervisor kills a hung or unhealthy process
+	restartTimer *time.Timer   // Pending automatic restart
+
+	log *rotatingLog // Captures stdout and stderr (see extension_logs.go)
 }
 
 // ExtensionManager manages extension processes
@@ -26,72 +54,275 @@ type ExtensionManager struct {
 	extensions map[string]*ExtensionInfo
 	mutex      sync.RWMutex
 	repoDir    string
+	ipcPort    int             // Substituted for {ipc_port} in manifest args
+	vpnIPC     *ipc.VPNClient  // Issues each extension its IPC token
+	started    bool            // StartAll was called; newly discovered extensions start too
+	artifacts  *artifactSource // Signed releases to update from (nil = restart only)
+
+	// OnStatusChange is called (from any goroutine) when an extension's status changes
+	OnStatusChange func()
 }
 
 // NewExtensionManager creates a new extension manager
-func NewExtensionManager(repoDir string) *ExtensionManager {
+func NewExtensionManager(repoDir string, vpnIPC *ipc.VPNClient, ipcPort int) *ExtensionManager {
 	return &ExtensionManager{
 		extensions: make(map[string]*ExtensionInfo),
 		repoDir:    repoDir,
+		ipcPort:    ipcPort,
+		vpnIPC:     vpnIPC,
 	}
 }
 
-// RegisterExtension registers an extension to be managed
-func (m *ExtensionManager) RegisterExtension(name, binaryPath string, args []string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// extensionsDir is the directory scanned for extension manifests
+func (m *ExtensionManager) extensionsDir() string {
+	return filepath.Join(m.repoDir, "extensions")
+}
+
+// loadManifests reads extensions/*/extension.json. Invalid manifests, duplicate
+// names and fixed ports already claimed by another extension are skipped.
+func (m *ExtensionManager) loadManifests() map[string]*ExtensionInfo {
+	paths, err := filepath.Glob(filepath.Join(m.extensionsDir(), "*", protocol.ManifestFileName))
+	if err != nil {
+		log.Printf("[EXT] Failed to scan for manifests: %v", err)
+		return nil
+	}
+	sort.Strings(paths)
+
+	found := make(map[string]*ExtensionInfo)
+	ports := make(map[int]string) // port -> extension
+	for _, path := range paths {
+		manifest, err := protocol.LoadManifest(path)
+		if err != nil {
+			log.Printf("[EXT] Skipping extension: %v", err)
+			continue
+		}
+		if other, exists := found[manifest.Name]; exists {
+			log.Printf("[EXT] Skipping %s: extension %s is already defined in %s", path, manifest.Name, other.Dir)
+			continue
+		}
+
+		conflict := ""
+		for _, port := range manifest.HTTP {
+			if owner, claimed := ports[port.Port]; port.Port != 0 && claimed {
+				conflict = fmt.Sprintf("port %d is already used by %s", port.Port, owner)
+			}
+		}
+		if conflict != "" {
+			log.Printf("[EXT] Skipping extension %s: %s", manifest.Name, conflict)
+			continue
+		}
+		for _, port := range manifest.HTTP {
+			if port.Port != 0 {
+				ports[port.Port] = manifest.Name
+			}
+		}
 
-	m.extensions[name] = &ExtensionInfo{
-		Name:       name,
-		BinaryPath: binaryPath,
+		found[manifest.Name] = m.extensionFromManifest(filepath.Dir(path), manifest)
+	}
+
+	return found
+}
+
+// extensionFromManifest builds the launch settings for a discovered extension
+func (m *ExtensionManager) extensionFromManifest(dir string, manifest *protocol.Manifest) *ExtensionInfo {
+	args := make([]string, len(manifest.Args))
+	for i, arg := range manifest.Args {
+		args[i] = strings.ReplaceAll(arg, protocol.ArgIPCPort, strconv.Itoa(m.ipcPort))
+	}
+
+	return &ExtensionInfo{
+		Name:       manifest.Name,
+		Dir:        dir,
+		Manifest:   manifest,
+		BinaryPath: filepath.Join(dir, manifest.Binary),
 		Args:       args,
-		Running:    false,
 		RestartCh:  make(chan bool, 1),
+		Status:     extensionStatusStopped,
+	}
+}
+
+// Discover registers the extensions described by manifests under extensions/.
+// New extensions are started if the manager is running, changed ones are
+// restarted with their new settings and removed ones are stopped.
+func (m *ExtensionManager) Discover() {
+	found := m.loadManifests()
+
+	var added, changed, removed []string
+	m.mutex.Lock()
+	for name, ext := range found {
+		current, exists := m.extensions[name]
+		if !exists {
+			m.extensions[name] = ext
+			added = append(added, name)
+		} else if current.Dir != ext.Dir || !reflect.DeepEqual(current.Manifest, ext.Manifest) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range m.extensions {
+		if _, exists := found[name]; !exists {
+			removed = append(removed, name)
+		}
+	}
+	started := m.started
+	m.mutex.Unlock()
+
+	for _, name := range removed {
+		log.Printf("[EXT] Extension %s was removed", name)
+		if err := m.StopExtension(name); err != nil {
+			log.Printf("[EXT] Failed to stop %s: %v", name, err)
+		}
+		m.mutex.Lock()
+		if ext := m.extensions[name]; ext.log != nil {
+			ext.log.Close()
+		}
+		delete(m.extensions, name)
+		m.mutex.Unlock()
+		m.notifyStatusChange()
+	}
+
+	for _, name := range changed {
+		wasRunning := m.IsRunning(name)
+		if err := m.StopExtension(name); err != nil {
+			log.Printf("[EXT] Failed to stop %s: %v", name, err)
+		}
+
+		update := found[name]
+		m.mutex.Lock()
+		ext := m.extensions[name]
+		ext.Dir = update.Dir
+		ext.Manifest = update.Manifest
+		ext.BinaryPath = update.BinaryPath
+		ext.Args = update.Args
+		m.mutex.Unlock()
+		log.Printf("[EXT] Extension %s manifest changed (v%s)", name, update.Manifest.Version)
+
+		if wasRunning {
+			if err := m.StartExtension(name); err != nil {
+				log.Printf("[EXT] Failed to restart %s: %v", name, err)
+				m.scheduleRestart(name, ext, err.Error())
+			}
+		}
+	}
+
+	for _, name := range added {
+		ext := found[name]
+		log.Printf("[EXT] Discovered extension %s v%s (%s)", name, ext.Manifest.Version, ext.Dir)
+		if started {
+			if err := m.StartExtension(name); err != nil {
+				log.Printf("[EXT] Failed to start %s: %v", name, err)
+				m.scheduleRestart(name, ext, err.Error())
+			}
+		}
+	}
+
+	if len(added) > 0 || len(changed) > 0 {
+		m.notifyStatusChange()
+	}
+}
+
+// WatchManifests re-runs Discover periodically so extensions can be added,
+// changed or removed without restarting the menu bar
+func (m *ExtensionManager) WatchManifests() {
+	ticker := time.NewTicker(manifestWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.Discover()
+	}
+}
+
+// Manifests returns the manifests of all registered extensions, sorted by name
+func (m *ExtensionManager) Manifests() []*protocol.Manifest {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	manifests := make([]*protocol.Manifest, 0, len(m.extensions))
+	for _, ext := range m.extensions {
+		manifests = append(manifests, ext.Manifest)
 	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests
 }
 
 // StartExtension starts a registered extension
 func (m *ExtensionManager) StartExtension(name string) error {
+	if netstackMode {
+		return errNetstackExtensions
+	}
+
 	m.mutex.Lock()
 	ext, exists := m.extensions[name]
 	if !exists {
 		m.mutex.Unlock()
 		return fmt.Errorf("extension %s not registered", name)
 	}
+	// Discover may change these once the lock is released
+	running, binaryPath, args, version := ext.Running, ext.BinaryPath, ext.Args, ext.Manifest.Version
 	m.mutex.Unlock()
 
-	if ext.Running {
+	if running {
 		log.Printf("[EXT] Extension %s is already running", name)
 		return nil
 	}
 
 	// Check if binary exists
-	if _, err := os.Stat(ext.BinaryPath); os.IsNotExist(err) {
-		return fmt.Errorf("extension binary not found: %s", ext.BinaryPath)
+	if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
+		return fmt.Errorf("extension binary not found: %s", binaryPath)
 	}
 
+	// Every launch gets a fresh IPC token scoped to this extension
+	token, err := m.vpnIPC.IssueExtensionToken(name)
+	if err != nil {
+		return fmt.Errorf("failed to get IPC token for %s: %v", name, err)
+	}
+
+	// Output goes to the extension's own log, kept open across restarts
+	m.mutex.Lock()
+	if ext.log == nil {
+		if ext.log, err = openRotatingLog(extensionLogPath(name)); err != nil {
+			m.mutex.Unlock()
+			return fmt.Errorf("failed to open log for %s: %v", name, err)
+		}
+	}
+	output := ext.log
+	m.mutex.Unlock()
+
 	// Start the extension process
-	cmd := exec.Command(ext.BinaryPath, ext.Args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := exec.Command(binaryPath, args...)
+	cmd.Env = append(os.Environ(),
+		protocol.TokenEnv+"="+token,
+		protocol.ExtensionSocketEnv+"="+protocol.ExtensionSocketPath(os.Getuid(), name),
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
 
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start extension %s: %v", name, err)
 	}
+	fmt.Fprintf(output, "=== %s: started v%s (PID %d) ===\n", time.Now().Format(time.RFC3339), version, cmd.Process.Pid)
 
+	exited := make(chan struct{})
+	m.mutex.Lock()
 	ext.Process = cmd
 	ext.Running = true
 	ext.LastStart = time.Now()
+	ext.exited = exited
+	ext.killReason = ""
+	ext.Status = extensionStatusStarting
+	m.mutex.Unlock()
+	m.notifyStatusChange()
 
 	log.Printf("[EXT] Started extension: %s (PID %d)", name, cmd.Process.Pid)
 
-	// Monitor process in background
-	go m.monitorExtension(name, ext, cmd)
+	// Monitor the process and its health in background
+	go m.monitorExtension(name, ext, cmd, exited)
+	go m.superviseHealth(name, ext, cmd, exited)
 
 	return nil
 }
 
-// StopExtension stops a running extension
+// StopExtension stops a running extension. It gets SIGTERM so it can clean
+// up, and is killed if it hasn't exited after its manifest's grace period.
 func (m *ExtensionManager) StopExtension(name string) error {
 	m.mutex.Lock()
 	ext, exists := m.extensions[name]
@@ -99,27 +330,50 @@ func (m *ExtensionManager) StopExtension(name string) error {
 		m.mutex.Unlock()
 		return fmt.Errorf("extension %s not registered", name)
 	}
-	m.mutex.Unlock()
-
+	if ext.restartTimer != nil {
+		ext.restartTimer.Stop()
+		ext.restartTimer = nil
+	}
 	if !ext.Running {
+		ext.Status = extensionStatusStopped
+		m.mutex.Unlock()
+		m.notifyStatusChange()
 		return nil
 	}
+	// Cleared before the signal so monitorExtension knows this exit was requested
+	ext.Running = false
+	cmd, exited := ext.Process, ext.exited
+	grace := ext.Manifest.StopGracePeriod()
+	m.mutex.Unlock()
 
-	if ext.Process != nil && ext.Process.Process != nil {
+	if cmd != nil && cmd.Process != nil {
 		log.Printf("[EXT] Stopping extension: %s", name)
-		if err := ext.Process.Process.Kill(); err != nil {
-			log.Printf("[EXT] Failed to kill %s: %v", name, err)
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("[EXT] Failed to signal %s: %v", name, err)
+		}
+
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			log.Printf("[EXT] Extension %s did not exit within %v, killing it", name, grace)
+			if err := cmd.Process.Kill(); err != nil {
+				log.Printf("[EXT] Failed to kill %s: %v", name, err)
+			}
+			<-exited
 		}
-		ext.Process.Wait()
 	}
 
-	ext.Running = false
-	ext.Process = nil
+	m.mutex.Lock()
+	ext.Status = extensionStatusStopped
+	m.mutex.Unlock()
+	m.notifyStatusChange()
 
 	return nil
 }
 
-// RestartExtension restarts an extension (rebuild + restart)
+// RestartExtension updates an extension to its latest signed release and
+// restarts it. A new version that fails to start or to report healthy is
+// rolled back to the one it replaced.
 func (m *ExtensionManager) RestartExtension(name string) error {
 	log.Printf("[EXT] Restarting extension: %s", name)
 
@@ -128,134 +382,153 @@ func (m *ExtensionManager) RestartExtension(name string) error {
 		log.Printf("[EXT] Failed to stop %s: %v", name, err)
 	}
 
-	// Wait a moment for cleanup
-	time.Sleep(500 * time.Millisecond)
-
-	// Rebuild the extension
-	if err := m.rebuildExtension(name); err != nil {
-		return fmt.Errorf("failed to rebuild %s: %v", name, err)
+	updated, err := m.updateExtension(name)
+	if err != nil {
+		log.Printf("[EXT] Not updating %s, restarting the installed version: %v", name, err)
 	}
 
+	// Pick up manifest changes that came with the update
+	m.Discover()
+
 	// Start it again
-	if err := m.StartExtension(name); err != nil {
-		return fmt.Errorf("failed to start %s: %v", name, err)
+	err = m.StartExtension(name)
+	if err == nil && updated {
+		err = m.waitHealthy(name, updateHealthTimeout)
+	}
+	if err != nil {
+		if !updated {
+			return fmt.Errorf("failed to start %s: %v", name, err)
+		}
+		return m.rollback(name, err)
 	}
 
 	log.Printf("[EXT] Successfully restarted extension: %s", name)
 	return nil
 }
 
-// getGoBinary returns the path to the go binary
-func getGoBinary() string {
-	// Try go in PATH first
-	if _, err := exec.LookPath("go"); err == nil {
-		return "go"
-	}
+// RollBackExtension reinstalls the version the last update replaced, on the
+// user's request, and starts it again if extensions are running
+func (m *ExtensionManager) RollBackExtension(name string) error {
+	log.Printf("[EXT] Rolling back extension: %s", name)
 
-	// Try common installation locations
-	commonPaths := []string{
-		"/usr/local/go/bin/go",
-		"/usr/bin/go",
-		"/opt/homebrew/bin/go",
+	if err := m.StopExtension(name); err != nil {
+		log.Printf("[EXT] Failed to stop %s: %v", name, err)
 	}
+	rollbackErr := m.rollbackExtension(name)
+	m.Discover()
 
-	for _, path := range commonPaths {
-		if _, err := os.Stat(path); err == nil {
-			return path
+	m.mutex.RLock()
+	started := m.started
+	m.mutex.RUnlock()
+	if started {
+		if err := m.StartExtension(name); err != nil {
+			return fmt.Errorf("failed to start %s: %v", name, err)
 		}
 	}
-
-	// Default to "go" and let it fail with a clear error
-	return "go"
+	return rollbackErr
 }
 
-// rebuildExtension rebuilds an extension binary
-func (m *ExtensionManager) rebuildExtension(name string) error {
-	log.Printf("[EXT] Rebuilding extension: %s", name)
+// rollback reinstalls and starts the previous version after a failed update
+func (m *ExtensionManager) rollback(name string, cause error) error {
+	log.Printf("[EXT] New version of %s failed (%v), rolling back", name, cause)
 
-	// Pull latest changes first
-	pullCmd := exec.Command("git", "-C", m.repoDir, "pull", "origin", "main")
-	if output, err := pullCmd.CombinedOutput(); err != nil {
-		log.Printf("[EXT] Git pull output: %s", string(output))
-		return fmt.Errorf("git pull failed: %v", err)
+	if err := m.StopExtension(name); err != nil {
+		log.Printf("[EXT] Failed to stop %s: %v", name, err)
 	}
-
-	// Build the extension using the correct go binary
-	goBin := getGoBinary()
-	log.Printf("[EXT] Using go binary: %s", goBin)
-
-	extDir := filepath.Join(m.repoDir, "extensions", name)
-	buildCmd := exec.Command(goBin, "build", "-o", name+"-extension", ".")
-	buildCmd.Dir = extDir
-	buildCmd.Stdout = os.Stdout
-	buildCmd.Stderr = os.Stderr
-
-	if err := buildCmd.Run(); err != nil {
-		return fmt.Errorf("build failed: %v", err)
+	if err := m.rollbackExtension(name); err != nil {
+		return fmt.Errorf("update of %s failed (%v) and could not be rolled back: %v", name, cause, err)
 	}
+	m.Discover()
 
-	log.Printf("[EXT] Successfully rebuilt: %s", name)
-	return nil
+	if err := m.StartExtension(name); err != nil {
+		return fmt.Errorf("failed to start %s after rollback: %v", name, err)
+	}
+	return fmt.Errorf("update of %s rolled back: %v", name, cause)
 }
 
-// monitorExtension monitors an extension process for crashes
-func (m *ExtensionManager) monitorExtension(name string, ext *ExtensionInfo, cmd *exec.Cmd) {
+// monitorExtension waits for an extension process to exit and schedules a
+// restart unless it was stopped on purpose
+func (m *ExtensionManager) monitorExtension(name string, ext *ExtensionInfo, cmd *exec.Cmd, exited chan struct{}) {
 	// Wait for process to exit
 	err := cmd.Wait()
+	close(exited)
 
 	m.mutex.Lock()
-	wasRunning := ext.Running
-	ext.Running = false
-	ext.Process = nil
+	crashed := ext.Running && ext.Process == cmd
+	if ext.Process == cmd {
+		ext.Running = false
+		ext.Process = nil
+	}
+	reason := ext.killReason
 	m.mutex.Unlock()
 
-	if wasRunning {
-		// Process crashed or was killed
-		log.Printf("[EXT] Extension %s exited: %v", name, err)
+	if !crashed {
+		return
+	}
 
-		// Auto-restart if it crashed (not manually stopped)
-		if time.Since(ext.LastStart) > 10*time.Second {
-			log.Printf("[EXT] Auto-restarting crashed extension: %s", name)
-			time.Sleep(2 * time.Second)
-			if err := m.StartExtension(name); err != nil {
-				log.Printf("[EXT] Failed to auto-restart %s: %v", name, err)
-			}
-		}
+	// Process crashed or was killed by the health supervisor
+	if reason == "" {
+		reason = fmt.Sprintf("exited: %v", err)
 	}
+	log.Printf("[EXT] Extension %s %s", name, reason)
+	if tail, err := m.LogTail(name, crashLogLines); err == nil && tail != "" {
+		log.Printf("[EXT] Last output of %s:\n%s", name, tail)
+	}
+	m.scheduleRestart(name, ext, reason)
 }
 
 // StartAll starts all registered extensions
 func (m *ExtensionManager) StartAll() error {
-	m.mutex.RLock()
+	if netstackMode {
+		log.Printf("[EXT] Not starting extensions: %v", errNetstackExtensions)
+		return nil
+	}
+
+	m.mutex.Lock()
+	m.started = true
 	names := make([]string, 0, len(m.extensions))
 	for name := range m.extensions {
 		names = append(names, name)
 	}
-	m.mutex.RUnlock()
+	m.mutex.Unlock()
 
 	for _, name := range names {
 		if err := m.StartExtension(name); err != nil {
 			log.Printf("[EXT] Failed to start %s: %v", name, err)
+			m.mutex.RLock()
+			ext := m.extensions[name]
+			m.mutex.RUnlock()
+			if ext != nil {
+				m.scheduleRestart(name, ext, err.Error())
+			}
 		}
 	}
 
 	return nil
 }
 
-// StopAll stops all running extensions
+// StopAll stops all running extensions. They are stopped in parallel so
+// their grace periods overlap.
 func (m *ExtensionManager) StopAll() error {
-	m.mutex.RLock()
+	m.mutex.Lock()
+	m.started = false
 	names := make([]string, 0, len(m.extensions))
 	for name := range m.extensions {
 		names = append(names, name)
 	}
-	m.mutex.RUnlock()
+	m.mutex.Unlock()
 
+	var wg sync.WaitGroup
 	for _, name := range names {
-		if err := m.StopExtension(name); err != nil {
-			log.Printf("[EXT] Failed to stop %s: %v", name, err)
-		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := m.StopExtension(name); err != nil {
+				log.Printf("[EXT] Failed to stop %s: %v", name, err)
+			}
+		}(name)
 	}
+	wg.Wait()
 
 	return nil
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// Extension statuses shown in the menu
+const (
+	extensionStatusStopped    = "stopped"
+	extensionStatusStarting   = "starting"
+	extensionStatusHealthy    = "healthy"
+	extensionStatusUnhealthy  = "unhealthy"
+	extensionStatusRestarting = "restarting"
+	extensionStatusFailed     = "failed"
+)
+
+const (
+	healthProbeInterval     = 10 * time.Second
+	healthProbeTimeout      = 5 * time.Second
+	unhealthyThreshold      = 3                // Failed probes in a row before the extension is restarted
+	restartBackoffMin       = time.Second      // First restart delay, doubled on each failure
+	restartBackoffMax       = time.Minute      // Restart delay cap
+	stableRunDuration       = 2 * time.Minute  // Healthy this long after a start clears the failure count
+	circuitBreakerThreshold = 5                // Failures in a row before automatic restarts pause
+	circuitBreakerCooldown  = 10 * time.Minute // Pause before one more attempt
+)
+
+// ExtensionStatus is a snapshot of an extension for the menu
+type ExtensionStatus struct {
+	Name      string
+	Version   string
+	Status    string
+	Failures  int
+	LastError string
+}
+
+// notifyStatusChange tells the menu that extension statuses changed
+func (m *ExtensionManager) notifyStatusChange() {
+	if m.OnStatusChange != nil {
+		m.OnStatusChange()
+	}
+}
+
+// Statuses returns the status of every registered extension, sorted by name
+func (m *ExtensionManager) Statuses() []ExtensionStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	statuses := make([]ExtensionStatus, 0, len(m.extensions))
+	for _, ext := range m.extensions {
+		statuses = append(statuses, ExtensionStatus{
+			Name:      ext.Name,
+			Version:   ext.Manifest.Version,
+			Status:    ext.Status,
+			Failures:  ext.Failures,
+			LastError: ext.LastError,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// restartBackoff returns the delay before restart attempt n (1-based)
+func restartBackoff(n int) time.Duration {
+	delay := restartBackoffMin
+	for i := 1; i < n && delay < restartBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > restartBackoffMax {
+		delay = restartBackoffMax
+	}
+	return delay
+}
+
+// scheduleRestart records a failure and restarts the extension after an
+// exponential backoff. After circuitBreakerThreshold failures in a row the
+// circuit opens: the extension is marked failed and only retried after
+// circuitBreakerCooldown (or when the user clicks it in the menu).
+func (m *ExtensionManager) scheduleRestart(name string, ext *ExtensionInfo, reason string) {
+	m.mutex.Lock()
+	if !m.started || m.extensions[name] != ext {
+		m.mutex.Unlock()
+		return
+	}
+
+	ext.Failures++
+	ext.LastError = reason
+
+	var delay time.Duration
+	if ext.Failures >= circuitBreakerThreshold {
+		delay = circuitBreakerCooldown
+		ext.Status = extensionStatusFailed
+		log.Printf("[EXT] Extension %s failed %d times in a row, pausing restarts for %v", name, ext.Failures, delay)
+	} else {
+		delay = restartBackoff(ext.Failures)
+		ext.Status = extensionStatusRestarting
+		log.Printf("[EXT] Restarting %s in %v (failure %d/%d)", name, delay, ext.Failures, circuitBreakerThreshold)
+	}
+
+	if ext.restartTimer != nil {
+		ext.restartTimer.Stop()
+	}
+	ext.restartTimer = time.AfterFunc(delay, func() { m.autoRestart(name, ext) })
+	m.mutex.Unlock()
+
+	m.notifyStatusChange()
+}
+
+// autoRestart runs a restart scheduled by scheduleRestart
+func (m *ExtensionManager) autoRestart(name string, ext *ExtensionInfo) {
+	m.mutex.Lock()
+	ext.restartTimer = nil
+	current := m.started && m.extensions[name] == ext
+	m.mutex.Unlock()
+
+	if !current {
+		return
+	}
+
+	log.Printf("[EXT] Auto-restarting extension: %s", name)
+	if err := m.StartExtension(name); err != nil {
+		log.Printf("[EXT] Failed to auto-restart %s: %v", name, err)
+		m.scheduleRestart(name, ext, err.Error())
+	}
+}
+
+// RetryExtension restarts an extension now and closes its circuit breaker
+func (m *ExtensionManager) RetryExtension(name string) error {
+	m.mutex.Lock()
+	ext, exists := m.extensions[name]
+	if !exists {
+		m.mutex.Unlock()
+		return fmt.Errorf("extension %s not registered", name)
+	}
+	if !m.started {
+		m.mutex.Unlock()
+		return fmt.Errorf("extensions only run while the VPN is connected")
+	}
+	ext.Failures = 0
+	ext.LastError = ""
+	m.mutex.Unlock()
+
+	log.Printf("[EXT] Manual restart of extension: %s", name)
+	if err := m.StopExtension(name); err != nil {
+		return err
+	}
+	if err := m.StartExtension(name); err != nil {
+		m.scheduleRestart(name, ext, err.Error())
+		return err
+	}
+	return nil
+}
+
+// superviseHealth probes an extension's control socket until the process
+// exits. A process that fails unhealthyThreshold probes in a row (unhealthy
+// or not answering at all) is killed; monitorExtension then restarts it.
+func (m *ExtensionManager) superviseHealth(name string, ext *ExtensionInfo, cmd *exec.Cmd, exited chan struct{}) {
+	client := controlClient(name, healthProbeTimeout)
+
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+
+	failed := 0
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+
+		err := probeHealth(client)
+		if err == nil {
+			failed = 0
+			m.mutex.Lock()
+			changed := ext.Status != extensionStatusHealthy
+			ext.Status = extensionStatusHealthy
+			if time.Since(ext.LastStart) >= stableRunDuration {
+				ext.Failures = 0
+			}
+			m.mutex.Unlock()
+			if changed {
+				log.Printf("[EXT] Extension %s is healthy", name)
+				m.notifyStatusChange()
+			}
+			continue
+		}
+
+		failed++
+		log.Printf("[EXT] Health check %d/%d for %s failed: %v", failed, unhealthyThreshold, name, err)
+		m.mutex.Lock()
+		ext.Status = extensionStatusUnhealthy
+		ext.LastError = err.Error()
+		m.mutex.Unlock()
+		m.notifyStatusChange()
+
+		if failed >= unhealthyThreshold {
+			m.mutex.Lock()
+			ext.killReason = fmt.Sprintf("unhealthy, killed: %v", err)
+			m.mutex.Unlock()
+			if err := cmd.Process.Kill(); err != nil {
+				log.Printf("[EXT] Failed to kill %s: %v", name, err)
+			}
+			return
+		}
+	}
+}
+
+// probeHealth asks an extension for its health over its control socket
+func probeHealth(client *http.Client) error {
+	resp, err := client.Get("http://extension/health")
+	if err != nil {
+		return fmt.Errorf("not responding: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var health protocol.ExtensionHealth
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return fmt.Errorf("invalid health response: %v", err)
+	}
+	if !health.Healthy {
+		return fmt.Errorf("reports unhealthy")
+	}
+	return nil
+}
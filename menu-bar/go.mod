@@ -4,6 +4,8 @@ go 1.25.4
 
 require (
 	github.com/getlantern/systray v1.2.2
+	github.com/miguelemosreverte/family-vpn/ipc v0.0.0
+	github.com/miguelemosreverte/family-vpn/protocol v0.0.0
 	github.com/miguelemosreverte/family-vpn/video-call v0.0.0
 	github.com/sqweek/dialog v0.0.0-20240226140203-065105509627
 )
@@ -24,3 +26,7 @@ require (
 )
 
 replace github.com/miguelemosreverte/family-vpn/video-call => ../video-call
+
+replace github.com/miguelemosreverte/family-vpn/ipc => ../ipc
+
+replace github.com/miguelemosreverte/family-vpn/protocol => ../protocol
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,13 +13,21 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/systray"
+	"github.com/miguelemosreverte/family-vpn/ipc"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 	"github.com/sqweek/dialog"
 )
 
+// vpnIPCPort is the VPN client's local IPC TCP port. The client serves none
+// by default (see -ipc-port), so everything uses the Unix socket.
+const vpnIPCPort = 0
+
 type VPNState struct {
 	Connected     bool
 	Server        string
@@ -27,15 +36,8 @@ type VPNState struct {
 	BytesSent     int64
 	BytesReceived int64
 	Process       *exec.Cmd
-}
-
-// PeerInfo represents a connected VPN peer
-type PeerInfo struct {
-	Hostname    string `json:"hostname"`
-	VPNAddress  string `json:"vpn_address"`
-	PublicIP    string `json:"public_ip"`
-	ConnectedAt string `json:"connected_at"`
-	OS          string `json:"os"`
+	VPNAddress    string // Tunnel address assigned by the server (from IPC state events)
+	Proxies       string // Local proxies of the userspace client, e.g. "SOCKS5 127.0.0.1:1080" (from IPC state events)
 }
 
 var (
@@ -46,6 +48,8 @@ var (
 	mIP      *systray.MenuItem
 	mDuration *systray.MenuItem
 	mData    *systray.MenuItem
+	mProxies *systray.MenuItem
+	mMessage *systray.MenuItem // Latest message from the server operator
 
 	// VPN Configuration - will be loaded from .env file in main()
 	vpnServerHost string
@@ -54,12 +58,26 @@ var (
 	// Development mode - disables auto-connect
 	devMode bool
 
+	// Userspace mode (VPN_NETSTACK=true): the client runs without root and
+	// apps connect through its local proxies, so no SUDO_PASSWORD is needed
+	netstackMode bool
+
 	// Peer list
-	connectedPeers []*PeerInfo
+	connectedPeers []*protocol.PeerInfo
 	peerMenuItems  map[string]*systray.MenuItem // Map peer VPN address to menu item
+	peerMenuMutex  sync.Mutex
+	peerActionKeys string // Actions the peer menu was last built with (see refreshPeerActions)
 
 	// Extension manager
 	extensionManager *ExtensionManager
+
+	// Extension status menu (one item per extension under mExtensions)
+	mExtensions        *systray.MenuItem
+	extensionMenuItems = make(map[string]*systray.MenuItem)
+	extensionMenuMutex sync.Mutex
+
+	// VPN client IPC API, authenticated with the manager token
+	vpnIPC *ipc.VPNClient
 )
 
 // getEnv reads an environment variable or returns a default value
@@ -237,85 +255,60 @@ func performVPNUpdate() error {
 	return nil
 }
 
-// watchUpdateSignal watches for update signal file from VPN client
-func watchUpdateSignal() {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Printf("Failed to get home dir: %v", err)
-		return
-	}
-	signalFile := filepath.Join(homeDir, ".family-vpn-update-signal")
-
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		<-ticker.C
-
-		// Check if signal file exists
-		data, err := os.ReadFile(signalFile)
-		if err != nil {
-			continue // File doesn't exist or can't read
+// handleUpdateMessage acts on an update announced by the VPN server (via the client's IPC events)
+func handleUpdateMessage(updateMessage string) {
+	log.Printf("🔔 Update signal received from VPN server: %s", updateMessage)
+
+	// Handle component-specific updates
+	switch {
+	case updateMessage == "UPDATE_VIDEO":
+		log.Println("[UPDATE] Restarting video extension...")
+		if extensionManager != nil {
+			go func() {
+				if err := extensionManager.RestartExtension("video"); err != nil {
+					log.Printf("[UPDATE] Failed to restart video extension: %v", err)
+				}
+			}()
 		}
 
-		updateMessage := strings.TrimSpace(string(data))
-		log.Printf("🔔 Update signal received from VPN server: %s", updateMessage)
+	case updateMessage == "UPDATE_MENU":
+		log.Println("[UPDATE] Restarting menu-bar (self)...")
+		if err := performUpdate(); err != nil {
+			log.Printf("[UPDATE] Failed to update menu-bar: %v", err)
+		}
 
-		// Remove signal file
-		os.Remove(signalFile)
+	case updateMessage == "UPDATE_VPN" || updateMessage == "UPDATE_ALL":
+		log.Println("[UPDATE] Full system update (VPN core + all components)...")
+		// Stop extensions first
+		if extensionManager != nil {
+			extensionManager.StopAll()
+		}
+		// Perform full VPN update (rebuilds VPN client + menu-bar)
+		if err := performVPNUpdate(); err != nil {
+			log.Printf("[UPDATE] Failed to update: %v", err)
+		}
 
-		// Handle component-specific updates
-		switch {
-		case updateMessage == "UPDATE_VIDEO":
-			log.Println("[UPDATE] Restarting video extension...")
+	default:
+		// Check if it's an extension update (UPDATE_<extensionname>)
+		if strings.HasPrefix(updateMessage, "UPDATE_") {
+			extName := strings.ToLower(strings.TrimPrefix(updateMessage, "UPDATE_"))
+			log.Printf("[UPDATE] Restarting extension: %s", extName)
 			if extensionManager != nil {
 				go func() {
-					if err := extensionManager.RestartExtension("video"); err != nil {
-						log.Printf("[UPDATE] Failed to restart video extension: %v", err)
+					if err := extensionManager.RestartExtension(extName); err != nil {
+						log.Printf("[UPDATE] Failed to restart %s extension: %v", extName, err)
 					}
 				}()
 			}
-
-		case updateMessage == "UPDATE_MENU":
-			log.Println("[UPDATE] Restarting menu-bar (self)...")
-			if err := performUpdate(); err != nil {
-				log.Printf("[UPDATE] Failed to update menu-bar: %v", err)
-			}
-
-		case updateMessage == "UPDATE_VPN" || updateMessage == "UPDATE_ALL":
-			log.Println("[UPDATE] Full system update (VPN core + all components)...")
-			// Stop extensions first
-			if extensionManager != nil {
-				extensionManager.StopAll()
-			}
-			// Perform full VPN update (rebuilds VPN client + menu-bar)
-			if err := performVPNUpdate(); err != nil {
-				log.Printf("[UPDATE] Failed to update: %v", err)
-			}
-
-		default:
-			// Check if it's an extension update (UPDATE_<extensionname>)
-			if strings.HasPrefix(updateMessage, "UPDATE_") {
-				extName := strings.ToLower(strings.TrimPrefix(updateMessage, "UPDATE_"))
-				log.Printf("[UPDATE] Restarting extension: %s", extName)
-				if extensionManager != nil {
-					go func() {
-						if err := extensionManager.RestartExtension(extName); err != nil {
-							log.Printf("[UPDATE] Failed to restart %s extension: %v", extName, err)
-						}
-					}()
-				}
-			} else {
-				log.Printf("[UPDATE] Unknown update signal: %s", updateMessage)
-			}
+		} else {
+			log.Printf("[UPDATE] Unknown update signal: %s", updateMessage)
 		}
 	}
 }
 
 // autoUpdater runs in background and checks for updates every hour
 func autoUpdater() {
-	// Start signal file watcher (for real-time updates from VPN server)
-	go watchUpdateSignal()
+	// Real-time update notifications from the VPN server arrive as IPC events (see subscribeToVPNEvents)
 
 	// Wait 5 minutes before first check (let app start up first)
 	time.Sleep(5 * time.Minute)
@@ -359,7 +352,11 @@ func main() {
 	// Initialize VPN configuration from environment (after .env is loaded)
 	vpnServerHost = getEnv("VPN_SERVER_HOST", "95.217.238.72")
 	vpnServerPort = getEnv("VPN_SERVER_PORT", "443")
+	netstackMode = getEnv("VPN_NETSTACK", "false") == "true"
 	log.Printf("VPN Server: %s:%s", vpnServerHost, vpnServerPort)
+	if netstackMode {
+		log.Println("Userspace network mode: no sudo, apps use the SOCKS5/HTTP proxies")
+	}
 
 	// Initialize extension manager
 	exePath, err := os.Executable()
@@ -367,17 +364,29 @@ func main() {
 		log.Fatalf("Failed to get executable path: %v", err)
 	}
 	repoDir := filepath.Dir(filepath.Dir(exePath))
-	extensionManager = NewExtensionManager(repoDir)
+	vpnIPC = ipc.NewVPNClient(vpnIPCPort)
+	vpnIPC.UseTokenFile(protocol.ManagerTokenFile(os.Getuid()))
+	extensionManager = NewExtensionManager(repoDir, vpnIPC, vpnIPCPort)
+	extensionManager.OnStatusChange = func() {
+		updateExtensionMenu()
+		refreshPeerActions()
+	}
 
-	// Register video extension
-	videoExtPath := filepath.Join(repoDir, "extensions", "video", "video-extension")
-	extensionManager.RegisterExtension("video", videoExtPath, []string{"--vpn-port", "8889"})
-	log.Printf("[EXT] Registered video extension: %s", videoExtPath)
+	// Extension updates are signed releases downloaded from the VPN server
+	if key := getEnv(protocol.ArtifactKeyEnv, artifactPublicKey); key != "" {
+		publicKey, err := protocol.ParsePublicKey(key)
+		if err != nil {
+			log.Printf("Warning: Ignoring artifact key, extensions will not update: %v", err)
+		} else {
+			extensionManager.UseArtifacts(getEnv("VPN_ARTIFACTS_URL", "http://"+vpnServerHost+":9000"), publicKey)
+		}
+	} else {
+		log.Printf("Warning: No %s configured, extensions will not update", protocol.ArtifactKeyEnv)
+	}
 
-	// Register SSH extension
-	sshExtPath := filepath.Join(repoDir, "extensions", "ssh", "ssh-extension")
-	extensionManager.RegisterExtension("ssh", sshExtPath, []string{"--vpn-port", "8889"})
-	log.Printf("[EXT] Registered SSH extension: %s", sshExtPath)
+	// Register every extension that ships a manifest, and follow changes
+	extensionManager.Discover()
+	go extensionManager.WatchManifests()
 
 	// Start auto-updater in background
 	go autoUpdater()
@@ -413,6 +422,12 @@ func onReady() {
 	mDuration.Disable()
 	mData = systray.AddMenuItem("Data: --- / ---", "Data sent/received")
 	mData.Disable()
+	mProxies = systray.AddMenuItem("Proxies: ---", "Point apps at these proxies to use the VPN (userspace mode)")
+	mProxies.Disable()
+	mProxies.Hide()
+	mMessage = systray.AddMenuItem("📢 ---", "Latest message from the VPN server operator")
+	mMessage.Disable()
+	mMessage.Hide()
 
 	systray.AddSeparator()
 
@@ -425,6 +440,20 @@ func onReady() {
 
 	systray.AddSeparator()
 
+	// Extensions and their health, kept up to date by the extension manager
+	mExtensions = systray.AddMenuItem("🧩 Extensions", "Installed extensions and their status")
+	if netstackMode {
+		mExtensions.SetTitle("🧩 Extensions (off in userspace mode)")
+		mExtensions.SetTooltip("Extensions need the TUN device; set VPN_NETSTACK=false to use them")
+	}
+	updateExtensionMenu()
+
+	// Services this Mac offers, shown to the family under its peer entry
+	mServices := systray.AddMenuItem("🔌 My Services…", "Edit the services this Mac offers the family")
+	go handleEditServicesClick(mServices)
+
+	systray.AddSeparator()
+
 	// About and Quit
 	mAbout := systray.AddMenuItem("About", "About this VPN")
 
@@ -434,8 +463,8 @@ func onReady() {
 	// Start data updater
 	go dataUpdater()
 
-	// Start peer list updater
-	go peerListUpdater()
+	// Follow peer list, connection state and update events from the VPN client
+	go subscribeToVPNEvents()
 
 	// Auto-connect on startup (unless in dev mode)
 	if !devMode {
@@ -523,33 +552,41 @@ func connectVPN() {
 		return
 	}
 
-	// Get sudo password from environment (.env file)
-	password := os.Getenv("SUDO_PASSWORD")
-	if password == "" {
-		log.Printf("SUDO_PASSWORD not found in .env file")
-		dialog.Message("SUDO_PASSWORD not found in .env file.\n\nPlease add your password to the .env file.").Title("Family VPN").Error()
-		handleConnectionFailure()
-		return
-	}
-
-	// Spawn VPN client with sudo using the password
 	serverAddr := fmt.Sprintf("%s:%s", vpnServerHost, vpnServerPort)
-	cmd := exec.Command("sudo", "-S", vpnClientPath, "-server", serverAddr, "-encrypt", "-tls", "--no-timeout")
+	clientArgs := []string{"-server", serverAddr, "-encrypt", "-tls", "--no-timeout", "-services", servicesFilePath()}
 
-	// Pass password to sudo via stdin
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Printf("Failed to get stdin pipe: %v", err)
-		dialog.Message("Failed to start VPN: %v", err).Title("Family VPN").Error()
-		handleConnectionFailure()
-		return
-	}
+	var cmd *exec.Cmd
+	if netstackMode {
+		// Userspace network stack: runs as us, nothing to unlock
+		cmd = exec.Command(vpnClientPath, append(clientArgs, "-netstack")...)
+	} else {
+		// Get sudo password from environment (.env file)
+		password := os.Getenv("SUDO_PASSWORD")
+		if password == "" {
+			log.Printf("SUDO_PASSWORD not found in .env file")
+			dialog.Message("SUDO_PASSWORD not found in .env file.\n\nPlease add your password to the .env file, or set VPN_NETSTACK=true to connect without root.").Title("Family VPN").Error()
+			handleConnectionFailure()
+			return
+		}
 
-	// Write password to sudo
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, password+"\n")
-	}()
+		// Spawn VPN client with sudo using the password
+		cmd = exec.Command("sudo", append([]string{"-S", vpnClientPath}, clientArgs...)...)
+
+		// Pass password to sudo via stdin
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			log.Printf("Failed to get stdin pipe: %v", err)
+			dialog.Message("Failed to start VPN: %v", err).Title("Family VPN").Error()
+			handleConnectionFailure()
+			return
+		}
+
+		// Write password to sudo
+		go func() {
+			defer stdin.Close()
+			io.WriteString(stdin, password+"\n")
+		}()
+	}
 
 	// Get stdout/stderr for monitoring
 	stdout, err := cmd.StdoutPipe()
@@ -633,6 +670,8 @@ func handleConnectionFailure() {
 	// This prevents internet from being broken
 	vpnState.Connected = false
 	vpnState.Process = nil
+	vpnState.VPNAddress = ""
+	clearPeers()
 	mStatus.SetTitle("● Disconnected")
 	mToggle.SetTitle("Connect to VPN")
 	updateConnectionDetails()
@@ -648,6 +687,15 @@ func disconnectVPN() {
 		extensionManager.StopAll()
 	}
 
+	// The userspace client runs as us and never touched routes or DNS
+	if netstackMode {
+		log.Println("Stopping vpn-client...")
+		vpnState.Connected = false // Expected exit, not a lost connection
+		exec.Command("pkill", "-TERM", "-f", "vpn-client").Run()
+		markDisconnected()
+		return
+	}
+
 	// Get sudo password from environment
 	password := os.Getenv("SUDO_PASSWORD")
 	if password == "" {
@@ -693,14 +741,22 @@ func disconnectVPN() {
 	restoreDNS := exec.Command("networksetup", "-setdnsservers", "Wi-Fi", "Empty")
 	restoreDNS.Run()
 
+	log.Println("Network restored")
+	markDisconnected()
+}
+
+// markDisconnected updates the menu once the VPN client is gone
+func markDisconnected() {
 	vpnState.Process = nil
 	vpnState.Connected = false
+	vpnState.VPNAddress = ""
+	clearPeers()
 	mStatus.SetTitle("● Disconnected")
 	mToggle.SetTitle("Connect to VPN")
 	updateConnectionDetails()
 	updateMenuBarIcon()
 
-	log.Println("VPN disconnected and network restored successfully")
+	log.Println("VPN disconnected")
 	dialog.Message("VPN Disconnected").Title("Family VPN").Info()
 }
 
@@ -786,12 +842,23 @@ func updateConnectionDetails() {
 	} else {
 		duration := time.Since(vpnState.ConnectedAt).Round(time.Second)
 		mServer.SetTitle(fmt.Sprintf("Server: %s", vpnState.Server))
-		mIP.SetTitle(fmt.Sprintf("IP Address: %s", vpnState.IP))
+		if vpnState.VPNAddress != "" {
+			mIP.SetTitle(fmt.Sprintf("IP Address: %s (VPN %s)", vpnState.IP, vpnState.VPNAddress))
+		} else {
+			mIP.SetTitle(fmt.Sprintf("IP Address: %s", vpnState.IP))
+		}
 		mDuration.SetTitle(fmt.Sprintf("Connected: %s", duration))
 		mData.SetTitle(fmt.Sprintf("Data: ↑ %s / ↓ %s",
 			formatBytes(vpnState.BytesSent),
 			formatBytes(vpnState.BytesReceived)))
 	}
+
+	if vpnState.Connected && vpnState.Proxies != "" {
+		mProxies.SetTitle("Proxies: " + vpnState.Proxies)
+		mProxies.Show()
+	} else {
+		mProxies.Hide()
+	}
 }
 
 func formatBytes(bytes int64) string {
@@ -958,193 +1025,358 @@ func getDisconnectedIcon() []byte {
 	}
 }
 
-// peerListUpdater periodically reads the peer list file
-func peerListUpdater() {
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
+// subscribeToVPNEvents follows peer-list, connection-state and update events
+// from the VPN client's IPC API. The stream reconnects whenever the client restarts.
+func subscribeToVPNEvents() {
+	vpnIPC.Subscribe(context.Background(), "", func(event protocol.Event) {
+		switch event.Type {
+		case protocol.EventPeers:
+			var peers []*protocol.PeerInfo
+			if err := json.Unmarshal(event.Data, &peers); err != nil {
+				log.Printf("Failed to parse peer list: %v", err)
+				return
+			}
 
-	for range ticker.C {
-		if !vpnState.Connected {
-			// Clear peers when disconnected
-			if len(connectedPeers) > 0 {
-				connectedPeers = nil
+			// Update if changed
+			if !peersEqual(connectedPeers, peers) {
+				connectedPeers = peers
 				updatePeerMenu()
 			}
-			continue
-		}
 
-		// Read peer list from file
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			continue
-		}
+		case protocol.EventState:
+			var state protocol.ConnectionState
+			if err := json.Unmarshal(event.Data, &state); err != nil {
+				log.Printf("Failed to parse connection state: %v", err)
+				return
+			}
 
-		peerFile := filepath.Join(homeDir, ".family-vpn-peers.json")
-		data, err := os.ReadFile(peerFile)
-		if err != nil {
-			// File might not exist yet
-			continue
-		}
+			vpnState.VPNAddress = state.VPNIP
+			var proxies []string
+			if state.SOCKSProxy != "" {
+				proxies = append(proxies, "SOCKS5 "+state.SOCKSProxy)
+			}
+			if state.HTTPProxy != "" {
+				proxies = append(proxies, "HTTP "+state.HTTPProxy)
+			}
+			vpnState.Proxies = strings.Join(proxies, ", ")
+			if !state.Connected {
+				clearPeers()
+			}
+			updateConnectionDetails()
 
-		var peers []*PeerInfo
-		if err := json.Unmarshal(data, &peers); err != nil {
-			log.Printf("Failed to parse peer list: %v", err)
-			continue
-		}
+		case protocol.EventUpdate:
+			var notice protocol.UpdateNotice
+			if err := json.Unmarshal(event.Data, &notice); err != nil {
+				log.Printf("Failed to parse update notice: %v", err)
+				return
+			}
+			handleUpdateMessage(notice.Message)
 
-		// Update if changed
-		if !peersEqual(connectedPeers, peers) {
-			connectedPeers = peers
-			updatePeerMenu()
+		case protocol.EventMessage:
+			var message protocol.OperatorMessage
+			if err := json.Unmarshal(event.Data, &message); err != nil {
+				log.Printf("Failed to parse operator message: %v", err)
+				return
+			}
+			showOperatorMessage(message)
 		}
+	})
+}
+
+// showOperatorMessage puts the server operator's latest message in the menu
+func showOperatorMessage(message protocol.OperatorMessage) {
+	log.Printf("📢 Message from the server operator: %s", message.Message)
+
+	title := message.Message
+	if runes := []rune(title); len(runes) > 60 {
+		title = string(runes[:60]) + "…"
+	}
+	mMessage.SetTitle("📢 " + title)
+	if receivedAt, err := time.Parse(time.RFC3339, message.ReceivedAt); err == nil {
+		mMessage.SetTooltip(fmt.Sprintf("%s (%s)", message.Message, receivedAt.Format("Jan 2 15:04")))
+	} else {
+		mMessage.SetTooltip(message.Message)
+	}
+	mMessage.Show()
+}
+
+// clearPeers empties the peer menu (e.g. when the VPN disconnects)
+func clearPeers() {
+	if len(connectedPeers) > 0 {
+		connectedPeers = nil
+		updatePeerMenu()
 	}
 }
 
 // peersEqual checks if two peer lists are equal
-func peersEqual(a, b []*PeerInfo) bool {
+func peersEqual(a, b []*protocol.PeerInfo) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := range a {
-		if a[i].VPNAddress != b[i].VPNAddress || a[i].Hostname != b[i].Hostname {
+		if a[i].VPNAddress != b[i].VPNAddress || a[i].Hostname != b[i].Hostname ||
+			!reflect.DeepEqual(a[i].Capabilities, b[i].Capabilities) ||
+			!reflect.DeepEqual(a[i].Services, b[i].Services) {
 			return false
 		}
 	}
 	return true
 }
 
+// builtinPeerActions are peer actions the menu bar provides itself
+var builtinPeerActions = []protocol.PeerAction{
+	{ID: "screen-sharing", Label: "Screen Sharing", Icon: "🖥️", Tooltip: "Remote desktop access", Open: "vnc://{peer}"},
+}
+
+// peerAction is a peer menu entry and the extension that declared it ("" = built in)
+type peerAction struct {
+	extension string
+	action    protocol.PeerAction
+}
+
+// peerActions returns the built-in actions followed by those declared in
+// extension manifests. Extensions don't run in userspace mode, so their
+// actions are left out there.
+func peerActions() []peerAction {
+	var actions []peerAction
+	for _, action := range builtinPeerActions {
+		actions = append(actions, peerAction{action: action})
+	}
+	if extensionManager != nil && !netstackMode {
+		for _, manifest := range extensionManager.Manifests() {
+			for _, action := range manifest.PeerActions {
+				actions = append(actions, peerAction{extension: manifest.Name, action: action})
+			}
+		}
+	}
+	return actions
+}
+
+// peerActionsKey identifies a set of peer actions, to notice when it changes
+func peerActionsKey(actions []peerAction) string {
+	var key strings.Builder
+	for _, a := range actions {
+		fmt.Fprintf(&key, "%s/%s/%s/%s;", a.extension, a.action.ID, a.action.Title(), a.action.Tooltip)
+	}
+	return key.String()
+}
+
+// refreshPeerActions rebuilds the peer menu when extensions added, changed or removed actions
+func refreshPeerActions() {
+	peerMenuMutex.Lock()
+	changed := peerMenuItems != nil && peerActionsKey(peerActions()) != peerActionKeys
+	peerMenuMutex.Unlock()
+
+	if changed {
+		updatePeerMenu()
+	}
+}
+
 // updatePeerMenu updates the peer menu items
 func updatePeerMenu() {
+	peerMenuMutex.Lock()
+	defer peerMenuMutex.Unlock()
+
 	// Remove all existing peer menu items
 	for _, item := range peerMenuItems {
 		item.Hide()
 	}
 	peerMenuItems = make(map[string]*systray.MenuItem)
 
+	actions := peerActions()
+	peerActionKeys = peerActionsKey(actions)
+
 	// Add new peer menu items
 	for _, peer := range connectedPeers {
 		// Create menu item: "🖥️  MacBook-Air (10.8.0.2)"
 		label := fmt.Sprintf("🖥️  %s (%s)", peer.Hostname, peer.VPNAddress)
 
-		item := systray.AddMenuItem(label, "Connected device")
+		tooltip := "Connected device"
+		if peer.Capabilities != nil {
+			tooltip = fmt.Sprintf("Connected device (Family VPN %s)", peer.Capabilities.ClientVersion)
+		}
+
+		item := systray.AddMenuItem(label, tooltip)
 		peerMenuItems[peer.VPNAddress] = item
 
-		// Add submenu items for this peer
-		videoCallItem := item.AddSubMenuItem("📹 Video Call", "Start video call")
-		screenShareItem := item.AddSubMenuItem("🖥️ Screen Sharing", "Remote desktop access")
-		sshTerminalItem := item.AddSubMenuItem("💻 SSH Terminal", "Open terminal to peer")
+		// One submenu item per built-in action and per action of an extension the peer runs
+		for _, action := range actions {
+			if action.extension != "" && !peer.RunsExtension(action.extension) {
+				continue
+			}
+			actionItem := item.AddSubMenuItem(action.action.Title(), action.action.Tooltip)
+			go handlePeerActionClick(actionItem, action, peer)
+		}
 
-		// Start click handlers
-		go handleVideoCallClick(videoCallItem, peer)
-		go handleScreenShareClick(screenShareItem, peer)
-		go handleSSHTerminalClick(sshTerminalItem, peer)
+		// Then what the peer offers
+		addServiceItems(item, peer)
 	}
 
-	log.Printf("Updated peer menu: %d peers", len(connectedPeers))
+	log.Printf("Updated peer menu: %d peers, %d actions", len(connectedPeers), len(actions))
 }
 
-// handleVideoCallClick handles video call button clicks
-func handleVideoCallClick(item *systray.MenuItem, peer *PeerInfo) {
+// handlePeerActionClick runs a peer action each time its menu item is clicked
+func handlePeerActionClick(item *systray.MenuItem, action peerAction, peer *protocol.PeerInfo) {
 	for {
 		<-item.ClickedCh
-		log.Printf("Starting video call with %s (%s)", peer.Hostname, peer.VPNAddress)
-		startVideoCall(peer)
+		log.Printf("Running %s on %s (%s)", action.action.ID, peer.Hostname, peer.VPNAddress)
+		go runPeerAction(action, peer)
 	}
 }
 
-// handleScreenShareClick handles screen sharing button clicks
-func handleScreenShareClick(item *systray.MenuItem, peer *PeerInfo) {
-	for {
-		<-item.ClickedCh
-		log.Printf("Opening remote access to %s (%s)", peer.Hostname, peer.VPNAddress)
-		openRemoteAccess(peer.VPNAddress)
+// runPeerAction dispatches a peer action: open a URL, request a URL, or
+// invoke the extension over its control socket
+func runPeerAction(action peerAction, peer *protocol.PeerInfo) {
+	target := protocol.PeerTarget{
+		Peer:     peer.VPNAddress,
+		Name:     peer.Hostname,
+		Username: getUsernameForPeer(peer),
+	}
+
+	var err error
+	switch {
+	case action.action.Open != "":
+		err = exec.Command("open", target.ExpandURL(action.action.Open)).Start()
+
+	case action.action.Request != "":
+		var resp *http.Response
+		resp, err = http.Get(target.ExpandURL(action.action.Request))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("%s", resp.Status)
+			}
+		}
+
+	case action.action.Invoke:
+		err = extensionManager.InvokeAction(action.extension, action.action.ID, target)
 	}
-}
 
-// handleSSHTerminalClick handles SSH terminal button clicks
-func handleSSHTerminalClick(item *systray.MenuItem, peer *PeerInfo) {
-	for {
-		<-item.ClickedCh
-		log.Printf("Opening SSH terminal to %s (%s)", peer.Hostname, peer.VPNAddress)
-		openSSHTerminal(peer)
+	if err != nil {
+		log.Printf("%s on %s failed: %v", action.action.ID, peer.Hostname, err)
+		hint := ""
+		if action.extension != "" {
+			hint = fmt.Sprintf("\n\nMake sure the %s extension is running.", action.extension)
+		}
+		dialog.Message("%s failed for %s%s\n\nError: %v", action.action.Label, peer.Hostname, hint, err).Title(action.action.Label).Error()
+		return
 	}
+	log.Printf("%s on %s (%s) done", action.action.ID, peer.Hostname, peer.VPNAddress)
 }
 
-// getUsernameForPeer determines the SSH username for a peer based on hostname
-func getUsernameForPeer(peer *PeerInfo) string {
-	// Simple mapping based on hostname patterns
-	hostname := strings.ToLower(peer.Hostname)
+// extensionStatusIcons marks each extension status in the menu
+var extensionStatusIcons = map[string]string{
+	extensionStatusHealthy:    "🟢",
+	extensionStatusStarting:   "🟡",
+	extensionStatusRestarting: "🟡",
+	extensionStatusUnhealthy:  "🟠",
+	extensionStatusFailed:     "🔴",
+	extensionStatusStopped:    "⚪",
+}
 
-	// Extract username from hostname like "Miguels-MacBook-Air.local" → "miguel_lemos"
-	if strings.Contains(hostname, "miguel") {
-		return "miguel_lemos"
-	} else if strings.Contains(hostname, "anastasiia") {
-		return "anastasiia"
+// updateExtensionMenu shows the status of every extension under mExtensions
+func updateExtensionMenu() {
+	if mExtensions == nil || extensionManager == nil {
+		return // Menu not built yet; onReady calls us again
 	}
 
-	// Fallback to current user
-	if u, err := user.Current(); err == nil {
-		return u.Username
-	}
-	return ""
-}
+	extensionMenuMutex.Lock()
+	defer extensionMenuMutex.Unlock()
 
-// openSSHTerminal opens an SSH terminal to the peer via SSH extension
-func openSSHTerminal(peer *PeerInfo) {
-	username := getUsernameForPeer(peer)
+	seen := make(map[string]bool)
+	for _, status := range extensionManager.Statuses() {
+		seen[status.Name] = true
 
-	// Trigger SSH extension on localhost:8891
-	url := fmt.Sprintf("http://localhost:8891/ssh?peer=%s&name=%s&username=%s",
-		peer.VPNAddress, peer.Hostname, username)
+		label := fmt.Sprintf("%s %s v%s: %s", extensionStatusIcons[status.Status], status.Name, status.Version, status.Status)
+		if status.Failures > 0 {
+			label += fmt.Sprintf(" (%d failures)", status.Failures)
+		}
+		tooltip := status.Status
+		if status.LastError != "" {
+			tooltip = status.LastError
+		}
+		if netstackMode {
+			label = fmt.Sprintf("⚪ %s v%s: unavailable in userspace mode", status.Name, status.Version)
+			tooltip = errNetstackExtensions.Error()
+		}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Failed to trigger SSH extension: %v", err)
-		dialog.Message("Failed to open SSH terminal\n\nMake sure SSH extension is running.\n\nError: %v", err).Title("SSH Error").Error()
-		return
+		item, exists := extensionMenuItems[status.Name]
+		if !exists {
+			item = mExtensions.AddSubMenuItem(label, tooltip)
+			extensionMenuItems[status.Name] = item
+			mRestart := item.AddSubMenuItem("🔄 Restart", "Restart the extension and reset its failure count")
+			mRollBack := item.AddSubMenuItem("⏪ Roll Back", "Reinstall the version the last update replaced")
+			mLog := item.AddSubMenuItem("📄 View Log", "Open the extension's output in Console")
+			go handleExtensionClick(mRestart, status.Name)
+			go handleExtensionRollBackClick(mRollBack, status.Name)
+			go handleExtensionLogClick(mLog, status.Name)
+		}
+		item.SetTitle(label)
+		item.SetTooltip(tooltip)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("SSH extension returned error: %s", resp.Status)
-		dialog.Message("SSH extension error: %s", resp.Status).Title("SSH Error").Error()
-	} else {
-		log.Printf("SSH terminal opened to %s", peer.Hostname)
+	// Extensions whose manifest was removed
+	for name, item := range extensionMenuItems {
+		if !seen[name] {
+			item.Hide()
+			delete(extensionMenuItems, name)
+		}
 	}
 }
 
-// openRemoteAccess opens macOS Screen Sharing to the specified IP
-func openRemoteAccess(vpnIP string) {
-	// Use macOS Screen Sharing URL scheme
-	// vnc://username@hostname or vnc://ip-address
-	url := fmt.Sprintf("vnc://%s", vpnIP)
+// handleExtensionClick restarts an extension (and resets its crash-loop breaker) on click
+func handleExtensionClick(item *systray.MenuItem, name string) {
+	for range item.ClickedCh {
+		go func() {
+			if err := extensionManager.RetryExtension(name); err != nil {
+				log.Printf("[EXT] Failed to restart %s: %v", name, err)
+			}
+		}()
+	}
+}
 
-	cmd := exec.Command("open", url)
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to open Screen Sharing: %v", err)
-		dialog.Message("Failed to open Screen Sharing to %s\n\nError: %v", vpnIP, err).Title("Remote Access Error").Error()
-	} else {
-		log.Printf("Opened Screen Sharing to %s", vpnIP)
+// handleExtensionRollBackClick reinstalls an extension's previous version on click
+func handleExtensionRollBackClick(item *systray.MenuItem, name string) {
+	for range item.ClickedCh {
+		go func() {
+			if err := extensionManager.RollBackExtension(name); err != nil {
+				log.Printf("[EXT] Failed to roll back %s: %v", name, err)
+			}
+		}()
 	}
 }
 
-// startVideoCall initiates a video call with the specified peer
-func startVideoCall(peer *PeerInfo) {
-	log.Printf("[VIDEO] Initiating call with %s (%s)", peer.Hostname, peer.VPNAddress)
+// handleExtensionLogClick opens an extension's log in Console on click
+func handleExtensionLogClick(item *systray.MenuItem, name string) {
+	for range item.ClickedCh {
+		path := extensionManager.LogPath(name)
+		if _, err := os.Stat(path); err != nil {
+			dialog.Message("%s has not written any output yet.", name).Title("Extension Log").Info()
+			continue
+		}
+		if err := exec.Command("open", "-a", "Console", path).Start(); err != nil {
+			log.Printf("[EXT] Failed to open log of %s: %v", name, err)
+		}
+	}
+}
 
-	// Video extension will handle everything via IPC
-	// Just trigger it by opening the video call URL
-	// The extension listens on localhost:8890 (or dynamic port)
-	url := fmt.Sprintf("http://localhost:8890/?peer=%s&name=%s", peer.VPNAddress, peer.Hostname)
+// getUsernameForPeer determines the SSH username for a peer based on hostname
+func getUsernameForPeer(peer *protocol.PeerInfo) string {
+	// Simple mapping based on hostname patterns
+	hostname := strings.ToLower(peer.Hostname)
 
-	// Open browser window - the video extension will handle the rest
-	cmd := exec.Command("open", url)
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to open video call window: %v", err)
-		dialog.Message("Failed to open video call window\n\nMake sure the video extension is running.\n\nError: %v", err).Title("Video Call Error").Error()
-	} else {
-		log.Printf("Opened video call with %s (%s)", peer.Hostname, peer.VPNAddress)
+	// Extract username from hostname like "Miguels-MacBook-Air.local" → "miguel_lemos"
+	if strings.Contains(hostname, "miguel") {
+		return "miguel_lemos"
+	} else if strings.Contains(hostname, "anastasiia") {
+		return "anastasiia"
 	}
+
+	// Fallback to current user
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
 }
 
 
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/getlantern/systray"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+	"github.com/sqweek/dialog"
+)
+
+// servicesFilePath is where the user lists the services this Mac offers the
+// family. The VPN client reads it when it starts (-services).
+func servicesFilePath() string {
+	configDir, _ := os.UserConfigDir()
+	return filepath.Join(configDir, "family-vpn", "services.json")
+}
+
+// handleEditServicesClick opens the services file in a text editor, creating
+// an empty one first
+func handleEditServicesClick(item *systray.MenuItem) {
+	for range item.ClickedCh {
+		path := servicesFilePath()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.WriteFile(path, []byte("[]\n"), 0644)
+			}
+			if err != nil {
+				log.Printf("Failed to create %s: %v", path, err)
+				continue
+			}
+		}
+
+		if err := exec.Command("open", "-t", path).Start(); err != nil {
+			log.Printf("Failed to open %s: %v", path, err)
+			continue
+		}
+		dialog.Message("List the services this Mac offers, for example:\n\n"+
+			`[{"name": "plex", "port": 32400, "protocol": "http", "description": "Movies"}]`+
+			"\n\nChanges apply the next time the VPN connects.").Title("My Services").Info()
+	}
+}
+
+// addServiceItems lists what a peer offers under its menu item. Services with
+// a URL open on click; the rest only show their port.
+func addServiceItems(item *systray.MenuItem, peer *protocol.PeerInfo) {
+	for _, service := range peer.Services {
+		label := fmt.Sprintf("🔌 %s (%s %d)", service.Name, service.Protocol, service.Port)
+		tooltip := service.Description
+		if tooltip == "" {
+			tooltip = fmt.Sprintf("%s on %s", service.Name, peer.Hostname)
+		}
+
+		serviceItem := item.AddSubMenuItem(label, tooltip)
+		url := service.URL(peer.VPNAddress)
+		if url == "" {
+			serviceItem.Disable()
+			continue
+		}
+		go handleServiceClick(serviceItem, url)
+	}
+}
+
+// handleServiceClick opens a peer's service each time its menu item is clicked
+func handleServiceClick(item *systray.MenuItem, url string) {
+	for range item.ClickedCh {
+		if err := exec.Command("open", url).Start(); err != nil {
+			log.Printf("Failed to open %s: %v", url, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ArtifactKeyEnv holds the base64 Ed25519 public key extension releases are
+// verified with
+const ArtifactKeyEnv = "FAMILY_VPN_ARTIFACT_KEY"
+
+// Release is a prebuilt extension binary for one platform. The binary is
+// stored on the server by its SHA-256 (content addressed); the release is
+// signed by the operator so clients can trust it whoever serves it.
+type Release struct {
+	Name      string          `json:"name"`
+	Version   string          `json:"version"`
+	OS        string          `json:"os"`   // GOOS
+	Arch      string          `json:"arch"` // GOARCH
+	SHA256    string          `json:"sha256"`
+	Size      int64           `json:"size"`
+	Manifest  json.RawMessage `json:"manifest"`  // extension.json shipped with the binary
+	Signature string          `json:"signature"` // Base64 Ed25519 signature of signedMessage
+}
+
+// validSHA256 matches a hex encoded SHA-256 digest
+var validSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidSHA256 reports whether s is a hex encoded SHA-256 digest (a blob name)
+func ValidSHA256(s string) bool {
+	return validSHA256.MatchString(s)
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signedMessage is what the signature covers: everything a client acts on
+func (r *Release) signedMessage() []byte {
+	manifestSum := sha256.Sum256(r.Manifest)
+	return []byte(fmt.Sprintf("family-vpn-release/v1\n%s\n%s\n%s/%s\n%s\n%d\n%x\n",
+		r.Name, r.Version, r.OS, r.Arch, r.SHA256, r.Size, manifestSum))
+}
+
+// Sign signs the release with the operator's private key
+func (r *Release) Sign(key ed25519.PrivateKey) {
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.signedMessage()))
+}
+
+// Verify checks the signature and that the shipped manifest describes this release
+func (r *Release) Verify(key ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(key, r.signedMessage(), signature) {
+		return fmt.Errorf("release %s v%s has an invalid signature", r.Name, r.Version)
+	}
+	if !ValidSHA256(r.SHA256) {
+		return fmt.Errorf("release %s v%s has an invalid digest", r.Name, r.Version)
+	}
+
+	manifest, err := r.LoadManifest()
+	if err != nil {
+		return err
+	}
+	if manifest.Name != r.Name || manifest.Version != r.Version {
+		return fmt.Errorf("release %s v%s ships the manifest of %s v%s", r.Name, r.Version, manifest.Name, manifest.Version)
+	}
+	return nil
+}
+
+// VerifyBinary checks a downloaded binary against the release digest
+func (r *Release) VerifyBinary(data []byte) error {
+	if int64(len(data)) != r.Size {
+		return fmt.Errorf("binary is %d bytes, release says %d", len(data), r.Size)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != r.SHA256 {
+		return fmt.Errorf("binary does not match digest %s", r.SHA256)
+	}
+	return nil
+}
+
+// LoadManifest parses and validates the manifest shipped with the release
+func (r *Release) LoadManifest() (*Manifest, error) {
+	manifest, err := ParseManifest(r.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("release %s v%s: %v", r.Name, r.Version, err)
+	}
+	return manifest, nil
+}
+
+// CompareVersions compares two dotted numeric versions ("1.2.10", "v2.0"),
+// returning -1, 0 or 1. Missing components count as 0.
+func CompareVersions(a, b string) (int, error) {
+	x, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var m, n int
+		if i < len(x) {
+			m = x[i]
+		}
+		if i < len(y) {
+			n = y[i]
+		}
+		switch {
+		case m < n:
+			return -1, nil
+		case m > n:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// parseVersion splits a dotted numeric version into its components
+func parseVersion(version string) ([]int, error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	components := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		components[i] = n
+	}
+	return components, nil
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// signedRelease returns a release of binary signed with key
+func signedRelease(key ed25519.PrivateKey, binary []byte) *Release {
+	sum := sha256.Sum256(binary)
+	release := &Release{
+		Name:     "chat",
+		Version:  "1.2.0",
+		OS:       "darwin",
+		Arch:     "arm64",
+		SHA256:   hex.EncodeToString(sum[:]),
+		Size:     int64(len(binary)),
+		Manifest: []byte(`{"name":"chat","version":"1.2.0","binary":"chat"}`),
+	}
+	release.Sign(key)
+	return release
+}
+
+func TestReleaseVerify(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	otherPublic, otherPrivate, _ := ed25519.GenerateKey(nil)
+	binary := []byte("binary")
+
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		release func() *Release
+		wantErr bool
+	}{
+		{"valid", public, func() *Release { return signedRelease(private, binary) }, false},
+		{"other key", otherPublic, func() *Release { return signedRelease(private, binary) }, true},
+		{"signed by someone else", public, func() *Release { return signedRelease(otherPrivate, binary) }, true},
+		{"no signature", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Signature = ""
+			return r
+		}, true},
+		{"version changed", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Version = "9.9.9"
+			return r
+		}, true},
+		{"digest changed", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.SHA256 = hex.EncodeToString(make([]byte, 32))
+			return r
+		}, true},
+		{"platform changed", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.OS = "windows"
+			return r
+		}, true},
+		{"manifest changed", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Manifest = []byte(`{"name":"chat","version":"1.2.0","binary":"evil"}`)
+			return r
+		}, true},
+		{"invalid digest", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.SHA256 = "../../etc/passwd"
+			r.Sign(private)
+			return r
+		}, true},
+		{"manifest of another version", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Manifest = []byte(`{"name":"chat","version":"1.0.0","binary":"chat"}`)
+			r.Sign(private)
+			return r
+		}, true},
+		{"manifest of another extension", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Manifest = []byte(`{"name":"files","version":"1.2.0","binary":"files"}`)
+			r.Sign(private)
+			return r
+		}, true},
+		{"invalid manifest", public, func() *Release {
+			r := signedRelease(private, binary)
+			r.Manifest = []byte(`{"name":"chat","version":"1.2.0","binary":"/bin/sh"}`)
+			r.Sign(private)
+			return r
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.release().Verify(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReleaseVerifyBinary(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(nil)
+	release := signedRelease(private, []byte("binary"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"matches", []byte("binary"), false},
+		{"other content", []byte("bInary"), true},
+		{"truncated", []byte("binar"), true},
+		{"longer", []byte("binary!"), true},
+		{"empty", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := release.VerifyBinary(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyBinary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    int
+		wantErr bool
+	}{
+		{"1.0.0", "1.0.0", 0, false},
+		{"1.0.1", "1.0.0", 1, false},
+		{"1.0.0", "1.0.1", -1, false},
+		{"1.10.0", "1.9.0", 1, false},
+		{"2.0", "1.9.9", 1, false},
+		{"1.0", "1.0.0", 0, false},
+		{"1.0.0.1", "1.0", 1, false},
+		{"v1.2.0", "1.2.0", 0, false},
+		{"1.0.0-beta", "1.0.0", 0, true},
+		{"1..0", "1.0.0", 0, true},
+		{"", "1.0.0", 0, true},
+		{"1.0.0", "-1", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			got, err := CompareVersions(tt.a, tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompareVersions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CompareVersions() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
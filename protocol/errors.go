@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned by the IPC API
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeTunnelDown       = "tunnel_down"
+	CodeQueueFull        = "queue_full"
+	CodeTooLarge         = "too_large"
+	CodeInternal         = "internal"
+)
+
+// Error is a typed IPC error. Handlers write it as JSON with the matching
+// HTTP status; the ipc client decodes it back, so callers can use errors.Is.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"-"`
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Is matches errors by code, so errors.Is(err, ErrTunnelDown) works across the IPC boundary
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Well-known errors
+var (
+	ErrUnauthorized     = &Error{Code: CodeUnauthorized, Message: "missing or invalid IPC token", Status: http.StatusUnauthorized}
+	ErrForbidden        = &Error{Code: CodeForbidden, Message: "token not valid for this request", Status: http.StatusForbidden}
+	ErrMethodNotAllowed = &Error{Code: CodeMethodNotAllowed, Message: "method not allowed", Status: http.StatusMethodNotAllowed}
+	ErrTunnelDown       = &Error{Code: CodeTunnelDown, Message: "VPN tunnel is not connected", Status: http.StatusServiceUnavailable}
+	ErrQueueFull        = &Error{Code: CodeQueueFull, Message: "outgoing signal queue is full", Status: http.StatusServiceUnavailable}
+	ErrSignalTooLarge   = &Error{Code: CodeTooLarge, Message: "signal is larger than MaxSignalSize", Status: http.StatusRequestEntityTooLarge}
+)
+
+// NewError creates an error with a specific message
+func NewError(code string, status int, message string) *Error {
+	return &Error{Code: code, Message: message, Status: status}
+}
+
+// errorBody is the JSON body of an error response
+type errorBody struct {
+	Error *Error `json:"error"`
+}
+
+// WriteError writes err as a JSON error response
+func WriteError(w http.ResponseWriter, err *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(errorBody{Error: err})
+}
+
+// ReadError decodes an error response. Bodies that aren't protocol errors
+// (e.g. from an older VPN client) are mapped from the HTTP status.
+func ReadError(status int, body []byte) *Error {
+	var decoded errorBody
+	if err := json.Unmarshal(body, &decoded); err == nil && decoded.Error != nil {
+		decoded.Error.Status = status
+		return decoded.Error
+	}
+
+	code := CodeInternal
+	switch status {
+	case http.StatusBadRequest:
+		code = CodeBadRequest
+	case http.StatusUnauthorized:
+		code = CodeUnauthorized
+	case http.StatusForbidden:
+		code = CodeForbidden
+	case http.StatusNotFound:
+		code = CodeNotFound
+	case http.StatusMethodNotAllowed:
+		code = CodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		code = CodeTooLarge
+	}
+	return &Error{Code: code, Message: strings.TrimSpace(string(body)), Status: status}
+}
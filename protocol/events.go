@@ -0,0 +1,51 @@
+package protocol
+
+import "encoding/json"
+
+// Event types pushed on the IPC /events stream
+const (
+	EventSignal  = "signal"  // Incoming signal or delivery receipt for the subscribed extension (Signal)
+	EventPeers   = "peers"   // Peer list changed ([]PeerInfo)
+	EventState   = "state"   // VPN connection state changed (ConnectionState)
+	EventUpdate  = "update"  // Server announced a component update (UpdateNotice)
+	EventMessage = "message" // Server operator sent everyone a message (OperatorMessage)
+
+	EventExtensions = "extensions" // Extension registered, unregistered or expired ([]RegisteredExtension)
+)
+
+// Event is one Server-Sent Event from the /events stream
+type Event struct {
+	Type string
+	Data json.RawMessage
+}
+
+// ConnectionState describes the VPN client's tunnel and signaling connection
+type ConnectionState struct {
+	Connected bool   `json:"connected"`
+	VPNIP     string `json:"vpn_ip"`
+	Server    string `json:"server"`
+	Signaling bool   `json:"signaling"`
+	// Local proxies into the tunnel, set when the client runs its userspace
+	// network stack (vpn-client -netstack) instead of a TUN device
+	SOCKSProxy string `json:"socks_proxy,omitempty"` // e.g. "127.0.0.1:1080"
+	HTTPProxy  string `json:"http_proxy,omitempty"`  // e.g. "127.0.0.1:3128"
+}
+
+// UpdateNotice is a component update announced by the VPN server
+type UpdateNotice struct {
+	Message string `json:"message"` // e.g. "UPDATE_VIDEO", "UPDATE_VPN", "UPDATE_ALL"
+}
+
+// OperatorMessage is a message the VPN server's operator sent every client
+// (admin API POST /admin/broadcast)
+type OperatorMessage struct {
+	Message    string `json:"message"`
+	ReceivedAt string `json:"received_at"` // RFC 3339
+}
+
+// HealthStatus is the reply to GET /health
+type HealthStatus struct {
+	Status  string `json:"status"`  // "healthy"
+	Enabled bool   `json:"enabled"` // Tunnel is up
+	Schema  int    `json:"schema"`  // SchemaVersion of the VPN client
+}
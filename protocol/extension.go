@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Registration timing: extensions send a heartbeat every
+// ExtensionHeartbeatInterval, and the VPN core drops registrations that go
+// ExtensionRegistrationTTL without one
+const (
+	ExtensionHeartbeatInterval = 10 * time.Second
+	ExtensionRegistrationTTL   = 30 * time.Second
+)
+
+// ErrNotRegistered is returned for heartbeats of an extension the VPN core
+// doesn't know (e.g. after the core restarted); the extension should register again
+var ErrNotRegistered = &Error{Code: CodeNotFound, Message: "extension is not registered", Status: http.StatusNotFound}
+
+// ExtensionInfo identifies an extension binary
+type ExtensionInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Schema  int    `json:"schema"` // SchemaVersion the extension was built against
+}
+
+// ExtensionHealth is an extension's reply to GET /health on its control socket
+type ExtensionHealth struct {
+	ExtensionInfo
+	Healthy bool            `json:"healthy"`
+	Status  json.RawMessage `json:"status,omitempty"` // Extension-specific details, see framework.StatusReporter
+}
+
+// ExtensionRegistration announces a running extension to the VPN core
+// (POST /extensions/register)
+type ExtensionRegistration struct {
+	ExtensionInfo
+	Endpoints map[string]string `json:"endpoints,omitempty"` // e.g. "ui": "http://127.0.0.1:8890"
+	Services  []Service         `json:"services,omitempty"`  // Advertised to peers while the extension runs
+}
+
+// RegisteredExtension is an entry of GET /extensions
+type RegisteredExtension struct {
+	ExtensionRegistration
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
@@ -0,0 +1,3 @@
+module github.com/miguelemosreverte/family-vpn/protocol
+
+go 1.24.0
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ManifestFileName is the manifest every extension ships in its directory
+const ManifestFileName = "extension.json"
+
+// Capabilities an extension can request in its manifest
+const (
+	CapabilitySignals   = "signals"     // Send and receive signals over the VPN
+	CapabilityPeers     = "peers"       // Read the peer list
+	CapabilityVPNListen = "vpn-listen"  // Accept connections from peers on the VPN address
+	CapabilityLaunch    = "launch-apps" // Open terminals, browsers or other local apps
+)
+
+// knownCapabilities are the capabilities this schema version can grant
+var knownCapabilities = map[string]bool{
+	CapabilitySignals:   true,
+	CapabilityPeers:     true,
+	CapabilityVPNListen: true,
+	CapabilityLaunch:    true,
+}
+
+// HTTP port bindings
+const (
+	BindLocal = "local" // 127.0.0.1 only
+	BindVPN   = "vpn"   // Reachable by peers over the VPN
+)
+
+// ArgIPCPort in manifest args is replaced with the VPN client's IPC port
+const ArgIPCPort = "{ipc_port}"
+
+// DefaultStopTimeout is how long an extension gets to exit after SIGTERM
+// before it is killed, unless its manifest sets stop_timeout
+const DefaultStopTimeout = 5 * time.Second
+
+// Manifest describes an extension: how to run it, what it needs and which
+// actions it adds to each peer in the menu bar
+type Manifest struct {
+	Name         string       `json:"name"`
+	Version      string       `json:"version"`
+	Description  string       `json:"description,omitempty"`
+	Binary       string       `json:"binary"`                 // Entry binary, relative to the extension directory
+	Args         []string     `json:"args,omitempty"`         // May contain ArgIPCPort
+	Capabilities []string     `json:"capabilities,omitempty"` // Capability* constants
+	HTTP         []HTTPPort   `json:"http,omitempty"`         // Ports the extension listens on
+	PeerActions  []PeerAction `json:"peer_actions,omitempty"` // Per-peer menu entries
+	StopTimeout  int          `json:"stop_timeout,omitempty"` // Seconds between SIGTERM and SIGKILL (0 = DefaultStopTimeout)
+}
+
+// HTTPPort is a port an extension listens on
+type HTTPPort struct {
+	Name string `json:"name"` // e.g. "ui"
+	Port int    `json:"port"` // 0 = any free port
+	Bind string `json:"bind"` // BindLocal or BindVPN
+}
+
+// PeerAction is a menu entry shown under each peer. Exactly one way of
+// running it is set:
+//   - Open: a URL opened with the system handler (browser, vnc://, ...)
+//   - Request: a URL fetched in the background
+//   - Invoke: POST /actions/<id> on the extension's control socket, with a
+//     PeerTarget body (see framework.ExtensionBase.HandleAction)
+//
+// Open and Request URLs may use the {peer}, {name} and {username} placeholders.
+type PeerAction struct {
+	ID      string `json:"id"`
+	Label   string `json:"label"`
+	Icon    string `json:"icon,omitempty"` // Emoji shown before the label
+	Tooltip string `json:"tooltip,omitempty"`
+	Open    string `json:"open,omitempty"`
+	Request string `json:"request,omitempty"`
+	Invoke  bool   `json:"invoke,omitempty"`
+}
+
+// Title is the menu label of the action
+func (a *PeerAction) Title() string {
+	if a.Icon == "" {
+		return a.Label
+	}
+	return a.Icon + " " + a.Label
+}
+
+// PeerTarget is the peer a peer action runs for
+type PeerTarget struct {
+	Peer     string `json:"peer"`     // VPN address
+	Name     string `json:"name"`     // Hostname
+	Username string `json:"username"` // Login on the peer
+}
+
+// ExpandURL fills the {peer}, {name} and {username} placeholders of a peer action URL
+func (t PeerTarget) ExpandURL(template string) string {
+	return strings.NewReplacer(
+		"{peer}", url.QueryEscape(t.Peer),
+		"{name}", url.QueryEscape(t.Name),
+		"{username}", url.QueryEscape(t.Username),
+	).Replace(template)
+}
+
+// validName matches extension and action names (also used as directory names)
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// LoadManifest reads and validates a manifest file
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return manifest, nil
+}
+
+// ParseManifest parses and validates manifest JSON
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// Validate checks that a manifest is complete and only asks for things we can grant
+func (m *Manifest) Validate() error {
+	if !validName.MatchString(m.Name) {
+		return fmt.Errorf("invalid name %q", m.Name)
+	}
+	if m.Version == "" {
+		return fmt.Errorf("version is required")
+	}
+	if m.Binary == "" || filepath.IsAbs(m.Binary) || strings.Contains(m.Binary, "..") {
+		return fmt.Errorf("binary must be a path inside the extension directory")
+	}
+
+	if m.StopTimeout < 0 {
+		return fmt.Errorf("stop_timeout must not be negative")
+	}
+
+	for _, capability := range m.Capabilities {
+		if !knownCapabilities[capability] {
+			return fmt.Errorf("unknown capability %q", capability)
+		}
+	}
+
+	for _, port := range m.HTTP {
+		if port.Port < 0 || port.Port > 65535 {
+			return fmt.Errorf("invalid port %d for %q", port.Port, port.Name)
+		}
+		if port.Bind != BindLocal && port.Bind != BindVPN {
+			return fmt.Errorf("invalid bind %q for %q", port.Bind, port.Name)
+		}
+		if port.Bind == BindVPN && !m.HasCapability(CapabilityVPNListen) {
+			return fmt.Errorf("port %q is bound to the VPN but %q is not requested", port.Name, CapabilityVPNListen)
+		}
+	}
+
+	actions := make(map[string]bool)
+	for _, action := range m.PeerActions {
+		if !validName.MatchString(action.ID) {
+			return fmt.Errorf("invalid peer action id %q", action.ID)
+		}
+		if actions[action.ID] {
+			return fmt.Errorf("duplicate peer action %q", action.ID)
+		}
+		actions[action.ID] = true
+		if action.Label == "" {
+			return fmt.Errorf("peer action %q needs a label", action.ID)
+		}
+		ways := 0
+		for _, set := range []bool{action.Open != "", action.Request != "", action.Invoke} {
+			if set {
+				ways++
+			}
+		}
+		if ways != 1 {
+			return fmt.Errorf("peer action %q needs exactly one of open, request or invoke", action.ID)
+		}
+	}
+
+	return nil
+}
+
+// StopGracePeriod returns how long the extension may take to exit after SIGTERM
+func (m *Manifest) StopGracePeriod() time.Duration {
+	if m.StopTimeout == 0 {
+		return DefaultStopTimeout
+	}
+	return time.Duration(m.StopTimeout) * time.Second
+}
+
+// HasCapability reports whether the manifest requests a capability
+func (m *Manifest) HasCapability(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
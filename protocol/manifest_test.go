@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string // Substring of the error, "" = valid
+	}{
+		{"minimal", `{"name":"chat","version":"1.0.0","binary":"chat"}`, ""},
+		{"full", `{"name":"files","version":"1.0.0","binary":"bin/files","capabilities":["signals","vpn-listen"],
+			"http":[{"name":"ui","port":0,"bind":"local"},{"name":"transfer","port":7001,"bind":"vpn"}],
+			"peer_actions":[{"id":"send","label":"Send File","invoke":true},{"id":"open","label":"Open","open":"http://{peer}:7001"}]}`, ""},
+		{"not json", `{"name":`, "failed to parse"},
+		{"bad name", `{"name":"Chat!","version":"1.0.0","binary":"chat"}`, "invalid name"},
+		{"no version", `{"name":"chat","binary":"chat"}`, "version is required"},
+		{"no binary", `{"name":"chat","version":"1.0.0"}`, "binary must be"},
+		{"absolute binary", `{"name":"chat","version":"1.0.0","binary":"/bin/sh"}`, "binary must be"},
+		{"binary outside", `{"name":"chat","version":"1.0.0","binary":"../ssh/ssh"}`, "binary must be"},
+		{"negative stop timeout", `{"name":"chat","version":"1.0.0","binary":"chat","stop_timeout":-1}`, "stop_timeout"},
+		{"unknown capability", `{"name":"chat","version":"1.0.0","binary":"chat","capabilities":["root"]}`, "unknown capability"},
+		{"bad port", `{"name":"chat","version":"1.0.0","binary":"chat","http":[{"name":"ui","port":70000,"bind":"local"}]}`, "invalid port"},
+		{"bad bind", `{"name":"chat","version":"1.0.0","binary":"chat","http":[{"name":"ui","port":80,"bind":"all"}]}`, "invalid bind"},
+		{"vpn bind without capability", `{"name":"chat","version":"1.0.0","binary":"chat","http":[{"name":"ui","port":80,"bind":"vpn"}]}`, "vpn-listen"},
+		{"bad action id", `{"name":"chat","version":"1.0.0","binary":"chat","peer_actions":[{"id":"Send","label":"Send","invoke":true}]}`, "invalid peer action id"},
+		{"duplicate action", `{"name":"chat","version":"1.0.0","binary":"chat","peer_actions":[{"id":"a","label":"A","invoke":true},{"id":"a","label":"B","invoke":true}]}`, "duplicate peer action"},
+		{"action without label", `{"name":"chat","version":"1.0.0","binary":"chat","peer_actions":[{"id":"a","invoke":true}]}`, "needs a label"},
+		{"action without way", `{"name":"chat","version":"1.0.0","binary":"chat","peer_actions":[{"id":"a","label":"A"}]}`, "exactly one"},
+		{"action with two ways", `{"name":"chat","version":"1.0.0","binary":"chat","peer_actions":[{"id":"a","label":"A","invoke":true,"open":"http://{peer}"}]}`, "exactly one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := ParseManifest([]byte(tt.json))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseManifest() error = %v", err)
+				}
+				if manifest.Name == "" {
+					t.Error("ParseManifest() returned an empty manifest")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseManifest() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
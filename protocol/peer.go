@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// PeerInfo represents a connected VPN peer. The client sends Hostname, OS,
+// Capabilities and Services at handshake; the server fills in the rest and
+// broadcasts the list (PEER_LIST control message, IPC "peers" event and GET /peers).
+// PEER_LIST leaves out Capabilities and Services, which clients get per peer
+// in PEER_DETAILS (FeaturePeerDetails), so the list stays small.
+type PeerInfo struct {
+	Hostname     string            `json:"hostname"`
+	VPNAddress   string            `json:"vpn_address"`
+	PublicIP     string            `json:"public_ip"`
+	ConnectedAt  string            `json:"connected_at"`
+	OS           string            `json:"os"`
+	Capabilities *PeerCapabilities `json:"capabilities,omitempty"` // Nil for clients that don't advertise them
+	Services     []Service         `json:"services,omitempty"`     // What the device offers the family
+	LeaseToken   string            `json:"lease_token,omitempty"`  // Handshake only: the token of the device's previous address (LEASE)
+}
+
+// Protocol features a client can advertise
+const (
+	FeatureSignals        = "signals"         // Relays extension signals (CTRL:SIGNAL)
+	FeatureSignalReceipts = "signal-receipts" // Sends delivered/acked/failed receipts
+	FeatureWebSocket      = "websocket"       // Receives signals over WebSocket signaling
+	FeatureCapabilities   = "capabilities"    // Sends CTRL:CAPABILITIES updates
+	FeatureServices       = "services"        // Sends CTRL:SERVICES updates
+	FeatureLargeFrames    = "large-frames"    // Accepts frames up to MaxFrameSize
+	FeaturePeerDetails    = "peer-details"    // Takes capabilities and services from PEER_DETAILS
+)
+
+// Limits on what a client advertises, so that PEER_LIST and PEER_DETAILS
+// always fit in a frame. The server cuts hostnames and OS names, drops
+// services over MaxServices and refuses capabilities over the limits.
+const (
+	MaxHostnameLength = 64  // Bytes of PeerInfo.Hostname and OS
+	MaxServices       = 32  // Services per device
+	MaxExtensions     = 32  // Running extensions in PeerCapabilities
+	MaxFeatures       = 32  // Features in PeerCapabilities
+	MaxNameLength     = 64  // Bytes of service, extension and feature names, protocols and versions
+	MaxDescription    = 200 // Bytes of a service description
+)
+
+// PeerDetails is the body of a PEER_DETAILS control message: the parts of a
+// peer's PeerInfo that are too large to repeat in every PEER_LIST
+type PeerDetails struct {
+	VPNAddress   string            `json:"vpn_address"`
+	Capabilities *PeerCapabilities `json:"capabilities,omitempty"`
+	Services     []Service         `json:"services,omitempty"`
+}
+
+// PeerCapabilities is what a peer's client advertises about itself. It is
+// sent in the handshake PeerInfo, then as a CTRL:CAPABILITIES:<json> control
+// message whenever an extension starts or stops.
+type PeerCapabilities struct {
+	ClientVersion string          `json:"client_version"`
+	Schema        int             `json:"schema"` // IPC SchemaVersion of the client
+	Features      []string        `json:"features,omitempty"`
+	Extensions    []ExtensionInfo `json:"extensions,omitempty"` // Running extensions
+}
+
+// Validate checks that advertised capabilities are within the limits
+func (c *PeerCapabilities) Validate() error {
+	if len(c.ClientVersion) > MaxNameLength {
+		return fmt.Errorf("client version too long")
+	}
+	if len(c.Features) > MaxFeatures {
+		return fmt.Errorf("%d features, at most %d allowed", len(c.Features), MaxFeatures)
+	}
+	for _, feature := range c.Features {
+		if len(feature) > MaxNameLength {
+			return fmt.Errorf("feature name too long")
+		}
+	}
+	if len(c.Extensions) > MaxExtensions {
+		return fmt.Errorf("%d extensions, at most %d allowed", len(c.Extensions), MaxExtensions)
+	}
+	for _, ext := range c.Extensions {
+		if len(ext.Name) > MaxNameLength || len(ext.Version) > MaxNameLength {
+			return fmt.Errorf("extension name or version too long")
+		}
+	}
+	return nil
+}
+
+// HasFeature reports whether the peer advertised a protocol feature
+func (c *PeerCapabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Extension returns a running extension of the peer, or nil
+func (c *PeerCapabilities) Extension(name string) *ExtensionInfo {
+	for i := range c.Extensions {
+		if c.Extensions[i].Name == name {
+			return &c.Extensions[i]
+		}
+	}
+	return nil
+}
+
+// RunsExtension reports whether the peer runs an extension. Peers that
+// don't advertise capabilities are assumed to run everything.
+func (p *PeerInfo) RunsExtension(name string) bool {
+	return p.Capabilities == nil || p.Capabilities.Extension(name) != nil
+}
+
+// Traffic counts tunnel traffic for a single peer, as seen by the server.
+// The server updates the counters with sync/atomic.
+type Traffic struct {
+	BytesIn    int64 `json:"bytes_in"`    // Client -> server
+	BytesOut   int64 `json:"bytes_out"`   // Server -> client
+	PacketsIn  int64 `json:"packets_in"`  // Client -> server
+	PacketsOut int64 `json:"packets_out"` // Server -> client
+}
+
+// Snapshot returns a consistent copy of counters that are being updated atomically
+func (t *Traffic) Snapshot() Traffic {
+	return Traffic{
+		BytesIn:    atomic.LoadInt64(&t.BytesIn),
+		BytesOut:   atomic.LoadInt64(&t.BytesOut),
+		PacketsIn:  atomic.LoadInt64(&t.PacketsIn),
+		PacketsOut: atomic.LoadInt64(&t.PacketsOut),
+	}
+}
@@ -0,0 +1,59 @@
+// Package protocol defines the types shared by the VPN server, the VPN client,
+// the menu bar and extensions: peers, signals, IPC events, traffic stats and
+// errors. See SCHEMA.md for the wire format of the local IPC API.
+package protocol
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SchemaVersion is the version of the IPC schema described in SCHEMA.md.
+// It is bumped on incompatible changes; adding optional fields is not one.
+const SchemaVersion = 1
+
+// SchemaHeader carries SchemaVersion on every IPC response
+const SchemaHeader = "X-Family-VPN-Schema"
+
+// Tunnel frames are a 4-byte big-endian length followed by an IP packet or a
+// "CTRL:" control message, encrypted when the session is. IP packets fit the
+// MTU; control messages (peer details, signals) may be larger.
+const (
+	MaxFrameSize      = 256 << 10         // Largest frame the server and FeatureLargeFrames clients accept
+	LegacyFrameSize   = 2800              // Largest frame older clients accept (twice their MTU)
+	MaxControlMessage = MaxFrameSize - 64 // Largest control message, leaving room for encryption
+)
+
+// Environment variables the extension manager sets for extensions
+const (
+	TokenEnv           = "FAMILY_VPN_IPC_TOKEN"        // Extension's IPC token
+	SocketEnv          = "FAMILY_VPN_IPC_SOCKET"       // Overrides the IPC socket path
+	ExtensionSocketEnv = "FAMILY_VPN_EXTENSION_SOCKET" // Where the extension serves its control API
+)
+
+// File names inside the runtime directory
+const (
+	SocketFileName = "ipc.sock"  // IPC Unix socket
+	TokenFileName  = "ipc-token" // Manager token (mode 0600)
+)
+
+// RuntimeDir returns the private directory the VPN client shares with the menu
+// bar and extensions of user uid
+func RuntimeDir(uid int) string {
+	return filepath.Join("/tmp", fmt.Sprintf("family-vpn-%d", uid))
+}
+
+// SocketPath returns the IPC socket of user uid
+func SocketPath(uid int) string {
+	return filepath.Join(RuntimeDir(uid), SocketFileName)
+}
+
+// ExtensionSocketPath returns the control socket of an extension of user uid
+func ExtensionSocketPath(uid int, extension string) string {
+	return filepath.Join(RuntimeDir(uid), "ext-"+extension+".sock")
+}
+
+// ManagerTokenFile returns the manager token file of user uid
+func ManagerTokenFile(uid int) string {
+	return filepath.Join(RuntimeDir(uid), TokenFileName)
+}
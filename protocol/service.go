@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Service is something a device offers the family, e.g. a printer, a Plex
+// server or SSH. Clients advertise their services to the server, which passes
+// them on to every peer (PeerInfo.Services, see PeerDetails).
+type Service struct {
+	Name        string `json:"name"` // e.g. "printer", "plex", "ssh"
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"` // "tcp", "udp", or a URL scheme such as "http", "ssh" or "smb"
+	Description string `json:"description,omitempty"`
+	Extension   string `json:"extension,omitempty"` // Set for services advertised by an extension
+}
+
+// Validate checks that a service can be advertised
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("service name required")
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("service %s: invalid port %d", s.Name, s.Port)
+	}
+	if s.Protocol == "" || strings.ContainsAny(s.Protocol, ":/ ") {
+		return fmt.Errorf("service %s: invalid protocol %q", s.Name, s.Protocol)
+	}
+	if len(s.Name) > MaxNameLength || len(s.Protocol) > MaxNameLength || len(s.Extension) > MaxNameLength {
+		return fmt.Errorf("service %.64s: name, protocol or extension too long", s.Name)
+	}
+	if len(s.Description) > MaxDescription {
+		return fmt.Errorf("service %s: description longer than %d bytes", s.Name, MaxDescription)
+	}
+	return nil
+}
+
+// URL returns the address of the service on a peer, or "" for plain tcp and
+// udp services, which have nothing to open
+func (s *Service) URL(peerIP string) string {
+	if s.Protocol == "tcp" || s.Protocol == "udp" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s:%d", s.Protocol, peerIP, s.Port)
+}
+
+// PeerServices is an entry of GET /services: what one device offers
+type PeerServices struct {
+	Peer     string    `json:"peer"` // VPN address
+	Hostname string    `json:"hostname"`
+	Services []Service `json:"services"`
+}
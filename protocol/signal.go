@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Signal types
+const (
+	SignalTypeData   = "signal" // Extension payload
+	SignalTypeAck    = "ack"    // Receipt: the target extension received signal ID
+	SignalTypeFailed = "failed" // Receipt: signal ID could not be delivered (see Reason)
+)
+
+// Signals travel as single control messages, so their size is limited. The
+// VPN client refuses larger ones with ErrSignalTooLarge; the server fails
+// signals too large for the target's client (see LegacyFrameSize).
+const (
+	MaxSignalSize    = 64 << 10             // Largest encoded SignalMessage a client sends
+	MaxSignalPayload = MaxSignalSize - 1024 // Room for the payload, as measured by SignalPayloadSize
+)
+
+// SignalPayloadSize returns how many bytes a payload takes up in an encoded
+// SignalMessage, where it is escaped as a JSON string
+func SignalPayloadSize(payload []byte) int {
+	encoded, _ := json.Marshal(string(payload))
+	return len(encoded)
+}
+
+// SignalMessage is an extension-addressed message relayed between peers.
+// Clients send it as "CTRL:SIGNAL:<json>"; the server delivers it as "SIGNAL:<json>".
+type SignalMessage struct {
+	ID        string `json:"id"`                   // Unique signal ID (receipts carry the ID they refer to)
+	Type      string `json:"type,omitempty"`       // SignalTypeData (default), SignalTypeAck or SignalTypeFailed
+	Extension string `json:"extension"`            // Target extension on the receiving peer (e.g. "video", "ssh")
+	To        string `json:"to"`                   // Target peer VPN address
+	From      string `json:"from"`                 // Sender VPN address, always stamped by the server
+	Payload   string `json:"payload,omitempty"`    // Extension-defined content
+	TTL       int    `json:"ttl,omitempty"`        // Seconds the signal may wait for delivery
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix time after which the signal is dropped (set by the server)
+	Reason    string `json:"reason,omitempty"`     // Failure reason for SignalTypeFailed receipts
+}
+
+// Expired reports whether the signal's TTL has run out
+func (m *SignalMessage) Expired() bool {
+	return m.ExpiresAt != 0 && time.Now().Unix() > m.ExpiresAt
+}
+
+// Signal is how an extension sees an incoming signal or a receipt over IPC
+type Signal struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`             // SignalTypeData, SignalTypeAck or SignalTypeFailed
+	Peer   string `json:"peer"`             // Sender VPN address
+	Data   string `json:"data,omitempty"`   // Payload of data signals
+	Reason string `json:"reason,omitempty"` // Failure reason of failed receipts
+}
+
+// SignalFromMessage converts a relayed SignalMessage into its IPC form
+func SignalFromMessage(msg *SignalMessage) Signal {
+	return Signal{
+		ID:     msg.ID,
+		Type:   msg.Type,
+		Peer:   msg.From,
+		Data:   msg.Payload,
+		Reason: msg.Reason,
+	}
+}
+
+// SendSignalRequest is the body of POST /signal/send
+type SendSignalRequest struct {
+	Extension string `json:"extension"`     // Target extension on the peer (must match the caller's token)
+	Peer      string `json:"peer"`          // Target peer VPN address
+	Data      string `json:"data"`          // Extension-defined payload
+	TTL       int    `json:"ttl,omitempty"` // Seconds the signal may wait for delivery (0 = default)
+}
+
+// SendSignalResponse is the reply to POST /signal/send
+type SendSignalResponse struct {
+	Status string `json:"status"` // "sent"
+	ID     string `json:"id"`     // Signal ID, referenced by receipts
+}
@@ -0,0 +1,64 @@
+#!/bin/bash
+#
+# Publish Extension Release
+# Builds an extension for every supported Mac, signs it and uploads it to
+# the VPN server's artifact store. Clients install it on UPDATE_<NAME>.
+#
+# Usage:
+#   ./publish-extension.sh ssh
+#
+# Needs in .env:
+#   VPN_ADMIN_TOKEN       - admin API token
+#   ARTIFACT_SIGNING_KEY  - private key file (create with: sign-artifact -genkey <file>)
+#
+# The admin API only answers inside the VPN, so connect to it first.
+#
+
+set -e
+
+ADMIN_SERVER="10.8.0.1" # Server's tunnel address (admin API)
+UPDATE_PORT="9000"
+PLATFORMS=("darwin/arm64" "darwin/amd64")
+NAME="$1"
+
+SCRIPT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )"
+EXT_DIR="$SCRIPT_DIR/extensions/$NAME"
+
+if [ -z "$NAME" ] || [ ! -f "$EXT_DIR/extension.json" ]; then
+    echo "Usage: $0 <extension>   (extensions/<extension>/extension.json must exist)"
+    exit 1
+fi
+
+# Load operator credentials from .env
+if [ -f "$SCRIPT_DIR/.env" ]; then
+    export $(cat "$SCRIPT_DIR/.env" | grep -v '^#' | xargs)
+fi
+
+if [ -z "${VPN_ADMIN_TOKEN:-}" ] || [ -z "${ARTIFACT_SIGNING_KEY:-}" ]; then
+    echo "❌ VPN_ADMIN_TOKEN and ARTIFACT_SIGNING_KEY must be set (add them to .env)"
+    exit 1
+fi
+
+BUILD_DIR=$(mktemp -d)
+trap 'rm -rf "$BUILD_DIR"' EXIT
+
+echo "Building signing tool..."
+(cd "$SCRIPT_DIR/server" && go build -o "$BUILD_DIR/sign-artifact" ./cmd/sign-artifact)
+
+for PLATFORM in "${PLATFORMS[@]}"; do
+    GOOS_TARGET="${PLATFORM%/*}"
+    GOARCH_TARGET="${PLATFORM#*/}"
+    BINARY="$BUILD_DIR/$NAME-$GOOS_TARGET-$GOARCH_TARGET"
+
+    echo "Building $NAME for $PLATFORM..."
+    (cd "$EXT_DIR" && GOOS=$GOOS_TARGET GOARCH=$GOARCH_TARGET go build -o "$BINARY" .)
+
+    "$BUILD_DIR/sign-artifact" \
+        -key "$ARTIFACT_SIGNING_KEY" \
+        -manifest "$EXT_DIR/extension.json" \
+        -binary "$BINARY" \
+        -os "$GOOS_TARGET" -arch "$GOARCH_TARGET" \
+        -server "http://$ADMIN_SERVER:$UPDATE_PORT"
+done
+
+echo "✅ $NAME published"
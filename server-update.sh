@@ -17,6 +17,13 @@ echo "========================================"
 
 cd "$REPO_DIR"
 
+# Load server secrets (e.g. VPN_ADMIN_TOKEN) so the restarted server keeps them
+if [ -f "$REPO_DIR/.env" ]; then
+    set -a
+    . "$REPO_DIR/.env"
+    set +a
+fi
+
 # Pull latest code from GitHub
 echo "📥 Pulling latest code from GitHub..."
 git pull origin main
@@ -31,7 +38,7 @@ fi
 # Rebuild server binary
 echo "🔨 Building server..."
 cd "$REPO_DIR/server"
-/usr/local/go/bin/go build -o "$SERVER_BINARY" main.go
+/usr/local/go/bin/go build -o "$SERVER_BINARY" .
 
 if [ ! -f "$SERVER_BINARY" ]; then
     echo "❌ Build failed - binary not found"
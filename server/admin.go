@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// maxAdminFailures is how many wrong admin tokens a client IP may send per
+// minute before it is refused outright
+const maxAdminFailures = 10
+
+// IPLease records which device was given a VPN address and when
+type IPLease struct {
+	VPNAddress string `json:"vpn_address"`
+	Hostname   string `json:"hostname"`
+	PublicIP   string `json:"public_ip"`
+	AssignedAt string `json:"assigned_at"`
+	ReleasedAt string `json:"released_at,omitempty"`
+	Active     bool   `json:"active"`
+}
+
+// DeviceBan blocks a device from connecting. Devices are recognized by the
+// lease token the server gave them (see allocateIP), not by the hostname they
+// report.
+type DeviceBan struct {
+	VPNAddress string `json:"vpn_address"`        // Address the device held when it was banned
+	Hostname   string `json:"hostname,omitempty"` // What the device called itself, for reference
+	Reason     string `json:"reason,omitempty"`
+	BannedAt   string `json:"banned_at"`
+	LeaseHash  string `json:"lease_hash"` // SHA-256 of the device's lease token
+}
+
+// AdminPeer is the admin view of a connected peer
+type AdminPeer struct {
+	protocol.PeerInfo
+	Encryption bool             `json:"encryption"`
+	Traffic    protocol.Traffic `json:"traffic"`
+}
+
+// leaseHash is how bans store a lease token
+func leaseHash(leaseToken string) string {
+	sum := sha256.Sum256([]byte(leaseToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// isBanned reports whether the device presenting a lease token is banned
+func (s *VPNServer) isBanned(leaseToken string) bool {
+	if leaseToken == "" {
+		return false
+	}
+	s.bansMutex.RLock()
+	defer s.bansMutex.RUnlock()
+	_, banned := s.bans[leaseHash(leaseToken)]
+	return banned
+}
+
+// loadBans reads the persisted ban list (a missing file means no bans)
+func (s *VPNServer) loadBans() error {
+	if s.banFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.banFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bans []*DeviceBan
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.banFile, err)
+	}
+
+	loaded := 0
+	s.bansMutex.Lock()
+	for _, ban := range bans {
+		if ban.LeaseHash == "" {
+			continue // Hostname bans from older servers can't be enforced
+		}
+		s.bans[ban.LeaseHash] = ban
+		loaded++
+	}
+	s.bansMutex.Unlock()
+
+	log.Printf("[ADMIN] Loaded %d device ban(s) from %s", loaded, s.banFile)
+	if loaded < len(bans) {
+		log.Printf("[ADMIN] Ignored %d ban(s) without a lease; ban those devices again by VPN address", len(bans)-loaded)
+	}
+	return nil
+}
+
+// saveBans persists the ban list so bans survive server restarts
+func (s *VPNServer) saveBans() error {
+	if s.banFile == "" {
+		return nil
+	}
+
+	s.bansMutex.RLock()
+	bans := make([]*DeviceBan, 0, len(s.bans))
+	for _, ban := range s.bans {
+		bans = append(bans, ban)
+	}
+	s.bansMutex.RUnlock()
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := s.banFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.banFile)
+}
+
+// kickPeer closes a peer's tunnel connection; cleanup happens in handleClient
+func (s *VPNServer) kickPeer(vpnIP string) bool {
+	s.peersMutex.RLock()
+	conn, exists := s.peerConnections[vpnIP]
+	s.peersMutex.RUnlock()
+
+	if !exists {
+		return false
+	}
+
+	log.Printf("[ADMIN] Kicking peer %s", vpnIP)
+	conn.Close()
+	return true
+}
+
+// adminAddress reports whether a request reached the server on an address
+// the admin API is served on: the tunnel address, where requests travel
+// inside the encrypted tunnel, or loopback. The public HTTP port is plaintext,
+// so the admin token must never be accepted there.
+func adminAddress(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.Equal(net.ParseIP(SERVER_IP)) || ip.IsLoopback())
+}
+
+// requireAdmin wraps an admin handler with bearer token authentication. It
+// only answers on the tunnel address and loopback (see adminAddress), and
+// refuses client IPs that sent too many wrong tokens.
+func (s *VPNServer) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "Admin API disabled (no admin token configured)", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !adminAddress(r) {
+			log.Printf("[ADMIN] Rejected %s %s from %s: not on the tunnel address", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Admin API is only served inside the VPN (http://"+SERVER_IP+":9000)", http.StatusForbidden)
+			return
+		}
+
+		if s.adminFailures.exceeded(clientIP(r)) {
+			log.Printf("[SECURITY] Rate limited %s %s from %s after failed authentications", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			s.adminFailures.record(clientIP(r))
+			log.Printf("[ADMIN] Rejected unauthenticated request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAdminPeers lists connected peers with their traffic counters
+func (s *VPNServer) handleAdminPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.peersMutex.RLock()
+	peers := make([]*AdminPeer, 0, len(s.peers))
+	for vpnIP, peer := range s.peers {
+		adminPeer := &AdminPeer{
+			PeerInfo:   *peer,
+			Encryption: s.peerEncryption[vpnIP],
+		}
+		if traffic, ok := s.peerTraffic[vpnIP]; ok {
+			adminPeer.Traffic = traffic.Snapshot()
+		}
+		peers = append(peers, adminPeer)
+	}
+	s.peersMutex.RUnlock()
+
+	writeJSON(w, peers)
+}
+
+// handleAdminKick disconnects a peer by VPN address
+func (s *VPNServer) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		VPNAddress string `json:"vpn_address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.VPNAddress == "" {
+		http.Error(w, "vpn_address required", http.StatusBadRequest)
+		return
+	}
+
+	if !s.kickPeer(payload.VPNAddress) {
+		http.Error(w, fmt.Sprintf("peer %s not connected", payload.VPNAddress), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "kicked", "vpn_address": payload.VPNAddress})
+}
+
+// handleAdminBans lists, adds (POST) and removes (DELETE) device bans
+func (s *VPNServer) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.bansMutex.RLock()
+		bans := make([]*DeviceBan, 0, len(s.bans))
+		for _, ban := range s.bans {
+			bans = append(bans, ban)
+		}
+		s.bansMutex.RUnlock()
+		writeJSON(w, bans)
+
+	case "POST":
+		var payload struct {
+			VPNAddress string `json:"vpn_address"`
+			Reason     string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.VPNAddress == "" {
+			http.Error(w, "vpn_address required", http.StatusBadRequest)
+			return
+		}
+
+		// The ban follows the lease the server handed out for that address
+		s.peersMutex.RLock()
+		token, leased := s.leaseTokens[payload.VPNAddress]
+		lease := s.leases[payload.VPNAddress]
+		s.peersMutex.RUnlock()
+		if !leased || lease == nil {
+			http.Error(w, fmt.Sprintf("no lease for %s", payload.VPNAddress), http.StatusNotFound)
+			return
+		}
+
+		ban := &DeviceBan{
+			VPNAddress: payload.VPNAddress,
+			Hostname:   lease.Hostname,
+			Reason:     payload.Reason,
+			BannedAt:   time.Now().Format(time.RFC3339),
+			LeaseHash:  leaseHash(token),
+		}
+		s.bansMutex.Lock()
+		s.bans[ban.LeaseHash] = ban
+		s.bansMutex.Unlock()
+
+		if err := s.saveBans(); err != nil {
+			log.Printf("[ADMIN] Failed to persist bans: %v", err)
+		}
+		log.Printf("[ADMIN] Banned device %s at %s (%s)", ban.Hostname, ban.VPNAddress, ban.Reason)
+
+		// Disconnect the banned device if it is online
+		kicked := s.kickPeer(payload.VPNAddress)
+
+		writeJSON(w, map[string]interface{}{"status": "banned", "vpn_address": ban.VPNAddress, "kicked": kicked})
+
+	case "DELETE":
+		vpnIP := r.URL.Query().Get("vpn_address")
+		if vpnIP == "" {
+			http.Error(w, "vpn_address parameter required", http.StatusBadRequest)
+			return
+		}
+
+		removed := 0
+		s.bansMutex.Lock()
+		for hash, ban := range s.bans {
+			if ban.VPNAddress == vpnIP {
+				delete(s.bans, hash)
+				removed++
+			}
+		}
+		s.bansMutex.Unlock()
+
+		if removed == 0 {
+			http.Error(w, fmt.Sprintf("no device at %s is banned", vpnIP), http.StatusNotFound)
+			return
+		}
+		if err := s.saveBans(); err != nil {
+			log.Printf("[ADMIN] Failed to persist bans: %v", err)
+		}
+		log.Printf("[ADMIN] Unbanned device at %s", vpnIP)
+
+		writeJSON(w, map[string]string{"status": "unbanned", "vpn_address": vpnIP})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminLeases returns IP lease history, optionally filtered by ?ip=
+func (s *VPNServer) handleAdminLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := r.URL.Query().Get("ip")
+
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+
+	if ip != "" {
+		lease, exists := s.leases[ip]
+		if !exists {
+			http.Error(w, fmt.Sprintf("no lease for %s", ip), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, lease)
+		return
+	}
+
+	leases := make([]*IPLease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, lease)
+	}
+	writeJSON(w, leases)
+}
+
+// handleAdminBroadcast sends a text message to every connected client
+func (s *VPNServer) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Message == "" {
+		http.Error(w, "message required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[ADMIN] Broadcasting message: %s", payload.Message)
+	s.broadcastControlMessage("MESSAGE:" + payload.Message)
+
+	writeJSON(w, map[string]string{"status": "sent"})
+}
+
+// registerAdminHandlers mounts the admin API on the given mux
+func (s *VPNServer) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/peers", s.requireAdmin(s.handleAdminPeers))
+	mux.HandleFunc("/admin/kick", s.requireAdmin(s.handleAdminKick))
+	mux.HandleFunc("/admin/bans", s.requireAdmin(s.handleAdminBans))
+	mux.HandleFunc("/admin/leases", s.requireAdmin(s.handleAdminLeases))
+	mux.HandleFunc("/admin/broadcast", s.requireAdmin(s.handleAdminBroadcast))
+	mux.HandleFunc("/admin/enroll", s.requireAdmin(s.handleAdminEnroll))
+}
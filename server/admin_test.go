@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		localAddr  net.Addr // Address the request arrived on (nil = unknown)
+		auth       string
+		want       int
+	}{
+		{"tunnel address", "token", &net.TCPAddr{IP: net.ParseIP(SERVER_IP), Port: 9000}, "Bearer token", http.StatusOK},
+		{"loopback", "token", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}, "Bearer token", http.StatusOK},
+		{"public address", "token", &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 9000}, "Bearer token", http.StatusForbidden},
+		{"unknown address", "token", nil, "Bearer token", http.StatusForbidden},
+		{"wrong token", "token", &net.TCPAddr{IP: net.ParseIP(SERVER_IP), Port: 9000}, "Bearer nope", http.StatusUnauthorized},
+		{"no token", "token", &net.TCPAddr{IP: net.ParseIP(SERVER_IP), Port: 9000}, "", http.StatusUnauthorized},
+		{"admin API disabled", "", &net.TCPAddr{IP: net.ParseIP(SERVER_IP), Port: 9000}, "Bearer ", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewVPNServer(":0", false, nil)
+			s.adminToken = tt.adminToken
+			handler := s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest("GET", "/admin/peers", nil)
+			if tt.localAddr != nil {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, tt.localAddr))
+			}
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// adminRequest sends a request from remoteIP on the tunnel address
+func adminRequest(handler http.HandlerFunc, remoteIP, token string) int {
+	r := httptest.NewRequest("POST", "/update/init", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP(SERVER_IP), Port: 9000}))
+	r.RemoteAddr = remoteIP + ":40000"
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestRequireAdminLimitsFailures(t *testing.T) {
+	s := NewVPNServer(":0", false, nil)
+	s.adminToken = "token"
+	handler := s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// The operator is never limited for using the right token
+	for i := 0; i < 2*maxAdminFailures; i++ {
+		if code := adminRequest(handler, "10.8.0.2", "token"); code != http.StatusOK {
+			t.Fatalf("request %d with the right token: status %d", i+1, code)
+		}
+	}
+
+	for i := 0; i < maxAdminFailures; i++ {
+		if code := adminRequest(handler, "10.8.0.3", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: status %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+	}
+	if code := adminRequest(handler, "10.8.0.3", "token"); code != http.StatusTooManyRequests {
+		t.Errorf("right token after too many guesses: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := adminRequest(handler, "10.8.0.2", "token"); code != http.StatusOK {
+		t.Errorf("operator locked out by another client's guesses: status %d", code)
+	}
+}
+
+func TestUpdateLimitAfterAuthentication(t *testing.T) {
+	s := NewVPNServer(":0", false, nil)
+	s.adminToken = "token"
+	handler := s.requireAdmin(rateLimit(newRateLimiter(2, time.Minute), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Junk requests don't use up the operator's updates
+	for i := 0; i < 5; i++ {
+		adminRequest(handler, "10.8.0.2", "guess")
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := adminRequest(handler, "10.8.0.2", "token"); code != want {
+			t.Errorf("update %d: status %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+// newBanTestServer returns a server persisting bans in a temporary file,
+// with one device leased 10.8.0.2
+func newBanTestServer(t *testing.T, banFile string) *VPNServer {
+	t.Helper()
+	s := NewVPNServer(":0", false, nil)
+	s.banFile = banFile
+	s.leases["10.8.0.2"] = &IPLease{VPNAddress: "10.8.0.2", Hostname: "laptop"}
+	s.leaseTokens["10.8.0.2"] = "lease-token"
+	return s
+}
+
+func TestBansPersist(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	s := newBanTestServer(t, banFile)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{"ban unknown address", "POST", "/admin/bans", `{"vpn_address":"10.8.0.9"}`, http.StatusNotFound},
+		{"ban without address", "POST", "/admin/bans", `{"reason":"spam"}`, http.StatusBadRequest},
+		{"ban leased device", "POST", "/admin/bans", `{"vpn_address":"10.8.0.2","reason":"spam"}`, http.StatusOK},
+		{"unban unknown address", "DELETE", "/admin/bans?vpn_address=10.8.0.9", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleAdminBans(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// A restarted server still knows the device, whatever it calls itself
+	restarted := newBanTestServer(t, banFile)
+	if err := restarted.loadBans(); err != nil {
+		t.Fatalf("loadBans: %v", err)
+	}
+	if !restarted.isBanned("lease-token") {
+		t.Error("banned lease is not banned after a restart")
+	}
+	if restarted.isBanned("other-token") || restarted.isBanned("") {
+		t.Error("a device with another lease is banned")
+	}
+
+	w := httptest.NewRecorder()
+	restarted.handleAdminBans(w, httptest.NewRequest("DELETE", "/admin/bans?vpn_address=10.8.0.2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unban status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	again := newBanTestServer(t, banFile)
+	if err := again.loadBans(); err != nil {
+		t.Fatalf("loadBans: %v", err)
+	}
+	if again.isBanned("lease-token") {
+		t.Error("unbanned lease is still banned after a restart")
+	}
+}
+
+func TestLoadBansSkipsHostnameBans(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	bans := []*DeviceBan{
+		{Hostname: "old-style"},
+		{VPNAddress: "10.8.0.3", LeaseHash: leaseHash("kept")},
+	}
+	data, _ := json.Marshal(bans)
+	if err := os.WriteFile(banFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newBanTestServer(t, banFile)
+	if err := s.loadBans(); err != nil {
+		t.Fatalf("loadBans: %v", err)
+	}
+	if len(s.bans) != 1 || !s.isBanned("kept") {
+		t.Errorf("loaded bans = %v, want only the lease ban", s.bans)
+	}
+}
+
+func TestLoadBansMissingFile(t *testing.T) {
+	s := newBanTestServer(t, filepath.Join(t.TempDir(), "missing.json"))
+	if err := s.loadBans(); err != nil {
+		t.Errorf("loadBans with no file: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// maxArtifactSize caps uploaded extension binaries
+const maxArtifactSize = 200 << 20
+
+// validArtifactPart matches extension names, versions and platforms used in paths
+var validArtifactPart = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Artifact store layout under artifactsDir:
+//
+//	blobs/<sha256>                              binaries, named by content
+//	releases/<name>/<version>/<os>-<arch>.json  every published release
+//	releases/<name>/latest/<os>-<arch>.json     the most recent one
+
+// blobPath returns where a binary with the given digest is stored
+func (s *VPNServer) blobPath(digest string) string {
+	return filepath.Join(s.artifactsDir, "blobs", digest)
+}
+
+// releasePath returns where a release is stored ("latest" for the most recent)
+func (s *VPNServer) releasePath(name, version, goos, goarch string) string {
+	return filepath.Join(s.artifactsDir, "releases", name, version, goos+"-"+goarch+".json")
+}
+
+// writeFileAtomic writes a file via a temporary file and rename
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// handleRelease serves a release (GET /artifacts/releases/<name>?os=&arch=[&version=])
+func (s *VPNServer) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/artifacts/releases/")
+	query := r.URL.Query()
+	version := query.Get("version")
+	if version == "" {
+		version = "latest"
+	}
+	for _, part := range []string{name, version, query.Get("os"), query.Get("arch")} {
+		if !validArtifactPart.MatchString(part) {
+			http.Error(w, "name, os and arch required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(s.releasePath(name, version, query.Get("os"), query.Get("arch")))
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("no %s release of %s for %s/%s", version, name, query.Get("os"), query.Get("arch")), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[ARTIFACTS] Failed to read release of %s: %v", name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleBlob serves a binary by digest (GET /artifacts/blobs/<sha256>)
+func (s *VPNServer) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	digest := strings.TrimPrefix(r.URL.Path, "/artifacts/blobs/")
+	if !protocol.ValidSHA256(digest) {
+		http.Error(w, "Invalid digest", http.StatusBadRequest)
+		return
+	}
+
+	// Content never changes for a digest
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, s.blobPath(digest))
+}
+
+// handleAdminUploadBlob stores a binary under its digest (PUT /admin/artifacts/blobs/<sha256>)
+func (s *VPNServer) handleAdminUploadBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	digest := strings.TrimPrefix(r.URL.Path, "/admin/artifacts/blobs/")
+	if !protocol.ValidSHA256(digest) {
+		http.Error(w, "Invalid digest", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxArtifactSize+1))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxArtifactSize {
+		http.Error(w, "Binary too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != digest {
+		http.Error(w, "Content does not match digest", http.StatusBadRequest)
+		return
+	}
+
+	if err := writeFileAtomic(s.blobPath(digest), data); err != nil {
+		log.Printf("[ARTIFACTS] Failed to store blob %s: %v", digest, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ARTIFACTS] Stored blob %s (%d bytes)", digest, len(data))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminPublish publishes a signed release whose binary was uploaded
+// before (POST /admin/artifacts/releases)
+func (s *VPNServer) handleAdminPublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var release protocol.Release
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&release); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	for _, part := range []string{release.Name, release.Version, release.OS, release.Arch} {
+		if !validArtifactPart.MatchString(part) || part == "latest" {
+			http.Error(w, "name, version, os and arch required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Refuse releases clients would reject anyway
+	if s.artifactKey == nil {
+		http.Error(w, "Publishing disabled (no artifact key configured)", http.StatusServiceUnavailable)
+		return
+	}
+	if err := release.Verify(s.artifactKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(s.blobPath(release.SHA256))
+	if err != nil || info.Size() != release.Size {
+		http.Error(w, fmt.Sprintf("blob %s not uploaded", release.SHA256), http.StatusConflict)
+		return
+	}
+
+	data, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	for _, version := range []string{release.Version, "latest"} {
+		if err := writeFileAtomic(s.releasePath(release.Name, version, release.OS, release.Arch), data); err != nil {
+			log.Printf("[ARTIFACTS] Failed to publish %s v%s: %v", release.Name, release.Version, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("[ARTIFACTS] Published %s v%s for %s/%s (%s)", release.Name, release.Version, release.OS, release.Arch, release.SHA256)
+	writeJSON(w, release)
+}
+
+// registerArtifactHandlers adds the public download and admin publish endpoints
+func (s *VPNServer) registerArtifactHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/artifacts/releases/", s.handleRelease)
+	mux.HandleFunc("/artifacts/blobs/", s.handleBlob)
+	mux.HandleFunc("/admin/artifacts/blobs/", s.requireAdmin(s.handleAdminUploadBlob))
+	mux.HandleFunc("/admin/artifacts/releases", s.requireAdmin(s.handleAdminPublish))
+}
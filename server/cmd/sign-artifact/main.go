@@ -0,0 +1,165 @@
+// sign-artifact signs a prebuilt extension binary and publishes it to the
+// VPN server's artifact store.
+//
+//	sign-artifact -genkey signing.key
+//	sign-artifact -key signing.key -manifest extensions/ssh/extension.json \
+//	    -binary ssh-darwin-arm64 -os darwin -arch arm64 -server http://10.8.0.1:9000
+//
+// The private key never leaves the operator's machine; clients and the server
+// only get the public key (FAMILY_VPN_ARTIFACT_KEY).
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+func main() {
+	genKey := flag.String("genkey", "", "Generate a new key pair, writing the private key to this file")
+	keyFile := flag.String("key", "", "Private key file (from -genkey)")
+	manifestFile := flag.String("manifest", "", "The extension's extension.json")
+	binaryFile := flag.String("binary", "", "Prebuilt extension binary")
+	goos := flag.String("os", runtime.GOOS, "GOOS the binary was built for")
+	goarch := flag.String("arch", runtime.GOARCH, "GOARCH the binary was built for")
+	server := flag.String("server", "http://10.8.0.1:9000", "VPN server HTTP address (the admin API only answers inside the VPN)")
+	token := flag.String("admin-token", os.Getenv("VPN_ADMIN_TOKEN"), "Admin token (default $VPN_ADMIN_TOKEN)")
+	flag.Parse()
+
+	if *genKey != "" {
+		if err := generateKey(*genKey); err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		return
+	}
+
+	if *keyFile == "" || *manifestFile == "" || *binaryFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := loadKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load key: %v", err)
+	}
+	release, binary, err := signRelease(key, *manifestFile, *binaryFile, *goos, *goarch)
+	if err != nil {
+		log.Fatalf("Failed to sign: %v", err)
+	}
+	if err := publish(strings.TrimRight(*server, "/"), *token, release, binary); err != nil {
+		log.Fatalf("Failed to publish: %v", err)
+	}
+
+	fmt.Printf("Published %s v%s for %s/%s (%s)\n", release.Name, release.Version, release.OS, release.Arch, release.SHA256)
+}
+
+// generateKey writes a new private key and prints the public key
+func generateKey(path string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key written to %s (keep it off the server)\n", path)
+	fmt.Printf("%s=%s\n", protocol.ArtifactKeyEnv, base64.StdEncoding.EncodeToString(public))
+	return nil
+}
+
+// loadKey reads a private key written by generateKey
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not a private key", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// signRelease builds and signs the release of a binary
+func signRelease(key ed25519.PrivateKey, manifestFile, binaryFile, goos, goarch string) (*protocol.Release, []byte, error) {
+	manifestData, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := protocol.ParseManifest(manifestData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", manifestFile, err)
+	}
+
+	binary, err := os.ReadFile(binaryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(binary)
+
+	release := &protocol.Release{
+		Name:     manifest.Name,
+		Version:  manifest.Version,
+		OS:       goos,
+		Arch:     goarch,
+		SHA256:   hex.EncodeToString(sum[:]),
+		Size:     int64(len(binary)),
+		Manifest: manifestData,
+	}
+	release.Sign(key)
+
+	// Catch a key that doesn't match before the server does
+	if err := release.Verify(key.Public().(ed25519.PublicKey)); err != nil {
+		return nil, nil, err
+	}
+	return release, binary, nil
+}
+
+// publish uploads the binary, then the release pointing at it
+func publish(server, token string, release *protocol.Release, binary []byte) error {
+	if err := adminRequest("PUT", server+"/admin/artifacts/blobs/"+release.SHA256, token, binary); err != nil {
+		return fmt.Errorf("upload failed: %v", err)
+	}
+
+	body, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+	return adminRequest("POST", server+"/admin/artifacts/releases", token, body)
+}
+
+// adminRequest sends an authenticated request to the admin API
+func adminRequest(method, url, token string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const signalQueueSize = 256 // Signals a client may have waiting to be relayed
+
+// clientConn is a client's tunnel connection. The TUN router, signal relays,
+// broadcasts and the handshake all write to it from different goroutines, so
+// every frame goes through writeFrame.
+type clientConn struct {
+	net.Conn
+	writeMutex  sync.Mutex
+	largeFrames atomic.Bool // The client advertised FeatureLargeFrames
+}
+
+// errFrameTooLarge is returned for frames the client would take for a broken
+// stream and disconnect on
+var errFrameTooLarge = errors.New("frame too large for the client")
+
+// writeFrame writes a length-prefixed frame in one piece, never interleaved
+// with another frame
+func (c *clientConn) writeFrame(data []byte) error {
+	limit := protocol.LegacyFrameSize
+	if c.largeFrames.Load() {
+		limit = protocol.MaxFrameSize
+	}
+	if len(data) > limit {
+		return errFrameTooLarge
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// wsClient is a client's signaling WebSocket. A WebSocket allows one writer
+// at a time.
+type wsClient struct {
+	*websocket.Conn
+	writeMutex sync.Mutex
+}
+
+// writeJSON sends a message, never interleaved with another one
+func (c *wsClient) writeJSON(v interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.Conn.WriteJSON(v)
+}
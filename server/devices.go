@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultEnrollment = 10 * time.Minute // How long POST /admin/enroll lets new devices in by default
+	maxEnrollment     = 24 * time.Hour   // Upper bound on requested enrollment windows
+)
+
+// isKnownDevice reports whether a lease token is one the server handed out
+func (s *VPNServer) isKnownDevice(leaseToken string) bool {
+	if leaseToken == "" {
+		return false
+	}
+	s.devicesMutex.RLock()
+	defer s.devicesMutex.RUnlock()
+	return s.knownDevices[leaseHash(leaseToken)]
+}
+
+// admitsNewDevices reports whether devices without a known lease token may
+// connect. While any device is banned they may only during enrollment, or a
+// banned device could drop its lease token and come back as a new device.
+func (s *VPNServer) admitsNewDevices() bool {
+	s.bansMutex.RLock()
+	banned := len(s.bans) > 0
+	s.bansMutex.RUnlock()
+	if !banned {
+		return true
+	}
+
+	s.devicesMutex.RLock()
+	defer s.devicesMutex.RUnlock()
+	return time.Now().Before(s.enrollUntil)
+}
+
+// rememberDevice records a lease token the server handed out, so the device
+// is known when it comes back, even after a server restart
+func (s *VPNServer) rememberDevice(leaseToken string) {
+	hash := leaseHash(leaseToken)
+
+	s.devicesMutex.Lock()
+	known := s.knownDevices[hash]
+	s.knownDevices[hash] = true
+	s.devicesMutex.Unlock()
+
+	if known {
+		return
+	}
+	if err := s.saveKnownDevices(); err != nil {
+		log.Printf("[ADMIN] Failed to persist known devices: %v", err)
+	}
+}
+
+// loadKnownDevices reads the lease token hashes handed out before. Servers
+// that never kept the file don't know their devices yet, so a missing file
+// opens enrollment for them to come back.
+func (s *VPNServer) loadKnownDevices() error {
+	if s.deviceFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.deviceFile)
+	if os.IsNotExist(err) {
+		s.devicesMutex.Lock()
+		s.enrollUntil = time.Now().Add(defaultEnrollment)
+		s.devicesMutex.Unlock()
+		log.Printf("[ADMIN] No %s yet, new devices may join for %v", s.deviceFile, defaultEnrollment)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var hashes []string
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.deviceFile, err)
+	}
+
+	s.devicesMutex.Lock()
+	for _, hash := range hashes {
+		s.knownDevices[hash] = true
+	}
+	s.devicesMutex.Unlock()
+
+	log.Printf("[ADMIN] Loaded %d known device(s) from %s", len(hashes), s.deviceFile)
+	return nil
+}
+
+// saveKnownDevices persists the lease token hashes handed out
+func (s *VPNServer) saveKnownDevices() error {
+	if s.deviceFile == "" {
+		return nil
+	}
+
+	s.devicesMutex.RLock()
+	hashes := make([]string, 0, len(s.knownDevices))
+	for hash := range s.knownDevices {
+		hashes = append(hashes, hash)
+	}
+	s.devicesMutex.RUnlock()
+
+	data, err := json.MarshalIndent(hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := s.deviceFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.deviceFile)
+}
+
+// handleAdminEnroll shows (GET), opens (POST) and closes (DELETE) the window
+// in which new devices may join while devices are banned
+func (s *VPNServer) handleAdminEnroll(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// Only the status below
+
+	case "POST":
+		var payload struct {
+			Minutes int `json:"minutes"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Minutes < 0 {
+				http.Error(w, "minutes must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		window := time.Duration(payload.Minutes) * time.Minute
+		if window == 0 {
+			window = defaultEnrollment
+		} else if window > maxEnrollment {
+			window = maxEnrollment
+		}
+
+		s.devicesMutex.Lock()
+		s.enrollUntil = time.Now().Add(window)
+		s.devicesMutex.Unlock()
+		log.Printf("[ADMIN] New devices may join for %v", window)
+
+	case "DELETE":
+		s.devicesMutex.Lock()
+		s.enrollUntil = time.Time{}
+		s.devicesMutex.Unlock()
+		log.Printf("[ADMIN] Closed enrollment")
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.devicesMutex.RLock()
+	until := s.enrollUntil
+	s.devicesMutex.RUnlock()
+
+	status := map[string]interface{}{"new_devices": s.admitsNewDevices()}
+	if time.Now().Before(until) {
+		status["until"] = until.Format(time.RFC3339)
+	}
+	writeJSON(w, status)
+}
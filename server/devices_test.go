@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// handshake connects a device presenting leaseToken and returns the address
+// and lease token it was given, or "" if the server refused it
+func handshake(t *testing.T, s *VPNServer, leaseToken string) (vpnIP, lease string) {
+	t.Helper()
+	server, device := net.Pipe()
+	defer device.Close()
+	go s.handleClient(server)
+
+	peerInfo, _ := json.Marshal(protocol.PeerInfo{Hostname: "laptop", OS: "darwin", LeaseToken: leaseToken})
+	hello := append([]byte{0, 0, 0, 0, 0}, peerInfo...)
+	binary.BigEndian.PutUint32(hello[1:], uint32(len(peerInfo)))
+	device.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := device.Write(hello); err != nil {
+		t.Fatalf("sending handshake: %v", err)
+	}
+
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(device, length[:]); err != nil {
+			if vpnIP != "" {
+				t.Fatalf("connection closed before the lease token arrived: %v", err)
+			}
+			return "", "" // Refused
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(device, frame); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		if vpnIP == "" {
+			vpnIP = string(frame)
+		} else if lease, found := strings.CutPrefix(string(frame), "CTRL:LEASE:"); found {
+			return vpnIP, lease
+		}
+	}
+}
+
+// adminCall calls an admin handler from loopback
+func adminCall(t *testing.T, handler http.HandlerFunc, method, target, body string) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", method, target, w.Code, w.Body)
+	}
+}
+
+func TestBannedDeviceCannotReturnAsNew(t *testing.T) {
+	s := NewVPNServer(":0", false, nil)
+
+	banned, bannedLease := handshake(t, s, "")
+	_, friendLease := handshake(t, s, "")
+	if banned == "" || friendLease == "" {
+		t.Fatal("devices were refused before anyone was banned")
+	}
+	adminCall(t, s.handleAdminBans, "POST", "/admin/bans", `{"vpn_address":"`+banned+`"}`)
+
+	tests := []struct {
+		name       string
+		leaseToken string
+		admitted   bool
+	}{
+		{"banned lease", bannedLease, false},
+		{"dropped lease file", "", false},
+		{"made-up lease", "0123456789abcdef", false},
+		{"known device", friendLease, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if vpnIP, _ := handshake(t, s, tt.leaseToken); (vpnIP != "") != tt.admitted {
+				t.Errorf("admitted = %v, want %v", vpnIP != "", tt.admitted)
+			}
+		})
+	}
+
+	// The operator lets a new device join
+	adminCall(t, s.handleAdminEnroll, "POST", "/admin/enroll", `{"minutes":5}`)
+	if vpnIP, _ := handshake(t, s, ""); vpnIP == "" {
+		t.Error("new device refused during enrollment")
+	}
+	if vpnIP, _ := handshake(t, s, bannedLease); vpnIP != "" {
+		t.Error("banned device admitted during enrollment")
+	}
+
+	adminCall(t, s.handleAdminEnroll, "DELETE", "/admin/enroll", "")
+	if vpnIP, _ := handshake(t, s, ""); vpnIP != "" {
+		t.Error("new device admitted after enrollment closed")
+	}
+}
+
+func TestKnownDevicesPersist(t *testing.T) {
+	deviceFile := filepath.Join(t.TempDir(), "devices.json")
+	s := NewVPNServer(":0", false, nil)
+	s.deviceFile = deviceFile
+	s.rememberDevice("lease-token")
+
+	restarted := NewVPNServer(":0", false, nil)
+	restarted.deviceFile = deviceFile
+	if err := restarted.loadKnownDevices(); err != nil {
+		t.Fatalf("loadKnownDevices: %v", err)
+	}
+	if !restarted.isKnownDevice("lease-token") {
+		t.Error("device forgotten after restart")
+	}
+	if restarted.isKnownDevice("other-token") || restarted.isKnownDevice("") {
+		t.Error("unknown device reported as known")
+	}
+
+	data, err := os.ReadFile(deviceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "lease-token") {
+		t.Error("lease token stored in the clear")
+	}
+}
+
+func TestKnownDevicesMissingFile(t *testing.T) {
+	// Devices of a server that never kept the file may come back for a while
+	s := NewVPNServer(":0", false, nil)
+	s.deviceFile = filepath.Join(t.TempDir(), "devices.json")
+	s.bans["hash"] = &DeviceBan{LeaseHash: "hash"}
+	if err := s.loadKnownDevices(); err != nil {
+		t.Fatalf("loadKnownDevices: %v", err)
+	}
+	if !s.admitsNewDevices() {
+		t.Error("devices locked out after upgrading")
+	}
+}
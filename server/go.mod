@@ -4,6 +4,9 @@ go 1.24.0
 
 require (
 	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/miguelemosreverte/family-vpn/protocol v0.0.0
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
 	golang.org/x/sys v0.37.0 // indirect
 )
+
+replace github.com/miguelemosreverte/family-vpn/protocol => ../protocol
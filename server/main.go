@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -19,48 +22,67 @@ import (
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"github.com/miguelemosreverte/family-vpn/protocol"
 	"github.com/songgao/water"
 )
 
 const (
-	MTU         = 1400  // Reduced to account for encryption overhead (GCM adds ~28 bytes)
+	MTU         = 1400 // Reduced to account for encryption overhead (GCM adds ~28 bytes)
 	TUN_DEVICE  = "tun0"
 	VPN_NETWORK = "10.8.0.0/24"
 	SERVER_IP   = "10.8.0.1"
 )
 
-// PeerInfo represents a connected VPN client
-type PeerInfo struct {
-	Hostname   string `json:"hostname"`
-	VPNAddress string `json:"vpn_address"`
-	PublicIP   string `json:"public_ip"`
-	ConnectedAt string `json:"connected_at"`
-	OS         string `json:"os"`
-}
-
 type VPNServer struct {
 	listenAddr   string
 	encryption   bool
 	key          []byte
 	tunIface     *water.Interface
-	clients      map[net.Conn]bool
+	clients      map[*clientConn]bool
 	clientsMutex sync.RWMutex
 	tlsConfig    *tls.Config
 	useTLS       bool
 	// Peer registry for remote access
-	peers         map[string]*PeerInfo  // key: VPN IP address
-	peersMutex    sync.RWMutex
-	nextClientIP  int  // Counter for assigning IPs (10.8.0.2, 10.8.0.3, etc.)
+	peers        map[string]*protocol.PeerInfo // key: VPN IP address
+	peersMutex   sync.RWMutex
+	nextClientIP int // Counter for assigning IPs (10.8.0.2, 10.8.0.3, etc.)
 	// Peer-to-peer routing
-	peerConnections map[string]net.Conn // key: VPN IP address, value: client connection
-	peerEncryption  map[string]bool     // key: VPN IP address, value: wants encryption
+	peerConnections map[string]*clientConn       // key: VPN IP address, value: client connection
+	peerEncryption  map[string]bool              // key: VPN IP address, value: wants encryption
+	peerTraffic     map[string]*protocol.Traffic // key: VPN IP address, value: traffic counters
+	leases          map[string]*IPLease          // key: VPN IP address, value: latest lease
+	leaseTokens     map[string]string            // key: VPN IP address, value: token a returning device presents (LEASE)
+	// Admin API
+	adminToken    string
+	adminFailures *rateLimiter          // Failed admin authentications per client IP
+	bans          map[string]*DeviceBan // key: lease token hash (see leaseHash)
+	bansMutex     sync.RWMutex
+	banFile       string
+	knownDevices  map[string]bool // key: lease token hash of every device given a lease
+	enrollUntil   time.Time       // New devices may join until then, even while devices are banned
+	devicesMutex  sync.RWMutex
+	deviceFile    string
+	// Deployment endpoints
+	webhookSecret string
+	artifactsDir  string            // Signed extension releases (see artifacts.go)
+	artifactKey   ed25519.PublicKey // Verifies releases before they are published
 	// WebSocket support for real-time signaling
-	wsClients      map[string]*websocket.Conn // key: VPN IP address, value: WebSocket connection
+	wsClients      map[string]*wsClient // key: VPN IP address, value: WebSocket connection
 	wsClientsMutex sync.RWMutex
 	wsUpgrader     websocket.Upgrader
+	// Signaling session tokens bound to tunnel sessions
+	sessions      map[string]string // key: session token, value: VPN IP address
+	sessionTokens map[string]string // key: VPN IP address, value: session token
+	sessionsMutex sync.RWMutex
+	// Store-and-forward for signals addressed to offline peers
+	pendingSignals map[string][]*protocol.SignalMessage // key: target VPN IP address
+	pendingBytes   int                                  // Size of all held signals (see signalSize)
+	pendingMutex   sync.Mutex
 }
 
 func NewVPNServer(listenAddr string, encryption bool, key []byte) *VPNServer {
@@ -68,12 +90,21 @@ func NewVPNServer(listenAddr string, encryption bool, key []byte) *VPNServer {
 		listenAddr:      listenAddr,
 		encryption:      encryption,
 		key:             key,
-		clients:         make(map[net.Conn]bool),
-		peers:           make(map[string]*PeerInfo),
-		peerConnections: make(map[string]net.Conn),
+		clients:         make(map[*clientConn]bool),
+		peers:           make(map[string]*protocol.PeerInfo),
+		peerConnections: make(map[string]*clientConn),
 		peerEncryption:  make(map[string]bool),
+		peerTraffic:     make(map[string]*protocol.Traffic),
+		leases:          make(map[string]*IPLease),
+		leaseTokens:     make(map[string]string),
+		bans:            make(map[string]*DeviceBan),
+		knownDevices:    make(map[string]bool),
+		adminFailures:   newRateLimiter(maxAdminFailures, time.Minute),
 		nextClientIP:    2, // Start from 10.8.0.2 (10.8.0.1 is server)
-		wsClients:       make(map[string]*websocket.Conn),
+		wsClients:       make(map[string]*wsClient),
+		sessions:        make(map[string]string),
+		sessionTokens:   make(map[string]string),
+		pendingSignals:  make(map[string][]*protocol.SignalMessage),
 		wsUpgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true }, // Allow all origins for VPN clients
 		},
@@ -205,22 +236,154 @@ func getDestinationIP(packet []byte) string {
 	return fmt.Sprintf("%d.%d.%d.%d", packet[16], packet[17], packet[18], packet[19])
 }
 
+// allocateIP picks the VPN address for a device and returns it with its lease
+// token (caller holds peersMutex). A returning device that presents the token
+// of its previous address gets that address back when it is free, so signals
+// held for it while it was offline still reach it.
+func (s *VPNServer) allocateIP(leaseToken string) (string, string, error) {
+	if leaseToken != "" {
+		for vpnIP, token := range s.leaseTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(leaseToken)) != 1 {
+				continue
+			}
+			if lease, exists := s.leases[vpnIP]; exists && !lease.Active {
+				lease.Active = true // Reserve it until registerPeer records the new lease
+				return vpnIP, token, nil
+			}
+			break // Still in use by another connection: hand out a new address
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate lease token: %v", err)
+	}
+	vpnIP := fmt.Sprintf("10.8.0.%d", s.nextClientIP)
+	s.nextClientIP++
+	s.leaseTokens[vpnIP] = hex.EncodeToString(buf)
+	return vpnIP, s.leaseTokens[vpnIP], nil
+}
+
 // registerPeer adds a new peer to the registry and broadcasts updated list
-func (s *VPNServer) registerPeer(vpnIP, hostname, publicIP, os string, conn net.Conn, wantsEncryption bool) {
+func (s *VPNServer) registerPeer(vpnIP, hostname, publicIP, os string, capabilities *protocol.PeerCapabilities, services []protocol.Service, conn *clientConn, wantsEncryption bool) {
+	connectedAt := time.Now().Format(time.RFC3339)
+
 	s.peersMutex.Lock()
-	s.peers[vpnIP] = &PeerInfo{
-		Hostname:    hostname,
-		VPNAddress:  vpnIP,
-		PublicIP:    publicIP,
-		ConnectedAt: time.Now().Format(time.RFC3339),
-		OS:          os,
+	s.peers[vpnIP] = &protocol.PeerInfo{
+		Hostname:     hostname,
+		VPNAddress:   vpnIP,
+		PublicIP:     publicIP,
+		ConnectedAt:  connectedAt,
+		OS:           os,
+		Capabilities: capabilities,
+		Services:     services,
 	}
 	s.peerConnections[vpnIP] = conn
+	conn.largeFrames.Store(capabilities != nil && capabilities.HasFeature(protocol.FeatureLargeFrames))
 	s.peerEncryption[vpnIP] = wantsEncryption
+	s.peerTraffic[vpnIP] = &protocol.Traffic{}
+	s.leases[vpnIP] = &IPLease{
+		VPNAddress: vpnIP,
+		Hostname:   hostname,
+		PublicIP:   publicIP,
+		AssignedAt: connectedAt,
+		Active:     true,
+	}
 	s.peersMutex.Unlock()
 
 	log.Printf("[PEERS] Registered: %s (%s) at %s", hostname, os, vpnIP)
 	s.broadcastPeerList()
+	s.broadcastPeerDetails(vpnIP)
+	s.sendAllPeerDetails(vpnIP)
+}
+
+// updateCapabilities records what a peer advertised (CTRL:CAPABILITIES) and
+// passes it on in PEER_DETAILS
+func (s *VPNServer) updateCapabilities(vpnIP string, capabilities *protocol.PeerCapabilities) {
+	s.peersMutex.Lock()
+	peer, exists := s.peers[vpnIP]
+	if exists {
+		// Replaced rather than modified: broadcastPeerDetails marshals outside the lock
+		updated := *peer
+		updated.Capabilities = capabilities
+		s.peers[vpnIP] = &updated
+		if conn := s.peerConnections[vpnIP]; conn != nil {
+			conn.largeFrames.Store(capabilities.HasFeature(protocol.FeatureLargeFrames))
+		}
+	}
+	s.peersMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	log.Printf("[PEERS] %s now runs %d extension(s) (client %s)", peer.Hostname, len(capabilities.Extensions), capabilities.ClientVersion)
+	s.broadcastPeerDetails(vpnIP)
+}
+
+// updateServices records the services a peer offers (CTRL:SERVICES) and
+// passes them on in PEER_DETAILS
+func (s *VPNServer) updateServices(vpnIP string, services []protocol.Service) {
+	s.peersMutex.Lock()
+	peer, exists := s.peers[vpnIP]
+	if exists {
+		// Replaced rather than modified: broadcastPeerDetails marshals outside the lock
+		updated := *peer
+		updated.Services = services
+		s.peers[vpnIP] = &updated
+	}
+	s.peersMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	log.Printf("[PEERS] %s now offers %d service(s)", peer.Hostname, len(services))
+	s.broadcastPeerDetails(vpnIP)
+}
+
+// validServices drops advertised services that don't validate, and any
+// beyond protocol.MaxServices
+func validServices(vpnIP string, services []protocol.Service) []protocol.Service {
+	valid := make([]protocol.Service, 0, len(services))
+	for _, service := range services {
+		if len(valid) == protocol.MaxServices {
+			log.Printf("[PEERS] Ignoring services from %s beyond the first %d", vpnIP, protocol.MaxServices)
+			break
+		}
+		if err := service.Validate(); err != nil {
+			log.Printf("[PEERS] Ignoring service from %s: %v", vpnIP, err)
+			continue
+		}
+		valid = append(valid, service)
+	}
+	return valid
+}
+
+// validCapabilities returns advertised capabilities, or nil if they exceed
+// the limits
+func validCapabilities(vpnIP string, capabilities *protocol.PeerCapabilities) *protocol.PeerCapabilities {
+	if capabilities == nil {
+		return nil
+	}
+	if err := capabilities.Validate(); err != nil {
+		log.Printf("[PEERS] Ignoring capabilities from %s: %v", vpnIP, err)
+		return nil
+	}
+	return capabilities
+}
+
+// truncateName cuts a client-supplied hostname or OS to
+// protocol.MaxHostnameLength bytes, on a character boundary
+func truncateName(name string) string {
+	if len(name) <= protocol.MaxHostnameLength {
+		return name
+	}
+	cut := protocol.MaxHostnameLength
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut]
 }
 
 // unregisterPeer removes a peer and broadcasts updated list
@@ -232,38 +395,139 @@ func (s *VPNServer) unregisterPeer(vpnIP string) {
 	}
 	delete(s.peerConnections, vpnIP)
 	delete(s.peerEncryption, vpnIP)
+	delete(s.peerTraffic, vpnIP)
+	if lease, exists := s.leases[vpnIP]; exists {
+		lease.Active = false
+		lease.ReleasedAt = time.Now().Format(time.RFC3339)
+	}
 	s.peersMutex.Unlock()
 
+	s.revokeSession(vpnIP)
 	s.broadcastPeerList()
 }
 
 // broadcastPeerList sends current peer list to all clients
 func (s *VPNServer) broadcastPeerList() {
 	s.peersMutex.RLock()
-	peerList := make([]*PeerInfo, 0, len(s.peers))
+	peerList := make([]*protocol.PeerInfo, 0, len(s.peers))
 	for _, peer := range s.peers {
 		peerList = append(peerList, peer)
 	}
 	s.peersMutex.RUnlock()
 
-	peerJSON, err := json.Marshal(peerList)
+	command, err := peerListMessage(peerList)
 	if err != nil {
 		log.Printf("[PEERS] Failed to marshal peer list: %v", err)
 		return
 	}
 
-	command := "PEER_LIST:" + string(peerJSON)
 	s.broadcastControlMessage(command)
 	log.Printf("[PEERS] Broadcasted peer list to all clients (%d peers)", len(peerList))
 }
 
+// peerListMessage returns the PEER_LIST control message. Capabilities and
+// services are left out; they go in PEER_DETAILS, one peer at a time.
+func peerListMessage(peers []*protocol.PeerInfo) (string, error) {
+	list := make([]protocol.PeerInfo, len(peers))
+	for i, peer := range peers {
+		list[i] = *peer
+		list[i].Capabilities = nil
+		list[i].Services = nil
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+	return "PEER_LIST:" + string(data), nil
+}
+
+// peerDetailsMessage returns the PEER_DETAILS control message for a peer
+func peerDetailsMessage(peer *protocol.PeerInfo) (string, error) {
+	data, err := json.Marshal(protocol.PeerDetails{
+		VPNAddress:   peer.VPNAddress,
+		Capabilities: peer.Capabilities,
+		Services:     peer.Services,
+	})
+	if err != nil {
+		return "", err
+	}
+	return "PEER_DETAILS:" + string(data), nil
+}
+
+// peerDetailsTargets returns the peers whose clients take PEER_DETAILS.
+// Callers hold peersMutex.
+func (s *VPNServer) peerDetailsTargets() []string {
+	var targets []string
+	for vpnIP, peer := range s.peers {
+		if peer.Capabilities != nil && peer.Capabilities.HasFeature(protocol.FeaturePeerDetails) {
+			targets = append(targets, vpnIP)
+		}
+	}
+	return targets
+}
+
+// broadcastPeerDetails sends a peer's capabilities and services to every
+// client that takes PEER_DETAILS
+func (s *VPNServer) broadcastPeerDetails(vpnIP string) {
+	s.peersMutex.RLock()
+	peer, exists := s.peers[vpnIP]
+	targets := s.peerDetailsTargets()
+	s.peersMutex.RUnlock()
+
+	if !exists || len(targets) == 0 {
+		return
+	}
+
+	command, err := peerDetailsMessage(peer)
+	if err != nil {
+		log.Printf("[PEERS] Failed to marshal details of %s: %v", vpnIP, err)
+		return
+	}
+	for _, target := range targets {
+		if err := s.sendFrameToPeer(target, command); err != nil {
+			log.Printf("[PEERS] Failed to send details of %s to %s: %v", vpnIP, target, err)
+		}
+	}
+}
+
+// sendAllPeerDetails sends a newly registered peer the details of every
+// other peer, if its client takes PEER_DETAILS
+func (s *VPNServer) sendAllPeerDetails(vpnIP string) {
+	s.peersMutex.RLock()
+	self, exists := s.peers[vpnIP]
+	peers := make([]*protocol.PeerInfo, 0, len(s.peers))
+	for ip, peer := range s.peers {
+		if ip != vpnIP {
+			peers = append(peers, peer)
+		}
+	}
+	s.peersMutex.RUnlock()
+
+	if !exists || self.Capabilities == nil || !self.Capabilities.HasFeature(protocol.FeaturePeerDetails) {
+		return
+	}
+
+	for _, peer := range peers {
+		command, err := peerDetailsMessage(peer)
+		if err != nil {
+			log.Printf("[PEERS] Failed to marshal details of %s: %v", peer.VPNAddress, err)
+			continue
+		}
+		if err := s.sendFrameToPeer(vpnIP, command); err != nil {
+			log.Printf("[PEERS] Failed to send details of %s to %s: %v", peer.VPNAddress, vpnIP, err)
+			return
+		}
+	}
+}
+
 // broadcastControlMessage sends a control message to all connected clients
 func (s *VPNServer) broadcastControlMessage(command string) {
 	s.clientsMutex.RLock()
 	clientCount := len(s.clients)
 	s.clientsMutex.RUnlock()
 
-	log.Printf("[CONTROL] Broadcasting '%s' to %d client(s)", command, clientCount)
+	log.Printf("[CONTROL] Broadcasting %s to %d client(s)", describeCommand(command), clientCount)
 
 	// Create control message packet
 	message := append([]byte("CTRL:"), []byte(command)...)
@@ -272,7 +536,7 @@ func (s *VPNServer) broadcastControlMessage(command string) {
 	defer s.clientsMutex.RUnlock()
 
 	for conn := range s.clients {
-		go func(c net.Conn) {
+		go func(c *clientConn) {
 			// Encrypt the control message
 			encrypted, err := s.encryptData(message)
 			if err != nil {
@@ -281,24 +545,24 @@ func (s *VPNServer) broadcastControlMessage(command string) {
 			}
 
 			// Send length + encrypted packet
-			lengthBuf := make([]byte, 4)
-			binary.BigEndian.PutUint32(lengthBuf, uint32(len(encrypted)))
-
-			if _, err := c.Write(lengthBuf); err != nil {
-				log.Printf("[CONTROL] Failed to send length to %s: %v", c.RemoteAddr(), err)
-				return
-			}
-
-			if _, err := c.Write(encrypted); err != nil {
+			if err := c.writeFrame(encrypted); err != nil {
 				log.Printf("[CONTROL] Failed to send message to %s: %v", c.RemoteAddr(), err)
 				return
 			}
 
-			log.Printf("[CONTROL] Sent '%s' to %s", command, c.RemoteAddr())
+			log.Printf("[CONTROL] Sent %s to %s", describeCommand(command), c.RemoteAddr())
 		}(conn)
 	}
 }
 
+// describeCommand names a control message for the log by its verb and size.
+// Messages carry tokens (LEASE, SESSION) and signal payloads, so their
+// contents are never logged.
+func describeCommand(command string) string {
+	verb, _, _ := strings.Cut(command, ":")
+	return fmt.Sprintf("%s (%d bytes)", verb, len(command))
+}
+
 // sendToPeer sends a control message to a specific peer
 // Prefers WebSocket if available, falls back to control message
 func (s *VPNServer) sendToPeer(peerIP, command string) error {
@@ -313,7 +577,7 @@ func (s *VPNServer) sendToPeer(peerIP, command string) error {
 			"type": "signal",
 			"data": command,
 		}
-		if err := wsConn.WriteJSON(message); err != nil {
+		if err := wsConn.writeJSON(message); err != nil {
 			log.Printf("[WS] Failed to send to %s via WebSocket: %v, falling back to control message", peerIP, err)
 			// Remove dead WebSocket connection
 			s.wsClientsMutex.Lock()
@@ -326,6 +590,12 @@ func (s *VPNServer) sendToPeer(peerIP, command string) error {
 	}
 
 	// Fallback to control message (legacy)
+	return s.sendFrameToPeer(peerIP, command)
+}
+
+// sendFrameToPeer sends a control message to a specific peer through its
+// tunnel. It fails with errFrameTooLarge if the peer's client can't take it.
+func (s *VPNServer) sendFrameToPeer(peerIP, command string) error {
 	s.peersMutex.RLock()
 	conn, exists := s.peerConnections[peerIP]
 	wantsEncryption, encryptExists := s.peerEncryption[peerIP]
@@ -335,7 +605,7 @@ func (s *VPNServer) sendToPeer(peerIP, command string) error {
 		return fmt.Errorf("peer %s not found or not connected", peerIP)
 	}
 
-	log.Printf("[CONTROL] Sending '%s' to peer %s (legacy)", command, peerIP)
+	log.Printf("[CONTROL] Sending %s to peer %s (legacy)", describeCommand(command), peerIP)
 
 	// Create control message packet
 	message := append([]byte("CTRL:"), []byte(command)...)
@@ -345,7 +615,7 @@ func (s *VPNServer) sendToPeer(peerIP, command string) error {
 	if wantsEncryption {
 		encrypted, err := s.encryptData(message)
 		if err != nil {
-			return fmt.Errorf("failed to encrypt message: %v", err)
+			return fmt.Errorf("failed to encrypt message: %w", err)
 		}
 		toSend = encrypted
 	} else {
@@ -353,33 +623,27 @@ func (s *VPNServer) sendToPeer(peerIP, command string) error {
 	}
 
 	// Send length + packet
-	lengthBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBuf, uint32(len(toSend)))
-
-	if _, err := conn.Write(lengthBuf); err != nil {
-		return fmt.Errorf("failed to send length: %v", err)
-	}
-
-	if _, err := conn.Write(toSend); err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+	if err := conn.writeFrame(toSend); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
 	}
 
 	log.Printf("[CONTROL] Sent to peer %s successfully", peerIP)
 	return nil
 }
 
-func (s *VPNServer) handleClient(conn net.Conn) {
-	defer conn.Close()
+func (s *VPNServer) handleClient(netConn net.Conn) {
+	defer netConn.Close()
+	conn := &clientConn{Conn: netConn}
 
 	// Extract public IP - handle both TLS and non-TLS connections
 	var publicIP string
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
 		// For TLS connections, get the underlying connection's remote address
 		publicIP = tlsConn.RemoteAddr().String()
 		if tcpAddr, ok := tlsConn.RemoteAddr().(*net.TCPAddr); ok {
 			publicIP = tcpAddr.IP.String()
 		}
-	} else if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+	} else if tcpAddr, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
 		publicIP = tcpAddr.IP.String()
 	} else {
 		publicIP = conn.RemoteAddr().String()
@@ -407,12 +671,12 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 
 	// Tune TCP socket for high throughput - handle both TLS and non-TLS
 	var tcpConn *net.TCPConn
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
 		// For TLS connections, get underlying TCP connection
 		if underlying, ok := tlsConn.NetConn().(*net.TCPConn); ok {
 			tcpConn = underlying
 		}
-	} else if directTCP, ok := conn.(*net.TCPConn); ok {
+	} else if directTCP, ok := netConn.(*net.TCPConn); ok {
 		tcpConn = directTCP
 	}
 
@@ -439,6 +703,10 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 		return
 	}
 	peerInfoLen := binary.BigEndian.Uint32(peerInfoLenBuf)
+	if peerInfoLen > protocol.MaxFrameSize {
+		log.Printf("Peer info too large: %d bytes", peerInfoLen)
+		return
+	}
 
 	// Read peer info JSON
 	peerInfoBuf := make([]byte, peerInfoLen)
@@ -447,35 +715,75 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 		return
 	}
 
-	var peerInfo PeerInfo
+	var peerInfo protocol.PeerInfo
 	if err := json.Unmarshal(peerInfoBuf, &peerInfo); err != nil {
 		log.Printf("Failed to parse peer info: %v", err)
 		return
 	}
+	peerInfo.Hostname = truncateName(peerInfo.Hostname)
+	peerInfo.OS = truncateName(peerInfo.OS)
+
+	// Refuse banned devices before handing out an address
+	if s.isBanned(peerInfo.LeaseToken) {
+		log.Printf("[ADMIN] Refused connection from banned device %s (%s)", peerInfo.Hostname, publicIP)
+		return
+	}
+	if !s.isKnownDevice(peerInfo.LeaseToken) && !s.admitsNewDevices() {
+		log.Printf("[ADMIN] Refused new device %s (%s): devices are banned and enrollment is closed", peerInfo.Hostname, publicIP)
+		return
+	}
 
 	// Assign VPN IP address
 	s.peersMutex.Lock()
-	assignedVPNIP = fmt.Sprintf("10.8.0.%d", s.nextClientIP)
-	s.nextClientIP++
+	assignedVPNIP, leaseToken, err := s.allocateIP(peerInfo.LeaseToken)
 	s.peersMutex.Unlock()
-
-	// Send assigned VPN IP back to client
-	vpnIPBytes := []byte(assignedVPNIP)
-	vpnIPLen := make([]byte, 4)
-	binary.BigEndian.PutUint32(vpnIPLen, uint32(len(vpnIPBytes)))
-	if _, err := conn.Write(vpnIPLen); err != nil {
-		log.Printf("Failed to send VPN IP length: %v", err)
+	if err != nil {
+		log.Printf("[PEERS] %v", err)
 		return
 	}
-	if _, err := conn.Write(vpnIPBytes); err != nil {
+	s.rememberDevice(leaseToken)
+
+	// Send assigned VPN IP back to client
+	if err := conn.writeFrame([]byte(assignedVPNIP)); err != nil {
 		log.Printf("Failed to send VPN IP: %v", err)
 		return
 	}
 
 	// Register peer in registry
-	s.registerPeer(assignedVPNIP, peerInfo.Hostname, publicIP, peerInfo.OS, conn, clientWantsEncryption)
+	s.registerPeer(assignedVPNIP, peerInfo.Hostname, publicIP, peerInfo.OS, validCapabilities(assignedVPNIP, peerInfo.Capabilities), validServices(assignedVPNIP, peerInfo.Services), conn, clientWantsEncryption)
 	log.Printf("[PEERS] Assigned %s to %s (%s)", assignedVPNIP, peerInfo.Hostname, peerInfo.OS)
 
+	s.peersMutex.RLock()
+	traffic := s.peerTraffic[assignedVPNIP]
+	s.peersMutex.RUnlock()
+
+	// The lease token lets this device claim its address again next time
+	if err := s.sendToPeer(assignedVPNIP, "LEASE:"+leaseToken); err != nil {
+		log.Printf("[PEERS] Failed to deliver lease token to %s: %v", assignedVPNIP, err)
+	}
+
+	// Hand out the signaling session token through the tunnel itself
+	sessionToken, err := s.issueSessionToken(assignedVPNIP)
+	if err != nil {
+		log.Printf("[WS] %v", err)
+		return
+	}
+	if err := s.sendToPeer(assignedVPNIP, "SESSION:"+sessionToken); err != nil {
+		log.Printf("[WS] Failed to deliver session token to %s: %v", assignedVPNIP, err)
+	}
+
+	// Deliver signals that were held while this device was offline
+	go s.flushPendingSignals(assignedVPNIP)
+
+	// Relay this client's signals one at a time, in the order they were sent
+	signals := make(chan []byte, signalQueueSize)
+	defer close(signals)
+	go func() {
+		for signalData := range signals {
+			s.relaySignal(assignedVPNIP, signalData)
+		}
+	}()
+
 	// Channel for graceful shutdown
 	done := make(chan bool)
 
@@ -485,8 +793,8 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 	// Client -> TUN (ingress)
 	go func() {
 		lengthBuf := make([]byte, 4)
-		packetBuf := make([]byte, MTU*2) // Reuse packet buffer (sized for encrypted packets)
-		reader := bufio.NewReader(conn)  // Buffered reader
+		packetBuf := make([]byte, protocol.MaxFrameSize) // Reuse packet buffer (sized for control messages)
+		reader := bufio.NewReader(conn)                  // Buffered reader
 
 		// Diagnostics
 		var packetsRecv, totalBytesRecv int64
@@ -534,7 +842,7 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 			}
 
 			length := binary.BigEndian.Uint32(lengthBuf)
-			if length > MTU*2 { // Sanity check
+			if length > protocol.MaxFrameSize { // Sanity check
 				log.Printf("Invalid packet length: %d", length)
 				done <- true
 				return
@@ -563,20 +871,40 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 			}
 			timeDecrypt += time.Since(t1).Microseconds()
 
-			// Check if this is a VIDEO_CALL control message
-			if len(packet) > 17 && string(packet[:17]) == "CTRL:VIDEO_CALL:" {
-				// Extract peer IP and data: peerIP:data
-				videoData := string(packet[17:])
-				parts := strings.SplitN(videoData, ":", 2)
-				if len(parts) == 2 {
-					targetPeerIP := parts[0]
-					signalData := parts[1]
-					log.Printf("[VIDEO] Forwarding video call signal to peer %s", targetPeerIP)
-					go s.sendToPeer(targetPeerIP, "VIDEO_CALL:"+signalData)
-				}
+			// Check if this is an extension signal for another peer
+			if len(packet) > 12 && string(packet[:12]) == "CTRL:SIGNAL:" {
+				signalData := make([]byte, len(packet)-12)
+				copy(signalData, packet[12:]) // packetBuf is reused by the next read
+				signals <- signalData
 				continue // Don't write control messages to TUN
 			}
 
+			// Check if the client is advertising new capabilities
+			if len(packet) > 18 && string(packet[:18]) == "CTRL:CAPABILITIES:" {
+				var capabilities protocol.PeerCapabilities
+				if err := json.Unmarshal(packet[18:], &capabilities); err != nil {
+					log.Printf("[PEERS] Invalid capabilities from %s: %v", assignedVPNIP, err)
+					continue
+				}
+				if err := capabilities.Validate(); err != nil {
+					log.Printf("[PEERS] Ignoring capabilities from %s: %v", assignedVPNIP, err)
+					continue
+				}
+				s.updateCapabilities(assignedVPNIP, &capabilities) // In order, so the latest one wins
+				continue
+			}
+
+			// Check if the client is advertising the services it offers
+			if len(packet) > 14 && string(packet[:14]) == "CTRL:SERVICES:" {
+				var services []protocol.Service
+				if err := json.Unmarshal(packet[14:], &services); err != nil {
+					log.Printf("[PEERS] Invalid services from %s: %v", assignedVPNIP, err)
+					continue
+				}
+				s.updateServices(assignedVPNIP, validServices(assignedVPNIP, services))
+				continue
+			}
+
 			// Measure TUN write
 			t2 := time.Now()
 			if _, err := s.tunIface.Write(packet); err != nil {
@@ -589,6 +917,8 @@ func (s *VPNServer) handleClient(conn net.Conn) {
 			// Update stats
 			packetsRecv++
 			totalBytesRecv += int64(len(packet))
+			atomic.AddInt64(&traffic.PacketsIn, 1)
+			atomic.AddInt64(&traffic.BytesIn, int64(len(packet)))
 		}
 	}()
 
@@ -625,6 +955,7 @@ func (s *VPNServer) startTUNRouter() {
 			s.peersMutex.RLock()
 			targetConn, connExists := s.peerConnections[destIP]
 			wantsEncryption, encryptExists := s.peerEncryption[destIP]
+			traffic := s.peerTraffic[destIP]
 			s.peersMutex.RUnlock()
 
 			if !connExists || !encryptExists {
@@ -647,15 +978,14 @@ func (s *VPNServer) startTUNRouter() {
 			}
 
 			// Send packet length (4 bytes) + packet to target peer
-			lengthBuf := make([]byte, 4)
-			binary.BigEndian.PutUint32(lengthBuf, uint32(len(toSend)))
-
-			// Write to connection (errors are expected if peer disconnects)
-			if _, err := targetConn.Write(lengthBuf); err != nil {
+			// (errors are expected if peer disconnects)
+			if err := targetConn.writeFrame(toSend); err != nil {
 				continue
 			}
-			if _, err := targetConn.Write(toSend); err != nil {
-				continue
+
+			if traffic != nil {
+				atomic.AddInt64(&traffic.PacketsOut, 1)
+				atomic.AddInt64(&traffic.BytesOut, int64(len(packet)))
 			}
 		}
 	}()
@@ -669,6 +999,9 @@ func (s *VPNServer) Start() error {
 	// Start centralized TUN router for peer-to-peer traffic
 	s.startTUNRouter()
 
+	// Expire signals held for peers that never came back
+	go s.expirePendingSignals()
+
 	var listener net.Listener
 	var err error
 
@@ -701,16 +1034,35 @@ func (s *VPNServer) Start() error {
 
 var globalServer *VPNServer
 
-// webhookHandler handles GitHub webhook POSTs
+// webhookHandler handles GitHub webhook POSTs (signed with X-Hub-Signature-256)
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if globalServer == nil || globalServer.webhookSecret == "" {
+		log.Printf("[WEBHOOK] Rejected request from %s: no webhook secret configured", r.RemoteAddr)
+		http.Error(w, "Webhook disabled (no secret configured)", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the payload was signed by GitHub with our shared secret
+	if !verifyGitHubSignature(globalServer.webhookSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+		log.Printf("[WEBHOOK] Rejected request from %s: invalid or missing signature", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
 	// Parse webhook payload
 	var payload map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	if err := json.Unmarshal(body, &payload); err != nil {
 		log.Printf("[WEBHOOK] Failed to parse payload: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -735,33 +1087,56 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
-// handleWebSocket handles WebSocket connections from VPN clients for real-time signaling
+// handleWebSocket handles WebSocket connections from VPN clients for real-time signaling.
+// The caller's identity comes from the session token issued over its tunnel, never from the request.
 func (s *VPNServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get VPN IP from query parameter
-	vpnIP := r.URL.Query().Get("vpn_ip")
-	if vpnIP == "" {
-		http.Error(w, "Missing vpn_ip parameter", http.StatusBadRequest)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	vpnIP, ok := s.sessionIP(token)
+	if token == "" || !ok {
+		log.Printf("[WS] Rejected connection from %s: missing or unknown session token", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A session may only speak for its own address
+	if claimed := r.URL.Query().Get("vpn_ip"); claimed != "" && claimed != vpnIP {
+		log.Printf("[WS] Rejected connection from %s: session of %s tried to claim %s", r.RemoteAddr, vpnIP, claimed)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// Clients connect through the tunnel, so the session's own address is the only valid source
+	if remoteIP := clientIP(r); remoteIP != vpnIP {
+		log.Printf("[WS] Rejected connection from %s: session belongs to %s", remoteIP, vpnIP)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
 	// Upgrade connection to WebSocket
-	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
+	upgraded, err := s.wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("[WS] Failed to upgrade connection for %s: %v", vpnIP, err)
 		return
 	}
+	conn := &wsClient{Conn: upgraded}
 
-	// Register WebSocket connection
+	// Register WebSocket connection (a reconnect from the same session replaces the stale one)
 	s.wsClientsMutex.Lock()
+	previous, replaced := s.wsClients[vpnIP]
 	s.wsClients[vpnIP] = conn
 	s.wsClientsMutex.Unlock()
 
+	if replaced {
+		previous.Close()
+		log.Printf("[WS] Replaced previous WebSocket for %s", vpnIP)
+	}
 	log.Printf("[WS] Client %s connected via WebSocket", vpnIP)
 
 	// Keep connection alive and handle disconnection
 	defer func() {
 		s.wsClientsMutex.Lock()
-		delete(s.wsClients, vpnIP)
+		if s.wsClients[vpnIP] == conn {
+			delete(s.wsClients, vpnIP)
+		}
 		s.wsClientsMutex.Unlock()
 		conn.Close()
 		log.Printf("[WS] Client %s disconnected from WebSocket", vpnIP)
@@ -835,6 +1210,12 @@ func main() {
 	tlsKey := flag.String("tls-key", "certs/server.key", "Path to TLS private key")
 	useTLS := flag.Bool("tls", true, "Use TLS to look like HTTPS (default true)")
 	cpuprofile := flag.String("cpuprofile", "", "Write CPU profile to file")
+	adminToken := flag.String("admin-token", os.Getenv("VPN_ADMIN_TOKEN"), "Bearer token for /admin and /update/init (default $VPN_ADMIN_TOKEN, empty disables them)")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("GITHUB_WEBHOOK_SECRET"), "GitHub webhook secret (default $GITHUB_WEBHOOK_SECRET, empty disables /webhook)")
+	banFile := flag.String("ban-file", "banned-devices.json", "File where device bans are persisted")
+	deviceFile := flag.String("device-file", "known-devices.json", "File where the devices given a lease are persisted")
+	artifactsDir := flag.String("artifacts-dir", "artifacts", "Directory holding signed extension releases")
+	artifactKey := flag.String("artifact-key", os.Getenv(protocol.ArtifactKeyEnv), "Base64 Ed25519 public key releases must be signed with (default $"+protocol.ArtifactKeyEnv+", empty disables publishing)")
 	flag.Parse()
 
 	// Start CPU profiling if requested
@@ -870,17 +1251,50 @@ func main() {
 		log.Printf("TLS enabled: cert=%s, key=%s", *tlsCert, *tlsKey)
 	}
 
+	server.adminToken = *adminToken
+	server.banFile = *banFile
+	server.deviceFile = *deviceFile
+	server.webhookSecret = *webhookSecret
+	server.artifactsDir = *artifactsDir
+	if *artifactKey != "" {
+		key, err := protocol.ParsePublicKey(*artifactKey)
+		if err != nil {
+			log.Fatalf("Invalid artifact key: %v", err)
+		}
+		server.artifactKey = key
+	}
+	if err := server.loadBans(); err != nil {
+		log.Fatalf("Failed to load device bans: %v", err)
+	}
+	if err := server.loadKnownDevices(); err != nil {
+		log.Fatalf("Failed to load known devices: %v", err)
+	}
+
 	globalServer = server
 
-	// Start HTTP server for webhooks, updates, and WebSocket signaling
+	// Start HTTP server for webhooks, updates, WebSocket signaling and admin API
 	http.HandleFunc("/webhook", webhookHandler)
-	http.HandleFunc("/update/init", updateInitHandler)
+	// Operators may trigger at most 6 updates per minute (deploy.sh sends one per component).
+	// Authenticated first, so nobody else can use up the operator's updates.
+	http.HandleFunc("/update/init", server.requireAdmin(rateLimit(newRateLimiter(6, time.Minute), updateInitHandler)))
 	http.HandleFunc("/ws", server.handleWebSocket)
+	server.registerAdminHandlers(http.DefaultServeMux)
+	server.registerArtifactHandlers(http.DefaultServeMux)
 	go func() {
 		log.Printf("Starting HTTP server on port %s", *webhookPort)
-		log.Printf("  - POST /webhook - GitHub webhook endpoint")
-		log.Printf("  - POST /update/init - Trigger server and client updates")
+		if server.webhookSecret != "" {
+			log.Printf("  - POST /webhook - GitHub webhook endpoint (signature verified)")
+		} else {
+			log.Printf("  - POST /webhook - Disabled (set -webhook-secret or GITHUB_WEBHOOK_SECRET to enable)")
+		}
+		log.Printf("  - POST /update/init - Trigger server and client updates (admin token, rate limited)")
 		log.Printf("  - GET  /ws - WebSocket endpoint for real-time signaling")
+		if server.adminToken != "" {
+			log.Printf("  - /admin/* - Authenticated admin API (peers, kick, bans, leases, broadcast)")
+		} else {
+			log.Printf("  - /admin/* - Disabled (set -admin-token or VPN_ADMIN_TOKEN to enable)")
+		}
+		log.Printf("  - GET  /artifacts/* - Signed extension releases from %s", server.artifactsDir)
 		if err := http.ListenAndServe(":"+*webhookPort, nil); err != nil {
 			log.Fatalf("HTTP server failed: %v", err)
 		}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// largestPeer returns a peer that advertises as much as the limits allow,
+// in characters JSON escapes to six bytes each
+func largestPeer(vpnIP string) *protocol.PeerInfo {
+	name := strings.Repeat("<", protocol.MaxHostnameLength)
+	long := strings.Repeat("<", protocol.MaxNameLength)
+
+	capabilities := &protocol.PeerCapabilities{ClientVersion: long, Schema: protocol.SchemaVersion}
+	for i := 0; i < protocol.MaxFeatures; i++ {
+		capabilities.Features = append(capabilities.Features, long)
+	}
+	for i := 0; i < protocol.MaxExtensions; i++ {
+		capabilities.Extensions = append(capabilities.Extensions, protocol.ExtensionInfo{Name: long, Version: long})
+	}
+
+	var services []protocol.Service
+	for i := 0; i < protocol.MaxServices; i++ {
+		services = append(services, protocol.Service{
+			Name:        long,
+			Port:        65535,
+			Protocol:    long,
+			Description: strings.Repeat("<", protocol.MaxDescription),
+			Extension:   long,
+		})
+	}
+
+	return &protocol.PeerInfo{
+		Hostname:     name,
+		VPNAddress:   vpnIP,
+		PublicIP:     "[2001:db8:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+		ConnectedAt:  "2026-01-01T00:00:00+00:00",
+		OS:           name,
+		Capabilities: capabilities,
+		Services:     services,
+	}
+}
+
+func TestPeerListFitsOneFrame(t *testing.T) {
+	// Every address of 10.8.0.0/24 is taken
+	peers := make([]*protocol.PeerInfo, 0, 253)
+	for i := 2; i <= 254; i++ {
+		peer := largestPeer(fmt.Sprintf("10.8.0.%d", i))
+		if err := peer.Capabilities.Validate(); err != nil {
+			t.Fatalf("largest capabilities don't validate: %v", err)
+		}
+		for _, service := range peer.Services {
+			if err := service.Validate(); err != nil {
+				t.Fatalf("largest service doesn't validate: %v", err)
+			}
+		}
+		peers = append(peers, peer)
+	}
+
+	list, err := peerListMessage(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := len("CTRL:" + list); size > protocol.MaxControlMessage {
+		t.Errorf("PEER_LIST for %d peers is %d bytes, more than one frame (%d)", len(peers), size, protocol.MaxControlMessage)
+	}
+	if strings.Contains(list, `"services"`) || strings.Contains(list, `"capabilities"`) {
+		t.Error("PEER_LIST carries details that belong in PEER_DETAILS")
+	}
+
+	details, err := peerDetailsMessage(peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := len("CTRL:" + details); size > protocol.MaxControlMessage {
+		t.Errorf("PEER_DETAILS is %d bytes, more than one frame (%d)", size, protocol.MaxControlMessage)
+	}
+}
+
+func TestValidServicesLimit(t *testing.T) {
+	services := make([]protocol.Service, protocol.MaxServices+10)
+	for i := range services {
+		services[i] = protocol.Service{Name: fmt.Sprintf("service-%d", i), Port: 8000 + i, Protocol: "tcp"}
+	}
+	services[0].Description = strings.Repeat("x", protocol.MaxDescription+1)
+
+	valid := validServices("10.8.0.2", services)
+	if len(valid) != protocol.MaxServices {
+		t.Fatalf("%d services kept, want %d", len(valid), protocol.MaxServices)
+	}
+	if valid[0].Name != "service-1" {
+		t.Errorf("first service kept is %s, want the one after the invalid one", valid[0].Name)
+	}
+}
+
+func TestValidCapabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities *protocol.PeerCapabilities
+		valid        bool
+	}{
+		{"none", nil, false},
+		{"small", &protocol.PeerCapabilities{ClientVersion: "1.0.0", Features: []string{protocol.FeatureSignals}}, true},
+		{"too many features", &protocol.PeerCapabilities{Features: make([]string, protocol.MaxFeatures+1)}, false},
+		{"too many extensions", &protocol.PeerCapabilities{Extensions: make([]protocol.ExtensionInfo, protocol.MaxExtensions+1)}, false},
+		{"long extension name", &protocol.PeerCapabilities{Extensions: []protocol.ExtensionInfo{{Name: strings.Repeat("x", protocol.MaxNameLength+1)}}}, false},
+		{"long version", &protocol.PeerCapabilities{ClientVersion: strings.Repeat("1", protocol.MaxNameLength+1)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validCapabilities("10.8.0.2", tt.capabilities)
+			if (got != nil) != tt.valid {
+				t.Errorf("validCapabilities = %+v, want valid %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", "laptop", "laptop"},
+		{"limit", strings.Repeat("a", protocol.MaxHostnameLength), strings.Repeat("a", protocol.MaxHostnameLength)},
+		{"long", strings.Repeat("a", 100), strings.Repeat("a", protocol.MaxHostnameLength)},
+		{"multibyte", "a" + strings.Repeat("é", 40), "a" + strings.Repeat("é", 31)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateName(tt.in)
+			if got != tt.want {
+				t.Errorf("truncateName = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateName cut a character: %q", got)
+			}
+		})
+	}
+}
+
+func TestWriteFrameLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	conn := &clientConn{Conn: server}
+
+	// Older clients take a frame this large for a broken stream
+	if err := conn.writeFrame(make([]byte, protocol.LegacyFrameSize+1)); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("writeFrame to a legacy client = %v, want errFrameTooLarge", err)
+	}
+
+	conn.largeFrames.Store(true)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if err := conn.writeFrame(make([]byte, protocol.LegacyFrameSize+1)); err != nil {
+		t.Errorf("writeFrame to a large-frames client = %v", err)
+	}
+	if err := conn.writeFrame(make([]byte, protocol.MaxFrameSize+1)); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("writeFrame beyond MaxFrameSize = %v, want errFrameTooLarge", err)
+	}
+}
+
+func TestDescribeCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"LEASE:0123456789abcdef", "LEASE (22 bytes)"},
+		{"SESSION:secret", "SESSION (14 bytes)"},
+		{`SIGNAL:{"payload":"hello"}`, "SIGNAL (26 bytes)"},
+		{"UPDATE_VPN", "UPDATE_VPN (10 bytes)"},
+	}
+
+	for _, tt := range tests {
+		if got := describeCommand(tt.command); got != tt.want {
+			t.Errorf("describeCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
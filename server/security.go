@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifyGitHubSignature checks an X-Hub-Signature-256 header ("sha256=<hex>") against the body
+func verifyGitHubSignature(secret string, body []byte, header string) bool {
+	if secret == "" || !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+
+	received, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(received, mac.Sum(nil))
+}
+
+// rateLimiter allows at most `limit` requests per `window` for each client IP
+type rateLimiter struct {
+	limit    int
+	window   time.Duration
+	attempts map[string][]time.Time // key: client IP
+	mutex    sync.Mutex
+}
+
+// newRateLimiter creates a sliding-window rate limiter
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:    limit,
+		window:   window,
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// allow records an attempt and reports whether it is within the limit
+func (l *rateLimiter) allow(remoteIP string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	if len(l.attempts[remoteIP]) >= l.limit {
+		return false
+	}
+
+	l.attempts[remoteIP] = append(l.attempts[remoteIP], now)
+	return true
+}
+
+// exceeded reports whether a client IP used up its attempts, without
+// counting this as one (see record)
+func (l *rateLimiter) exceeded(remoteIP string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.prune(time.Now())
+	return len(l.attempts[remoteIP]) >= l.limit
+}
+
+// record counts an attempt by a client IP
+func (l *rateLimiter) record(remoteIP string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	l.attempts[remoteIP] = append(l.attempts[remoteIP], now)
+}
+
+// prune drops attempts that fell out of the window, forgetting idle clients
+// entirely. Callers hold mutex.
+func (l *rateLimiter) prune(now time.Time) {
+	cutoff := now.Add(-l.window)
+	for ip, times := range l.attempts {
+		recent := times[:0]
+		for _, t := range times {
+			if t.After(cutoff) {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.attempts, ip)
+		} else {
+			l.attempts[ip] = recent
+		}
+	}
+}
+
+// clientIP returns the remote IP of a request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit wraps a handler so each client IP is limited by the given limiter
+func rateLimit(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(clientIP(r)) {
+			log.Printf("[SECURITY] Rate limited %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
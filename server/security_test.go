@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestVerifyGitHubSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		secret string
+		body   []byte
+		header string
+		want   bool
+	}{
+		{"valid", "secret", body, valid, true},
+		{"wrong secret", "other", body, valid, false},
+		{"tampered body", "secret", []byte(`{"ref":"refs/heads/evil"}`), valid, false},
+		{"no secret configured", "", body, valid, false},
+		{"missing header", "secret", body, "", false},
+		{"sha1 header", "secret", body, "sha1=" + valid[len("sha256="):], false},
+		{"not hex", "secret", body, "sha256=zz", false},
+		{"truncated", "secret", body, valid[:len(valid)-2], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyGitHubSignature(tt.secret, tt.body, tt.header); got != tt.want {
+				t.Errorf("verifyGitHubSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		window time.Duration
+		wait   time.Duration // Pause after the first `limit` attempts
+		want   []bool        // Result of each attempt from 1.2.3.4
+	}{
+		{"within limit", 3, time.Minute, 0, []bool{true, true, true}},
+		{"over limit", 2, time.Minute, 0, []bool{true, true, false, false}},
+		{"window passed", 2, 50 * time.Millisecond, 100 * time.Millisecond, []bool{true, true, true, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.limit, tt.window)
+			for i, want := range tt.want {
+				if i == tt.limit && tt.wait > 0 {
+					time.Sleep(tt.wait)
+				}
+				if got := limiter.allow("1.2.3.4"); got != want {
+					t.Fatalf("attempt %d: allow() = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterPerClient(t *testing.T) {
+	limiter := newRateLimiter(1, time.Minute)
+	if !limiter.allow("1.2.3.4") {
+		t.Fatal("first attempt from 1.2.3.4 was refused")
+	}
+	if limiter.allow("1.2.3.4") {
+		t.Fatal("second attempt from 1.2.3.4 was allowed")
+	}
+	if !limiter.allow("5.6.7.8") {
+		t.Fatal("another client was limited too")
+	}
+}
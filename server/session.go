@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// issueSessionToken creates the signaling credential for a tunnel session.
+// The token is delivered inside the tunnel (SESSION control message), so only
+// the device that completed the handshake for vpnIP can present it.
+func (s *VPNServer) issueSessionToken(vpnIP string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	s.sessionsMutex.Lock()
+	if old, exists := s.sessionTokens[vpnIP]; exists {
+		delete(s.sessions, old)
+	}
+	s.sessions[token] = vpnIP
+	s.sessionTokens[vpnIP] = token
+	s.sessionsMutex.Unlock()
+
+	return token, nil
+}
+
+// revokeSession invalidates the session token of vpnIP and closes its WebSocket
+func (s *VPNServer) revokeSession(vpnIP string) {
+	s.sessionsMutex.Lock()
+	if token, exists := s.sessionTokens[vpnIP]; exists {
+		delete(s.sessions, token)
+		delete(s.sessionTokens, vpnIP)
+	}
+	s.sessionsMutex.Unlock()
+
+	s.wsClientsMutex.Lock()
+	wsConn, hasWS := s.wsClients[vpnIP]
+	delete(s.wsClients, vpnIP)
+	s.wsClientsMutex.Unlock()
+
+	if hasWS {
+		wsConn.Close()
+		log.Printf("[WS] Closed WebSocket for ended session %s", vpnIP)
+	}
+}
+
+// sessionIP returns the VPN IP owning a session token
+func (s *VPNServer) sessionIP(token string) (string, bool) {
+	s.sessionsMutex.RLock()
+	defer s.sessionsMutex.RUnlock()
+	vpnIP, exists := s.sessions[token]
+	return vpnIP, exists
+}
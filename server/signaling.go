@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+const (
+	defaultSignalTTL  = 60 * time.Second // How long a signal may wait for an offline peer by default
+	maxSignalTTL      = 24 * time.Hour   // Upper bound on sender-requested TTLs
+	maxPendingPerPeer = 100              // Held signals per offline peer before the oldest is dropped
+	maxPendingBytes   = 8 << 20          // Held signals across all peers before new ones are refused
+)
+
+// newSignalID generates a random signal ID
+func newSignalID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// relaySignal forwards a signal from the tunnel session of senderIP to its target peer
+func (s *VPNServer) relaySignal(senderIP string, data []byte) {
+	var msg protocol.SignalMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[SIGNAL] Dropping malformed signal from %s: %v", senderIP, err)
+		return
+	}
+
+	if msg.Extension == "" || msg.To == "" {
+		log.Printf("[SIGNAL] Dropping signal from %s without extension or target", senderIP)
+		return
+	}
+
+	// Never trust the sender's claim about who it is
+	msg.From = senderIP
+
+	// Only devices that were given an address can ever pick a signal up
+	s.peersMutex.RLock()
+	_, leased := s.leases[msg.To]
+	s.peersMutex.RUnlock()
+	if !leased {
+		log.Printf("[SIGNAL] Dropping signal from %s to unknown peer %q", senderIP, msg.To)
+		return
+	}
+
+	if msg.Type == "" {
+		msg.Type = protocol.SignalTypeData
+	}
+	if msg.ID == "" {
+		msg.ID = newSignalID()
+	}
+
+	ttl := time.Duration(msg.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultSignalTTL
+	} else if ttl > maxSignalTTL {
+		ttl = maxSignalTTL
+	}
+	msg.ExpiresAt = time.Now().Add(ttl).Unix()
+
+	log.Printf("[SIGNAL] Forwarding '%s' %s %s from %s to %s", msg.Extension, msg.Type, msg.ID, msg.From, msg.To)
+	s.deliverSignal(&msg)
+}
+
+// deliverSignal sends a signal now, or holds it until the target reconnects.
+// Signals already held for the target go first, so it sees them in order.
+func (s *VPNServer) deliverSignal(msg *protocol.SignalMessage) {
+	if s.holdBehindPending(msg) {
+		return
+	}
+	err := s.sendSignal(msg)
+	if errors.Is(err, errFrameTooLarge) {
+		s.failSignal(msg, "too large for the peer's client")
+	} else if err != nil {
+		s.holdSignal(msg)
+	}
+}
+
+// sendSignal writes a signal to its target peer
+func (s *VPNServer) sendSignal(msg *protocol.SignalMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.sendToPeer(msg.To, "SIGNAL:"+string(data))
+}
+
+// holdSignal stores a signal for an offline peer
+func (s *VPNServer) holdSignal(msg *protocol.SignalMessage) {
+	s.pendingMutex.Lock()
+	dropped, pending := s.appendPending(msg)
+	s.pendingMutex.Unlock()
+
+	if dropped != msg {
+		log.Printf("[SIGNAL] Holding %s %s for offline peer %s (%d pending)", msg.Type, msg.ID, msg.To, pending)
+	}
+
+	if dropped != nil {
+		s.failSignal(dropped, "queue full")
+	}
+}
+
+// holdBehindPending holds a signal if others are already held for its
+// target, and reports whether it did
+func (s *VPNServer) holdBehindPending(msg *protocol.SignalMessage) bool {
+	s.pendingMutex.Lock()
+	if len(s.pendingSignals[msg.To]) == 0 {
+		s.pendingMutex.Unlock()
+		return false
+	}
+	dropped, _ := s.appendPending(msg)
+	s.pendingMutex.Unlock()
+
+	if dropped != nil {
+		s.failSignal(dropped, "queue full")
+	}
+	return true
+}
+
+// appendPending queues a signal for its target, dropping the oldest one if
+// the target's queue is full, or msg itself if the server holds too much
+// already. Callers hold pendingMutex.
+func (s *VPNServer) appendPending(msg *protocol.SignalMessage) (dropped *protocol.SignalMessage, pending int) {
+	queue := s.pendingSignals[msg.To]
+	if s.pendingBytes+signalSize(msg) > maxPendingBytes {
+		return msg, len(queue)
+	}
+
+	queue = append(queue, msg)
+	s.pendingBytes += signalSize(msg)
+	if len(queue) > maxPendingPerPeer {
+		dropped = queue[0]
+		queue = queue[1:]
+		s.pendingBytes -= signalSize(dropped)
+	}
+	s.pendingSignals[msg.To] = queue
+	return dropped, len(queue)
+}
+
+// signalSize is roughly how much memory a held signal takes
+func signalSize(msg *protocol.SignalMessage) int {
+	return len(msg.ID) + len(msg.Type) + len(msg.Extension) + len(msg.To) + len(msg.From) + len(msg.Payload) + len(msg.Reason)
+}
+
+// failSignal tells the sender of a data signal that it will not be delivered
+func (s *VPNServer) failSignal(msg *protocol.SignalMessage, reason string) {
+	log.Printf("[SIGNAL] Dropping %s %s for %s: %s", msg.Type, msg.ID, msg.To, reason)
+
+	// Receipts are never answered with receipts
+	if msg.Type != protocol.SignalTypeData {
+		return
+	}
+
+	s.deliverSignal(&protocol.SignalMessage{
+		ID:        msg.ID,
+		Type:      protocol.SignalTypeFailed,
+		Extension: msg.Extension,
+		To:        msg.From,
+		From:      msg.To,
+		ExpiresAt: time.Now().Add(defaultSignalTTL).Unix(),
+		Reason:    reason,
+	})
+}
+
+// flushPendingSignals delivers everything held for a peer that just connected.
+// Each signal stays queued until it is sent, so signals relayed meanwhile line
+// up behind it (see deliverSignal).
+func (s *VPNServer) flushPendingSignals(vpnIP string) {
+	delivered := 0
+	for {
+		s.pendingMutex.Lock()
+		queue := s.pendingSignals[vpnIP]
+		if len(queue) == 0 {
+			delete(s.pendingSignals, vpnIP)
+			s.pendingMutex.Unlock()
+			if delivered > 0 {
+				log.Printf("[SIGNAL] Delivered %d held signal(s) to %s", delivered, vpnIP)
+			}
+			return
+		}
+		msg := queue[0]
+		s.pendingMutex.Unlock()
+
+		expired := msg.Expired()
+		tooLarge := false
+		if !expired {
+			err := s.sendSignal(msg)
+			if errors.Is(err, errFrameTooLarge) {
+				tooLarge = true
+			} else if err != nil {
+				return // Offline again; the rest stays held
+			} else {
+				delivered++
+			}
+		}
+
+		// expirePendingSignals may have taken it meanwhile
+		s.pendingMutex.Lock()
+		removed := false
+		if queue := s.pendingSignals[vpnIP]; len(queue) > 0 && queue[0] == msg {
+			s.pendingSignals[vpnIP] = queue[1:]
+			s.pendingBytes -= signalSize(msg)
+			removed = true
+		}
+		s.pendingMutex.Unlock()
+
+		if expired && removed {
+			s.failSignal(msg, "expired")
+		} else if tooLarge && removed {
+			s.failSignal(msg, "too large for the peer's client")
+		}
+	}
+}
+
+// expirePendingSignals periodically drops held signals whose TTL ran out
+func (s *VPNServer) expirePendingSignals() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*protocol.SignalMessage
+
+		s.pendingMutex.Lock()
+		for peerIP, queue := range s.pendingSignals {
+			kept := queue[:0]
+			for _, msg := range queue {
+				if msg.Expired() {
+					expired = append(expired, msg)
+					s.pendingBytes -= signalSize(msg)
+				} else {
+					kept = append(kept, msg)
+				}
+			}
+			if len(kept) == 0 {
+				delete(s.pendingSignals, peerIP)
+			} else {
+				s.pendingSignals[peerIP] = kept
+			}
+		}
+		s.pendingMutex.Unlock()
+
+		for _, msg := range expired {
+			s.failSignal(msg, "expired")
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miguelemosreverte/family-vpn/protocol"
+)
+
+// newSignalTestServer returns a server that leased the given addresses to
+// devices that are all offline
+func newSignalTestServer(addresses ...string) *VPNServer {
+	s := NewVPNServer(":0", false, nil)
+	for _, address := range addresses {
+		s.leases[address] = &IPLease{VPNAddress: address, Active: true}
+	}
+	return s
+}
+
+// connectTestPeer puts a peer online and returns the signals it receives
+func connectTestPeer(t *testing.T, s *VPNServer, vpnIP string) <-chan *protocol.SignalMessage {
+	t.Helper()
+	server, peer := net.Pipe()
+	t.Cleanup(func() { server.Close(); peer.Close() })
+
+	s.peersMutex.Lock()
+	s.peerConnections[vpnIP] = &clientConn{Conn: server}
+	s.peerEncryption[vpnIP] = false
+	s.peersMutex.Unlock()
+
+	received := make(chan *protocol.SignalMessage, 16)
+	go func() {
+		defer close(received)
+		for {
+			var length [4]byte
+			if _, err := io.ReadFull(peer, length[:]); err != nil {
+				return
+			}
+			frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+			if _, err := io.ReadFull(peer, frame); err != nil {
+				return
+			}
+			data := strings.TrimPrefix(string(frame), "CTRL:SIGNAL:")
+			var msg protocol.SignalMessage
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				t.Errorf("peer %s got a frame that is not a signal: %q", vpnIP, frame)
+				return
+			}
+			received <- &msg
+		}
+	}()
+	return received
+}
+
+// nextSignal waits for a signal to arrive
+func nextSignal(t *testing.T, received <-chan *protocol.SignalMessage) *protocol.SignalMessage {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no signal arrived")
+		return nil
+	}
+}
+
+// relayData relays a data signal from sender to target
+func relayData(s *VPNServer, sender, target, id string, ttl int) {
+	data, _ := json.Marshal(protocol.SignalMessage{ID: id, Extension: "chat", To: target, From: "10.8.0.99", TTL: ttl})
+	s.relaySignal(sender, data)
+}
+
+func TestRelaySignalTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  int
+		want time.Duration
+	}{
+		{"default", 0, defaultSignalTTL},
+		{"negative", -5, defaultSignalTTL},
+		{"requested", 30, 30 * time.Second},
+		{"clamped", int((10 * 24 * time.Hour).Seconds()), maxSignalTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+			relayData(s, "10.8.0.2", "10.8.0.3", "a", tt.ttl)
+
+			held := s.pendingSignals["10.8.0.3"]
+			if len(held) != 1 {
+				t.Fatalf("%d signals held, want 1", len(held))
+			}
+			got := time.Until(time.Unix(held[0].ExpiresAt, 0))
+			if got < tt.want-2*time.Second || got > tt.want {
+				t.Errorf("signal expires in %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelaySignalSender(t *testing.T) {
+	s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+	received := connectTestPeer(t, s, "10.8.0.3")
+
+	relayData(s, "10.8.0.2", "10.8.0.3", "a", 0)
+	msg := nextSignal(t, received)
+	if msg.From != "10.8.0.2" {
+		t.Errorf("From = %q, want the sending session's address", msg.From)
+	}
+	if msg.Type != protocol.SignalTypeData {
+		t.Errorf("Type = %q, want %q", msg.Type, protocol.SignalTypeData)
+	}
+
+	// Nobody was given 10.8.0.4, so nothing is held for it
+	relayData(s, "10.8.0.2", "10.8.0.4", "b", 0)
+	if len(s.pendingSignals) != 0 {
+		t.Errorf("signal to an unknown peer was held: %v", s.pendingSignals)
+	}
+}
+
+func TestRelayLargeSignal(t *testing.T) {
+	payload := strings.Repeat("a=candidate:1 1 udp 2130706431 10.8.0.2 50000 typ host\r\n", 120)
+	data, _ := json.Marshal(protocol.SignalMessage{ID: "offer", Extension: "video", To: "10.8.0.3", Payload: payload})
+
+	// Clients with FeatureLargeFrames take signals well beyond the MTU
+	s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+	received := connectTestPeer(t, s, "10.8.0.3")
+	s.peerConnections["10.8.0.3"].largeFrames.Store(true)
+
+	s.relaySignal("10.8.0.2", data)
+	if msg := nextSignal(t, received); msg.Payload != payload {
+		t.Errorf("payload arrived as %d bytes, want the %d sent", len(msg.Payload), len(payload))
+	}
+
+	// Older clients would drop the tunnel, so the sender hears it failed
+	s = newSignalTestServer("10.8.0.2", "10.8.0.3")
+	connectTestPeer(t, s, "10.8.0.3")
+
+	s.relaySignal("10.8.0.2", data)
+	if _, held := s.pendingSignals["10.8.0.3"]; held {
+		t.Error("signal held for a client that can never take it")
+	}
+	receipts := s.pendingSignals["10.8.0.2"]
+	if len(receipts) != 1 || receipts[0].Type != protocol.SignalTypeFailed || receipts[0].Reason != "too large for the peer's client" {
+		t.Errorf("sender receipts = %+v, want one too large receipt", receipts)
+	}
+}
+
+func TestFlushPendingSignals(t *testing.T) {
+	s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+	relayData(s, "10.8.0.2", "10.8.0.3", "first", 0)
+	relayData(s, "10.8.0.2", "10.8.0.3", "stale", 0)
+	relayData(s, "10.8.0.2", "10.8.0.3", "last", 0)
+	s.pendingSignals["10.8.0.3"][1].ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	received := connectTestPeer(t, s, "10.8.0.3")
+	s.flushPendingSignals("10.8.0.3")
+
+	for _, want := range []string{"first", "last"} {
+		if msg := nextSignal(t, received); msg.ID != want {
+			t.Errorf("got signal %q, want %q", msg.ID, want)
+		}
+	}
+	if _, held := s.pendingSignals["10.8.0.3"]; held {
+		t.Error("signals still held after flushing")
+	}
+
+	// The sender is offline, so its receipt for the expired signal waits for it
+	receipts := s.pendingSignals["10.8.0.2"]
+	if len(receipts) != 1 {
+		t.Fatalf("%d receipts held for the sender, want 1", len(receipts))
+	}
+	if r := receipts[0]; r.ID != "stale" || r.Type != protocol.SignalTypeFailed || r.Reason != "expired" || r.From != "10.8.0.3" {
+		t.Errorf("receipt = %+v, want failed/expired for stale from 10.8.0.3", r)
+	}
+	if want := signalSize(receipts[0]); s.pendingBytes != want {
+		t.Errorf("pendingBytes = %d, want %d", s.pendingBytes, want)
+	}
+}
+
+func TestPendingSignalsQueueFull(t *testing.T) {
+	s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+	for i := 0; i <= maxPendingPerPeer; i++ {
+		relayData(s, "10.8.0.2", "10.8.0.3", newSignalID(), 0)
+	}
+
+	held := s.pendingSignals["10.8.0.3"]
+	if len(held) != maxPendingPerPeer {
+		t.Errorf("%d signals held, want %d", len(held), maxPendingPerPeer)
+	}
+	receipts := s.pendingSignals["10.8.0.2"]
+	if len(receipts) != 1 || receipts[0].Reason != "queue full" {
+		t.Errorf("sender receipts = %v, want one queue full receipt", receipts)
+	}
+}
+
+func TestReceiptsAreNotAnswered(t *testing.T) {
+	tests := []struct {
+		signalType  string
+		wantReceipt bool
+	}{
+		{protocol.SignalTypeData, true},
+		{protocol.SignalTypeAck, false},
+		{protocol.SignalTypeFailed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.signalType, func(t *testing.T) {
+			s := newSignalTestServer("10.8.0.2", "10.8.0.3")
+			s.failSignal(&protocol.SignalMessage{ID: "a", Type: tt.signalType, Extension: "chat", To: "10.8.0.3", From: "10.8.0.2"}, "expired")
+
+			_, got := s.pendingSignals["10.8.0.2"]
+			if got != tt.wantReceipt {
+				t.Errorf("receipt sent = %v, want %v", got, tt.wantReceipt)
+			}
+		})
+	}
+}
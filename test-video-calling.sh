@@ -26,6 +26,10 @@ NC='\033[0m' # No Color
 VERBOSE=${VERBOSE:-0}
 TIMEOUT=30
 
+# The VPN client's IPC API requires the manager token it writes at startup
+IPC_AUTH="Authorization: Bearer $(cat /tmp/family-vpn-$(id -u)/ipc-token 2>/dev/null)"
+IPC_SOCKET="/tmp/family-vpn-$(id -u)/ipc.sock"
+
 # Helper functions
 log_info() {
     echo -e "${BLUE}ℹ${NC}  $1"
@@ -65,9 +69,9 @@ run_test() {
 get_peer_info() {
     log_info "Getting peer information..."
 
-    PEERS=$(curl -s http://localhost:8889/peers 2>/dev/null)
+    PEERS=$(curl -s -H "$IPC_AUTH" --unix-socket "$IPC_SOCKET" http://localhost/peers 2>/dev/null)
     if [ $? -ne 0 ]; then
-        log_error "Failed to connect to VPN IPC (localhost:8889)"
+        log_error "Failed to connect to VPN IPC ($IPC_SOCKET)"
         log_error "Is the VPN client running?"
         exit 1
     fi
@@ -102,7 +106,7 @@ test_vpn_connectivity() {
 test_ipc_server() {
     log_info "Testing IPC server..."
 
-    HEALTH=$(curl -s http://localhost:8889/health 2>/dev/null)
+    HEALTH=$(curl -s -H "$IPC_AUTH" --unix-socket "$IPC_SOCKET" http://localhost/health 2>/dev/null)
     if echo "$HEALTH" | grep -q "healthy"; then
         log_success "IPC server is healthy"
         return 0
@@ -159,9 +163,10 @@ test_clean_signals() {
 test_send_signal() {
     log_info "Sending video call signal to Miguel..."
 
-    RESPONSE=$(curl -s -w "\nHTTP_CODE:%{http_code}" -X POST http://localhost:8889/signal/send \
+    RESPONSE=$(curl -s -w "\nHTTP_CODE:%{http_code}" -X POST --unix-socket "$IPC_SOCKET" http://localhost/signal/send \
+        -H "$IPC_AUTH" \
         -H "Content-Type: application/json" \
-        -d "{\"peer\":\"$MIGUEL_IP\",\"data\":\"{\\\"type\\\":\\\"call-start\\\",\\\"from\\\":\\\"$THIS_IP\\\",\\\"fromName\\\":\\\"Anastasiia\\\"}\"}" 2>&1)
+        -d "{\"extension\":\"video\",\"peer\":\"$MIGUEL_IP\",\"data\":\"{\\\"type\\\":\\\"call-start\\\",\\\"from\\\":\\\"$THIS_IP\\\",\\\"fromName\\\":\\\"Anastasiia\\\"}\"}" 2>&1)
 
     HTTP_CODE=$(echo "$RESPONSE" | grep "HTTP_CODE" | cut -d: -f2)
 
@@ -175,35 +180,20 @@ test_send_signal() {
     fi
 }
 
-# Test 6: Verify outgoing signal file created
-test_outgoing_signal_file() {
-    log_info "Checking for outgoing signal file..."
-
-    sleep 1  # Give it a moment to create
+# Test 6: Verify the VPN client handed the signal to the tunnel
+test_signal_queued() {
+    log_info "Checking IPC response for signal ID..."
 
-    SIGNAL_FILE=$(ls ~/.family-vpn-video-out-* 2>/dev/null | head -1)
+    # /signal/send writes straight into the tunnel and fails with 503 if it is down
+    SIGNAL_ID=$(echo "$RESPONSE" | grep -o '"id":"[^"]*"' | cut -d'"' -f4)
 
-    if [ -n "$SIGNAL_FILE" ]; then
-        log_success "Outgoing signal file created: $SIGNAL_FILE"
-        if [ "$VERBOSE" -eq 1 ]; then
-            log_info "Contents:"
-            cat "$SIGNAL_FILE"
-        fi
+    if [ -n "$SIGNAL_ID" ]; then
+        log_success "Signal queued on the tunnel with ID $SIGNAL_ID"
         return 0
     else
-        log_error "No outgoing signal file found"
-        log_error "Expected: ~/.family-vpn-video-out-$MIGUEL_IP"
-
-        # Check if file was created and immediately consumed
-        log_info "Checking VPN client logs for signal processing..."
-        if ps aux | grep vpn-client | grep -v grep >/dev/null; then
-            log_info "VPN client is running"
-            log_warning "Signal file may have been created and immediately consumed (this is OK)"
-            return 0  # This is actually fine - means it was processed quickly
-        else
-            log_error "VPN client not running"
-            return 1
-        fi
+        log_error "IPC response did not include a signal ID"
+        echo "$RESPONSE" | grep -v "HTTP_CODE"
+        return 1
     fi
 }
 
@@ -307,7 +297,7 @@ main() {
     run_test "Video Extensions Running" test_video_extensions || FAILED=$((FAILED + 1))
     run_test "Clean Old Signal Files" test_clean_signals || FAILED=$((FAILED + 1))
     run_test "Send Video Call Signal" test_send_signal || FAILED=$((FAILED + 1))
-    run_test "Outgoing Signal File" test_outgoing_signal_file || FAILED=$((FAILED + 1))
+    run_test "Signal Queued On Tunnel" test_signal_queued || FAILED=$((FAILED + 1))
     run_test "Remote Signal Delivery" test_remote_signal_delivery || FAILED=$((FAILED + 1))
     run_test "Browser Opened" test_browser_opened || FAILED=$((FAILED + 1))
     run_test "VPN Logs" test_vpn_logs || FAILED=$((FAILED + 1))
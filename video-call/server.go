@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -15,6 +16,17 @@ import (
 //go:embed ui.html
 var uiHTML string
 
+const (
+	bufferedMessageTTL = 60 * time.Second // How long peer messages wait for a browser to attach
+	maxBufferedPerPeer = 64               // Buffered messages per peer before the oldest is dropped
+)
+
+// bufferedMessage is a peer message received before the browser page connected
+type bufferedMessage struct {
+	data       []byte
+	receivedAt time.Time
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for local server
@@ -28,6 +40,10 @@ type VideoServer struct {
 	peers      map[string]*websocket.Conn // peer VPN IP -> websocket
 	peersMutex sync.RWMutex
 
+	// Peer messages that arrived before a browser attached (e.g. an offer
+	// received while the call page is still opening)
+	buffered map[string][]bufferedMessage
+
 	// Callback to send data to peer over VPN
 	SendToPeer func(peerIP string, data []byte) error
 }
@@ -35,7 +51,8 @@ type VideoServer struct {
 // NewVideoServer creates a new video call server
 func NewVideoServer() *VideoServer {
 	return &VideoServer{
-		peers: make(map[string]*websocket.Conn),
+		peers:    make(map[string]*websocket.Conn),
+		buffered: make(map[string][]bufferedMessage),
 	}
 }
 
@@ -150,14 +167,20 @@ func (s *VideoServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 // HandlePeerMessage handles incoming video messages from VPN peer
 func (s *VideoServer) HandlePeerMessage(peerIP string, data []byte) {
 	// Find browser WebSocket and forward message
-	s.peersMutex.RLock()
+	s.peersMutex.Lock()
 	conn, exists := s.peers[peerIP]
-	s.peersMutex.RUnlock()
-
 	if !exists {
-		log.Printf("[VIDEO] No browser connection for peer %s", peerIP)
+		// Hold the message until the browser attaches
+		queue := append(s.buffered[peerIP], bufferedMessage{data: data, receivedAt: time.Now()})
+		if len(queue) > maxBufferedPerPeer {
+			queue = queue[1:]
+		}
+		s.buffered[peerIP] = queue
+		s.peersMutex.Unlock()
+		log.Printf("[VIDEO] No browser connection for peer %s, buffered message (%d pending)", peerIP, len(queue))
 		return
 	}
+	s.peersMutex.Unlock()
 
 	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
 		log.Printf("[VIDEO] Failed to write to browser: %v", err)
@@ -168,6 +191,22 @@ func (s *VideoServer) HandlePeerMessage(peerIP string, data []byte) {
 func (s *VideoServer) RegisterPeer(peerIP string, conn *websocket.Conn) {
 	s.peersMutex.Lock()
 	s.peers[peerIP] = conn
+	pending := s.buffered[peerIP]
+	delete(s.buffered, peerIP)
 	s.peersMutex.Unlock()
 	log.Printf("[VIDEO] Registered browser connection for peer %s", peerIP)
+
+	// Deliver messages that arrived before the browser was ready
+	for _, msg := range pending {
+		if time.Since(msg.receivedAt) > bufferedMessageTTL {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+			log.Printf("[VIDEO] Failed to flush buffered message to browser: %v", err)
+			return
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("[VIDEO] Flushed %d buffered message(s) for peer %s", len(pending), peerIP)
+	}
 }
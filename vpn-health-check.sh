@@ -32,7 +32,7 @@ if ! ping -c 1 -W 2 10.8.0.1 > /dev/null 2>&1; then
 fi
 
 # Check if we can reach IPC
-if ! curl -s --max-time 2 http://localhost:8889/peers > /dev/null 2>&1; then
+if ! curl -s --max-time 2 --unix-socket "/tmp/family-vpn-$(id -u)/ipc.sock" http://localhost/peers > /dev/null 2>&1; then
     log "VPN IPC not responding - restarting"
     echo "$SUDO_PASSWORD" | sudo -S killall -9 vpn-client 2>/dev/null || true
     sleep 2